@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+)
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("cannot write response", "err", err)
+	}
+}
+
+type storagesHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *storagesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, h.dd.StorageStatuses())
+}
+
+// unreadableHandler lists files which cannot be restored until some dead storages come back
+type unreadableHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *unreadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, h.dd.UnreadableFiles())
+}
+
+// dedupHandler tells how much space deduplicated buckets save
+type dedupHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *dedupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, h.dd.DedupStats())
+}
+
+// encryptionHandler tells which master keys wrap data keys of files, and rewraps all of them with the current master key
+type encryptionHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *encryptionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		writeJSON(w, h.dd.MasterKeys())
+		return
+	}
+	rotation, err := h.dd.RotateKeys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, rotation)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/keyring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyfile(t *testing.T, keyfilePath, current string) {
+	keyfile := fmt.Sprintf(`{"current": %q, "keys": [{"id": "old", "key": %q}, {"id": "new", "key": %q}]}`, current,
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, keyring.KeySize)),
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, keyring.KeySize)))
+	require.NoError(t, os.WriteFile(keyfilePath, []byte(keyfile), 0o600))
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	keyfilePath := path.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, keyfilePath, "old")
+	keys, err := keyring.NewKeyring(keyfilePath)
+	require.NoError(t, err)
+	srv := serveTestDataDistributor(t, newTestDataDistributorWithConfig(t, datadistributor.Config{Keyring: keys}), nil)
+
+	data := randomData(54623)
+	upload(t, srv, "file", data)
+	writeKeyfile(t, keyfilePath, "new")
+	require.NoError(t, keys.Reload())
+
+	resp, body := do(t, srv, http.MethodPost, "admin/encryption/rotate", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rotation datadistributor.KeyRotation
+	require.NoError(t, json.Unmarshal(body, &rotation))
+	assert.Equal(t, 1, rotation.Rewrapped)
+
+	resp, body = get(t, srv, "admin/encryption", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var usage []datadistributor.MasterKeyUsage
+	require.NoError(t, json.Unmarshal(body, &usage))
+	assert.Equal(t, []datadistributor.MasterKeyUsage{{MasterKeyID: "new", Current: true, Files: 1}}, usage)
+
+	resp, body = get(t, srv, "file", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+}
+
+func TestEncryptionKeyRotationWithoutKeyfile(t *testing.T) {
+	srv := newTestServer(t)
+	resp, _ := do(t, srv, http.MethodPost, "admin/encryption/rotate", nil, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
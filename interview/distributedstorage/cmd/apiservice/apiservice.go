@@ -1,23 +1,63 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
 	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
 	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/keyring"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/metrics"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
 	pb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
 	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
 )
 
 func main() {
 	argInventoryPort := flag.Int("inventory-port", 3609, "port where we listen for grpc info about storages")
 	argChunksNum := flag.Int("chunks-num", 6, "number of chunks to split incoming file")
+	argReplicationFactor := flag.Int("replication-factor", 1, "number of storages which keep a copy of every chunk")
+	argParityChunks := flag.Int("parity-chunks", 0, "number of Reed-Solomon parity chunks among chunks-num; any chunks-num minus parity-chunks chunks are enough to restore a file")
+	argDedup := flag.Bool("dedup", false, "cut files of the default bucket into chunks by content and store the same chunks only once; cannot be used with parity-chunks")
+	argDedupChunkSize := flag.Int("dedup-chunk-size", datadistributor.DefaultDedupChunkSize, "average size of chunks of deduplicated files; a chunk is buffered in memory and takes up to four times of it")
+	argCompress := flag.String("compress", "", "codecs for chunks of files by fileref prefix, e.g. logs/=zstd,photos/=none; the longest matching prefix wins")
+	argCompressSniff := flag.String("compress-sniff", "none", "codec for chunks of other files which data looks compressible: none, gzip or zstd")
+	argEncryptionKeyfile := flag.String("encryption-keyfile", "", "JSON file with master keys which wrap data keys of encrypted chunks, reloaded on SIGHUP; new chunks are not encrypted if empty")
+	argPlacement := flag.String("placement", chunkmaster.PlacementSpread, "how chunks are spread among storages: most-free, rendezvous (weighted consistent hashing) or spread (across zones, racks and hosts)")
+	argWriteQuorum := flag.Int("write-quorum", 0, "number of replicas which must store a chunk for upload to succeed; 0 means majority")
+	argCatalogDir := flag.String("catalog-dir", "", "directory for persistent chunk catalog; catalog is kept only in memory if empty")
+	argCatalogSnapshotEvery := flag.Int("catalog-snapshot-every", 1000, "number of catalog changes after which the catalog log is compacted into a snapshot")
+	argSuspectAfter := flag.Duration("storage-suspect-after", 3*time.Second, "heartbeat silence after which a storage gets no new chunks; 0 disables liveness tracking")
+	argDeadAfter := flag.Duration("storage-dead-after", 10*time.Second, "heartbeat silence after which chunks on a storage are considered lost")
+	argStreamChunkSize := flag.Int64("stream-chunk-size", datadistributor.DefaultStreamChunkSize, "chunk size for uploads without Content-Length and the biggest chunk of compressed files, which is buffered in memory")
+	argParallelChunks := flag.Int("parallel-chunks", datadistributor.DefaultParallelism, "number of chunks of a file which are stored or read at once")
+	argChunkBufferSize := flag.Int("chunk-buffer-size", datadistributor.DefaultChunkBufferSize, "bytes buffered in memory for every chunk being transferred")
+	argMultipartDir := flag.String("multipart-dir", path.Join(os.TempDir(), "diststorage-multipart"), "directory where parts of multipart uploads are kept until the upload is completed")
+	argMultipartTTL := flag.Duration("multipart-ttl", 24*time.Hour, "multipart uploads which have not been touched for this time are removed")
+	argTLSCA := flag.String("tls-ca", "", "CA certificate (PEM) which signs certificates of storages; with tls-cert and tls-key turns on mTLS for gRPC")
+	argTLSCert := flag.String("tls-cert", "", "certificate (PEM) to serve the inventory and to connect to storages")
+	argTLSKey := flag.String("tls-key", "", "private key (PEM) of tls-cert")
+	argS3Port := flag.Int("s3-port", 9000, "port of the S3-compatible API; 0 turns it off")
+	argAuthConfig := flag.String("auth-config", "", "JSON file with API keys and their permissions, reloaded on SIGHUP; requests are not checked if empty")
+	argRebalanceBytesPerSecond := flag.Int64("rebalance-bytes-per-second", 50<<20, "how fast rebalancing copies chunks between storages; 0 means no limit")
+	argVersionPruneInterval := flag.Duration("version-prune-interval", 10*time.Minute, "how often versions which retention policies of their buckets do not keep any more are removed")
+	argDrainBytesPerSecond := flag.Int64("drain-bytes-per-second", 50<<20, "how fast chunks are copied away from every draining storage; 0 means no limit")
+	argMetricsPort := flag.Int("metrics-port", 2112, "port of Prometheus metrics at /metrics; 0 turns them off")
 	flag.Parse()
 	if *argInventoryPort <= 0 {
 		slog.Error("inventory port is bad", "port", *argInventoryPort)
@@ -27,38 +67,281 @@ func main() {
 		slog.Error("nunmber of chunks is bad", "port", *argChunksNum)
 		os.Exit(1)
 	}
+	layout := chunkmaster.Layout{
+		Chunks:            *argChunksNum,
+		ReplicationFactor: *argReplicationFactor,
+		ParityChunks:      *argParityChunks,
+		Dedup:             *argDedup,
+	}
+	if err := layout.Validate(); err != nil {
+		slog.Error("chunk layout is bad", "err", err)
+		os.Exit(1)
+	}
+	placement, err := chunkmaster.ParsePlacementPolicy(*argPlacement)
+	if err != nil {
+		slog.Error("placement policy is bad", "err", err)
+		os.Exit(1)
+	}
+	if *argWriteQuorum < 0 || *argWriteQuorum > *argReplicationFactor {
+		slog.Error("write quorum is bad", "write_quorum", *argWriteQuorum, "replication_factor", *argReplicationFactor)
+		os.Exit(1)
+	}
+
+	if *argStreamChunkSize <= 0 {
+		slog.Error("stream chunk size is bad", "stream_chunk_size", *argStreamChunkSize)
+		os.Exit(1)
+	}
+
+	if *argDedupChunkSize <= 0 {
+		slog.Error("dedup chunk size is bad", "dedup_chunk_size", *argDedupChunkSize)
+		os.Exit(1)
+	}
+
+	compressPrefixes, err := datadistributor.ParseCompressionPrefixes(*argCompress)
+	if err != nil {
+		slog.Error("compression prefixes are bad", "err", err)
+		os.Exit(1)
+	}
+	compressSniff, err := datadistributor.ParseCodec(*argCompressSniff)
+	if err != nil {
+		slog.Error("compression sniffing codec is bad", "err", err)
+		os.Exit(1)
+	}
+
+	keys, err := newKeyring(*argEncryptionKeyfile)
+	if err != nil {
+		slog.Error("cannot load encryption keyfile", "err", err)
+		os.Exit(1)
+	}
+
+	if *argParallelChunks <= 0 || *argChunkBufferSize <= 0 {
+		slog.Error("chunk transfer settings are bad", "parallel_chunks", *argParallelChunks, "chunk_buffer_size", *argChunkBufferSize)
+		os.Exit(1)
+	}
+
+	if *argSuspectAfter < 0 || (*argSuspectAfter > 0 && *argDeadAfter < *argSuspectAfter) {
+		slog.Error("storage liveness timeouts are bad", "suspect_after", *argSuspectAfter, "dead_after", *argDeadAfter)
+		os.Exit(1)
+	}
+
+	if *argVersionPruneInterval <= 0 {
+		slog.Error("version prune interval is bad", "interval", *argVersionPruneInterval)
+		os.Exit(1)
+	}
 
-	dataDistributor, err := startDataDistributor(*argInventoryPort, *argChunksNum)
+	if *argMultipartTTL <= 0 {
+		slog.Error("multipart ttl is bad", "ttl", *argMultipartTTL)
+		os.Exit(1)
+	}
+
+	if *argRebalanceBytesPerSecond < 0 {
+		slog.Error("rebalance rate is bad", "bytes_per_second", *argRebalanceBytesPerSecond)
+		os.Exit(1)
+	}
+
+	if *argDrainBytesPerSecond < 0 {
+		slog.Error("drain rate is bad", "bytes_per_second", *argDrainBytesPerSecond)
+		os.Exit(1)
+	}
+
+	tlsFiles := mtls.Files{CA: *argTLSCA, Cert: *argTLSCert, Key: *argTLSKey}
+	if err := tlsFiles.Validate(); err != nil {
+		slog.Error("tls settings are bad", "err", err)
+		os.Exit(1)
+	}
+
+	chunkMaster, err := newChunkMaster(*argCatalogDir, layout, *argCatalogSnapshotEvery)
+	if err != nil {
+		slog.Error("cannot create chunk master", "err", err)
+		os.Exit(1)
+	}
+	chunkMaster.SetPlacementPolicy(placement)
+
+	config := datadistributor.Config{
+		WriteQuorum:     *argWriteQuorum,
+		SuspectAfter:    *argSuspectAfter,
+		DeadAfter:       *argDeadAfter,
+		StreamChunkSize: *argStreamChunkSize,
+		Parallelism:     *argParallelChunks,
+		ChunkBufferSize: *argChunkBufferSize,
+		DedupChunkSize:  *argDedupChunkSize,
+		Compression:     datadistributor.Compression{Prefixes: compressPrefixes, Sniff: compressSniff},
+		Keyring:         keys,
+	}
+	dataDistributor, err := startDataDistributor(*argInventoryPort, chunkMaster, config, tlsFiles)
 	if err != nil {
 		slog.Error("cannot start chunk master", "err", err)
 		os.Exit(1)
 	}
+	go dataDistributor.MonitorLiveness(context.Background(), time.Second)
+	go dataDistributor.RunVersionPruner(context.Background(), *argVersionPruneInterval)
+
+	uploads, err := multipart.NewManager(*argMultipartDir, *argMultipartTTL)
+	if err != nil {
+		slog.Error("cannot create multipart upload manager", "err", err)
+		os.Exit(1)
+	}
+	go uploads.RunGC(context.Background(), min(*argMultipartTTL, time.Hour))
+
+	rebalancer := newRebalanceJob(dataDistributor, *argRebalanceBytesPerSecond)
+	drains := newDrainJobs(dataDistributor, *argDrainBytesPerSecond)
+
+	authn, err := newAuthenticator(*argAuthConfig)
+	if err != nil {
+		slog.Error("cannot load auth config", "err", err)
+		os.Exit(1)
+	}
+
+	if *argMetricsPort > 0 {
+		prometheus.MustRegister(&clusterCollector{dd: dataDistributor})
+		go func() {
+			err := metrics.Serve(*argMetricsPort)
+			slog.Error("metrics exit with error", "err", err)
+			os.Exit(2)
+		}()
+	}
+
+	if *argS3Port > 0 {
+		go func() {
+			slog.Info("s3 gateway listening", "port", *argS3Port)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", *argS3Port), metrics.InstrumentMux("s3", newS3Mux(dataDistributor, uploads, authn)))
+			slog.Error("s3 gateway exit with error", "err", err)
+			os.Exit(2)
+		}()
+	}
+
+	slog.Info("apiservice started", "chunks", layout.Chunks, "replication_factor", layout.ReplicationFactor, "parity_chunks", layout.ParityChunks, "dedup", layout.Dedup, "compress", *argCompress, "compress_sniff", compressSniff, "encryption", keys != nil, "placement", *argPlacement)
+	err = http.ListenAndServe("", metrics.InstrumentMux("api", newMux(dataDistributor, uploads, rebalancer, drains, authn)))
+	if err != nil {
+		slog.Error("server exit with error", "err", err)
+	}
+}
 
+// newMux checks credentials of every request when authn is set
+func newMux(dataDistributor *datadistributor.DataDistributor, uploads *multipart.Manager, rebalancer *rebalanceJob, drains *drainJobs, authn *auth.Authenticator) *http.ServeMux {
 	retriever := &retrieveHandler{dd: dataDistributor}
 	storer := &storeHandler{dd: dataDistributor}
+	multiparter := &multipartHandler{dd: dataDistributor, uploads: uploads}
 
-	http.Handle("GET /{fileref}", retriever)
-	http.Handle("POST /{fileref}", storer)
+	getter := orHead(&headHandler{dd: dataDistributor}, orMultipart(multiparter, orVersions(&versionsHandler{dd: dataDistributor}, retriever)))
+	deleter := orMultipart(multiparter, &deleteHandler{dd: dataDistributor})
+	buckets := &bucketsHandler{dd: dataDistributor}
+	authz := authorizer{authn: authn}
+
+	mux := http.NewServeMux()
+	// files of the default bucket
+	mux.Handle("GET /{fileref}", authz.wrap(objectAccess, getter))
+	mux.Handle("POST /{fileref}", authz.wrap(objectAccess, orMultipart(multiparter, storer)))
+	// curl -T sends PUT
+	mux.Handle("PUT /{fileref}", authz.wrap(objectAccess, orMultipart(multiparter, storer)))
+	mux.Handle("DELETE /{fileref}", authz.wrap(objectAccess, deleter))
+	mux.Handle("GET /{$}", authz.wrap(objectAccess, &listHandler{dd: dataDistributor}))
+	// files of other buckets. The key may have slashes
+	mux.Handle("GET /{bucket}/{key...}", authz.wrap(objectAccess, inBucket(dataDistributor, getter)))
+	mux.Handle("POST /{bucket}/{key...}", authz.wrap(objectAccess, inBucket(dataDistributor, orMultipart(multiparter, storer))))
+	mux.Handle("PUT /{bucket}/{key...}", authz.wrap(objectAccess, inBucket(dataDistributor, orMultipart(multiparter, storer))))
+	mux.Handle("DELETE /{bucket}/{key...}", authz.wrap(objectAccess, inBucket(dataDistributor, deleter)))
+	mux.Handle("GET /buckets", authz.wrap(clusterAccess, buckets))
+	mux.Handle("GET /buckets/{bucket}", authz.wrap(bucketAccess, buckets))
+	mux.Handle("PUT /buckets/{bucket}", authz.wrap(bucketAccess, buckets))
+	mux.Handle("DELETE /buckets/{bucket}", authz.wrap(bucketAccess, buckets))
+	mux.Handle("GET /admin/storages", authz.wrap(clusterAccess, &storagesHandler{dd: dataDistributor}))
+	mux.Handle("GET /admin/unreadable", authz.wrap(clusterAccess, &unreadableHandler{dd: dataDistributor}))
+	mux.Handle("GET /admin/dedup", authz.wrap(clusterAccess, &dedupHandler{dd: dataDistributor}))
+	mux.Handle("GET /admin/encryption", authz.wrap(clusterAccess, &encryptionHandler{dd: dataDistributor}))
+	mux.Handle("POST /admin/encryption/rotate", authz.wrap(clusterAccess, &encryptionHandler{dd: dataDistributor}))
+	mux.Handle("GET /admin/rebalance", authz.wrap(clusterAccess, rebalancer))
+	mux.Handle("POST /admin/rebalance", authz.wrap(clusterAccess, rebalancer))
+	mux.Handle("DELETE /admin/rebalance", authz.wrap(clusterAccess, rebalancer))
+	mux.Handle("GET /admin/drains", authz.wrap(clusterAccess, drains))
+	mux.Handle("GET /admin/storages/{storage}/drain", authz.wrap(clusterAccess, drains))
+	mux.Handle("POST /admin/storages/{storage}/drain", authz.wrap(clusterAccess, drains))
+	mux.Handle("DELETE /admin/storages/{storage}/drain", authz.wrap(clusterAccess, drains))
+	return mux
+}
 
-	slog.Info("apiservice started", "chunks", *argChunksNum)
-	err = http.ListenAndServe("", nil)
+// orHead sends HEAD requests to head and everything else to get. GET patterns match HEAD too, and a separate HEAD pattern
+// for objects would conflict with every more specific GET path, e.g. /admin/storages
+func orHead(head, get http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			head.ServeHTTP(w, req)
+			return
+		}
+		get.ServeHTTP(w, req)
+	})
+}
+
+func newChunkMaster(catalogDir string, layout chunkmaster.Layout, snapshotEvery int) (chunkmaster.ChunkMaster, error) {
+	if catalogDir == "" {
+		slog.Warn("chunk catalog is not persistent, all files will be lost on restart")
+		return chunkmaster.NewTemporaryChunkMaster(layout), nil
+	}
+	return chunkmaster.NewPersistentChunkMaster(catalogDir, layout, snapshotEvery)
+}
+
+// newAuthenticator reloads keys on SIGHUP, so they can be changed without a restart
+func newAuthenticator(configPath string) (*auth.Authenticator, error) {
+	if configPath == "" {
+		slog.Warn("auth is not configured, every request is allowed")
+		return nil, nil
+	}
+	authn, err := auth.NewAuthenticator(configPath)
 	if err != nil {
-		slog.Error("server exit with error", "err", err)
+		return nil, err
+	}
+	reloadOnHangup(authn.Reload, "auth config is not reloaded, old keys are kept")
+	return authn, nil
+}
+
+// newKeyring reloads master keys on SIGHUP, so a new current key can be added before data keys are rotated to it
+func newKeyring(keyfilePath string) (*keyring.Keyring, error) {
+	if keyfilePath == "" {
+		slog.Warn("encryption is not configured, chunks are stored as they are")
+		return nil, nil
+	}
+	keys, err := keyring.NewKeyring(keyfilePath)
+	if err != nil {
+		return nil, err
 	}
+	reloadOnHangup(keys.Reload, "encryption keyfile is not reloaded, old keys are kept")
+	return keys, nil
 }
 
-func startDataDistributor(storageInventoryPort int, chunksNum int) (*datadistributor.DataDistributor, error) {
+func reloadOnHangup(reload func() error, failure string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reload(); err != nil {
+				slog.Error(failure, "err", err)
+			}
+		}
+	}()
+}
+
+func startDataDistributor(storageInventoryPort int, chunkMaster chunkmaster.ChunkMaster, config datadistributor.Config, tlsFiles mtls.Files) (*datadistributor.DataDistributor, error) {
+	clientCreds, err := mtls.ClientCredentials(tlsFiles)
+	if err != nil {
+		return nil, err
+	}
+	serverCreds, err := mtls.ServerCredentials(tlsFiles)
+	if err != nil {
+		return nil, err
+	}
+	if !tlsFiles.Enabled() {
+		slog.Warn("mTLS is off, anyone on the network can send heartbeats and store chunks")
+	}
 	connectToRemoteStorage := func(storageId string) (storage.Storage, error) {
-		return storage.NewRemoteStorage(storageId)
+		return storage.NewRemoteStorage(storageId, clientCreds, metrics.ClientOptions()...)
 	}
-	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunksNum)
-	dataDistributor := datadistributor.NewDataDistributor(chunkMaster, connectToRemoteStorage)
+	dataDistributor := datadistributor.NewDataDistributor(chunkMaster, connectToRemoteStorage, config)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", storageInventoryPort))
 	if err != nil {
 		return nil, fmt.Errorf("listen for storage inventory failed: %w", err)
 	}
-	gsrv := grpc.NewServer()
+	gsrv := grpc.NewServer(append(metrics.ServerOptions(), grpc.Creds(serverCreds))...)
 	pb.RegisterStorageInventoryServer(gsrv, dataDistributor)
 
 	go func() {
@@ -77,14 +360,58 @@ type storeHandler struct {
 }
 
 func (h *storeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	fileref := req.PathValue("fileref")
+	fileref := objectName(req)
 	slog.Info("incoming store request", "fileref", fileref, "size", req.ContentLength)
-	err := h.dd.DistributeData(req.Context(), fileref, req.ContentLength, req.Body)
+	condition, err := parseCondition(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ContentLength < 0 {
+		// chunked transfer encoding, the size becomes known only in the end
+		var size int64
+		size, err = h.dd.DistributeStreamIf(req.Context(), fileref, condition, req.Body)
+		if err == nil {
+			slog.Info("stream stored", "fileref", fileref, "size", size)
+		}
+	} else {
+		err = h.dd.DistributeDataIf(req.Context(), fileref, condition, req.ContentLength, req.Body)
+	}
+	if errors.Is(err, chunkmaster.ErrFileDuplicate) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, chunkmaster.ErrPreconditionFailed) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, chunkmaster.ErrStreamingNotSupported) {
+		http.Error(w, err.Error(), http.StatusLengthRequired)
+		return
+	}
+	if errors.Is(err, chunkmaster.ErrBucketNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, chunkmaster.ErrBucketQuotaExceeded) || errors.Is(err, storage.ErrNotEnoughSpace) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Is(err, auth.ErrPayloadMismatch) || errors.Is(err, chunkmaster.ErrBadFileref) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		slog.Error("distribute data error", "err", err, "fileref", fileref)
 		return
 	}
+	if info, err := h.dd.StatFile(fileref); err == nil {
+		setETag(w, info)
+		if info.VersionID != "" {
+			w.Header().Set(versionIDHeader, info.VersionID)
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -93,14 +420,78 @@ type retrieveHandler struct {
 }
 
 func (h *retrieveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	fileref := req.PathValue("fileref")
-	slog.Info("incoming retrieve request", "fileref", fileref)
-	err := h.dd.ReconstructData(req.Context(), fileref, w)
+	fileref := objectName(req)
+	slog.Info("incoming retrieve request", "fileref", fileref, "range", req.Header.Get("Range"))
+	// the version is resolved once and kept until the end, so the whole response comes from it even if it is replaced meanwhile
+	catalogFileref, release, err := pinVersion(h.dd, req)
+	if errors.Is(err, chunkmaster.ErrFileNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("resolve version error", "err", err, "fileref", fileref)
+		return
+	}
+	defer release()
+	info, err := h.dd.StatFile(catalogFileref)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("stat file error", "err", err, "fileref", fileref)
+		return
+	}
+	size := info.Size
+	setVersionID(w, catalogFileref)
+	setETag(w, info)
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	statusCode := http.StatusOK
+	requested := byteRange{offset: 0, length: size}
+	if header := req.Header.Get("Range"); header != "" {
+		r, err := parseRange(header, size)
+		switch {
+		case errors.Is(err, errRangeNotSatisfiable):
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		case err == nil:
+			statusCode = http.StatusPartialContent
+			requested = r
+			w.Header().Set("Content-Range", r.contentRange(size))
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(requested.length, 10))
+
+	sw := &statusOnWriteWriter{w: w, statusCode: statusCode}
+	err = h.dd.ReconstructRange(req.Context(), catalogFileref, requested.offset, requested.length, sw)
+	if err != nil {
 		slog.Error("reconstruct data error", "err", err, "fileref", fileref)
+		if !sw.started {
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Range")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		// otherwise the client sees a response shorter than Content-Length
 		return
 	}
+	sw.start()
+}
 
-	w.WriteHeader(http.StatusOK)
+// statusOnWriteWriter postpones sending the status until the first byte of data, so an error which happens before can still be reported
+type statusOnWriteWriter struct {
+	w          http.ResponseWriter
+	statusCode int
+	started    bool
+}
+
+func (sw *statusOnWriteWriter) start() {
+	if !sw.started {
+		sw.started = true
+		sw.w.WriteHeader(sw.statusCode)
+	}
+}
+
+func (sw *statusOnWriteWriter) Write(p []byte) (int, error) {
+	sw.start()
+	return sw.w.Write(p)
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
+	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStorage is the simplest storage.Storage, enough to run handlers
+type memStorage struct {
+	mutex  sync.Mutex
+	chunks map[string][]byte
+	peers  map[string]*memStorage
+}
+
+var _ storage.Storage = (*memStorage)(nil)
+
+func (ms *memStorage) StoreChunk(_ context.Context, fileId string, reader io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.chunks[fileId] = data
+	checksum := sha256.Sum256(data)
+	return checksum[:], nil
+}
+
+func (ms *memStorage) RetrieveChunk(ctx context.Context, fileId string, _ []byte, writer io.Writer) error {
+	return ms.RetrieveChunkRange(ctx, fileId, nil, 0, -1, writer)
+}
+
+func (ms *memStorage) RetrieveChunkRange(_ context.Context, fileId string, _ []byte, offset, length int64, writer io.Writer) error {
+	ms.mutex.Lock()
+	data, found := ms.chunks[fileId]
+	ms.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("chunk %s not found", fileId)
+	}
+	if length >= 0 {
+		data = data[offset : offset+length]
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func (ms *memStorage) DeleteChunk(_ context.Context, fileId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.chunks, fileId)
+	return nil
+}
+
+func (ms *memStorage) ListChunks(_ context.Context) ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	list := make([]string, 0, len(ms.chunks))
+	for fileId := range ms.chunks {
+		list = append(list, fileId)
+	}
+	return list, nil
+}
+
+func (ms *memStorage) Reserve(context.Context, map[string]int64) error {
+	return nil
+}
+
+func (ms *memStorage) Commit(context.Context, []string) error {
+	return nil
+}
+
+func (ms *memStorage) Release(context.Context, []string) error {
+	return nil
+}
+
+func (ms *memStorage) CopyChunk(ctx context.Context, fileId string, _ []byte, source string) error {
+	var buffer bytes.Buffer
+	if err := ms.peers[source].RetrieveChunk(ctx, fileId, nil, &buffer); err != nil {
+		return err
+	}
+	_, err := ms.StoreChunk(ctx, fileId, &buffer)
+	return err
+}
+
+func newTestDataDistributor(t *testing.T) *datadistributor.DataDistributor {
+	return newTestDataDistributorWithConfig(t, datadistributor.Config{})
+}
+
+func newTestDataDistributorWithConfig(t *testing.T, config datadistributor.Config) *datadistributor.DataDistributor {
+	storages := make(map[string]*memStorage)
+	connect := func(storageID string) (storage.Storage, error) {
+		return storages[storageID], nil
+	}
+	dd := datadistributor.NewDataDistributor(chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}), connect, config)
+	for i := range 6 {
+		storageID := fmt.Sprintf("storage-%d", i)
+		storages[storageID] = &memStorage{chunks: make(map[string][]byte), peers: storages}
+		_, err := dd.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: storageID, AvailableBytes: 1 << 30})
+		require.NoError(t, err)
+	}
+	// new storages get into service once their inventory check is done
+	require.Eventually(t, func() bool {
+		for _, status := range dd.StorageStatuses() {
+			if status.State != datadistributor.StorageAlive {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+	return dd
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return newTestServerWithAuth(t, nil)
+}
+
+func newTestServerWithAuth(t *testing.T, authn *auth.Authenticator) *httptest.Server {
+	return serveTestDataDistributor(t, newTestDataDistributor(t), authn)
+}
+
+func serveTestDataDistributor(t *testing.T, dd *datadistributor.DataDistributor, authn *auth.Authenticator) *httptest.Server {
+	uploads, err := multipart.NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	srv := httptest.NewServer(newMux(dd, uploads, newRebalanceJob(dd, 0), newDrainJobs(dd, 0), authn))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func upload(t *testing.T, srv *httptest.Server, fileref string, data []byte) {
+	resp, err := http.Post(srv.URL+"/"+fileref, "application/octet-stream", bytes.NewReader(data))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func get(t *testing.T, srv *httptest.Server, fileref string, headers map[string]string) (*http.Response, []byte) {
+	return do(t, srv, http.MethodGet, fileref, nil, headers)
+}
+
+func do(t *testing.T, srv *httptest.Server, method, fileref string, payload []byte, headers map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, srv.URL+"/"+fileref, bytes.NewReader(payload))
+	require.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func TestGetWholeFile(t *testing.T) {
+	srv := newTestServer(t)
+	data := randomData(10007)
+	upload(t, srv, "file", data)
+
+	resp, body := get(t, srv, "file", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, data, body)
+
+	resp, _ = get(t, srv, "missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetRange(t *testing.T) {
+	srv := newTestServer(t)
+	data := randomData(10007)
+	upload(t, srv, "file", data)
+
+	resp, body := get(t, srv, "file", map[string]string{"Range": "bytes=1660-3350"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 1660-3350/10007", resp.Header.Get("Content-Range"))
+	assert.EqualValues(t, 1691, resp.ContentLength)
+	assert.Equal(t, data[1660:3351], body)
+
+	resp, body = get(t, srv, "file", map[string]string{"Range": "bytes=-7"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, data[10000:], body)
+
+	resp, _ = get(t, srv, "file", map[string]string{"Range": "bytes=20000-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.Equal(t, "bytes */10007", resp.Header.Get("Content-Range"))
+
+	resp, body = get(t, srv, "file", map[string]string{"Range": "bytes=0-1,5-6"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "several ranges are ignored")
+	assert.Equal(t, data, body)
+}
+
+func TestChunkedUpload(t *testing.T) {
+	srv := newTestServer(t)
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		data := randomData(10007)
+		fileref := "file-" + method
+		// a reader of unknown size makes the client use chunked transfer encoding
+		req, err := http.NewRequest(method, srv.URL+"/"+fileref, io.MultiReader(bytes.NewReader(data)))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, body := get(t, srv, fileref, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.EqualValues(t, len(data), resp.ContentLength)
+		assert.Equal(t, data, body)
+	}
+}
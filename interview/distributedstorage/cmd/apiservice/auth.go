@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+// accessFunc tells what a request needs: a permission for a key in a bucket. An empty bucket means the whole cluster
+type accessFunc func(req *http.Request) (permission auth.Permission, bucket, key string)
+
+// objectAccess is for file requests. Listing needs read permission for the listed prefix
+func objectAccess(req *http.Request) (auth.Permission, string, string) {
+	bucket, key := chunkmaster.SplitFileref(objectName(req))
+	if key == "" {
+		key = req.URL.Query().Get("prefix")
+	}
+	return objectPermission(req), bucket, key
+}
+
+func objectPermission(req *http.Request) auth.Permission {
+	switch {
+	case isMultipartRequest(req):
+		// aborting an upload does not delete anything which has been stored
+		return auth.PermissionWrite
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		return auth.PermissionRead
+	case req.Method == http.MethodDelete:
+		return auth.PermissionDelete
+	default:
+		return auth.PermissionWrite
+	}
+}
+
+// s3Access is for the S3 gateway. Listing a bucket needs read permission for the listed prefix,
+// other bucket requests need admin permission for the bucket
+func s3Access(req *http.Request) (auth.Permission, string, string) {
+	bucket, key := req.PathValue("bucket"), req.PathValue("key")
+	if key != "" {
+		return objectPermission(req), bucket, key
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return auth.PermissionRead, bucket, req.URL.Query().Get("prefix")
+	}
+	return auth.PermissionAdmin, bucket, ""
+}
+
+// bucketAccess is for bucket management. The list of all buckets is cluster-wide
+func bucketAccess(req *http.Request) (auth.Permission, string, string) {
+	return auth.PermissionAdmin, req.PathValue("bucket"), ""
+}
+
+func clusterAccess(*http.Request) (auth.Permission, string, string) {
+	return auth.PermissionAdmin, "", ""
+}
+
+// authorizer checks requests before they get to handlers. Without an authenticator everything is allowed
+type authorizer struct {
+	authn *auth.Authenticator
+	// deny answers requests which are not allowed, with auth.ErrUnauthenticated or auth.ErrForbidden. Plain text errors are sent if it is nil
+	deny func(w http.ResponseWriter, req *http.Request, err error)
+}
+
+func (a authorizer) wrap(access accessFunc, handler http.Handler) http.Handler {
+	if a.authn == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, err := a.authn.Authenticate(req)
+		if err != nil {
+			slog.Warn("unauthenticated request", "err", err, "method", req.Method, "path", req.URL.Path)
+			if a.deny != nil {
+				a.deny(w, req, err)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="diststorage"`)
+			http.Error(w, auth.ErrUnauthenticated.Error(), http.StatusUnauthorized)
+			return
+		}
+		permission, bucket, objectKey := access(req)
+		if !key.Allowed(permission, bucket, objectKey) {
+			slog.Warn("forbidden request", "key_id", key.ID, "permission", permission, "bucket", bucket, "key", objectKey)
+			if a.deny != nil {
+				a.deny(w, req, auth.ErrForbidden)
+				return
+			}
+			http.Error(w, auth.ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
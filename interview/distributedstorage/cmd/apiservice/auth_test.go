@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAuthConfig = `{"keys": [
+	{"id": "admin", "secret": "admin-secret", "grants": [{"bucket": "*", "permissions": ["read", "write", "delete", "admin"]}]},
+	{"id": "writer", "secret": "writer-secret", "grants": [
+		{"bucket": "photos", "prefix": "public/", "permissions": ["read", "write"]},
+		{"bucket": "default", "permissions": ["read"]}
+	]}
+]}`
+
+func newTestServerWithKeys(t *testing.T) *httptest.Server {
+	configPath := path.Join(t.TempDir(), "auth.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(testAuthConfig), 0o600))
+	authn, err := auth.NewAuthenticator(configPath)
+	require.NoError(t, err)
+	return newTestServerWithAuth(t, authn)
+}
+
+func bearer(id, secret string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + id + ":" + secret}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	srv := newTestServerWithKeys(t)
+	for _, path := range []string{"file", "", "photos/public/cat.jpg", "buckets", "admin/storages"} {
+		resp, _ := get(t, srv, path, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+		assert.NotEmpty(t, resp.Header.Get("WWW-Authenticate"), path)
+
+		resp, _ = get(t, srv, path, bearer("admin", "wrong"))
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+	}
+	resp, _ := do(t, srv, http.MethodPost, "file", []byte("data"), nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestPermissions(t *testing.T) {
+	srv := newTestServerWithKeys(t)
+	admin := bearer("admin", "admin-secret")
+	writer := bearer("writer", "writer-secret")
+	resp, _ := do(t, srv, http.MethodPut, "buckets/photos", nil, admin)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPost, "file", []byte("data"), admin)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, tc := range []struct {
+		method, path string
+		expected     int
+	}{
+		{http.MethodPost, "photos/public/cat.jpg", http.StatusOK},
+		{http.MethodGet, "photos/public/cat.jpg", http.StatusOK},
+		{http.MethodHead, "photos/public/cat.jpg", http.StatusOK},
+		{http.MethodGet, "photos/?prefix=public/", http.StatusOK},
+		{http.MethodPost, "photos/public/dog.jpg?uploads", http.StatusOK},
+		{http.MethodDelete, "photos/public/cat.jpg", http.StatusForbidden},
+		{http.MethodPost, "photos/private/cat.jpg", http.StatusForbidden},
+		{http.MethodGet, "photos/private/cat.jpg", http.StatusForbidden},
+		{http.MethodGet, "photos/", http.StatusForbidden},
+		{http.MethodGet, "file", http.StatusOK},
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodPost, "other", http.StatusForbidden},
+		{http.MethodDelete, "file", http.StatusForbidden},
+		{http.MethodPut, "buckets/mine", http.StatusForbidden},
+		{http.MethodGet, "buckets/photos", http.StatusForbidden},
+		{http.MethodGet, "buckets", http.StatusForbidden},
+		{http.MethodGet, "admin/storages", http.StatusForbidden},
+	} {
+		resp, _ := do(t, srv, tc.method, tc.path, []byte("data"), writer)
+		assert.Equal(t, tc.expected, resp.StatusCode, "%s %s", tc.method, tc.path)
+	}
+
+	for _, path := range []string{"photos/public/cat.jpg", "file"} {
+		resp, _ := do(t, srv, http.MethodDelete, path, nil, admin)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, path)
+	}
+	resp, _ = get(t, srv, "admin/storages", admin)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestSignedUpload(t *testing.T) {
+	srv := newTestServerWithKeys(t)
+	data := randomData(10007)
+	checksum := sha256.Sum256(data)
+	send := func(payloadHash string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/file", bytes.NewReader(body))
+		require.NoError(t, err)
+		auth.Sign(req, "admin", "admin-secret", payloadHash, time.Now())
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send(hex.EncodeToString(checksum[:]), randomData(10008)[:10007])
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "body does not match the signed checksum")
+	resp, _ = get(t, srv, "file", bearer("admin", "admin-secret"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "nothing is left after a bad body")
+
+	resp = send(hex.EncodeToString(checksum[:]), data)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := get(t, srv, "file", bearer("admin", "admin-secret"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+
+	resp = send(auth.UnsignedPayload, data)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "signed without body, and the file exists already")
+}
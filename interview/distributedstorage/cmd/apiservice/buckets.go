@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+)
+
+type bucketDescription struct {
+	Name              string    `json:"name"`
+	Chunks            int       `json:"chunks"`
+	ReplicationFactor int       `json:"replication_factor"`
+	ParityChunks      int       `json:"parity_chunks"`
+	Dedup             bool      `json:"dedup"`
+	QuotaBytes        int64     `json:"quota_bytes"`
+	UsedBytes         int64     `json:"used_bytes"`
+	Files             int       `json:"files"`
+	Versioning        bool      `json:"versioning"`
+	KeepVersions      int       `json:"keep_versions,omitempty"`
+	KeepVersionsFor   string    `json:"keep_versions_for,omitempty"`
+	Created           time.Time `json:"created,omitempty"`
+}
+
+func describeBucket(info chunkmaster.BucketInfo) bucketDescription {
+	description := bucketDescription{
+		Name:              info.Name,
+		Chunks:            info.Layout.Chunks,
+		ReplicationFactor: info.Layout.ReplicationFactor,
+		ParityChunks:      info.Layout.ParityChunks,
+		Dedup:             info.Layout.Dedup,
+		QuotaBytes:        info.QuotaBytes,
+		UsedBytes:         info.UsedBytes,
+		Files:             info.Files,
+		Versioning:        info.Versioning.Enabled,
+		KeepVersions:      info.Versioning.KeepVersions,
+		Created:           info.Created,
+	}
+	if info.Versioning.KeepFor > 0 {
+		description.KeepVersionsFor = info.Versioning.KeepFor.String()
+	}
+	return description
+}
+
+// createBucketRequest fields which are not set are taken from the default bucket
+type createBucketRequest struct {
+	Chunks            *int   `json:"chunks"`
+	ReplicationFactor *int   `json:"replication_factor"`
+	ParityChunks      *int   `json:"parity_chunks"`
+	Dedup             *bool  `json:"dedup"`
+	QuotaBytes        *int64 `json:"quota_bytes"`
+	// Versioning cannot be changed after the bucket is created. Retention is keep_versions replaced versions,
+	// each for keep_versions_for (e.g. "720h"); zero means no limit
+	Versioning      bool   `json:"versioning"`
+	KeepVersions    int    `json:"keep_versions"`
+	KeepVersionsFor string `json:"keep_versions_for"`
+}
+
+// objectName gives the fileref of a request to either /{fileref} or /{bucket}/{key...}
+func objectName(req *http.Request) string {
+	bucket := req.PathValue("bucket")
+	if bucket == "" {
+		return chunkmaster.ObjectName(chunkmaster.DefaultBucket, req.PathValue("fileref"))
+	}
+	return chunkmaster.ObjectName(bucket, req.PathValue("key"))
+}
+
+// inBucket answers 404 for requests to a bucket which does not exist, so none of handlers has to tell a missing bucket from a missing file.
+// GET of the bucket itself (an empty key) lists its files
+func inBucket(dd *datadistributor.DataDistributor, handler http.Handler) http.Handler {
+	lister := &listHandler{dd: dd}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bucket := req.PathValue("bucket")
+		if _, err := dd.StatBucket(bucket); err != nil || bucket == chunkmaster.DefaultBucket {
+			http.Error(w, chunkmaster.ErrBucketNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if req.PathValue("key") == "" {
+			if req.Method == http.MethodGet {
+				lister.ServeHTTP(w, req)
+				return
+			}
+			http.Error(w, chunkmaster.ErrBadFileref.Error(), http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// bucketsHandler serves bucket management:
+//   - GET /buckets lists buckets
+//   - PUT /buckets/{bucket} creates a bucket with settings from an optional JSON body
+//   - GET /buckets/{bucket} describes a bucket
+//   - DELETE /buckets/{bucket} deletes an empty bucket
+type bucketsHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *bucketsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("bucket")
+	switch {
+	case name == "":
+		h.list(w)
+	case req.Method == http.MethodPut:
+		h.create(w, req, name)
+	case req.Method == http.MethodGet:
+		h.stat(w, name)
+	case req.Method == http.MethodDelete:
+		h.delete(w, name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *bucketsHandler) list(w http.ResponseWriter) {
+	buckets := h.dd.Buckets()
+	list := make([]bucketDescription, 0, len(buckets))
+	for _, bucket := range buckets {
+		list = append(list, describeBucket(bucket))
+	}
+	writeJSON(w, list)
+}
+
+func (h *bucketsHandler) create(w http.ResponseWriter, req *http.Request, name string) {
+	var request createBucketRequest
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			slog.Warn("bad create bucket request", "err", err, "bucket", name)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	defaults, err := h.dd.StatBucket(chunkmaster.DefaultBucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("default bucket error", "err", err)
+		return
+	}
+	bucket := chunkmaster.Bucket{Name: name, Layout: defaults.Layout}
+	if request.Chunks != nil {
+		bucket.Layout.Chunks = *request.Chunks
+	}
+	if request.ReplicationFactor != nil {
+		bucket.Layout.ReplicationFactor = *request.ReplicationFactor
+	}
+	if request.ParityChunks != nil {
+		bucket.Layout.ParityChunks = *request.ParityChunks
+	}
+	if request.Dedup != nil {
+		bucket.Layout.Dedup = *request.Dedup
+	}
+	if request.QuotaBytes != nil {
+		bucket.QuotaBytes = *request.QuotaBytes
+	}
+	bucket.Versioning = chunkmaster.Versioning{Enabled: request.Versioning, KeepVersions: request.KeepVersions}
+	if request.KeepVersionsFor != "" {
+		bucket.Versioning.KeepFor, err = time.ParseDuration(request.KeepVersionsFor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = h.dd.CreateBucket(bucket)
+	if errors.Is(err, chunkmaster.ErrBucketExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		// everything else is a bad name or bad settings
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("bucket created", "bucket", name, "layout", bucket.Layout, "quota", bucket.QuotaBytes, "versioning", bucket.Versioning.Enabled)
+	info, _ := h.dd.StatBucket(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, describeBucket(info))
+}
+
+func (h *bucketsHandler) stat(w http.ResponseWriter, name string) {
+	info, err := h.dd.StatBucket(name)
+	if err != nil {
+		writeBucketError(w, err, name)
+		return
+	}
+	writeJSON(w, describeBucket(info))
+}
+
+func (h *bucketsHandler) delete(w http.ResponseWriter, name string) {
+	err := h.dd.DeleteBucket(name)
+	if err != nil {
+		writeBucketError(w, err, name)
+		return
+	}
+	slog.Info("bucket deleted", "bucket", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeBucketError(w http.ResponseWriter, err error, name string) {
+	switch {
+	case errors.Is(err, chunkmaster.ErrBucketNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, chunkmaster.ErrBucketNotEmpty), errors.Is(err, chunkmaster.ErrDefaultBucket):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		slog.Error("bucket error", "err", err, "bucket", name)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
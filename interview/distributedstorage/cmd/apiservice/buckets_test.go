@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createBucket(t *testing.T, srv *httptest.Server, name, settings string) (*http.Response, bucketDescription) {
+	resp, body := do(t, srv, http.MethodPut, "buckets/"+name, []byte(settings), nil)
+	var bucket bucketDescription
+	if resp.StatusCode == http.StatusCreated {
+		require.NoError(t, json.Unmarshal(body, &bucket))
+	}
+	return resp, bucket
+}
+
+func TestBuckets(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, bucket := createBucket(t, srv, "photos", `{"chunks":2,"replication_factor":3,"quota_bytes":100000}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, bucketDescription{Name: "photos", Chunks: 2, ReplicationFactor: 3, QuotaBytes: 100000, Created: bucket.Created}, bucket)
+	resp, bucket = createBucket(t, srv, "docs", "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, 6, bucket.Chunks, "settings are taken from the default bucket")
+
+	resp, _ = createBucket(t, srv, "photos", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	for _, name := range []string{"default", "admin", "Photos", "x"} {
+		resp, _ = createBucket(t, srv, name, "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+	resp, _ = createBucket(t, srv, "bad-layout", `{"chunks":0}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = createBucket(t, srv, "bad-json", `{`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body := get(t, srv, "buckets", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var buckets []bucketDescription
+	require.NoError(t, json.Unmarshal(body, &buckets))
+	names := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	assert.Equal(t, []string{"default", "docs", "photos"}, names)
+
+	upload(t, srv, "photos/2024/cat.jpg", randomData(9007))
+	resp, body = get(t, srv, "buckets/photos", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.Unmarshal(body, &bucket))
+	assert.EqualValues(t, 9007, bucket.UsedBytes)
+	assert.Equal(t, 1, bucket.Files)
+
+	resp, _ = do(t, srv, http.MethodDelete, "buckets/photos", nil, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodDelete, "buckets/default", nil, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodDelete, "photos/2024/cat.jpg", nil, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodDelete, "buckets/photos", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = get(t, srv, "buckets/photos", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodDelete, "buckets/photos", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestFilesCannotBeNamedAsAPIPaths(t *testing.T) {
+	srv := newTestServer(t)
+	for _, fileref := range []string{"buckets", "admin"} {
+		resp, _ := do(t, srv, http.MethodPut, fileref, randomData(100), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "%s could never be read back", fileref)
+	}
+	resp, _ := get(t, srv, "buckets", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "buckets are still listed")
+}
+
+func TestBucketObjects(t *testing.T) {
+	srv := newTestServer(t)
+	for _, name := range []string{"first", "second"} {
+		resp, _ := createBucket(t, srv, name, "")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	files := map[string][]byte{
+		"dir-file":                randomData(10007),
+		"first/dir/file":          randomData(10008),
+		"second/dir/file":         randomData(10009),
+		"second/dir/another/file": randomData(10010),
+	}
+	for fileref, data := range files {
+		upload(t, srv, fileref, data)
+	}
+	for fileref, data := range files {
+		resp, body := get(t, srv, fileref, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, fileref)
+		assert.Equal(t, data, body, fileref)
+		resp, _ = do(t, srv, http.MethodHead, fileref, nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, fileref)
+		assert.EqualValues(t, len(data), resp.ContentLength, fileref)
+	}
+
+	resp, body := get(t, srv, "second/dir/file", map[string]string{"Range": "bytes=10-19"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, files["second/dir/file"][10:20], body)
+
+	resp, _ = get(t, srv, "missing/dir/file", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPost, "missing/dir/file", []byte("data"), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPost, "default/file", []byte("data"), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the default bucket has no path")
+	resp, _ = do(t, srv, http.MethodPost, "first/", []byte("data"), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	assert.Equal(t, []string{"dir-file"}, listedFilerefs(list(t, srv, "")))
+	assert.Equal(t, []string{"first/dir/file"}, listedFilerefs(list(t, srv, "first/?")))
+	assert.Equal(t, []string{"second/dir/another/file", "second/dir/file"}, listedFilerefs(list(t, srv, "second/?prefix=dir/")))
+	page := list(t, srv, "second/?limit=1")
+	assert.Equal(t, []string{"second/dir/another/file"}, listedFilerefs(page))
+	assert.Equal(t, []string{"second/dir/file"}, listedFilerefs(list(t, srv, "second/?limit=1&cursor="+page.NextCursor)))
+
+	resp, _ = do(t, srv, http.MethodDelete, "first/dir/file", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, body = get(t, srv, "second/dir/file", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, files["second/dir/file"], body)
+}
+
+func TestEscapedSlashesStayInDefaultBucket(t *testing.T) {
+	srv := newTestServer(t)
+	resp, _ := createBucket(t, srv, "first", "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	data := randomData(10007)
+	upload(t, srv, "first%2Fdir%2Ffile", data)
+
+	resp, body := get(t, srv, "first%2Fdir%2Ffile", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+	resp, _ = get(t, srv, "first/dir/file", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, []string{"first/dir/file"}, listedFilerefs(list(t, srv, "")))
+	assert.Empty(t, listedFilerefs(list(t, srv, "first/?")))
+}
+
+func TestBucketQuota(t *testing.T) {
+	srv := newTestServer(t)
+	resp, _ := createBucket(t, srv, "small", `{"quota_bytes":15000}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	upload(t, srv, "small/first", randomData(10007))
+	resp, _ = do(t, srv, http.MethodPost, "small/second", randomData(10007), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	resp, _ = get(t, srv, "small/second", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDedupBucket(t *testing.T) {
+	srv := newTestServer(t)
+	resp, bucket := createBucket(t, srv, "backups", `{"chunks":1,"replication_factor":2,"dedup":true}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.True(t, bucket.Dedup)
+	resp, _ = createBucket(t, srv, "coded", `{"chunks":4,"parity_chunks":2,"dedup":true}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "erasure coded chunks cannot be shared")
+
+	data := randomData(9007)
+	upload(t, srv, "backups/monday", data)
+	upload(t, srv, "backups/tuesday", data)
+	resp, body := get(t, srv, "backups/tuesday", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+
+	resp, body = get(t, srv, "admin/dedup", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats datadistributor.DedupStats
+	require.NoError(t, json.Unmarshal(body, &stats))
+	assert.EqualValues(t, 2*9007, stats.LogicalBytes)
+	assert.EqualValues(t, 9007, stats.StoredBytes)
+	assert.EqualValues(t, 1, stats.SkippedChunks)
+}
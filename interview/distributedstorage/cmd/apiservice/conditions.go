@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+var errBadCondition = errors.New("bad conditional header")
+
+// etag is the quoted SHA-256 of the file, files without a checksum have no ETag. It is strong: equal ETags mean equal content
+func etag(info chunkmaster.FileInfo) string {
+	if len(info.Checksum) == 0 {
+		return ""
+	}
+	return strconv.Quote(hex.EncodeToString(info.Checksum))
+}
+
+func setETag(w http.ResponseWriter, info chunkmaster.FileInfo) {
+	if tag := etag(info); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+}
+
+// parseCondition reads If-Match and If-None-Match of an upload. If-Match takes "*" or a list of ETags and lets the upload replace
+// the current file, If-None-Match takes only "*" and lets the upload create a file which does not exist yet
+func parseCondition(req *http.Request) (chunkmaster.Condition, error) {
+	var condition chunkmaster.Condition
+	if header := req.Header.Get("If-None-Match"); header != "" {
+		if strings.TrimSpace(header) != "*" {
+			return chunkmaster.Condition{}, fmt.Errorf("%w: If-None-Match supports only *", errBadCondition)
+		}
+		condition.Absent = true
+	}
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return condition, nil
+	}
+	condition.Exists = true
+	if strings.TrimSpace(header) == "*" {
+		return condition, nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		unquoted, err := strconv.Unquote(strings.TrimSpace(tag))
+		if err != nil {
+			return chunkmaster.Condition{}, fmt.Errorf("%w: ETag %s is not quoted", errBadCondition, strings.TrimSpace(tag))
+		}
+		// an ETag which is not ours matches no file, the empty checksum does so too
+		checksum, _ := hex.DecodeString(unquoted)
+		condition.Checksums = append(condition.Checksums, checksum)
+	}
+	return condition, nil
+}
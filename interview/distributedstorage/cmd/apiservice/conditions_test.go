@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalUploads(t *testing.T) {
+	srv := newTestServer(t)
+	first, second := randomData(1000), randomData(2000)
+	checksum := sha256.Sum256(first)
+	firstETag := strconv.Quote(hex.EncodeToString(checksum[:]))
+
+	resp, _ := do(t, srv, http.MethodPut, "report", first, map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode, "nothing to replace")
+	resp, _ = do(t, srv, http.MethodPut, "report", first, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, firstETag, resp.Header.Get("ETag"))
+	resp, _ = do(t, srv, http.MethodPut, "report", second, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPut, "report", second, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "an unconditional upload does not overwrite")
+	resp, _ = do(t, srv, http.MethodPut, "report", second, map[string]string{"If-Match": `"0123", "not hex"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPut, "report", second, map[string]string{"If-Match": "unquoted"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPut, "report", second, map[string]string{"If-None-Match": firstETag})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "only * is supported")
+
+	resp, body := get(t, srv, "report", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, first, body)
+	assert.Equal(t, firstETag, resp.Header.Get("ETag"))
+
+	resp, _ = do(t, srv, http.MethodPost, "report", second, map[string]string{"If-Match": `"0123", ` + firstETag})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	secondETag := resp.Header.Get("ETag")
+	assert.NotEqual(t, firstETag, secondETag)
+	resp, body = get(t, srv, "report", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, second, body)
+	resp, _ = do(t, srv, http.MethodHead, "report", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, secondETag, resp.Header.Get("ETag"))
+	resp, _ = do(t, srv, http.MethodPut, "report", first, map[string]string{"If-Match": firstETag})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode, "the ETag is stale")
+
+	resp, _ = do(t, srv, http.MethodDelete, "report", nil, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = get(t, srv, "report", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	upload(t, srv, "report", first)
+}
+
+func TestS3ConditionalPut(t *testing.T) {
+	ctx := context.Background()
+	client := newS3Client(t, newS3TestServer(t, nil), "any", "any")
+	require.NoError(t, client.MakeBucket(ctx, "docs", minio.MakeBucketOptions{}))
+	first, second := randomData(1000), randomData(2000)
+
+	createOnly := minio.PutObjectOptions{}
+	createOnly.SetMatchETagExcept("*")
+	info, err := client.PutObject(ctx, "docs", "report", bytes.NewReader(first), int64(len(first)), createOnly)
+	require.NoError(t, err)
+	_, err = client.PutObject(ctx, "docs", "report", bytes.NewReader(second), int64(len(second)), createOnly)
+	assert.Equal(t, "PreconditionFailed", s3ErrorCode(err))
+
+	replace := minio.PutObjectOptions{}
+	replace.SetMatchETag(info.ETag)
+	_, err = client.PutObject(ctx, "docs", "report", bytes.NewReader(second), int64(len(second)), replace)
+	require.NoError(t, err)
+	assert.Equal(t, second, getS3Object(t, client, "docs", "report", minio.GetObjectOptions{}))
+	_, err = client.PutObject(ctx, "docs", "report", bytes.NewReader(first), int64(len(first)), replace)
+	assert.Equal(t, "PreconditionFailed", s3ErrorCode(err), "the ETag is stale")
+}
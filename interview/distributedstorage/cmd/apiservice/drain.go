@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+)
+
+const jobFailed jobState = "failed"
+
+type drainStatus struct {
+	StorageID string   `json:"storage_id"`
+	State     jobState `json:"state"`
+	// Remaining is the number of chunks still kept on the storage
+	Remaining  int       `json:"remaining_chunks"`
+	Moved      int       `json:"moved"`
+	Failed     int       `json:"failed"`
+	MovedBytes int64     `json:"moved_bytes"`
+	Started    time.Time `json:"started,omitempty"`
+	Finished   time.Time `json:"finished,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type drain struct {
+	status drainStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// drainJobs decommissions storages in background, any number of them at once. It is driven by the admin API:
+//   - POST /admin/storages/{storage}/drain starts draining, the storage is removed when it is empty
+//   - GET /admin/storages/{storage}/drain shows progress, GET /admin/drains shows it for every storage
+//   - DELETE /admin/storages/{storage}/drain cancels draining, the storage gets back in service
+type drainJobs struct {
+	dd             *datadistributor.DataDistributor
+	bytesPerSecond int64
+
+	mutex  sync.Mutex
+	drains map[string]*drain
+}
+
+var errDrainNotRunning = errors.New("storage is not draining")
+
+func newDrainJobs(dd *datadistributor.DataDistributor, bytesPerSecond int64) *drainJobs {
+	return &drainJobs{dd: dd, bytesPerSecond: bytesPerSecond, drains: make(map[string]*drain)}
+}
+
+func (j *drainJobs) start(storageID string) (drainStatus, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if d, found := j.drains[storageID]; found && d.status.State == jobRunning {
+		return d.status, datadistributor.ErrStorageDraining
+	}
+	if !slices.ContainsFunc(j.dd.StorageStatuses(), func(status datadistributor.StorageStatus) bool { return status.StorageID == storageID }) {
+		return drainStatus{}, datadistributor.ErrStorageNotFound
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &drain{
+		status: drainStatus{StorageID: storageID, State: jobRunning, Started: time.Now().UTC()},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	j.drains[storageID] = d
+	go j.run(ctx, d)
+	return d.status, nil
+}
+
+func (j *drainJobs) run(ctx context.Context, d *drain) {
+	defer close(d.done)
+	err := j.dd.Drain(ctx, d.status.StorageID, j.bytesPerSecond, func(progress datadistributor.DrainProgress) {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+		d.status.Remaining = progress.Remaining
+		d.status.Moved = progress.Moved
+		d.status.Failed = progress.Failed
+		d.status.MovedBytes = progress.MovedBytes
+	})
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	d.cancel()
+	switch {
+	case err == nil:
+		d.status.State = jobDone
+	case ctx.Err() != nil:
+		d.status.State = jobCancelled
+	default:
+		slog.Error("draining failed", "storage_id", d.status.StorageID, "err", err)
+		d.status.State = jobFailed
+		d.status.Error = err.Error()
+	}
+	d.status.Finished = time.Now().UTC()
+}
+
+// stop cancels draining and waits until it stops
+func (j *drainJobs) stop(storageID string) (drainStatus, error) {
+	j.mutex.Lock()
+	d, found := j.drains[storageID]
+	if !found || d.status.State != jobRunning {
+		defer j.mutex.Unlock()
+		if !found {
+			return drainStatus{}, errDrainNotRunning
+		}
+		return d.status, errDrainNotRunning
+	}
+	d.cancel()
+	j.mutex.Unlock()
+
+	<-d.done
+	return j.current(storageID)
+}
+
+func (j *drainJobs) current(storageID string) (drainStatus, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	d, found := j.drains[storageID]
+	if !found {
+		return drainStatus{}, datadistributor.ErrStorageNotFound
+	}
+	return d.status, nil
+}
+
+func (j *drainJobs) all() []drainStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	statuses := make([]drainStatus, 0, len(j.drains))
+	for _, d := range j.drains {
+		statuses = append(statuses, d.status)
+	}
+	slices.SortFunc(statuses, func(a, b drainStatus) int {
+		return strings.Compare(a.StorageID, b.StorageID)
+	})
+	return statuses
+}
+
+func (j *drainJobs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	storageID := req.PathValue("storage")
+	if storageID == "" {
+		writeJSON(w, j.all())
+		return
+	}
+
+	var (
+		status drainStatus
+		err    error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		status, err = j.current(storageID)
+	case http.MethodPost:
+		status, err = j.start(storageID)
+		if err == nil {
+			slog.Info("draining requested", "storage_id", storageID)
+		}
+	case http.MethodDelete:
+		status, err = j.stop(storageID)
+		if err == nil {
+			slog.Info("draining cancelled", "storage_id", storageID, "remaining", status.Remaining)
+		}
+	}
+	switch {
+	case errors.Is(err, datadistributor.ErrStorageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if req.Method == http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+	}
+	writeJSON(w, status)
+}
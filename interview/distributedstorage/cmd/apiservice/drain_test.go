@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drainRequest(t *testing.T, srv *httptest.Server, method, storageID string) (*http.Response, drainStatus) {
+	resp, body := do(t, srv, method, "admin/storages/"+storageID+"/drain", nil, nil)
+	var status drainStatus
+	if resp.StatusCode < 300 {
+		require.NoError(t, json.Unmarshal(body, &status))
+	}
+	return resp, status
+}
+
+func TestDrainAdmin(t *testing.T) {
+	srv := newTestServer(t)
+	for _, fileref := range []string{"a", "b", "c"} {
+		upload(t, srv, fileref, randomData(6000))
+	}
+
+	resp, _ := drainRequest(t, srv, http.MethodPost, "storage-9")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = drainRequest(t, srv, http.MethodDelete, "storage-0")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "nothing to cancel")
+
+	resp, status := drainRequest(t, srv, http.MethodPost, "storage-0")
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "storage-0", status.StorageID)
+	require.Eventually(t, func() bool {
+		_, status = drainRequest(t, srv, http.MethodGet, "storage-0")
+		return status.State != jobRunning
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, jobDone, status.State)
+	assert.Equal(t, 3, status.Moved, "every file has a chunk on every storage")
+	assert.Zero(t, status.Remaining)
+	assert.Zero(t, status.Failed)
+
+	resp, body := do(t, srv, http.MethodGet, "admin/storages", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var storages []datadistributor.StorageStatus
+	require.NoError(t, json.Unmarshal(body, &storages))
+	assert.Len(t, storages, 5)
+	for _, storage := range storages {
+		assert.NotEqual(t, "storage-0", storage.StorageID)
+	}
+	resp, body = do(t, srv, http.MethodGet, "admin/drains", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var drains []drainStatus
+	require.NoError(t, json.Unmarshal(body, &drains))
+	assert.Equal(t, []drainStatus{status}, drains)
+
+	resp, _ = drainRequest(t, srv, http.MethodPost, "storage-0")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "storage is removed")
+	for _, fileref := range []string{"a", "b", "c"} {
+		resp, body := do(t, srv, http.MethodGet, fileref, nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, randomData(6000), body)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 1000
+)
+
+type fileDescription struct {
+	Fileref   string    `json:"fileref"`
+	VersionID string    `json:"version_id,omitempty"`
+	Size      int64     `json:"size"`
+	Created   time.Time `json:"created"`
+	Checksum  string    `json:"checksum_sha256,omitempty"`
+}
+
+func describeFile(info chunkmaster.FileInfo) fileDescription {
+	fileref := info.Fileref
+	// a slashed key of the default bucket is addressed as /{key} with escaped slashes, not by its fileref
+	if bucket, key := chunkmaster.SplitFileref(fileref); bucket == chunkmaster.DefaultBucket {
+		fileref = key
+	}
+	return fileDescription{
+		Fileref:   fileref,
+		VersionID: info.VersionID,
+		Size:      info.Size,
+		Created:   info.Created,
+		Checksum:  hex.EncodeToString(info.Checksum),
+	}
+}
+
+type fileList struct {
+	Files []fileDescription `json:"files"`
+	// NextCursor is set when there are more files. It is passed as cursor to get them
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listHandler serves GET /?prefix=&limit=&cursor= for the default bucket and GET /{bucket}/?prefix=&limit=&cursor= for others.
+// Files are ordered by key, prefix is a prefix of the key
+type listHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *listHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			http.Error(w, "limit must be in [1, 1000]", http.StatusBadRequest)
+			return
+		}
+	}
+	// the cursor is the last key of the previous page, it is only encoded to be opaque
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		http.Error(w, "bad cursor", http.StatusBadRequest)
+		return
+	}
+
+	bucket := req.PathValue("bucket")
+	if bucket == "" {
+		bucket = chunkmaster.DefaultBucket
+	}
+	files := h.dd.ListFiles(bucket, query.Get("prefix"), string(after), limit+1)
+	list := fileList{Files: make([]fileDescription, 0, len(files))}
+	if len(files) > limit {
+		files = files[:limit]
+		_, lastKey := chunkmaster.SplitFileref(files[len(files)-1].Fileref)
+		list.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+	}
+	for _, file := range files {
+		list.Files = append(list.Files, describeFile(file))
+	}
+	writeJSON(w, list)
+}
+
+// headHandler gives file metadata without its data
+type headHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *headHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fileref := objectName(req)
+	catalogFileref, err := resolveVersion(h.dd, req)
+	var info chunkmaster.FileInfo
+	if err == nil {
+		info, err = h.dd.StatFile(catalogFileref)
+	}
+	if errors.Is(err, chunkmaster.ErrFileNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("stat file error", "err", err, "fileref", fileref)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.Created.IsZero() {
+		w.Header().Set("Last-Modified", info.Created.UTC().Format(http.TimeFormat))
+	}
+	if len(info.Checksum) > 0 {
+		w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(info.Checksum))
+	}
+	setVersionID(w, catalogFileref)
+	setETag(w, info)
+	w.WriteHeader(http.StatusOK)
+}
+
+type deleteHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *deleteHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fileref := objectName(req)
+	versionID := req.URL.Query().Get("version")
+	slog.Info("incoming delete request", "fileref", fileref, "version_id", versionID)
+	var err error
+	if versionID != "" {
+		// a single version goes away for good, while deletion of the file only makes a tombstone
+		err = h.dd.DeleteVersion(req.Context(), fileref, versionID)
+	} else {
+		err = h.dd.DeleteData(req.Context(), fileref)
+	}
+	if errors.Is(err, chunkmaster.ErrFileNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("delete data error", "err", err, "fileref", fileref)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHead(t *testing.T) {
+	srv := newTestServer(t)
+	data := randomData(10007)
+	upload(t, srv, "file", data)
+
+	resp, body := do(t, srv, http.MethodHead, "file", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.EqualValues(t, 10007, resp.ContentLength)
+	checksum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(checksum[:]), resp.Header.Get("X-Checksum-Sha256"))
+	_, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	assert.NoError(t, err)
+
+	resp, _ = do(t, srv, http.MethodHead, "missing", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDelete(t *testing.T) {
+	srv := newTestServer(t)
+	upload(t, srv, "file", randomData(10007))
+
+	resp, _ := do(t, srv, http.MethodDelete, "file", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = get(t, srv, "file", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodDelete, "file", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// the name is free again
+	upload(t, srv, "file", randomData(10))
+}
+
+// list gets the list of the default bucket for a query, or of another bucket for "bucket/?query"
+func list(t *testing.T, srv *httptest.Server, query string) fileList {
+	if !strings.Contains(query, "?") {
+		query = "?" + query
+	}
+	resp, body := get(t, srv, query, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var res fileList
+	require.NoError(t, json.Unmarshal(body, &res))
+	return res
+}
+
+func listedFilerefs(list fileList) []string {
+	res := make([]string, 0, len(list.Files))
+	for _, file := range list.Files {
+		res = append(res, file.Fileref)
+	}
+	return res
+}
+
+func TestList(t *testing.T) {
+	srv := newTestServer(t)
+	for _, fileref := range []string{"b2", "a1", "b1", "b3", "c"} {
+		upload(t, srv, fileref, randomData(len(fileref)))
+	}
+
+	all := list(t, srv, "")
+	require.Len(t, all.Files, 5)
+	assert.Equal(t, "a1", all.Files[0].Fileref)
+	assert.EqualValues(t, 2, all.Files[0].Size)
+	assert.NotEmpty(t, all.Files[0].Checksum)
+	assert.Empty(t, all.NextCursor)
+
+	var seen []string
+	cursor := ""
+	for {
+		page := list(t, srv, "prefix=b&limit=2&cursor="+cursor)
+		for _, file := range page.Files {
+			seen = append(seen, file.Fileref)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"b1", "b2", "b3"}, seen)
+
+	for _, query := range []string{"limit=0", "limit=x", "limit=1001", "cursor=!!"} {
+		resp, _ := get(t, srv, "?"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
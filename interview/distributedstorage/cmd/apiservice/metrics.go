@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	storageChunksDesc = prometheus.NewDesc(metrics.Namespace+"_storage_chunks",
+		"Chunk replicas which the catalog keeps on a storage", []string{"storage"}, nil)
+	storageAvailableBytesDesc = prometheus.NewDesc(metrics.Namespace+"_storage_available_bytes",
+		"Free space of a storage as DataDistributor knows it, i.e. reported by the last heartbeat minus what has been placed since", []string{"storage"}, nil)
+	storageHeartbeatAgeDesc = prometheus.NewDesc(metrics.Namespace+"_storage_heartbeat_age_seconds",
+		"Time since the last heartbeat of a storage", []string{"storage"}, nil)
+	storageStateDesc = prometheus.NewDesc(metrics.Namespace+"_storage_state",
+		"1 for the liveness state a storage is in", []string{"storage", "state"}, nil)
+	rollbacksDesc = prometheus.NewDesc(metrics.Namespace+"_upload_rollbacks_total",
+		"Uploads which have failed and have been rolled back", nil, nil)
+)
+
+// clusterCollector reads the state of storages when metrics are scraped, so it is never stale and storages which are gone
+// disappear from metrics
+type clusterCollector struct {
+	dd *datadistributor.DataDistributor
+}
+
+var _ prometheus.Collector = (*clusterCollector)(nil)
+
+func (c *clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storageChunksDesc
+	ch <- storageAvailableBytesDesc
+	ch <- storageHeartbeatAgeDesc
+	ch <- storageStateDesc
+	ch <- rollbacksDesc
+}
+
+func (c *clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, status := range c.dd.StorageStatuses() {
+		ch <- prometheus.MustNewConstMetric(storageAvailableBytesDesc, prometheus.GaugeValue, float64(status.AvailableBytes), status.StorageID)
+		ch <- prometheus.MustNewConstMetric(storageHeartbeatAgeDesc, prometheus.GaugeValue, now.Sub(status.LastHeartbeat).Seconds(), status.StorageID)
+		ch <- prometheus.MustNewConstMetric(storageStateDesc, prometheus.GaugeValue, 1, status.StorageID, string(status.State))
+	}
+	for storageID, chunks := range c.dd.ChunksPerStorage() {
+		ch <- prometheus.MustNewConstMetric(storageChunksDesc, prometheus.GaugeValue, float64(chunks), storageID)
+	}
+	ch <- prometheus.MustNewConstMetric(rollbacksDesc, prometheus.CounterValue, float64(c.dd.Rollbacks()))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterCollector(t *testing.T) {
+	dd := newTestDataDistributor(t)
+	data := randomData(6000)
+	require.NoError(t, dd.DistributeData(context.Background(), "file", int64(len(data)), bytes.NewReader(data)))
+	collector := &clusterCollector{dd: dd}
+
+	assert.Equal(t, 6, testutil.CollectAndCount(collector, "diststorage_storage_available_bytes"))
+	assert.Equal(t, 6, testutil.CollectAndCount(collector, "diststorage_storage_heartbeat_age_seconds"))
+	assert.Equal(t, 6, testutil.CollectAndCount(collector, "diststorage_storage_state"))
+	expected := `
+# HELP diststorage_storage_chunks Chunk replicas which the catalog keeps on a storage
+# TYPE diststorage_storage_chunks gauge
+diststorage_storage_chunks{storage="storage-0"} 1
+diststorage_storage_chunks{storage="storage-1"} 1
+diststorage_storage_chunks{storage="storage-2"} 1
+diststorage_storage_chunks{storage="storage-3"} 1
+diststorage_storage_chunks{storage="storage-4"} 1
+diststorage_storage_chunks{storage="storage-5"} 1
+# HELP diststorage_upload_rollbacks_total Uploads which have failed and have been rolled back
+# TYPE diststorage_upload_rollbacks_total counter
+diststorage_upload_rollbacks_total 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "diststorage_storage_chunks", "diststorage_upload_rollbacks_total"))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+)
+
+// multipartHandler serves S3-like multipart uploads, the same for /{fileref} and /{bucket}/{key...}:
+//   - POST /{fileref}?uploads initiates an upload
+//   - PUT /{fileref}?uploadId=X&partNumber=N uploads a part, sending the same part again replaces it
+//   - GET /{fileref}?uploadId=X lists uploaded parts, so an interrupted client knows what to resend
+//   - POST /{fileref}?uploadId=X completes the upload, optionally with the list of parts to use
+//   - DELETE /{fileref}?uploadId=X aborts the upload
+type multipartHandler struct {
+	dd      *datadistributor.DataDistributor
+	uploads *multipart.Manager
+}
+
+type completeRequest struct {
+	Parts []multipart.Part `json:"parts"`
+}
+
+func isMultipartRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	return query.Has("uploads") || query.Has("uploadId")
+}
+
+// orMultipart sends multipart requests to mp and everything else to plain
+func orMultipart(mp *multipartHandler, plain http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isMultipartRequest(req) {
+			mp.ServeHTTP(w, req)
+			return
+		}
+		plain.ServeHTTP(w, req)
+	})
+}
+
+func (h *multipartHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fileref := objectName(req)
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		h.initiate(w, fileref)
+	case uploadID == "":
+		w.WriteHeader(http.StatusBadRequest)
+	case req.Method == http.MethodPut:
+		h.putPart(w, req, fileref, uploadID)
+	case req.Method == http.MethodGet:
+		h.listParts(w, fileref, uploadID)
+	case req.Method == http.MethodPost:
+		h.complete(w, req, fileref, uploadID)
+	case req.Method == http.MethodDelete:
+		h.abort(w, fileref, uploadID)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *multipartHandler) initiate(w http.ResponseWriter, fileref string) {
+	upload, err := h.uploads.Initiate(fileref)
+	if err != nil {
+		writeMultipartError(w, err, fileref)
+		return
+	}
+	writeJSON(w, upload)
+}
+
+func (h *multipartHandler) putPart(w http.ResponseWriter, req *http.Request, fileref, uploadID string) {
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	part, err := h.uploads.PutPart(uploadID, fileref, partNumber, req.Body)
+	if err != nil {
+		writeMultipartError(w, err, fileref)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(part.ETag))
+	writeJSON(w, part)
+}
+
+func (h *multipartHandler) listParts(w http.ResponseWriter, fileref, uploadID string) {
+	parts, err := h.uploads.Parts(uploadID, fileref)
+	if err != nil {
+		writeMultipartError(w, err, fileref)
+		return
+	}
+	writeJSON(w, parts)
+}
+
+func (h *multipartHandler) complete(w http.ResponseWriter, req *http.Request, fileref, uploadID string) {
+	var request completeRequest
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			slog.Warn("bad complete request", "err", err, "fileref", fileref)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	err := h.uploads.Complete(req.Context(), uploadID, fileref, request.Parts, h.dd.DistributeData)
+	if err != nil {
+		writeMultipartError(w, err, fileref)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *multipartHandler) abort(w http.ResponseWriter, fileref, uploadID string) {
+	err := h.uploads.Abort(uploadID, fileref)
+	if err != nil {
+		writeMultipartError(w, err, fileref)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeMultipartError(w http.ResponseWriter, err error, fileref string) {
+	switch {
+	case errors.Is(err, multipart.ErrUploadNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, multipart.ErrBadPartNumber),
+		errors.Is(err, multipart.ErrBadPartOrder),
+		errors.Is(err, multipart.ErrPartNotFound),
+		errors.Is(err, multipart.ErrPartMismatch),
+		errors.Is(err, multipart.ErrNoParts),
+		errors.Is(err, auth.ErrPayloadMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, multipart.ErrUploadBusy), errors.Is(err, chunkmaster.ErrFileDuplicate):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, chunkmaster.ErrBucketNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, chunkmaster.ErrBucketQuotaExceeded), errors.Is(err, storage.ErrNotEnoughSpace):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		slog.Error("multipart upload error", "err", err, "fileref", fileref)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
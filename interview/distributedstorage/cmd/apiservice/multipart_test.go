@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func initiateUpload(t *testing.T, srv *httptest.Server, fileref string) string {
+	resp, body := do(t, srv, http.MethodPost, fileref+"?uploads", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var upload multipart.Upload
+	require.NoError(t, json.Unmarshal(body, &upload))
+	require.NotEmpty(t, upload.ID)
+	return upload.ID
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv := newTestServer(t)
+	data := randomData(30011)
+	uploadID := initiateUpload(t, srv, "file")
+
+	// the last part goes first and the first one is sent twice, as after a dropped connection
+	for _, part := range []int{3, 1, 2, 1} {
+		resp, body := do(t, srv, http.MethodPut, fmt.Sprintf("file?uploadId=%s&partNumber=%d", uploadID, part), partData(data, part), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+		var stored multipart.Part
+		require.NoError(t, json.Unmarshal(body, &stored))
+		assert.Equal(t, part, stored.Number)
+	}
+
+	resp, body := do(t, srv, http.MethodGet, "file?uploadId="+uploadID, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var parts []multipart.Part
+	require.NoError(t, json.Unmarshal(body, &parts))
+	assert.Len(t, parts, 3)
+
+	resp, _ = get(t, srv, "file", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "nothing is stored before completion")
+
+	complete, err := json.Marshal(completeRequest{Parts: parts})
+	require.NoError(t, err)
+	resp, _ = do(t, srv, http.MethodPost, "file?uploadId="+uploadID, complete, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = get(t, srv, "file", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+
+	resp, _ = do(t, srv, http.MethodGet, "file?uploadId="+uploadID, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMultipartAbort(t *testing.T) {
+	srv := newTestServer(t)
+	uploadID := initiateUpload(t, srv, "file")
+	resp, _ := do(t, srv, http.MethodPut, "file?uploadId="+uploadID+"&partNumber=1", []byte("data"), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = do(t, srv, http.MethodDelete, "file?uploadId="+uploadID, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPost, "file?uploadId="+uploadID, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMultipartErrors(t *testing.T) {
+	srv := newTestServer(t)
+	upload(t, srv, "existing", []byte("data"))
+	uploadID := initiateUpload(t, srv, "existing")
+
+	resp, _ := do(t, srv, http.MethodPut, "existing?uploadId="+uploadID+"&partNumber=0", []byte("data"), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPut, "existing?uploadId="+uploadID, []byte("data"), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPut, "existing?uploadId=unknown&partNumber=1", []byte("data"), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPost, "existing?uploadId="+uploadID, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "no parts")
+
+	resp, _ = do(t, srv, http.MethodPut, "existing?uploadId="+uploadID+"&partNumber=1", []byte("data"), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(t, srv, http.MethodPost, "existing?uploadId="+uploadID, nil, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "file already exists")
+}
+
+// partData splits data into three parts, the last one takes the remainder
+func partData(data []byte, part int) []byte {
+	if part == 3 {
+		return data[20000:]
+	}
+	return data[(part-1)*10000 : part*10000]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+	// errRangeIgnored means the header is malformed or has several ranges. The whole file is sent then, which is allowed by RFC 9110
+	errRangeIgnored = errors.New("range ignored")
+)
+
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.offset, r.offset+r.length-1, size)
+}
+
+// parseRange supports a single range of Range header: "bytes=a-b", "bytes=a-" or "bytes=-n"
+func parseRange(header string, size int64) (byteRange, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, errRangeIgnored
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, errRangeIgnored
+	}
+
+	if first == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, errRangeIgnored
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return byteRange{offset: size - n, length: n}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, errRangeIgnored
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, errRangeIgnored
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return byteRange{}, errRangeNotSatisfiable
+	}
+	return byteRange{offset: start, length: end - start + 1}, nil
+}
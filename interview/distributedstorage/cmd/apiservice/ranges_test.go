@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	for header, expected := range map[string]byteRange{
+		"bytes=0-0":       {offset: 0, length: 1},
+		"bytes=0-999":     {offset: 0, length: 1000},
+		"bytes=0-5000":    {offset: 0, length: 1000},
+		"bytes=100-199":   {offset: 100, length: 100},
+		"bytes=990-":      {offset: 990, length: 10},
+		"bytes=-10":       {offset: 990, length: 10},
+		"bytes=-5000":     {offset: 0, length: 1000},
+		"bytes= 100-199 ": {offset: 100, length: 100},
+	} {
+		r, err := parseRange(header, size)
+		assert.NoError(t, err, header)
+		assert.Equal(t, expected, r, header)
+	}
+
+	for _, header := range []string{"bytes=1000-", "bytes=1000-1005", "bytes=-0"} {
+		_, err := parseRange(header, size)
+		assert.ErrorIs(t, err, errRangeNotSatisfiable, header)
+	}
+	_, err := parseRange("bytes=-10", 0)
+	assert.ErrorIs(t, err, errRangeNotSatisfiable)
+
+	for _, header := range []string{"items=0-5", "bytes=5", "bytes=10-5", "bytes=a-b", "bytes=0-5,10-15", "bytes=--5"} {
+		_, err := parseRange(header, size)
+		assert.ErrorIs(t, err, errRangeIgnored, header)
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	assert.Equal(t, "bytes 100-199/1000", byteRange{offset: 100, length: 100}.contentRange(1000))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+)
+
+type jobState string
+
+const (
+	jobIdle      jobState = "idle"
+	jobRunning   jobState = "running"
+	jobDone      jobState = "done"
+	jobCancelled jobState = "cancelled"
+)
+
+type rebalanceStatus struct {
+	State        jobState  `json:"state"`
+	PlannedMoves int       `json:"planned_moves"`
+	Moved        int       `json:"moved"`
+	Failed       int       `json:"failed"`
+	MovedBytes   int64     `json:"moved_bytes"`
+	Started      time.Time `json:"started,omitempty"`
+	Finished     time.Time `json:"finished,omitempty"`
+}
+
+// rebalanceJob runs at most one rebalancing at a time in background. It is driven by the admin API:
+//   - POST /admin/rebalance starts it
+//   - GET /admin/rebalance shows progress of the running or the last one
+//   - DELETE /admin/rebalance cancels it, the move in flight is finished first
+type rebalanceJob struct {
+	dd             *datadistributor.DataDistributor
+	bytesPerSecond int64
+
+	mutex  sync.Mutex
+	status rebalanceStatus
+	cancel context.CancelFunc
+	// done is closed when the running rebalancing stops
+	done chan struct{}
+}
+
+var errRebalanceRunning = errors.New("rebalancing is running already")
+var errRebalanceNotRunning = errors.New("rebalancing is not running")
+
+func newRebalanceJob(dd *datadistributor.DataDistributor, bytesPerSecond int64) *rebalanceJob {
+	return &rebalanceJob{dd: dd, bytesPerSecond: bytesPerSecond, status: rebalanceStatus{State: jobIdle}}
+}
+
+func (j *rebalanceJob) start() (rebalanceStatus, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.status.State == jobRunning {
+		return j.status, errRebalanceRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+	j.status = rebalanceStatus{State: jobRunning, Started: time.Now().UTC()}
+	go j.run(ctx, j.done)
+	return j.status, nil
+}
+
+func (j *rebalanceJob) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	err := j.dd.Rebalance(ctx, j.bytesPerSecond, func(progress datadistributor.RebalanceProgress) {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+		j.status.PlannedMoves = progress.PlannedMoves
+		j.status.Moved = progress.Moved
+		j.status.Failed = progress.Failed
+		j.status.MovedBytes = progress.MovedBytes
+	})
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.cancel()
+	j.status.State = jobDone
+	if err != nil {
+		slog.Warn("rebalancing stopped", "err", err)
+		j.status.State = jobCancelled
+	}
+	j.status.Finished = time.Now().UTC()
+}
+
+// stop cancels the running rebalancing and waits until it stops
+func (j *rebalanceJob) stop() (rebalanceStatus, error) {
+	j.mutex.Lock()
+	if j.status.State != jobRunning {
+		defer j.mutex.Unlock()
+		return j.status, errRebalanceNotRunning
+	}
+	j.cancel()
+	done := j.done
+	j.mutex.Unlock()
+
+	<-done
+	return j.current(), nil
+}
+
+func (j *rebalanceJob) current() rebalanceStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.status
+}
+
+func (j *rebalanceJob) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var (
+		status rebalanceStatus
+		err    error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		status = j.current()
+	case http.MethodPost:
+		status, err = j.start()
+		if err == nil {
+			slog.Info("rebalancing requested")
+		}
+	case http.MethodDelete:
+		status, err = j.stop()
+		if err == nil {
+			slog.Info("rebalancing cancelled", "moved", status.Moved, "planned_moves", status.PlannedMoves)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if req.Method == http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+	}
+	writeJSON(w, status)
+}
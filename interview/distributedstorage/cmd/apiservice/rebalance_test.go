@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rebalanceRequest(t *testing.T, srv *httptest.Server, method string) (*http.Response, rebalanceStatus) {
+	resp, body := do(t, srv, method, "admin/rebalance", nil, nil)
+	var status rebalanceStatus
+	if resp.StatusCode < 300 {
+		require.NoError(t, json.Unmarshal(body, &status))
+	}
+	return resp, status
+}
+
+func TestRebalanceAdmin(t *testing.T) {
+	srv := newTestServer(t)
+	for _, fileref := range []string{"a", "b", "c"} {
+		upload(t, srv, fileref, randomData(6000))
+	}
+
+	resp, status := rebalanceRequest(t, srv, http.MethodGet)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, jobIdle, status.State)
+	resp, _ = rebalanceRequest(t, srv, http.MethodDelete)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "nothing to cancel")
+
+	resp, status = rebalanceRequest(t, srv, http.MethodPost)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.False(t, status.Started.IsZero())
+	require.Eventually(t, func() bool {
+		_, status = rebalanceRequest(t, srv, http.MethodGet)
+		return status.State != jobRunning
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, jobDone, status.State)
+	assert.Equal(t, status.PlannedMoves, status.Moved)
+	assert.Zero(t, status.Failed)
+	assert.False(t, status.Finished.IsZero())
+
+	// data is readable after rebalancing
+	for _, fileref := range []string{"a", "b", "c"} {
+		resp, body := do(t, srv, http.MethodGet, fileref, nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, randomData(6000), body)
+	}
+}
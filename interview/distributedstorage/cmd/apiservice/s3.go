@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
+)
+
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3Subresources are S3 calls which the gateway does not serve. Without the check they would look like plain object or bucket requests
+var s3Subresources = []string{
+	"acl", "attributes", "cors", "delete", "encryption", "legal-hold", "lifecycle", "logging", "notification", "object-lock",
+	"policy", "replication", "restore", "retention", "select", "tagging", "torrent", "uploads", "versioning", "versions", "website",
+}
+
+// s3Gateway serves a path-style subset of the S3 API on top of the same DataDistributor as the REST API:
+//   - GET / lists buckets
+//   - PUT, HEAD, DELETE /{bucket} create, check and delete a bucket, GET /{bucket} lists it (ListObjectsV2 and ListObjects)
+//   - PUT, GET, HEAD, DELETE /{bucket}/{key...} are PutObject, GetObject, HeadObject and DeleteObject, with versionId for buckets with versioning
+//   - multipart uploads, see serveMultipart
+//
+// The default bucket is the bucket named "default", its keys cannot have slashes
+type s3Gateway struct {
+	dd      *datadistributor.DataDistributor
+	uploads *multipart.Manager
+}
+
+// newS3Mux checks signatures of every request when authn is set. Keys of the auth config are S3 access keys
+func newS3Mux(dataDistributor *datadistributor.DataDistributor, uploads *multipart.Manager, authn *auth.Authenticator) *http.ServeMux {
+	gateway := &s3Gateway{dd: dataDistributor, uploads: uploads}
+	authz := authorizer{authn: authn, deny: denyS3}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /{$}", authz.wrap(clusterAccess, http.HandlerFunc(gateway.listBuckets)))
+	mux.Handle("/{bucket}", authz.wrap(s3Access, gateway))
+	mux.Handle("/{bucket}/{key...}", authz.wrap(s3Access, gateway))
+	return mux
+}
+
+func (g *s3Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth.DecodeS3Payload(req)
+	bucket, key := req.PathValue("bucket"), req.PathValue("key")
+	if key == "" {
+		g.serveBucket(w, req, bucket)
+		return
+	}
+	if _, err := g.dd.StatBucket(bucket); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if bucket == chunkmaster.DefaultBucket && strings.Contains(key, "/") {
+		writeS3ErrorCode(w, req, http.StatusBadRequest, "InvalidArgument", "keys of the default bucket cannot have slashes")
+		return
+	}
+	fileref := chunkmaster.ObjectName(bucket, key)
+	if isMultipartRequest(req) {
+		g.serveMultipart(w, req, bucket, key, fileref)
+		return
+	}
+	if unsupportedS3Request(req) || req.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3ErrorCode(w, req, http.StatusNotImplemented, "NotImplemented", "the gateway does not support this call")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		g.getObject(w, req, fileref)
+	case http.MethodHead:
+		g.headObject(w, req, fileref)
+	case http.MethodPut:
+		g.putObject(w, req, fileref)
+	case http.MethodDelete:
+		g.deleteObject(w, req, fileref)
+	default:
+		writeS3ErrorCode(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed for objects")
+	}
+}
+
+func unsupportedS3Request(req *http.Request) bool {
+	query := req.URL.Query()
+	for _, subresource := range s3Subresources {
+		if query.Has(subresource) {
+			return true
+		}
+	}
+	return false
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
+
+func setS3ObjectHeaders(w http.ResponseWriter, info chunkmaster.FileInfo) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Last-Modified", info.Created.UTC().Format(http.TimeFormat))
+	setETag(w, info)
+	if info.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", info.VersionID)
+	}
+}
+
+// statVersion describes the version from versionId, or the current version. The catalog fileref is used to read the same version later,
+// its data is kept until release is called
+func (g *s3Gateway) statVersion(req *http.Request, fileref string) (string, chunkmaster.FileInfo, func(), error) {
+	catalogFileref, release, err := g.dd.PinVersion(req.Context(), fileref, req.URL.Query().Get("versionId"))
+	if err != nil {
+		return "", chunkmaster.FileInfo{}, nil, err
+	}
+	info, err := g.dd.StatFile(catalogFileref)
+	if err != nil {
+		release()
+		return "", chunkmaster.FileInfo{}, nil, err
+	}
+	return catalogFileref, info, release, nil
+}
+
+func (g *s3Gateway) getObject(w http.ResponseWriter, req *http.Request, fileref string) {
+	catalogFileref, info, release, err := g.statVersion(req, fileref)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	defer release()
+	setS3ObjectHeaders(w, info)
+	statusCode := http.StatusOK
+	requested := byteRange{offset: 0, length: info.Size}
+	if header := req.Header.Get("Range"); header != "" {
+		r, err := parseRange(header, info.Size)
+		switch {
+		case errors.Is(err, errRangeNotSatisfiable):
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			writeS3ErrorCode(w, req, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", err.Error())
+			return
+		case err == nil:
+			statusCode = http.StatusPartialContent
+			requested = r
+			w.Header().Set("Content-Range", r.contentRange(info.Size))
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(requested.length, 10))
+
+	sw := &statusOnWriteWriter{w: w, statusCode: statusCode}
+	err = g.dd.ReconstructRange(req.Context(), catalogFileref, requested.offset, requested.length, sw)
+	if err != nil {
+		slog.Error("reconstruct data error", "err", err, "fileref", fileref)
+		if !sw.started {
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Range")
+			writeS3Error(w, req, err)
+		}
+		return
+	}
+	sw.start()
+}
+
+func (g *s3Gateway) headObject(w http.ResponseWriter, req *http.Request, fileref string) {
+	_, info, release, err := g.statVersion(req, fileref)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	release()
+	setS3ObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// putObject replaces an existing key as S3 does, unless If-Match or If-None-Match does not hold. In a bucket with versioning
+// every put makes a new version
+func (g *s3Gateway) putObject(w http.ResponseWriter, req *http.Request, fileref string) {
+	slog.Info("incoming s3 put request", "fileref", fileref, "size", req.ContentLength)
+	condition, err := parseCondition(req)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	condition.Overwrite = true
+	if req.ContentLength < 0 {
+		_, err = g.dd.DistributeStreamIf(req.Context(), fileref, condition, req.Body)
+	} else {
+		err = g.dd.DistributeDataIf(req.Context(), fileref, condition, req.ContentLength, req.Body)
+	}
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if info, err := g.dd.StatFile(fileref); err == nil {
+		setETag(w, info)
+		if info.VersionID != "" {
+			w.Header().Set("X-Amz-Version-Id", info.VersionID)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteObject succeeds for a missing key, as S3 does. With versionId only that version is removed
+func (g *s3Gateway) deleteObject(w http.ResponseWriter, req *http.Request, fileref string) {
+	versionID := req.URL.Query().Get("versionId")
+	slog.Info("incoming s3 delete request", "fileref", fileref, "version_id", versionID)
+	var err error
+	if versionID != "" {
+		err = g.dd.DeleteVersion(req.Context(), fileref, versionID)
+	} else {
+		err = g.dd.DeleteData(req.Context(), fileref)
+	}
+	if err != nil && !errors.Is(err, chunkmaster.ErrFileNotFound) {
+		writeS3Error(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func writeXML(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	_, err := w.Write([]byte(xml.Header))
+	if err == nil {
+		err = xml.NewEncoder(w).Encode(v)
+	}
+	if err != nil {
+		slog.Error("cannot write response", "err", err)
+	}
+}
+
+func writeS3ErrorCode(w http.ResponseWriter, req *http.Request, statusCode int, code, message string) {
+	if req.Method == http.MethodHead {
+		// no body, the client sees only the status
+		w.WriteHeader(statusCode)
+		return
+	}
+	writeXML(w, statusCode, s3ErrorResponse{Code: code, Message: message, Resource: req.URL.Path})
+}
+
+// writeS3Error answers with the S3 error code which is the closest to err
+func writeS3Error(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode, code := http.StatusInternalServerError, "InternalError"
+	switch {
+	case errors.Is(err, chunkmaster.ErrFileNotFound):
+		statusCode, code = http.StatusNotFound, "NoSuchKey"
+	case errors.Is(err, chunkmaster.ErrBucketNotFound):
+		statusCode, code = http.StatusNotFound, "NoSuchBucket"
+	case errors.Is(err, chunkmaster.ErrFileDuplicate):
+		statusCode, code = http.StatusConflict, "ObjectAlreadyExists"
+	case errors.Is(err, chunkmaster.ErrPreconditionFailed):
+		statusCode, code = http.StatusPreconditionFailed, "PreconditionFailed"
+	case errors.Is(err, errBadCondition):
+		statusCode, code = http.StatusBadRequest, "InvalidArgument"
+	case errors.Is(err, chunkmaster.ErrBucketExists):
+		statusCode, code = http.StatusConflict, "BucketAlreadyOwnedByYou"
+	case errors.Is(err, chunkmaster.ErrBucketNotEmpty):
+		statusCode, code = http.StatusConflict, "BucketNotEmpty"
+	case errors.Is(err, chunkmaster.ErrDefaultBucket):
+		statusCode, code = http.StatusConflict, "InvalidBucketState"
+	case errors.Is(err, chunkmaster.ErrBadBucketName):
+		statusCode, code = http.StatusBadRequest, "InvalidBucketName"
+	case errors.Is(err, chunkmaster.ErrBucketQuotaExceeded):
+		statusCode, code = http.StatusInsufficientStorage, "QuotaExceeded"
+	case errors.Is(err, chunkmaster.ErrStreamingNotSupported):
+		statusCode, code = http.StatusLengthRequired, "MissingContentLength"
+	case errors.Is(err, auth.ErrPayloadMismatch):
+		statusCode, code = http.StatusBadRequest, "XAmzContentSHA256Mismatch"
+	case errors.Is(err, chunkmaster.ErrBadFileref):
+		statusCode, code = http.StatusBadRequest, "InvalidArgument"
+	case errors.Is(err, multipart.ErrUploadNotFound):
+		statusCode, code = http.StatusNotFound, "NoSuchUpload"
+	case errors.Is(err, multipart.ErrPartNotFound), errors.Is(err, multipart.ErrPartMismatch):
+		statusCode, code = http.StatusBadRequest, "InvalidPart"
+	case errors.Is(err, multipart.ErrBadPartOrder):
+		statusCode, code = http.StatusBadRequest, "InvalidPartOrder"
+	case errors.Is(err, multipart.ErrBadPartNumber):
+		statusCode, code = http.StatusBadRequest, "InvalidArgument"
+	case errors.Is(err, multipart.ErrNoParts):
+		statusCode, code = http.StatusBadRequest, "MalformedXML"
+	case errors.Is(err, multipart.ErrUploadBusy):
+		statusCode, code = http.StatusConflict, "OperationAborted"
+	default:
+		slog.Error("s3 request error", "err", err, "method", req.Method, "path", req.URL.Path)
+	}
+	writeS3ErrorCode(w, req, statusCode, code, err.Error())
+}
+
+// denyS3 answers with 403 like S3 does, for missing credentials as well
+func denyS3(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, auth.ErrForbidden) || req.Header.Get("Authorization") == "" {
+		writeS3ErrorCode(w, req, http.StatusForbidden, "AccessDenied", "access denied")
+		return
+	}
+	writeS3ErrorCode(w, req, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+}
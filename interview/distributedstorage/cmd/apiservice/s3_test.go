@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/auth"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newS3TestServer(t *testing.T, authn *auth.Authenticator) *httptest.Server {
+	dd := newTestDataDistributor(t)
+	uploads, err := multipart.NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	srv := httptest.NewServer(newS3Mux(dd, uploads, authn))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newS3Client(t *testing.T, srv *httptest.Server, id, secret string) *minio.Client {
+	endpoint, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client, err := minio.New(endpoint.Host, &minio.Options{Creds: credentials.NewStaticV4(id, secret, ""), Region: "us-east-1"})
+	require.NoError(t, err)
+	return client
+}
+
+func s3ErrorCode(err error) string {
+	return minio.ToErrorResponse(err).Code
+}
+
+func getS3Object(t *testing.T, client *minio.Client, bucket, key string, opts minio.GetObjectOptions) []byte {
+	object, err := client.GetObject(context.Background(), bucket, key, opts)
+	require.NoError(t, err)
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	require.NoError(t, err)
+	return data
+}
+
+func TestS3Objects(t *testing.T) {
+	ctx := context.Background()
+	client := newS3Client(t, newS3TestServer(t, nil), "any", "any")
+	require.NoError(t, client.MakeBucket(ctx, "photos", minio.MakeBucketOptions{}))
+
+	data := randomData(100000)
+	for _, target := range []struct{ bucket, key string }{{"photos", "2024/cat 1.jpg"}, {"default", "flat"}} {
+		info, err := client.PutObject(ctx, target.bucket, target.key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+		require.NoError(t, err, target.key)
+		assert.NotEmpty(t, info.ETag)
+
+		assert.Equal(t, data, getS3Object(t, client, target.bucket, target.key, minio.GetObjectOptions{}))
+		stat, err := client.StatObject(ctx, target.bucket, target.key, minio.StatObjectOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), stat.Size)
+		assert.Equal(t, info.ETag, stat.ETag)
+		assert.WithinDuration(t, time.Now(), stat.LastModified, time.Minute)
+
+		opts := minio.GetObjectOptions{}
+		require.NoError(t, opts.SetRange(1000, 1999))
+		assert.Equal(t, data[1000:2000], getS3Object(t, client, target.bucket, target.key, opts))
+	}
+
+	replacement := randomData(12345)
+	_, err := client.PutObject(ctx, "photos", "2024/cat 1.jpg", bytes.NewReader(replacement), int64(len(replacement)), minio.PutObjectOptions{})
+	require.NoError(t, err, "objects are overwritten")
+	assert.Equal(t, replacement, getS3Object(t, client, "photos", "2024/cat 1.jpg", minio.GetObjectOptions{}))
+	_, err = client.PutObject(ctx, "default", "dir/file", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	assert.Equal(t, "InvalidArgument", s3ErrorCode(err))
+	_, err = client.PutObject(ctx, "missing", "file", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	assert.Equal(t, "NoSuchBucket", s3ErrorCode(err))
+	_, err = client.StatObject(ctx, "photos", "2024/dog.jpg", minio.StatObjectOptions{})
+	assert.Equal(t, "NoSuchKey", s3ErrorCode(err))
+
+	// unknown size goes as a stream
+	info, err := client.PutObject(ctx, "photos", "stream", bytes.NewReader(data), -1, minio.PutObjectOptions{PartSize: 5 * 1024 * 1024})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, data, getS3Object(t, client, "photos", "stream", minio.GetObjectOptions{}))
+
+	require.NoError(t, client.RemoveObject(ctx, "photos", "2024/cat 1.jpg", minio.RemoveObjectOptions{}))
+	_, err = client.StatObject(ctx, "photos", "2024/cat 1.jpg", minio.StatObjectOptions{})
+	assert.Equal(t, "NoSuchKey", s3ErrorCode(err))
+	assert.NoError(t, client.RemoveObject(ctx, "photos", "2024/cat 1.jpg", minio.RemoveObjectOptions{}), "deleting a missing key succeeds")
+
+	_, err = client.GetObjectACL(ctx, "photos", "stream")
+	assert.Equal(t, "NotImplemented", s3ErrorCode(err))
+}
+
+func TestS3ListObjects(t *testing.T) {
+	ctx := context.Background()
+	client := newS3Client(t, newS3TestServer(t, nil), "any", "any")
+	require.NoError(t, client.MakeBucket(ctx, "docs", minio.MakeBucketOptions{}))
+	keys := []string{"a", "dir/1", "dir/2", "dir/sub/3", "dir/sub/4", "dir2/5", "e"}
+	for _, key := range keys {
+		_, err := client.PutObject(ctx, "docs", key, bytes.NewReader([]byte(key)), int64(len(key)), minio.PutObjectOptions{})
+		require.NoError(t, err)
+	}
+
+	// the client gives keys of a page before its common prefixes
+	list := func(opts minio.ListObjectsOptions) []string {
+		var listed []string
+		for object := range client.ListObjects(ctx, "docs", opts) {
+			require.NoError(t, object.Err)
+			listed = append(listed, object.Key)
+		}
+		slices.Sort(listed)
+		return listed
+	}
+	for _, useV1 := range []bool{false, true} {
+		for _, maxKeys := range []int{0, 1, 2, 1000} {
+			assert.Equal(t, keys, list(minio.ListObjectsOptions{Recursive: true, MaxKeys: maxKeys, UseV1: useV1}), maxKeys)
+			assert.Equal(t, []string{"a", "dir/", "dir2/", "e"}, list(minio.ListObjectsOptions{MaxKeys: maxKeys, UseV1: useV1}), maxKeys)
+			assert.Equal(t, []string{"dir/1", "dir/2", "dir/sub/"}, list(minio.ListObjectsOptions{Prefix: "dir/", MaxKeys: maxKeys, UseV1: useV1}), maxKeys)
+		}
+	}
+	assert.Equal(t, []string{"dir/sub/4", "dir2/5", "e"}, list(minio.ListObjectsOptions{Recursive: true, StartAfter: "dir/sub/3"}))
+
+	for object := range client.ListObjects(ctx, "docs", minio.ListObjectsOptions{Prefix: "dir/1"}) {
+		assert.Equal(t, int64(5), object.Size)
+		assert.NotEmpty(t, object.ETag)
+	}
+	for object := range client.ListObjects(ctx, "missing", minio.ListObjectsOptions{}) {
+		assert.Equal(t, "NoSuchBucket", s3ErrorCode(object.Err))
+	}
+}
+
+func TestS3Buckets(t *testing.T) {
+	ctx := context.Background()
+	client := newS3Client(t, newS3TestServer(t, nil), "any", "any")
+	require.NoError(t, client.MakeBucket(ctx, "photos", minio.MakeBucketOptions{}))
+	assert.Equal(t, "BucketAlreadyOwnedByYou", s3ErrorCode(client.MakeBucket(ctx, "photos", minio.MakeBucketOptions{})))
+	assert.Equal(t, "BucketAlreadyOwnedByYou", s3ErrorCode(client.MakeBucket(ctx, "default", minio.MakeBucketOptions{})))
+	assert.Equal(t, "InvalidBucketName", s3ErrorCode(client.MakeBucket(ctx, "admin", minio.MakeBucketOptions{})))
+
+	exists, err := client.BucketExists(ctx, "photos")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = client.BucketExists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	buckets, err := client.ListBuckets(ctx)
+	require.NoError(t, err)
+	var names []string
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	assert.Equal(t, []string{"default", "photos"}, names)
+
+	_, err = client.PutObject(ctx, "photos", "cat.jpg", bytes.NewReader([]byte("meow")), 4, minio.PutObjectOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "BucketNotEmpty", s3ErrorCode(client.RemoveBucket(ctx, "photos")))
+	require.NoError(t, client.RemoveObject(ctx, "photos", "cat.jpg", minio.RemoveObjectOptions{}))
+	require.NoError(t, client.RemoveBucket(ctx, "photos"))
+	assert.Equal(t, "NoSuchBucket", s3ErrorCode(client.RemoveBucket(ctx, "photos")))
+	assert.Equal(t, "InvalidBucketState", s3ErrorCode(client.RemoveBucket(ctx, "default")))
+}
+
+func TestS3Multipart(t *testing.T) {
+	ctx := context.Background()
+	client := newS3Client(t, newS3TestServer(t, nil), "any", "any")
+	require.NoError(t, client.MakeBucket(ctx, "videos", minio.MakeBucketOptions{}))
+
+	// the client splits it into parts on its own
+	data := randomData(11 * 1024 * 1024)
+	_, err := client.PutObject(ctx, "videos", "big", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{PartSize: 5 * 1024 * 1024})
+	require.NoError(t, err)
+	assert.Equal(t, data, getS3Object(t, client, "videos", "big", minio.GetObjectOptions{}))
+	replacement := slices.Clone(data)
+	slices.Reverse(replacement)
+	_, err = client.PutObject(ctx, "videos", "big", bytes.NewReader(replacement), int64(len(replacement)), minio.PutObjectOptions{PartSize: 5 * 1024 * 1024})
+	require.NoError(t, err, "a completed upload replaces the object")
+	assert.Equal(t, replacement, getS3Object(t, client, "videos", "big", minio.GetObjectOptions{}))
+
+	core := minio.Core{Client: client}
+	uploadID, err := core.NewMultipartUpload(ctx, "videos", "parts", minio.PutObjectOptions{})
+	require.NoError(t, err)
+	var completed []minio.CompletePart
+	for _, number := range []int{2, 1} {
+		part, err := core.PutObjectPart(ctx, "videos", "parts", uploadID, number, bytes.NewReader(data[:number*1000]), int64(number*1000), minio.PutObjectPartOptions{})
+		require.NoError(t, err)
+		completed = append([]minio.CompletePart{{PartNumber: part.PartNumber, ETag: part.ETag}}, completed...)
+	}
+	parts, err := core.ListObjectParts(ctx, "videos", "parts", uploadID, 0, 1000)
+	require.NoError(t, err)
+	require.Len(t, parts.ObjectParts, 2)
+	assert.Equal(t, int64(1000), parts.ObjectParts[0].Size)
+
+	_, err = core.CompleteMultipartUpload(ctx, "videos", "parts", uploadID, []minio.CompletePart{{PartNumber: 3, ETag: "x"}}, minio.PutObjectOptions{})
+	assert.Equal(t, "InvalidPart", s3ErrorCode(err))
+	_, err = core.CompleteMultipartUpload(ctx, "videos", "parts", uploadID, completed, minio.PutObjectOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, append(bytes.Clone(data[:1000]), data[:2000]...), getS3Object(t, client, "videos", "parts", minio.GetObjectOptions{}))
+
+	uploadID, err = core.NewMultipartUpload(ctx, "videos", "aborted", minio.PutObjectOptions{})
+	require.NoError(t, err)
+	require.NoError(t, core.AbortMultipartUpload(ctx, "videos", "aborted", uploadID))
+	_, err = core.PutObjectPart(ctx, "videos", "aborted", uploadID, 1, bytes.NewReader(data[:10]), 10, minio.PutObjectPartOptions{})
+	assert.Equal(t, "NoSuchUpload", s3ErrorCode(err))
+}
+
+func TestS3Auth(t *testing.T) {
+	ctx := context.Background()
+	configPath := path.Join(t.TempDir(), "auth.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(testAuthConfig), 0o600))
+	authn, err := auth.NewAuthenticator(configPath)
+	require.NoError(t, err)
+	srv := newS3TestServer(t, authn)
+
+	admin := newS3Client(t, srv, "admin", "admin-secret")
+	require.NoError(t, admin.MakeBucket(ctx, "photos", minio.MakeBucketOptions{}))
+	// over plain HTTP the client signs every chunk of the body
+	data := randomData(300000)
+	_, err = admin.PutObject(ctx, "photos", "private/cat.jpg", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, data, getS3Object(t, admin, "photos", "private/cat.jpg", minio.GetObjectOptions{}))
+
+	writer := newS3Client(t, srv, "writer", "writer-secret")
+	_, err = writer.PutObject(ctx, "photos", "public/cat.jpg", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	require.NoError(t, err)
+	_, err = writer.PutObject(ctx, "photos", "private/dog.jpg", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	assert.Equal(t, "AccessDenied", s3ErrorCode(err))
+	_, err = writer.StatObject(ctx, "photos", "private/cat.jpg", minio.StatObjectOptions{})
+	assert.Equal(t, "AccessDenied", s3ErrorCode(err))
+	for object := range writer.ListObjects(ctx, "photos", minio.ListObjectsOptions{Prefix: "public/"}) {
+		require.NoError(t, object.Err)
+		assert.Equal(t, "public/cat.jpg", object.Key)
+	}
+	assert.Equal(t, "AccessDenied", s3ErrorCode(writer.MakeBucket(ctx, "docs", minio.MakeBucketOptions{})))
+	_, err = writer.ListBuckets(ctx)
+	assert.Equal(t, "AccessDenied", s3ErrorCode(err))
+
+	_, err = newS3Client(t, srv, "admin", "wrong").ListBuckets(ctx)
+	assert.Equal(t, "SignatureDoesNotMatch", s3ErrorCode(err))
+	_, err = newS3Client(t, srv, "", "").ListBuckets(ctx)
+	assert.Equal(t, "AccessDenied", s3ErrorCode(err))
+}
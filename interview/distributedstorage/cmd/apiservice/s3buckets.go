@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3BucketList struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Location struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3ListV2 is the answer of ListObjectsV2
+type s3ListV2 struct {
+	XMLName               xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// s3ListV1 is the answer of ListObjects, the first version which pages with markers
+type s3ListV1 struct {
+	XMLName        xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	Marker         string           `xml:"Marker"`
+	NextMarker     string           `xml:"NextMarker,omitempty"`
+	MaxKeys        int              `xml:"MaxKeys"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []s3Object       `xml:"Contents"`
+	CommonPrefixes []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+func (g *s3Gateway) serveBucket(w http.ResponseWriter, req *http.Request, bucket string) {
+	switch {
+	case req.Method == http.MethodPut:
+		g.createBucket(w, req, bucket)
+	case req.Method == http.MethodGet && req.URL.Query().Has("location"):
+		g.bucketLocation(w, req, bucket)
+	case unsupportedS3Request(req):
+		writeS3ErrorCode(w, req, http.StatusNotImplemented, "NotImplemented", "the gateway does not support this call")
+	case req.Method == http.MethodHead:
+		g.headBucket(w, req, bucket)
+	case req.Method == http.MethodGet:
+		g.listObjects(w, req, bucket)
+	case req.Method == http.MethodDelete:
+		g.deleteBucket(w, req, bucket)
+	default:
+		writeS3ErrorCode(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed for buckets")
+	}
+}
+
+func (g *s3Gateway) listBuckets(w http.ResponseWriter, req *http.Request) {
+	buckets := g.dd.Buckets()
+	list := s3BucketList{Owner: s3Owner{ID: "diststorage", DisplayName: "diststorage"}, Buckets: make([]s3Bucket, 0, len(buckets))}
+	for _, bucket := range buckets {
+		list.Buckets = append(list.Buckets, s3Bucket{Name: bucket.Name, CreationDate: s3Time(bucket.Created)})
+	}
+	writeXML(w, http.StatusOK, list)
+}
+
+// createBucket makes a bucket with the layout of the default bucket. A location constraint in the body is ignored
+func (g *s3Gateway) createBucket(w http.ResponseWriter, req *http.Request, name string) {
+	if _, err := g.dd.StatBucket(name); err == nil {
+		writeS3Error(w, req, chunkmaster.ErrBucketExists)
+		return
+	}
+	defaults, err := g.dd.StatBucket(chunkmaster.DefaultBucket)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	err = g.dd.CreateBucket(chunkmaster.Bucket{Name: name, Layout: defaults.Layout})
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	slog.Info("bucket created", "bucket", name, "layout", defaults.Layout)
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *s3Gateway) headBucket(w http.ResponseWriter, req *http.Request, name string) {
+	if _, err := g.dd.StatBucket(name); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// bucketLocation tells clients that every bucket is in the default region, so they sign requests for it
+func (g *s3Gateway) bucketLocation(w http.ResponseWriter, req *http.Request, name string) {
+	if _, err := g.dd.StatBucket(name); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	writeXML(w, http.StatusOK, s3Location{})
+}
+
+func (g *s3Gateway) deleteBucket(w http.ResponseWriter, req *http.Request, name string) {
+	if err := g.dd.DeleteBucket(name); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	slog.Info("bucket deleted", "bucket", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3Page is a page of a listing: files and common prefixes, both ordered by key, at most max-keys of them together
+type s3Page struct {
+	files    []chunkmaster.FileInfo
+	prefixes []string
+	// last is the last key or common prefix of the page, the listing goes on after it
+	last      string
+	truncated bool
+}
+
+// listPage lists keys after the given one. With a delimiter, keys which have it after the prefix are rolled up into
+// a common prefix: the part up to the delimiter. If after is a common prefix, all its keys are skipped
+func (g *s3Gateway) listPage(bucket, prefix, delimiter, after string, maxKeys int) s3Page {
+	commonPrefix := func(key string) string {
+		if delimiter == "" {
+			return ""
+		}
+		idx := strings.Index(key[len(prefix):], delimiter)
+		if idx < 0 {
+			return ""
+		}
+		return key[:len(prefix)+idx+len(delimiter)]
+	}
+
+	var page s3Page
+	lastPrefix := ""
+	if strings.HasPrefix(after, prefix) && commonPrefix(after) == after {
+		lastPrefix = after
+	}
+	for {
+		files := g.dd.ListFiles(bucket, prefix, after, maxKeys+1)
+		for _, file := range files {
+			_, key := chunkmaster.SplitFileref(file.Fileref)
+			after = key
+			common := commonPrefix(key)
+			if common != "" && common == lastPrefix {
+				continue
+			}
+			if len(page.files)+len(page.prefixes) == maxKeys {
+				page.truncated = true
+				return page
+			}
+			if common != "" {
+				page.prefixes = append(page.prefixes, common)
+				page.last, lastPrefix = common, common
+				continue
+			}
+			page.files = append(page.files, file)
+			page.last = key
+		}
+		if len(files) <= maxKeys {
+			return page
+		}
+	}
+}
+
+func (g *s3Gateway) listObjects(w http.ResponseWriter, req *http.Request, bucket string) {
+	if _, err := g.dd.StatBucket(bucket); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	query := req.URL.Query()
+	maxKeys := maxListLimit
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3ErrorCode(w, req, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative number")
+			return
+		}
+		maxKeys = min(n, maxListLimit)
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	if query.Get("list-type") != "2" {
+		page := g.listPage(bucket, prefix, delimiter, query.Get("marker"), maxKeys)
+		list := s3ListV1{Name: bucket, Prefix: prefix, Delimiter: delimiter, Marker: query.Get("marker"), MaxKeys: maxKeys, IsTruncated: page.truncated}
+		list.Contents, list.CommonPrefixes = page.entries()
+		if page.truncated {
+			list.NextMarker = page.last
+		}
+		writeXML(w, http.StatusOK, list)
+		return
+	}
+
+	// the continuation token is the last key or common prefix of the previous page, it is only encoded to be opaque
+	token := query.Get("continuation-token")
+	after, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		writeS3ErrorCode(w, req, http.StatusBadRequest, "InvalidArgument", "bad continuation token")
+		return
+	}
+	if token == "" {
+		after = []byte(query.Get("start-after"))
+	}
+	page := g.listPage(bucket, prefix, delimiter, string(after), maxKeys)
+	list := s3ListV2{
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		KeyCount:          len(page.files) + len(page.prefixes),
+		IsTruncated:       page.truncated,
+		ContinuationToken: token,
+		StartAfter:        query.Get("start-after"),
+	}
+	list.Contents, list.CommonPrefixes = page.entries()
+	if page.truncated {
+		list.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(page.last))
+	}
+	writeXML(w, http.StatusOK, list)
+}
+
+func (p s3Page) entries() ([]s3Object, []s3CommonPrefix) {
+	objects := make([]s3Object, 0, len(p.files))
+	for _, file := range p.files {
+		_, key := chunkmaster.SplitFileref(file.Fileref)
+		objects = append(objects, s3Object{
+			Key:          key,
+			LastModified: s3Time(file.Created),
+			ETag:         etag(file),
+			Size:         file.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	prefixes := make([]s3CommonPrefix, 0, len(p.prefixes))
+	for _, prefix := range p.prefixes {
+		prefixes = append(prefixes, s3CommonPrefix{Prefix: prefix})
+	}
+	return objects, prefixes
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/multipart"
+)
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag,omitempty"`
+}
+
+type s3PartList struct {
+	XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket      string   `xml:"Bucket"`
+	Key         string   `xml:"Key"`
+	UploadID    string   `xml:"UploadId"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Parts       []s3Part `xml:"Part"`
+}
+
+// serveMultipart maps S3 multipart calls on the multipart.Manager shared with the REST API:
+//   - POST ?uploads is CreateMultipartUpload
+//   - PUT ?partNumber=N&uploadId=X is UploadPart
+//   - GET ?uploadId=X is ListParts
+//   - POST ?uploadId=X is CompleteMultipartUpload
+//   - DELETE ?uploadId=X is AbortMultipartUpload
+func (g *s3Gateway) serveMultipart(w http.ResponseWriter, req *http.Request, bucket, key, fileref string) {
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		upload, err := g.uploads.Initiate(fileref)
+		if err != nil {
+			writeS3Error(w, req, err)
+			return
+		}
+		writeXML(w, http.StatusOK, s3InitiateResult{Bucket: bucket, Key: key, UploadID: upload.ID})
+	case uploadID == "":
+		writeS3ErrorCode(w, req, http.StatusBadRequest, "InvalidArgument", "uploadId is required")
+	case req.Method == http.MethodPut:
+		g.uploadPart(w, req, fileref, uploadID)
+	case req.Method == http.MethodGet:
+		g.listParts(w, req, bucket, key, fileref, uploadID)
+	case req.Method == http.MethodPost:
+		g.completeUpload(w, req, bucket, key, fileref, uploadID)
+	case req.Method == http.MethodDelete:
+		if err := g.uploads.Abort(uploadID, fileref); err != nil {
+			writeS3Error(w, req, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3ErrorCode(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "method is not allowed for multipart uploads")
+	}
+}
+
+func (g *s3Gateway) uploadPart(w http.ResponseWriter, req *http.Request, fileref, uploadID string) {
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3ErrorCode(w, req, http.StatusNotImplemented, "NotImplemented", "the gateway does not support UploadPartCopy")
+		return
+	}
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil {
+		writeS3Error(w, req, multipart.ErrBadPartNumber)
+		return
+	}
+	part, err := g.uploads.PutPart(uploadID, fileref, partNumber, req.Body)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(part.ETag))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *s3Gateway) listParts(w http.ResponseWriter, req *http.Request, bucket, key, fileref, uploadID string) {
+	parts, err := g.uploads.Parts(uploadID, fileref)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	list := s3PartList{Bucket: bucket, Key: key, UploadID: uploadID, Parts: make([]s3Part, 0, len(parts))}
+	for _, part := range parts {
+		list.Parts = append(list.Parts, s3Part{PartNumber: part.Number, ETag: strconv.Quote(part.ETag), Size: part.Size})
+	}
+	writeXML(w, http.StatusOK, list)
+}
+
+// completeUpload needs the list of parts, S3 has no "all uploaded parts" default
+func (g *s3Gateway) completeUpload(w http.ResponseWriter, req *http.Request, bucket, key, fileref, uploadID string) {
+	var request s3CompleteRequest
+	if err := xml.NewDecoder(req.Body).Decode(&request); err != nil || len(request.Parts) == 0 {
+		writeS3ErrorCode(w, req, http.StatusBadRequest, "MalformedXML", "the list of parts is missing or malformed")
+		return
+	}
+	parts := make([]multipart.Part, 0, len(request.Parts))
+	for _, part := range request.Parts {
+		parts = append(parts, multipart.Part{Number: part.PartNumber, ETag: part.ETag})
+	}
+	// the assembled object replaces an existing key, the same as a put
+	err := g.uploads.Complete(req.Context(), uploadID, fileref, parts, func(ctx context.Context, fileref string, size int64, reader io.Reader) error {
+		return g.dd.DistributeDataIf(ctx, fileref, chunkmaster.Condition{Overwrite: true}, size, reader)
+	})
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	result := s3CompleteResult{Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key}
+	if info, err := g.dd.StatFile(fileref); err == nil {
+		result.ETag = etag(info)
+	}
+	writeXML(w, http.StatusOK, result)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/datadistributor"
+)
+
+// versionIDHeader tells which version of a file of a bucket with versioning has been stored or read
+const versionIDHeader = "X-Version-Id"
+
+type versionDescription struct {
+	VersionID string    `json:"version_id"`
+	Created   time.Time `json:"created"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+type versionList struct {
+	Fileref string `json:"fileref"`
+	// Versions go from the oldest to the current one
+	Versions []versionDescription `json:"versions"`
+}
+
+// resolveVersion gives the catalog fileref of the version from ?version=, or of the current version
+func resolveVersion(dd *datadistributor.DataDistributor, req *http.Request) (string, error) {
+	return dd.ResolveVersion(objectName(req), req.URL.Query().Get("version"))
+}
+
+// pinVersion is resolveVersion which keeps the data of the version until release is called
+func pinVersion(dd *datadistributor.DataDistributor, req *http.Request) (string, func(), error) {
+	return dd.PinVersion(req.Context(), objectName(req), req.URL.Query().Get("version"))
+}
+
+func setVersionID(w http.ResponseWriter, catalogFileref string) {
+	if _, versionID := chunkmaster.SplitVersionFileref(catalogFileref); versionID != "" {
+		w.Header().Set(versionIDHeader, versionID)
+	}
+}
+
+// orVersions sends GET ?versions to versions and everything else to plain
+func orVersions(versions *versionsHandler, plain http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Has("versions") {
+			versions.ServeHTTP(w, req)
+			return
+		}
+		plain.ServeHTTP(w, req)
+	})
+}
+
+// versionsHandler lists versions of a file, tombstones included
+type versionsHandler struct {
+	dd *datadistributor.DataDistributor
+}
+
+func (h *versionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fileref := objectName(req)
+	versions, err := h.dd.Versions(fileref)
+	if errors.Is(err, chunkmaster.ErrFileNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("versions error", "err", err, "fileref", fileref)
+		return
+	}
+	list := versionList{Fileref: fileref, Versions: make([]versionDescription, 0, len(versions))}
+	for _, version := range versions {
+		list.Versions = append(list.Versions, versionDescription{VersionID: version.ID, Created: version.Created, Deleted: version.Deleted})
+	}
+	writeJSON(w, list)
+}
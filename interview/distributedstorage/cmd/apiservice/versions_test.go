@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedBucket(t *testing.T) {
+	srv := newTestServer(t)
+	resp, bucket := createBucket(t, srv, "docs", `{"versioning":true,"keep_versions":5,"keep_versions_for":"720h"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.True(t, bucket.Versioning)
+	assert.Equal(t, 5, bucket.KeepVersions)
+	assert.Equal(t, "720h0m0s", bucket.KeepVersionsFor)
+	resp, _ = createBucket(t, srv, "bad-retention", `{"keep_versions":5}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "retention needs versioning")
+
+	first, second := randomData(1000), randomData(2000)
+	resp, _ = do(t, srv, http.MethodPost, "docs/report", first, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	firstID := resp.Header.Get(versionIDHeader)
+	require.NotEmpty(t, firstID)
+	upload(t, srv, "docs/report", second)
+
+	resp, body := get(t, srv, "docs/report", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, second, body)
+	secondID := resp.Header.Get(versionIDHeader)
+	assert.NotEqual(t, firstID, secondID)
+	resp, body = get(t, srv, "docs/report?version="+firstID, map[string]string{"Range": "bytes=0-9"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, first[:10], body)
+	resp, _ = do(t, srv, http.MethodHead, "docs/report?version="+firstID, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1000", resp.Header.Get("Content-Length"))
+	resp, _ = get(t, srv, "docs/report?version=missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(t, srv, http.MethodDelete, "docs/report", nil, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = get(t, srv, "docs/report", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = get(t, srv, "docs/report?versions", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list versionList
+	require.NoError(t, json.Unmarshal(body, &list))
+	require.Len(t, list.Versions, 3)
+	assert.Equal(t, firstID, list.Versions[0].VersionID)
+	assert.Equal(t, secondID, list.Versions[1].VersionID)
+	assert.True(t, list.Versions[2].Deleted)
+
+	// removing the tombstone brings the file back
+	resp, _ = do(t, srv, http.MethodDelete, "docs/report?version="+list.Versions[2].VersionID, nil, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, body = get(t, srv, "docs/report", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, second, body)
+}
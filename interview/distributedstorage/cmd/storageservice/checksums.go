@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// checksumsDir keeps a sidecar with SHA-256 for every stored chunk. It is a directory, so chunk listing skips it
+const checksumsDir = ".checksums"
+
+func (ssrv *storageServer) checksumPath(fileId string) string {
+	return path.Join(ssrv.storageLocation, checksumsDir, fileId)
+}
+
+func (ssrv *storageServer) writeChecksum(fileId string, checksum []byte) error {
+	// written via rename, so a crash never leaves a half-written checksum which would look like corruption
+	tmpPath := ssrv.checksumPath(fileId) + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(hex.EncodeToString(checksum)), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, ssrv.checksumPath(fileId))
+}
+
+func (ssrv *storageServer) readChecksum(fileId string) ([]byte, error) {
+	data, err := os.ReadFile(ssrv.checksumPath(fileId))
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("bad checksum for %s: %w", fileId, err)
+	}
+	return checksum, nil
+}
+
+func fileChecksum(f io.Reader) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
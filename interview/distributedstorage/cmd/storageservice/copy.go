@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/metrics"
+	storagepb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storage"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// CopyData pulls a chunk straight from another storage, so moving a chunk does not pass its data through the API service.
+// The source verifies its copy before sending, and the received data is verified again before it is kept
+func (ssrv *storageServer) CopyData(ctx context.Context, in *storagepb.CopyRequest) (*emptypb.Empty, error) {
+	fileId, expected := in.GetFileInfo().GetFileId(), in.GetFileInfo().GetChecksum()
+	if fileId == "" || len(expected) == 0 || in.GetSource() == "" {
+		return nil, status.Error(codes.InvalidArgument, "file id, checksum and source are required")
+	}
+	source, err := ssrv.peer(in.GetSource())
+	if err != nil {
+		return nil, err
+	}
+
+	fullpath := path.Join(ssrv.storageLocation, fileId)
+	f, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, status.Errorf(codes.AlreadyExists, "file already exists at %s", fullpath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create file: %w", err)
+	}
+	complete := false
+	defer func() {
+		f.Close()
+		if !complete {
+			os.Remove(fullpath)
+			os.Remove(ssrv.checksumPath(fileId))
+			ssrv.leases.giveBack(fileId)
+		}
+	}()
+
+	hash := sha256.New()
+	err = source.RetrieveChunk(ctx, fileId, expected, io.MultiWriter(&leasedWriter{leases: ssrv.leases, fileId: fileId, w: f}, hash))
+	if errors.Is(err, storage.ErrChecksumMismatch) {
+		return nil, status.Errorf(codes.DataLoss, "source %s has a corrupted copy of %s", in.GetSource(), fileId)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch %s from %s: %w", fileId, in.GetSource(), err)
+	}
+	if !bytes.Equal(hash.Sum(nil), expected) {
+		return nil, status.Errorf(codes.DataLoss, "received data does not match checksum for %s", fullpath)
+	}
+	if err := ssrv.writeChecksum(fileId, expected); err != nil {
+		return nil, fmt.Errorf("cannot record checksum for %s: %w", fullpath, err)
+	}
+	complete = true
+	slog.Info("copy done", "fullpath", fullpath, "source", in.GetSource())
+	return nil, nil
+}
+
+// peer connects to another storage once and keeps the connection
+func (ssrv *storageServer) peer(addr string) (storage.Storage, error) {
+	ssrv.peersMutex.Lock()
+	defer ssrv.peersMutex.Unlock()
+	if rs, found := ssrv.peers[addr]; found {
+		return rs, nil
+	}
+	rs, err := storage.NewRemoteStorage(addr, ssrv.peerCreds, metrics.ClientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	ssrv.peers[addr] = rs
+	return rs, nil
+}
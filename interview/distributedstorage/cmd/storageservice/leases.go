@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	storagepb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storage"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// leaseBook keeps space reserved for chunks which are about to be stored. A lease is keyed by the file id of its chunk.
+// Data written to the chunk is taken from the lease, so the space already taken on disk is not counted twice
+type leaseBook struct {
+	ttl       time.Duration
+	freeSpace func() (int64, error)
+	now       func() time.Time
+
+	mutex  sync.Mutex
+	leases map[string]*lease
+}
+
+type lease struct {
+	bytes   int64
+	written int64
+	// expires is pushed further every time the lease is used
+	expires time.Time
+}
+
+func newLeaseBook(storageLocation string, ttl time.Duration) *leaseBook {
+	return &leaseBook{
+		ttl: ttl,
+		freeSpace: func() (int64, error) {
+			var stats unix.Statfs_t
+			if err := unix.Statfs(storageLocation, &stats); err != nil {
+				return 0, fmt.Errorf("cannot stat storage dir: %w", err)
+			}
+			return int64(stats.Bavail) * int64(stats.Bsize), nil
+		},
+		now:    time.Now,
+		leases: make(map[string]*lease),
+	}
+}
+
+// available gives free space which is not reserved
+func (lb *leaseBook) available() (int64, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.availableLocked()
+}
+
+func (lb *leaseBook) availableLocked() (int64, error) {
+	free, err := lb.freeSpace()
+	if err != nil {
+		return 0, err
+	}
+	now := lb.now()
+	for fileId, l := range lb.leases {
+		if now.After(l.expires) {
+			slog.Warn("lease expired", "file_id", fileId, "bytes", l.bytes, "written", l.written)
+			delete(lb.leases, fileId)
+			continue
+		}
+		free -= max(l.bytes-l.written, 0)
+	}
+	return free, nil
+}
+
+func (lb *leaseBook) reserve(reservations []*storagepb.Reservation) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	available, err := lb.availableLocked()
+	if err != nil {
+		return err
+	}
+	var required int64
+	for _, r := range reservations {
+		if r.GetFileId() == "" || r.GetBytes() < 0 {
+			return status.Errorf(codes.InvalidArgument, "bad reservation of %d bytes for %q", r.GetBytes(), r.GetFileId())
+		}
+		required += r.GetBytes()
+		if l, found := lb.leases[r.GetFileId()]; found {
+			// the lease is replaced, e.g. when the request is retried
+			required -= max(l.bytes-l.written, 0)
+		}
+	}
+	if required > available {
+		return status.Errorf(codes.ResourceExhausted, "cannot reserve %d bytes, %d bytes are available", required, available)
+	}
+	expires := lb.now().Add(lb.ttl)
+	for _, r := range reservations {
+		lb.leases[r.GetFileId()] = &lease{bytes: r.GetBytes(), expires: expires}
+	}
+	return nil
+}
+
+// take accounts bytes written to the chunk. Data without a lease, or beyond it, must fit into space which is not reserved
+func (lb *leaseBook) take(fileId string, bytes int64) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	available, err := lb.availableLocked()
+	if err != nil {
+		return err
+	}
+	l, found := lb.leases[fileId]
+	unleased := bytes
+	if found {
+		unleased = max(l.written+bytes-l.bytes, 0) - max(l.written-l.bytes, 0)
+	}
+	if unleased > available {
+		return status.Errorf(codes.ResourceExhausted, "no space for %d more bytes of %s, %d bytes are available", unleased, fileId, available)
+	}
+	if found {
+		l.written += bytes
+		l.expires = lb.now().Add(lb.ttl)
+	}
+	return nil
+}
+
+// giveBack returns space of a chunk which has not been stored to its lease, so the lease can be used again
+func (lb *leaseBook) giveBack(fileId string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if l, found := lb.leases[fileId]; found {
+		l.written = 0
+	}
+}
+
+func (lb *leaseBook) end(fileIds []string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	for _, fileId := range fileIds {
+		delete(lb.leases, fileId)
+	}
+}
+
+func (ssrv *storageServer) Reserve(ctx context.Context, in *storagepb.ReserveRequest) (*emptypb.Empty, error) {
+	if err := ssrv.leases.reserve(in.GetReservations()); err != nil {
+		slog.Warn("reservation rejected", "reservations", len(in.GetReservations()), "err", err)
+		return nil, err
+	}
+	slog.Debug("reservation granted", "reservations", len(in.GetReservations()))
+	return nil, nil
+}
+
+func (ssrv *storageServer) Commit(ctx context.Context, in *storagepb.FileList) (*emptypb.Empty, error) {
+	ssrv.leases.end(in.GetFileIds())
+	return nil, nil
+}
+
+func (ssrv *storageServer) Release(ctx context.Context, in *storagepb.FileList) (*emptypb.Empty, error) {
+	ssrv.leases.end(in.GetFileIds())
+	return nil, nil
+}
+
+// leasedWriter takes every written portion from the lease of the chunk
+type leasedWriter struct {
+	leases *leaseBook
+	fileId string
+	w      io.Writer
+}
+
+func (lw *leasedWriter) Write(p []byte) (int, error) {
+	if err := lw.leases.take(lw.fileId, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return lw.w.Write(p)
+}
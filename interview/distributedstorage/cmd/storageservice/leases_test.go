@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	storagepb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storage"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeaseBook(t *testing.T) {
+	free := int64(1000)
+	clock := time.Now()
+	lb := newLeaseBook(t.TempDir(), time.Minute)
+	lb.freeSpace = func() (int64, error) { return free, nil }
+	lb.now = func() time.Time { return clock }
+	available := func() int64 {
+		bytes, err := lb.available()
+		require.NoError(t, err)
+		return bytes
+	}
+
+	require.NoError(t, lb.reserve([]*storagepb.Reservation{{FileId: "a", Bytes: 600}, {FileId: "b", Bytes: 300}}))
+	assert.Equal(t, int64(100), available())
+	err := lb.reserve([]*storagepb.Reservation{{FileId: "c", Bytes: 50}, {FileId: "d", Bytes: 51}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, int64(100), available(), "a rejected request reserves nothing")
+
+	// data without a lease cannot take reserved space
+	assert.Equal(t, codes.ResourceExhausted, status.Code(lb.take("x", 101)))
+	require.NoError(t, lb.take("x", 100))
+	free -= 100
+
+	// data under a lease is not counted twice while it is written
+	require.NoError(t, lb.take("a", 600))
+	free -= 600
+	assert.Zero(t, available())
+	assert.Equal(t, codes.ResourceExhausted, status.Code(lb.take("a", 1)), "data beyond the lease needs free space")
+	lb.end([]string{"a"})
+	assert.Zero(t, available())
+
+	// a chunk which has failed can be stored again under the same lease
+	require.NoError(t, lb.take("b", 200))
+	lb.giveBack("b")
+	assert.Zero(t, available())
+
+	clock = clock.Add(2 * time.Minute)
+	assert.Equal(t, int64(300), available(), "unused lease expires")
+}
+
+func TestReserveOverGRPC(t *testing.T) {
+	addr, storageSrv := startTestServer(t)
+	rs, err := storage.NewRemoteStorage(addr, insecure.NewCredentials())
+	require.NoError(t, err)
+	free, err := storageSrv.leases.available()
+	require.NoError(t, err)
+
+	err = rs.Reserve(context.Background(), map[string]int64{"chunk": free + 1})
+	assert.ErrorIs(t, err, storage.ErrNotEnoughSpace)
+
+	require.NoError(t, rs.Reserve(context.Background(), map[string]int64{"chunk": 3000}))
+	_, err = rs.StoreChunk(context.Background(), "chunk", bytes.NewReader(make([]byte, 3000)))
+	require.NoError(t, err)
+	require.NoError(t, rs.Commit(context.Background(), []string{"chunk"}))
+	storageSrv.leases.mutex.Lock()
+	assert.Empty(t, storageSrv.leases.leases)
+	storageSrv.leases.mutex.Unlock()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+)
+
+type reportCorruptedFunc func(ctx context.Context, fileIds []string) error
+
+// scrubber periodically re-reads every stored chunk and compares it with the checksum recorded when the chunk was stored.
+// Reading is throttled, so scrubbing does not compete with clients for the disk
+type scrubber struct {
+	ssrv           *storageServer
+	bytesPerSecond int64
+	report         reportCorruptedFunc
+}
+
+func (s *scrubber) run(ctx context.Context, interval time.Duration) {
+	for {
+		start := time.Now()
+		checked, corrupted, err := s.scrubAll(ctx)
+		if err != nil {
+			slog.Error("scrubbing failed", "err", err)
+		} else {
+			slog.Info("scrubbing done", "checked", checked, "corrupted", corrupted, "took", time.Since(start))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// scrubAll goes through all chunks once. Corrupted chunks are reported as soon as they are found
+func (s *scrubber) scrubAll(ctx context.Context) (int, int, error) {
+	entries, err := os.ReadDir(s.ssrv.storageLocation)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot list %s: %w", s.ssrv.storageLocation, err)
+	}
+	limiter := newRateLimiter(s.bytesPerSecond)
+	var checked, corrupted int
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fileId := entry.Name()
+		ok, err := s.scrubChunk(ctx, fileId, limiter)
+		if ctx.Err() != nil {
+			return checked, corrupted, ctx.Err()
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted meanwhile or being written right now
+			continue
+		}
+		if err != nil {
+			slog.Warn("cannot scrub chunk", "file_id", fileId, "err", err)
+			continue
+		}
+		checked++
+		if ok {
+			continue
+		}
+		corrupted++
+		slog.Error("chunk is corrupted", "file_id", fileId)
+		if err := s.report(ctx, []string{fileId}); err != nil {
+			slog.Error("cannot report corrupted chunk", "file_id", fileId, "err", err)
+		}
+	}
+	return checked, corrupted, nil
+}
+
+func (s *scrubber) scrubChunk(ctx context.Context, fileId string, limiter *rateLimiter) (bool, error) {
+	expected, err := s.ssrv.readChecksum(fileId)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(path.Join(s.ssrv.storageLocation, fileId))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	checksum, err := fileChecksum(&throttledReader{ctx: ctx, r: f, limiter: limiter})
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(checksum, expected), nil
+}
+
+// rateLimiter lets consumed bytes grow no faster than bytesPerSecond since its creation
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	consumed       int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	rl.consumed += int64(n)
+	if rl.bytesPerSecond <= 0 {
+		return nil
+	}
+	due := rl.start.Add(time.Duration(float64(rl.consumed) / float64(rl.bytesPerSecond) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// small portions keep the pace smooth
+	if len(p) > 64*1024 {
+		p = p[:64*1024]
+	}
+	n, err := tr.r.Read(p)
+	if waitErr := tr.limiter.wait(tr.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestScrubberReportsCorruptedChunks(t *testing.T) {
+	addr, storageSrv := startTestServer(t)
+	rs, err := storage.NewRemoteStorage(addr, insecure.NewCredentials())
+	require.NoError(t, err)
+	for _, fileId := range []string{"good", "bad", "empty"} {
+		data := bytes.Repeat([]byte(fileId), 10000)
+		if fileId == "empty" {
+			data = nil
+		}
+		_, err := rs.StoreChunk(context.Background(), fileId, bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+	// chunks stored before checksums were recorded are skipped
+	require.NoError(t, os.WriteFile(path.Join(storageSrv.storageLocation, "legacy"), []byte("legacy"), 0o600))
+
+	badPath := path.Join(storageSrv.storageLocation, "bad")
+	stored, err := os.ReadFile(badPath)
+	require.NoError(t, err)
+	stored[5000] ^= 1
+	require.NoError(t, os.WriteFile(badPath, stored, 0o600))
+
+	var reported []string
+	scrub := &scrubber{ssrv: storageSrv, bytesPerSecond: 1 << 30, report: func(_ context.Context, fileIds []string) error {
+		reported = append(reported, fileIds...)
+		return nil
+	}}
+	checked, corrupted, err := scrub.scrubAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, checked)
+	assert.Equal(t, 1, corrupted)
+	assert.Equal(t, []string{"bad"}, reported)
+}
+
+func TestChecksumIsDeletedWithChunk(t *testing.T) {
+	addr, storageSrv := startTestServer(t)
+	rs, err := storage.NewRemoteStorage(addr, insecure.NewCredentials())
+	require.NoError(t, err)
+	_, err = rs.StoreChunk(context.Background(), "chunk", bytes.NewReader([]byte("data")))
+	require.NoError(t, err)
+	_, err = os.Stat(storageSrv.checksumPath("chunk"))
+	require.NoError(t, err)
+
+	require.NoError(t, rs.DeleteChunk(context.Background(), "chunk"))
+	_, err = os.Stat(storageSrv.checksumPath("chunk"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	list, err := rs.ListChunks(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, list, "checksums are not chunks")
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1024 * 1024)
+	start := time.Now()
+	for range 8 {
+		require.NoError(t, limiter.wait(context.Background(), 64*1024))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, limiter.wait(ctx, 1024*1024), context.Canceled)
+}
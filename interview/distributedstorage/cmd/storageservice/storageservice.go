@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,13 +12,20 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/metrics"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls"
 	storagepb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storage"
 	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
-	"golang.org/x/sys/unix"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -25,6 +33,16 @@ func main() {
 	argStorageLocation := flag.String("storage-location", "", "location where all files will be stored locally")
 	argPort := flag.Int("port", 45346, "port for listening for incoming data")
 	argInventoryHost := flag.String("inventory-host", "localhost:3609", "address to connect to notify that this storage is up")
+	argScrubInterval := flag.Duration("scrub-interval", 24*time.Hour, "pause between passes which re-read all chunks looking for corruption; 0 disables scrubbing")
+	argScrubBytesPerSecond := flag.Int64("scrub-bytes-per-second", 10*1024*1024, "read rate limit for scrubbing")
+	argTLSCA := flag.String("tls-ca", "", "CA certificate (PEM) which signs certificates of apiservice; with tls-cert and tls-key turns on mTLS for gRPC")
+	argTLSCert := flag.String("tls-cert", "", "certificate (PEM) to serve chunks and to connect to the inventory; it must be issued for the hostname")
+	argTLSKey := flag.String("tls-key", "", "private key (PEM) of tls-cert")
+	argZone := flag.String("zone", "", "zone of the storage, chunks of a file are spread among zones")
+	argRack := flag.String("rack", "", "rack of the storage, chunks of a file are spread among racks of a zone")
+	argHost := flag.String("host", "", "physical host of the storage, for storages sharing one; the hostname if empty")
+	argLeaseTTL := flag.Duration("lease-ttl", 10*time.Minute, "reserved space which has not been written to for this time is released")
+	argMetricsPort := flag.Int("metrics-port", 2112, "port of Prometheus metrics at /metrics; 0 turns them off")
 	flag.Parse()
 	if *argStorageLocation == "" {
 		slog.Error("missing storage location arg")
@@ -42,25 +60,86 @@ func main() {
 		os.Exit(1)
 	}
 
-	go runHeartbeatSender(fmt.Sprintf("%s:%d", hostname, *argPort), *argStorageLocation, *argInventoryHost)
+	if *argScrubBytesPerSecond <= 0 {
+		slog.Error("scrub rate is incorrect", "bytes_per_second", *argScrubBytesPerSecond)
+		os.Exit(1)
+	}
+
+	if *argLeaseTTL <= 0 {
+		slog.Error("lease ttl is incorrect", "ttl", *argLeaseTTL)
+		os.Exit(1)
+	}
 
-	err = runServer(*argStorageLocation, *argPort)
+	tlsFiles := mtls.Files{CA: *argTLSCA, Cert: *argTLSCert, Key: *argTLSKey}
+	if err := tlsFiles.Validate(); err != nil {
+		slog.Error("tls settings are bad", "err", err)
+		os.Exit(1)
+	}
+	serverCreds, err := mtls.ServerCredentials(tlsFiles)
 	if err != nil {
-		slog.Error("server exited with error", "err", err)
+		slog.Error("cannot load tls files", "err", err)
+		os.Exit(1)
+	}
+	clientCreds, err := mtls.ClientCredentials(tlsFiles)
+	if err != nil {
+		slog.Error("cannot load tls files", "err", err)
+		os.Exit(1)
+	}
+
+	storageSrv, err := newStorageServer(*argStorageLocation, *argLeaseTTL, clientCreds)
+	if err != nil {
+		slog.Error("cannot create storage server", "err", err)
+		os.Exit(1)
+	}
+
+	iam := fmt.Sprintf("%s:%d", hostname, *argPort)
+	labels := &inventorypb.Labels{Zone: *argZone, Rack: *argRack, Host: *argHost}
+	if labels.Host == "" {
+		labels.Host = hostname
+	}
+	go runHeartbeatSender(iam, labels, storageSrv.leases, *argInventoryHost, clientCreds)
+
+	if *argScrubInterval > 0 {
+		report, err := newCorruptionReporter(iam, *argInventoryHost, clientCreds)
+		if err != nil {
+			slog.Error("cannot create corruption reporter", "err", err)
+			os.Exit(1)
+		}
+		scrub := &scrubber{ssrv: storageSrv, bytesPerSecond: *argScrubBytesPerSecond, report: report}
+		go scrub.run(context.Background(), *argScrubInterval)
+	}
+
+	if *argMetricsPort > 0 {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "stored_chunks",
+			Help:      "Chunks kept on the disk of the storage",
+		}, func() float64 {
+			fileIds, err := storageSrv.listChunks()
+			if err != nil {
+				slog.Warn("cannot count chunks", "err", err)
+			}
+			return float64(len(fileIds))
+		})
+		go func() {
+			err := metrics.Serve(*argMetricsPort)
+			slog.Error("metrics exit with error", "err", err)
+			os.Exit(2)
+		}()
 	}
-}
 
-func runServer(storageLocation string, port int) error {
-	storageSrv, err := newStorageServer(storageLocation)
+	err = runServer(storageSrv, *argPort, serverCreds)
 	if err != nil {
-		return fmt.Errorf("cannot create storage server: %w", err)
+		slog.Error("server exited with error", "err", err)
 	}
+}
 
+func runServer(storageSrv *storageServer, port int, creds credentials.TransportCredentials) error {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return fmt.Errorf("listen failed: %w", err)
 	}
-	gsrv := grpc.NewServer()
+	gsrv := grpc.NewServer(append(metrics.ServerOptions(), grpc.Creds(creds))...)
 	storagepb.RegisterStorageServer(gsrv, storageSrv)
 
 	slog.Info("storage service listening", "port", port)
@@ -73,30 +152,50 @@ func runServer(storageLocation string, port int) error {
 type storageServer struct {
 	storagepb.UnsafeStorageServer
 	storageLocation string
+	leases          *leaseBook
+
+	// peers are other storages which chunks are copied from
+	peerCreds  credentials.TransportCredentials
+	peersMutex sync.Mutex
+	peers      map[string]storage.Storage
 }
 
 var _ storagepb.StorageServer = (*storageServer)(nil)
 
-func newStorageServer(storageLocation string) (*storageServer, error) {
-	err := os.MkdirAll(storageLocation, 0o700)
+// newStorageServer gets peerCreds to connect to other storages, the same ones it uses for the inventory
+func newStorageServer(storageLocation string, leaseTTL time.Duration, peerCreds credentials.TransportCredentials) (*storageServer, error) {
+	err := os.MkdirAll(path.Join(storageLocation, checksumsDir), 0o700)
 	if err != nil {
 		return nil, err
 	}
 
 	return &storageServer{
 		storageLocation: storageLocation,
+		leases:          newLeaseBook(storageLocation, leaseTTL),
+		peerCreds:       peerCreds,
+		peers:           make(map[string]storage.Storage),
 	}, nil
 }
 
 func (ssrv *storageServer) StoreData(stream grpc.ClientStreamingServer[storagepb.StoredUnit, emptypb.Empty]) error {
 	var (
 		f            *os.File
+		fileId       string
 		fullpath     string
 		totalWritten int
+		complete     bool
+		expected     []byte
 	)
+	hash := sha256.New()
 	defer func() {
 		if f != nil {
 			f.Close()
+			if !complete {
+				// sender has aborted the stream, a partial chunk must not look like a stored one
+				os.Remove(fullpath)
+				os.Remove(ssrv.checksumPath(fileId))
+				ssrv.leases.giveBack(fileId)
+			}
 		}
 	}()
 	for {
@@ -108,7 +207,8 @@ func (ssrv *storageServer) StoreData(stream grpc.ClientStreamingServer[storagepb
 			return err
 		}
 		if f == nil {
-			fullpath = path.Join(ssrv.storageLocation, unit.FileInfo.FileId)
+			fileId = unit.GetFileInfo().GetFileId()
+			fullpath = path.Join(ssrv.storageLocation, fileId)
 			slog.Debug("creating new file", "fullpath", fullpath)
 			_, err = os.Stat(fullpath)
 			if err == nil || !errors.Is(err, os.ErrNotExist) {
@@ -121,28 +221,69 @@ func (ssrv *storageServer) StoreData(stream grpc.ClientStreamingServer[storagepb
 			}
 		}
 
+		if err := ssrv.leases.take(fileId, int64(len(unit.GetData()))); err != nil {
+			return err
+		}
 		written, err := f.Write(unit.GetData())
 		totalWritten += written
 		if err != nil {
 			return fmt.Errorf("data portion copy error for %s: %w", fullpath, err)
 		}
+		hash.Write(unit.GetData())
+		if len(unit.GetChecksum()) > 0 {
+			expected = unit.GetChecksum()
+		}
 	}
+	if f != nil && !bytes.Equal(expected, hash.Sum(nil)) {
+		slog.Error("received data does not match checksum", "fullpath", fullpath, "written", totalWritten)
+		return status.Errorf(codes.DataLoss, "received data does not match checksum for %s", fullpath)
+	}
+	if f != nil {
+		err := ssrv.writeChecksum(fileId, expected)
+		if err != nil {
+			return fmt.Errorf("cannot record checksum for %s: %w", fullpath, err)
+		}
+	}
+	complete = true
 	slog.Info("accept full data done", "fullpath", fullpath, "written", totalWritten)
 	return stream.SendAndClose(nil)
 }
 
 func (ssrv *storageServer) RetrieveData(in *storagepb.FileInfo, gsrv grpc.ServerStreamingServer[storagepb.StoredUnit]) error {
 	fullpath := path.Join(ssrv.storageLocation, in.GetFileId())
+	if in.GetOffset() < 0 || in.GetLength() < 0 {
+		return status.Errorf(codes.InvalidArgument, "bad range offset %d length %d", in.GetOffset(), in.GetLength())
+	}
 
 	f, err := os.Open(fullpath)
 	if err != nil {
 		return fmt.Errorf("cannot open data at %s, err: %w", fullpath, err)
 	}
+	defer f.Close()
+
+	if len(in.GetChecksum()) > 0 {
+		// the whole chunk is checked before sending anything, so a corrupted chunk never reaches the caller
+		checksum, err := fileChecksum(f)
+		if err != nil {
+			return fmt.Errorf("cannot calculate checksum of %s, err: %w", fullpath, err)
+		}
+		if !bytes.Equal(checksum, in.GetChecksum()) {
+			slog.Error("stored data does not match checksum", "fullpath", fullpath)
+			return status.Errorf(codes.DataLoss, "stored data does not match checksum for %s", fullpath)
+		}
+	}
+	if _, err := f.Seek(in.GetOffset(), io.SeekStart); err != nil {
+		return fmt.Errorf("cannot seek %s to %d, err: %w", fullpath, in.GetOffset(), err)
+	}
+	var reader io.Reader = f
+	if in.GetLength() > 0 {
+		reader = io.LimitReader(f, in.GetLength())
+	}
 
 	var totalWritten int64
 	done := false
 	for !done {
-		portionReader := io.LimitReader(f, 1024*1024)
+		portionReader := io.LimitReader(reader, 1024*1024)
 		var buffer bytes.Buffer
 		written, copyErr := io.Copy(&buffer, portionReader)
 		unit := &storagepb.StoredUnit{
@@ -158,7 +299,7 @@ func (ssrv *storageServer) RetrieveData(in *storagepb.FileInfo, gsrv grpc.Server
 			done = true
 		}
 	}
-	slog.Info("send complete", "fullpath", fullpath, "written", totalWritten)
+	slog.Info("send complete", "fullpath", fullpath, "offset", in.GetOffset(), "written", totalWritten)
 	return nil
 }
 
@@ -169,33 +310,78 @@ func (ssrv *storageServer) DeleteData(ctx context.Context, in *storagepb.FileInf
 	if err != nil {
 		return nil, fmt.Errorf("cannot delete data at %s, err: %w", fullpath, err)
 	}
+	err = os.Remove(ssrv.checksumPath(in.GetFileId()))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("cannot delete checksum", "fullpath", fullpath, "err", err)
+	}
 	slog.Info("delete data done", "fullpath", fullpath)
 	return nil, nil
 }
 
-func runHeartbeatSender(iam, storageDir, inventoryServerAddr string) {
+func (ssrv *storageServer) ListData(ctx context.Context, _ *emptypb.Empty) (*storagepb.FileList, error) {
+	fileIds, err := ssrv.listChunks()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("list data done", "files", len(fileIds))
+	return &storagepb.FileList{FileIds: fileIds}, nil
+}
+
+func (ssrv *storageServer) listChunks() ([]string, error) {
+	entries, err := os.ReadDir(ssrv.storageLocation)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list data at %s, err: %w", ssrv.storageLocation, err)
+	}
+	fileIds := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fileIds = append(fileIds, entry.Name())
+	}
+	return fileIds, nil
+}
+
+func newCorruptionReporter(iam, inventoryServerAddr string, creds credentials.TransportCredentials) (reportCorruptedFunc, error) {
+	conn, err := grpc.NewClient(inventoryServerAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("storage inventory cannot connect: %w", err)
+	}
+	client := inventorypb.NewStorageInventoryClient(conn)
+	return func(ctx context.Context, fileIds []string) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err := client.ReportCorruptedChunks(ctx, &inventorypb.CorruptedChunks{Iam: iam, FileIds: fileIds})
+		return err
+	}, nil
+}
+
+// runHeartbeatSender reports free space which is not reserved by leases
+func runHeartbeatSender(iam string, labels *inventorypb.Labels, leases *leaseBook, inventoryServerAddr string, creds credentials.TransportCredentials) {
+	// the connection is established lazily and re-established by grpc itself when the inventory restarts
+	conn, err := grpc.NewClient(inventoryServerAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		slog.Error("storage inventory cannot connect", "err", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	client := inventorypb.NewStorageInventoryClient(conn)
+
 	ticker := time.NewTicker(1 * time.Second)
 	for {
 		<-ticker.C
-		conn, err := grpc.NewClient(inventoryServerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			slog.Error("storage inventory cannot connect", "err", err)
-			continue
-		}
 
-		var stats unix.Statfs_t
-		err = unix.Statfs(storageDir, &stats)
+		availableBytes, err := leases.available()
 		if err != nil {
-			slog.Error("cannot stat storage dir", "err", err)
+			slog.Error("cannot get available space", "err", err)
 			continue
 		}
-		availableBytes := int64(stats.Bavail) * int64(stats.Bsize)
 
-		client := inventorypb.NewStorageInventoryClient(conn)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		info := &inventorypb.StorageInfo{
 			Iam:            iam,
 			AvailableBytes: availableBytes,
+			Labels:         labels,
 		}
 		_, err = client.UpdateStorageInfo(ctx, info)
 		if err != nil {
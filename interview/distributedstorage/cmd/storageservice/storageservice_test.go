@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls/mtlstest"
+	storagepb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storage"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func startTestServer(t *testing.T) (string, *storageServer) {
+	return startTestServerWithCreds(t, insecure.NewCredentials())
+}
+
+func startTestServerWithCreds(t *testing.T, creds credentials.TransportCredentials) (string, *storageServer) {
+	storageSrv, err := newStorageServer(t.TempDir(), time.Minute, insecure.NewCredentials())
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer(grpc.Creds(creds))
+	storagepb.RegisterStorageServer(gsrv, storageSrv)
+	go gsrv.Serve(listener)
+	t.Cleanup(gsrv.Stop)
+	return listener.Addr().String(), storageSrv
+}
+
+func TestStoreAndRetrieveWithChecksum(t *testing.T) {
+	addr, _ := startTestServer(t)
+	rs, err := storage.NewRemoteStorage(addr, insecure.NewCredentials())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 300000)
+	checksum, err := rs.StoreChunk(context.Background(), "chunk", bytes.NewReader(data))
+	require.NoError(t, err)
+	expected := sha256.Sum256(data)
+	assert.Equal(t, expected[:], checksum)
+
+	var buffer bytes.Buffer
+	require.NoError(t, rs.RetrieveChunk(context.Background(), "chunk", checksum, &buffer))
+	assert.Equal(t, data, buffer.Bytes())
+}
+
+func TestRetrieveRange(t *testing.T) {
+	addr, _ := startTestServer(t)
+	rs, err := storage.NewRemoteStorage(addr, insecure.NewCredentials())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 300000)
+	_, err = rs.StoreChunk(context.Background(), "chunk", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	for _, r := range [][2]int64{{0, 1}, {5, 10}, {1024*1024 - 3, 1024*1024 + 6}, {2999990, 10}, {2999990, 100}} {
+		var buffer bytes.Buffer
+		require.NoError(t, rs.RetrieveChunkRange(context.Background(), "chunk", nil, r[0], r[1], &buffer))
+		assert.Equal(t, data[r[0]:min(r[0]+r[1], int64(len(data)))], buffer.Bytes(), "range %v", r)
+	}
+}
+
+func TestCorruptedChunkIsNotSent(t *testing.T) {
+	addr, storageSrv := startTestServer(t)
+	dir := storageSrv.storageLocation
+	rs, err := storage.NewRemoteStorage(addr, insecure.NewCredentials())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	checksum, err := rs.StoreChunk(context.Background(), "chunk", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	stored, err := os.ReadFile(path.Join(dir, "chunk"))
+	require.NoError(t, err)
+	stored[100] ^= 1
+	require.NoError(t, os.WriteFile(path.Join(dir, "chunk"), stored, 0o600))
+
+	var buffer bytes.Buffer
+	err = rs.RetrieveChunk(context.Background(), "chunk", checksum, &buffer)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	assert.Zero(t, buffer.Len())
+
+	// a range far from the corrupted byte is not sent either
+	err = rs.RetrieveChunkRange(context.Background(), "chunk", checksum, 5000, 100, &buffer)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	assert.Zero(t, buffer.Len())
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := storagepb.NewStorageClient(conn).RetrieveData(context.Background(), &storagepb.FileInfo{FileId: "chunk", Checksum: checksum, Offset: 5000, Length: 100})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+
+	// nothing is verified without a checksum
+	require.NoError(t, rs.RetrieveChunk(context.Background(), "chunk", nil, &buffer))
+	assert.Equal(t, stored, buffer.Bytes())
+	buffer.Reset()
+	require.NoError(t, rs.RetrieveChunkRange(context.Background(), "chunk", nil, 5000, 100, &buffer))
+	assert.Equal(t, stored[5000:5100], buffer.Bytes())
+}
+
+func TestStoreWithWrongChecksumIsRejected(t *testing.T) {
+	addr, storageSrv := startTestServer(t)
+	dir := storageSrv.storageLocation
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := storagepb.NewStorageClient(conn).StoreData(context.Background())
+	require.NoError(t, err)
+	wrong := sha256.Sum256([]byte("something else"))
+	require.NoError(t, stream.Send(&storagepb.StoredUnit{FileInfo: &storagepb.FileInfo{FileId: "chunk"}, Data: []byte("data")}))
+	require.NoError(t, stream.Send(&storagepb.StoredUnit{FileInfo: &storagepb.FileInfo{FileId: "chunk"}, Checksum: wrong[:]}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+
+	_, err = os.Stat(path.Join(dir, "chunk"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "rejected chunk must not be kept")
+}
+
+func TestStoreAndRetrieveOverMTLS(t *testing.T) {
+	ca := mtlstest.NewCA(t)
+	serverCreds, err := mtls.ServerCredentials(ca.Issue(t, "storage", "127.0.0.1"))
+	require.NoError(t, err)
+	addr, _ := startTestServerWithCreds(t, serverCreds)
+
+	clientCreds, err := mtls.ClientCredentials(ca.Issue(t, "apiservice", "apiservice"))
+	require.NoError(t, err)
+	rs, err := storage.NewRemoteStorage(addr, clientCreds)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	checksum, err := rs.StoreChunk(context.Background(), "chunk", bytes.NewReader(data))
+	require.NoError(t, err)
+	var buffer bytes.Buffer
+	require.NoError(t, rs.RetrieveChunk(context.Background(), "chunk", checksum, &buffer))
+	assert.Equal(t, data, buffer.Bytes())
+
+	strangerCreds, err := mtls.ClientCredentials(mtlstest.NewCA(t).Issue(t, "apiservice", "apiservice"))
+	require.NoError(t, err)
+	for name, creds := range map[string]credentials.TransportCredentials{
+		"plaintext":  insecure.NewCredentials(),
+		"another CA": strangerCreds,
+	} {
+		rs, err := storage.NewRemoteStorage(addr, creds)
+		require.NoError(t, err)
+		_, err = rs.StoreChunk(context.Background(), "stranger", bytes.NewReader(data))
+		assert.Error(t, err, name)
+		_, err = rs.ListChunks(context.Background())
+		assert.Error(t, err, name)
+	}
+}
+
+func TestCopyFromAnotherStorage(t *testing.T) {
+	sourceAddr, sourceSrv := startTestServer(t)
+	targetAddr, targetSrv := startTestServer(t)
+	source, err := storage.NewRemoteStorage(sourceAddr, insecure.NewCredentials())
+	require.NoError(t, err)
+	target, err := storage.NewRemoteStorage(targetAddr, insecure.NewCredentials())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 300000)
+	checksum, err := source.StoreChunk(context.Background(), "chunk", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	wrong := sha256.Sum256([]byte("something else"))
+	err = target.CopyChunk(context.Background(), "chunk", wrong[:], sourceAddr)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	_, err = os.Stat(path.Join(targetSrv.storageLocation, "chunk"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "rejected copy must not be kept")
+
+	require.NoError(t, target.CopyChunk(context.Background(), "chunk", checksum, sourceAddr))
+	var buffer bytes.Buffer
+	require.NoError(t, target.RetrieveChunk(context.Background(), "chunk", checksum, &buffer))
+	assert.Equal(t, data, buffer.Bytes())
+	recorded, err := targetSrv.readChecksum("chunk")
+	require.NoError(t, err)
+	assert.Equal(t, checksum, recorded, "the copy must be scrubbed as any other chunk")
+
+	// a chunk is never overwritten, and a corrupted source is not copied
+	assert.Error(t, target.CopyChunk(context.Background(), "chunk", checksum, sourceAddr))
+	stored, err := os.ReadFile(path.Join(sourceSrv.storageLocation, "chunk"))
+	require.NoError(t, err)
+	stored[100] ^= 1
+	require.NoError(t, os.WriteFile(path.Join(sourceSrv.storageLocation, "chunk"), stored, 0o600))
+	require.NoError(t, target.DeleteChunk(context.Background(), "chunk"))
+	err = target.CopyChunk(context.Background(), "chunk", checksum, sourceAddr)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+type Permission string
+
+const (
+	PermissionRead   Permission = "read"
+	PermissionWrite  Permission = "write"
+	PermissionDelete Permission = "delete"
+	// PermissionAdmin allows to manage buckets. Granted for any bucket ("*") it also allows cluster-wide admin endpoints
+	PermissionAdmin Permission = "admin"
+)
+
+// AnyBucket in a grant matches every bucket
+const AnyBucket = "*"
+
+var (
+	// ErrUnauthenticated means that the request has no credentials or they are wrong
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden means that the key is known, but it has no permission for the request
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Grant gives permissions for keys of a bucket which start with Prefix
+type Grant struct {
+	Bucket      string       `json:"bucket"`
+	Prefix      string       `json:"prefix,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+type Key struct {
+	ID     string  `json:"id"`
+	Secret string  `json:"secret"`
+	Grants []Grant `json:"grants"`
+}
+
+// Allowed tells whether the key has permission for key in bucket. An empty bucket is the whole cluster,
+// so only grants for AnyBucket match it
+func (k *Key) Allowed(permission Permission, bucket, key string) bool {
+	for _, grant := range k.Grants {
+		if grant.Bucket != AnyBucket && (bucket == "" || grant.Bucket != bucket) {
+			continue
+		}
+		if strings.HasPrefix(key, grant.Prefix) && slices.Contains(grant.Permissions, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+type config struct {
+	Keys []Key `json:"keys"`
+}
+
+func (c *config) validate() error {
+	seen := make(map[string]bool, len(c.Keys))
+	for _, key := range c.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return errors.New("every key must have id and secret")
+		}
+		if strings.Contains(key.ID, ":") {
+			return fmt.Errorf("key id %q must not contain a colon", key.ID)
+		}
+		if seen[key.ID] {
+			return fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		seen[key.ID] = true
+		for _, grant := range key.Grants {
+			if grant.Bucket == "" {
+				return fmt.Errorf("grant of key %q has no bucket", key.ID)
+			}
+			for _, permission := range grant.Permissions {
+				switch permission {
+				case PermissionRead, PermissionWrite, PermissionDelete, PermissionAdmin:
+				default:
+					return fmt.Errorf("key %q has unknown permission %q", key.ID, permission)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticator checks credentials of requests against keys from a config file:
+//
+//	{"keys": [{"id": "...", "secret": "...", "grants": [{"bucket": "photos", "prefix": "public/", "permissions": ["read"]}]}]}
+//
+// Keys are replaced as a whole by Reload, so requests which are in flight keep the keys they have started with
+type Authenticator struct {
+	path string
+	keys atomic.Pointer[map[string]*Key]
+}
+
+func NewAuthenticator(path string) (*Authenticator, error) {
+	a := &Authenticator{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the config file again. Keys are kept as they are if the file is broken
+func (a *Authenticator) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("cannot read auth config: %w", err)
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("cannot decode auth config: %w", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("bad auth config: %w", err)
+	}
+	keys := make(map[string]*Key, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		keys[key.ID] = &key
+	}
+	a.keys.Store(&keys)
+	slog.Info("auth config loaded", "path", a.path, "keys", len(keys))
+	return nil
+}
+
+func (a *Authenticator) lookup(id string) (*Key, bool) {
+	key, found := (*a.keys.Load())[id]
+	return key, found
+}
+
+// Authenticate finds the key which has made the request. Three schemes are supported:
+//   - Authorization: Bearer <key id>:<secret>
+//   - Authorization: DS-HMAC-SHA256 ..., see Sign
+//   - Authorization: AWS4-HMAC-SHA256 ..., AWS Signature Version 4 of S3 clients, with the key id as access key id
+//
+// With signed schemes the body is replaced by one which fails at the end if the body does not match the signed checksum.
+// An aws-chunked body is decoded, and every chunk is checked before it is read
+func (a *Authenticator) Authenticate(req *http.Request) (*Key, error) {
+	header := req.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch scheme {
+	case "Bearer":
+		id, secret, _ := strings.Cut(credentials, ":")
+		key, found := a.lookup(id)
+		if !found || subtle.ConstantTimeCompare([]byte(secret), []byte(key.Secret)) != 1 {
+			return nil, ErrUnauthenticated
+		}
+		return key, nil
+	case signatureAlgorithm:
+		return a.verifySignature(req, credentials)
+	case s3Algorithm:
+		return a.verifyS3Signature(req, credentials)
+	default:
+		return nil, ErrUnauthenticated
+	}
+}
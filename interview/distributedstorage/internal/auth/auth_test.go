@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `{"keys": [
+	{"id": "reader", "secret": "reader-secret", "grants": [{"bucket": "photos", "prefix": "public/", "permissions": ["read"]}]},
+	{"id": "admin", "secret": "admin-secret", "grants": [{"bucket": "*", "permissions": ["read", "write", "delete", "admin"]}]}
+]}`
+
+func writeConfig(t *testing.T, dir, config string) string {
+	configPath := path.Join(dir, "auth.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o600))
+	return configPath
+}
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	authn, err := NewAuthenticator(writeConfig(t, t.TempDir(), testConfig))
+	require.NoError(t, err)
+	return authn
+}
+
+func newRequest(t *testing.T, method, url string, body []byte) *http.Request {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	return req
+}
+
+func TestAllowed(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	reader, found := authn.lookup("reader")
+	require.True(t, found)
+	assert.True(t, reader.Allowed(PermissionRead, "photos", "public/cat.jpg"))
+	assert.True(t, reader.Allowed(PermissionRead, "photos", "public/"))
+	assert.False(t, reader.Allowed(PermissionRead, "photos", "private/cat.jpg"))
+	assert.False(t, reader.Allowed(PermissionRead, "photos", ""))
+	assert.False(t, reader.Allowed(PermissionWrite, "photos", "public/cat.jpg"))
+	assert.False(t, reader.Allowed(PermissionRead, "docs", "public/cat.jpg"))
+
+	admin, found := authn.lookup("admin")
+	require.True(t, found)
+	assert.True(t, admin.Allowed(PermissionDelete, "docs", "anything"))
+	assert.True(t, admin.Allowed(PermissionAdmin, "", ""), "cluster-wide admin")
+	assert.False(t, reader.Allowed(PermissionAdmin, "", ""))
+}
+
+func TestBadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, config := range []string{
+		`{`,
+		`{"keys": [{"id": "a", "secret": ""}]}`,
+		`{"keys": [{"id": "a:b", "secret": "s"}]}`,
+		`{"keys": [{"id": "a", "secret": "s"}, {"id": "a", "secret": "t"}]}`,
+		`{"keys": [{"id": "a", "secret": "s", "grants": [{"permissions": ["read"]}]}]}`,
+		`{"keys": [{"id": "a", "secret": "s", "grants": [{"bucket": "b", "permissions": ["everything"]}]}]}`,
+	} {
+		_, err := NewAuthenticator(writeConfig(t, dir, config))
+		assert.Error(t, err, config)
+	}
+	_, err := NewAuthenticator(path.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	authn, err := NewAuthenticator(writeConfig(t, dir, testConfig))
+	require.NoError(t, err)
+
+	writeConfig(t, dir, `{"keys": [{"id": "new", "secret": "new-secret"}]}`)
+	require.NoError(t, authn.Reload())
+	_, found := authn.lookup("reader")
+	assert.False(t, found)
+	_, found = authn.lookup("new")
+	assert.True(t, found)
+
+	writeConfig(t, dir, `{broken`)
+	assert.Error(t, authn.Reload())
+	_, found = authn.lookup("new")
+	assert.True(t, found, "keys are kept when the config is broken")
+}
+
+func TestBearer(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	for header, expected := range map[string]string{
+		"Bearer reader:reader-secret": "reader",
+		"Bearer reader:admin-secret":  "",
+		"Bearer reader":               "",
+		"Bearer missing:secret":       "",
+		"Basic cmVhZGVyOnNlY3JldA==":  "",
+		"":                            "",
+	} {
+		req := newRequest(t, http.MethodGet, "http://host/file", nil)
+		req.Header.Set("Authorization", header)
+		key, err := authn.Authenticate(req)
+		if expected == "" {
+			assert.ErrorIs(t, err, ErrUnauthenticated, header)
+			continue
+		}
+		require.NoError(t, err, header)
+		assert.Equal(t, expected, key.ID)
+	}
+}
+
+func TestSignedRequest(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	req := newRequest(t, http.MethodGet, "http://host/photos/public/cat%201.jpg?b=2&a=1&a=0", nil)
+	Sign(req, "reader", "reader-secret", UnsignedPayload, time.Now())
+	key, err := authn.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "reader", key.ID)
+
+	for name, tamper := range map[string]func(req *http.Request){
+		"path":   func(req *http.Request) { req.URL.Path = "/photos/private/cat.jpg" },
+		"query":  func(req *http.Request) { req.URL.RawQuery = "a=1" },
+		"method": func(req *http.Request) { req.Method = http.MethodDelete },
+		"host":   func(req *http.Request) { req.Host = "other" },
+		"date": func(req *http.Request) {
+			req.Header.Set(DateHeader, time.Now().Add(time.Second).UTC().Format(dateFormat))
+		},
+		"secret": func(req *http.Request) { Sign(req, "reader", "wrong", UnsignedPayload, time.Now()) },
+		"old": func(req *http.Request) {
+			Sign(req, "reader", "reader-secret", UnsignedPayload, time.Now().Add(-time.Hour))
+		},
+		"key": func(req *http.Request) { Sign(req, "missing", "reader-secret", UnsignedPayload, time.Now()) },
+	} {
+		req := newRequest(t, http.MethodGet, "http://host/photos/public/cat.jpg?a=1&b=2", nil)
+		Sign(req, "reader", "reader-secret", UnsignedPayload, time.Now().Add(-time.Minute))
+		tamper(req)
+		_, err := authn.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated, name)
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	data := []byte("some data")
+	checksum := sha256.Sum256(data)
+
+	for _, contentLength := range []int64{int64(len(data)), -1} {
+		req := newRequest(t, http.MethodPut, "http://host/file", data)
+		req.ContentLength = contentLength
+		Sign(req, "admin", "admin-secret", hex.EncodeToString(checksum[:]), time.Now())
+		_, err := authn.Authenticate(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, data, body)
+
+		req = newRequest(t, http.MethodPut, "http://host/file", []byte("other data"))
+		req.ContentLength = contentLength
+		Sign(req, "admin", "admin-secret", hex.EncodeToString(checksum[:]), time.Now())
+		_, err = authn.Authenticate(req)
+		require.NoError(t, err)
+		_, err = io.ReadAll(req.Body)
+		assert.ErrorIs(t, err, ErrPayloadMismatch)
+	}
+
+	req := newRequest(t, http.MethodPut, "http://host/file", data)
+	Sign(req, "admin", "admin-secret", "not-a-checksum", time.Now())
+	_, err := authn.Authenticate(req)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+// sha256Hasher is what the minio signer wants to hash chunks
+type sha256Hasher struct {
+	hash.Hash
+}
+
+func (sha256Hasher) Close() {}
+
+func TestS3Signature(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	data := []byte("some data")
+	newS3Request := func(payloadHash string) *http.Request {
+		req := newRequest(t, http.MethodPut, "http://host:9000/photos/public/cat%201.jpg?partNumber=1&uploadId=a%2Fb", data)
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		return req
+	}
+
+	req := signer.SignV4(*newS3Request(UnsignedPayload), "reader", "reader-secret", "", "us-east-1")
+	key, err := authn.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "reader", key.ID)
+
+	req = signer.SignV4(*newS3Request(sha256Hex(data)), "admin", "admin-secret", "", "eu-west-1")
+	_, err = authn.Authenticate(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+
+	req = signer.SignV4(*newS3Request(sha256Hex([]byte("other data"))), "admin", "admin-secret", "", "us-east-1")
+	_, err = authn.Authenticate(req)
+	require.NoError(t, err)
+	_, err = io.ReadAll(req.Body)
+	assert.ErrorIs(t, err, ErrPayloadMismatch)
+
+	for name, tamper := range map[string]func(req *http.Request){
+		"path":   func(req *http.Request) { req.URL.Path = "/photos/private/cat.jpg" },
+		"query":  func(req *http.Request) { req.URL.RawQuery = "partNumber=2&uploadId=a%2Fb" },
+		"header": func(req *http.Request) { req.Header.Set("X-Amz-Content-Sha256", sha256Hex(data)) },
+		"secret": func(req *http.Request) { *req = *signer.SignV4(*req, "reader", "wrong", "", "us-east-1") },
+		"key":    func(req *http.Request) { *req = *signer.SignV4(*req, "missing", "reader-secret", "", "us-east-1") },
+		"date": func(req *http.Request) {
+			req.Header.Set("X-Amz-Date", time.Now().Add(-time.Hour).UTC().Format(dateFormat))
+		},
+	} {
+		req := signer.SignV4(*newS3Request(UnsignedPayload), "reader", "reader-secret", "", "us-east-1")
+		tamper(req)
+		_, err := authn.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated, name)
+	}
+}
+
+func TestS3StreamingSignature(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	// a few 64KiB chunks and a short one
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	newStreamingRequest := func(secret string) *http.Request {
+		req := newRequest(t, http.MethodPut, "http://host:9000/photos/cat.jpg", data)
+		return signer.StreamingSignV4(req, "admin", secret, "", "us-east-1", int64(len(data)), time.Now().UTC(), sha256Hasher{sha256.New()})
+	}
+
+	req := newStreamingRequest("admin-secret")
+	_, err := authn.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), req.ContentLength)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+
+	// the seed signature is fine, but a chunk is changed on the way
+	req = newStreamingRequest("admin-secret")
+	_, err = authn.Authenticate(req)
+	require.NoError(t, err)
+	encoded, err := io.ReadAll(req.Body.(*chunkedBody).body)
+	require.NoError(t, err)
+	tampered := bytes.Clone(encoded)
+	tampered[len(tampered)/2] ^= 1
+	req.Body = io.NopCloser(bytes.NewReader(tampered))
+	decodeChunkedBody(req, nil)
+	_, err = io.ReadAll(req.Body)
+	assert.NoError(t, err, "nothing is checked without a signature")
+
+	req = newStreamingRequest("admin-secret")
+	req.Body = io.NopCloser(bytes.NewReader(tampered))
+	_, err = authn.Authenticate(req)
+	require.NoError(t, err)
+	_, err = io.ReadAll(req.Body)
+	assert.ErrorIs(t, err, ErrPayloadMismatch)
+
+	req = newStreamingRequest("admin-secret")
+	req.Body = io.NopCloser(io.LimitReader(req.Body, req.ContentLength-100))
+	_, err = authn.Authenticate(req)
+	require.NoError(t, err)
+	_, err = io.ReadAll(req.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = authn.Authenticate(newStreamingRequest("wrong"))
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestDecodeS3Payload(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), 50000)
+	req := newRequest(t, http.MethodPut, "http://host:9000/photos/cat.jpg", data)
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+	req.Header.Set("X-Amz-Decoded-Content-Length", strconv.Itoa(len(data)))
+	req.Trailer = http.Header{"X-Amz-Checksum-Crc32": []string{"AAAAAA=="}}
+	req = signer.StreamingUnsignedV4(req, "", int64(len(data)), time.Now().UTC())
+	DecodeS3Payload(req)
+	assert.Equal(t, int64(len(data)), req.ContentLength)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+
+	plain := newRequest(t, http.MethodPut, "http://host:9000/photos/cat.jpg", data)
+	DecodeS3Payload(plain)
+	body, err = io.ReadAll(plain.Body)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+}
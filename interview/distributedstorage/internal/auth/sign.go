@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	signatureAlgorithm = "DS-HMAC-SHA256"
+
+	DateHeader          = "X-Ds-Date"
+	ContentSha256Header = "X-Ds-Content-Sha256"
+	// UnsignedPayload in ContentSha256Header signs the request without its body, e.g. for a stream which checksum is not known in advance
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	dateFormat = "20060102T150405Z"
+	// MaxClockSkew limits how long a signed request can be replayed
+	MaxClockSkew = 15 * time.Minute
+)
+
+// ErrPayloadMismatch is returned by the body of a signed request when the body does not match its signed checksum
+var ErrPayloadMismatch = errors.New("body does not match signed checksum")
+
+// Sign adds the signed scheme to a request, similar to AWS SigV4 but without derived keys:
+//
+//	Authorization: DS-HMAC-SHA256 Credential=<key id>, SignedHeaders=host;x-ds-content-sha256;x-ds-date, Signature=<hex>
+//
+// The signature is HMAC-SHA256 with the secret of
+//
+//	DS-HMAC-SHA256 \n <X-Ds-Date> \n hex(sha256(canonical request))
+//
+// where the canonical request is method, escaped path, sorted query, "name:value" of every signed header, the list of signed headers
+// and payloadHash, all joined with \n. payloadHash is the hex SHA-256 of the body or UnsignedPayload
+func Sign(req *http.Request, keyID, secret, payloadHash string, now time.Time) {
+	req.Header.Set(DateHeader, now.UTC().Format(dateFormat))
+	req.Header.Set(ContentSha256Header, payloadHash)
+	signedHeaders := []string{"host", strings.ToLower(ContentSha256Header), strings.ToLower(DateHeader)}
+	signature := signature(secret, req, signedHeaders)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+		signatureAlgorithm, keyID, strings.Join(signedHeaders, ";"), signature))
+}
+
+func signature(secret string, req *http.Request, signedHeaders []string) string {
+	canonical := sha256.Sum256([]byte(canonicalRequest(req, signedHeaders)))
+	stringToSign := strings.Join([]string{signatureAlgorithm, req.Header.Get(DateHeader), hex.EncodeToString(canonical[:])}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func canonicalRequest(req *http.Request, signedHeaders []string) string {
+	query := req.URL.Query()
+	for _, values := range query {
+		slices.Sort(values)
+	}
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		// Encode sorts by key, and values of every key are sorted above
+		strings.ReplaceAll(query.Encode(), "+", "%20"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		req.Header.Get(ContentSha256Header),
+	}, "\n")
+}
+
+func (a *Authenticator) verifySignature(req *http.Request, credentials string) (*Key, error) {
+	params := make(map[string]string, 3)
+	for _, param := range strings.Split(credentials, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[name] = value
+	}
+	key, found := a.lookup(params["Credential"])
+	if !found {
+		return nil, ErrUnauthenticated
+	}
+
+	signedHeaders := strings.Split(params["SignedHeaders"], ";")
+	for _, required := range []string{"host", strings.ToLower(ContentSha256Header), strings.ToLower(DateHeader)} {
+		if !slices.Contains(signedHeaders, required) {
+			return nil, fmt.Errorf("%w: %s is not signed", ErrUnauthenticated, required)
+		}
+	}
+	date, err := time.Parse(dateFormat, req.Header.Get(DateHeader))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad date", ErrUnauthenticated)
+	}
+	if skew := time.Since(date); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, fmt.Errorf("%w: request date is too far from now", ErrUnauthenticated)
+	}
+	payloadHash := req.Header.Get(ContentSha256Header)
+	var expectedChecksum []byte
+	if payloadHash != UnsignedPayload {
+		expectedChecksum, err = hex.DecodeString(payloadHash)
+		if err != nil || len(expectedChecksum) != sha256.Size {
+			return nil, fmt.Errorf("%w: bad payload checksum", ErrUnauthenticated)
+		}
+	}
+
+	expected := signature(key.Secret, req, signedHeaders)
+	if !hmac.Equal([]byte(expected), []byte(params["Signature"])) {
+		return nil, ErrUnauthenticated
+	}
+	if expectedChecksum != nil && req.Body != nil {
+		req.Body = &verifyingBody{body: req.Body, hasher: sha256.New(), expected: expectedChecksum, remaining: req.ContentLength}
+	}
+	return key, nil
+}
+
+// verifyingBody cannot tell a body is wrong before all of it is read, so whoever reads it must be ready to throw everything away
+// when ErrPayloadMismatch comes with the last bytes. A body of known size is checked right when its last byte is read,
+// since a reader which wants exactly that many bytes may never ask for io.EOF
+type verifyingBody struct {
+	body      io.ReadCloser
+	hasher    hash.Hash
+	expected  []byte
+	remaining int64
+}
+
+func (vb *verifyingBody) Read(p []byte) (int, error) {
+	n, err := vb.body.Read(p)
+	vb.hasher.Write(p[:n])
+	if vb.remaining >= 0 {
+		vb.remaining -= int64(n)
+	}
+	if (err == io.EOF || vb.remaining == 0) && !bytes.Equal(vb.hasher.Sum(nil), vb.expected) {
+		return n, ErrPayloadMismatch
+	}
+	return n, err
+}
+
+func (vb *verifyingBody) Close() error {
+	return vb.body.Close()
+}
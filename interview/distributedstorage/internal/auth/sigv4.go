@@ -0,0 +1,310 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, so S3 clients can use keys of the config as access key id and secret access key
+const (
+	s3Algorithm = "AWS4-HMAC-SHA256"
+
+	amzDateHeader          = "X-Amz-Date"
+	amzContentSha256Header = "X-Amz-Content-Sha256"
+	amzDecodedLengthHeader = "X-Amz-Decoded-Content-Length"
+
+	// the body is sent in aws-chunked encoding, every chunk signed with the signature of the previous one
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// the body is sent in aws-chunked encoding without signatures, checksums come in trailers
+	streamingUnsignedPayload = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// maxStreamingChunk is what a chunk of aws-chunked body may take in memory until its signature is checked. Clients send 64KiB
+	maxStreamingChunk = 16 * 1024 * 1024
+
+	emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	checksum := sha256.Sum256(data)
+	return hex.EncodeToString(checksum[:])
+}
+
+// s3Escape is URI encoding of SigV4: everything but unreserved characters is escaped, slashes are kept only in paths
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Scope is the credential scope: <date>/<region>/<service>/aws4_request
+type s3Scope struct {
+	date, region, service string
+}
+
+func (s s3Scope) String() string {
+	return strings.Join([]string{s.date, s.region, s.service, "aws4_request"}, "/")
+}
+
+func (s s3Scope) signingKey(secret string) []byte {
+	key := hmacSha256([]byte("AWS4"+secret), s.date)
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, s.service)
+	return hmacSha256(key, "aws4_request")
+}
+
+func s3CanonicalRequest(req *http.Request, signedHeaders []string) string {
+	type param struct{ key, value string }
+	var params []param
+	for key, values := range req.URL.Query() {
+		for _, value := range values {
+			params = append(params, param{s3Escape(key, false), s3Escape(value, false)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+	query := make([]string, 0, len(params))
+	for _, p := range params {
+		query = append(query, p.key+"="+p.value)
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		values := req.Header.Values(name)
+		switch name {
+		case "host":
+			values = []string{req.Host}
+			if req.Host == "" {
+				values = []string{req.URL.Host}
+			}
+		case "content-length":
+			// the server keeps it out of headers for some requests
+			if len(values) == 0 {
+				values = []string{strconv.FormatInt(req.ContentLength, 10)}
+			}
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.Join(values, ","))
+	}
+	return strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		req.Header.Get(amzContentSha256Header),
+	}, "\n")
+}
+
+func s3StringToSign(amzDate string, scope s3Scope, canonicalRequest string) string {
+	return strings.Join([]string{s3Algorithm, amzDate, scope.String(), sha256Hex([]byte(canonicalRequest))}, "\n")
+}
+
+func (a *Authenticator) verifyS3Signature(req *http.Request, credentials string) (*Key, error) {
+	params := make(map[string]string, 3)
+	for _, param := range strings.Split(credentials, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[name] = value
+	}
+	scopeParts := strings.Split(params["Credential"], "/")
+	if len(scopeParts) != 5 || scopeParts[4] != "aws4_request" {
+		return nil, fmt.Errorf("%w: bad credential scope", ErrUnauthenticated)
+	}
+	key, found := a.lookup(scopeParts[0])
+	if !found {
+		return nil, ErrUnauthenticated
+	}
+	scope := s3Scope{date: scopeParts[1], region: scopeParts[2], service: scopeParts[3]}
+
+	signedHeaders := strings.Split(params["SignedHeaders"], ";")
+	for _, required := range []string{"host", strings.ToLower(amzContentSha256Header)} {
+		if !slices.Contains(signedHeaders, required) {
+			return nil, fmt.Errorf("%w: %s is not signed", ErrUnauthenticated, required)
+		}
+	}
+	amzDate := req.Header.Get(amzDateHeader)
+	date, err := time.Parse(dateFormat, amzDate)
+	if err != nil || !slices.Contains(signedHeaders, strings.ToLower(amzDateHeader)) {
+		return nil, fmt.Errorf("%w: bad date", ErrUnauthenticated)
+	}
+	if skew := time.Since(date); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, fmt.Errorf("%w: request date is too far from now", ErrUnauthenticated)
+	}
+	if scope.date != date.Format("20060102") {
+		return nil, fmt.Errorf("%w: credential scope is for another date", ErrUnauthenticated)
+	}
+
+	signingKey := scope.signingKey(key.Secret)
+	stringToSign := s3StringToSign(amzDate, scope, s3CanonicalRequest(req, signedHeaders))
+	expected := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(params["Signature"])) {
+		return nil, ErrUnauthenticated
+	}
+
+	switch payloadHash := req.Header.Get(amzContentSha256Header); payloadHash {
+	case UnsignedPayload:
+	case streamingPayload:
+		verifier := &chunkVerifier{signingKey: signingKey, amzDate: amzDate, scope: scope, previous: expected}
+		decodeChunkedBody(req, verifier.verify)
+	case streamingUnsignedPayload:
+		decodeChunkedBody(req, nil)
+	default:
+		expectedChecksum, err := hex.DecodeString(payloadHash)
+		if err != nil || len(expectedChecksum) != sha256.Size {
+			return nil, fmt.Errorf("%w: bad payload checksum", ErrUnauthenticated)
+		}
+		if req.Body != nil {
+			req.Body = &verifyingBody{body: req.Body, hasher: sha256.New(), expected: expectedChecksum, remaining: req.ContentLength}
+		}
+	}
+	return key, nil
+}
+
+// DecodeS3Payload replaces an aws-chunked body with the data it carries, so handlers of S3 requests see the plain object.
+// Chunk signatures are not checked, it is for servers without an Authenticator. Bodies which Authenticate has decoded are kept
+func DecodeS3Payload(req *http.Request) {
+	if _, decoded := req.Body.(*chunkedBody); decoded {
+		return
+	}
+	switch req.Header.Get(amzContentSha256Header) {
+	case streamingPayload, streamingUnsignedPayload:
+		decodeChunkedBody(req, nil)
+	}
+}
+
+func decodeChunkedBody(req *http.Request, verify func(signature string, data []byte) error) {
+	req.ContentLength = -1
+	if length, err := strconv.ParseInt(req.Header.Get(amzDecodedLengthHeader), 10, 64); err == nil && length >= 0 {
+		req.ContentLength = length
+	}
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	req.Body = &chunkedBody{body: req.Body, reader: bufio.NewReader(req.Body), verify: verify}
+}
+
+// chunkVerifier checks signatures of chunks, which are chained: every chunk is signed together with the signature before it
+type chunkVerifier struct {
+	signingKey []byte
+	amzDate    string
+	scope      s3Scope
+	previous   string
+}
+
+func (cv *chunkVerifier) verify(signature string, data []byte) error {
+	stringToSign := strings.Join([]string{s3Algorithm + "-PAYLOAD", cv.amzDate, cv.scope.String(), cv.previous, emptySha256, sha256Hex(data)}, "\n")
+	expected := hex.EncodeToString(hmacSha256(cv.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("%w: bad chunk signature", ErrPayloadMismatch)
+	}
+	cv.previous = expected
+	return nil
+}
+
+// chunkedBody reads aws-chunked encoding:
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n ... 0[;chunk-signature=<signature>]\r\n[<trailer>\r\n ...]\r\n
+//
+// A chunk is given away only after its signature is checked. Trailers are skipped
+type chunkedBody struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	verify func(signature string, data []byte) error
+	// chunk is what is left of the current chunk
+	chunk []byte
+	done  bool
+}
+
+func (cb *chunkedBody) Read(p []byte) (int, error) {
+	for len(cb.chunk) == 0 {
+		if cb.done {
+			return 0, io.EOF
+		}
+		if err := cb.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cb.chunk)
+	cb.chunk = cb.chunk[n:]
+	return n, nil
+}
+
+func (cb *chunkedBody) readLine() (string, error) {
+	line, err := cb.reader.ReadSlice('\n')
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrPayloadMismatch, err)
+	}
+	return strings.TrimSuffix(string(line), "\r\n"), nil
+}
+
+func (cb *chunkedBody) next() error {
+	header, err := cb.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, extension, _ := strings.Cut(header, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxStreamingChunk {
+		return fmt.Errorf("%w: bad chunk header %q", ErrPayloadMismatch, header)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cb.reader, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if cb.verify != nil {
+		if err := cb.verify(strings.TrimPrefix(extension, "chunk-signature="), data); err != nil {
+			return err
+		}
+	}
+	// the final chunk is followed by trailers, if any, and an empty line. Others are followed by a line break
+	for {
+		line, err := cb.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		if size > 0 {
+			return fmt.Errorf("%w: chunk is longer than its size", ErrPayloadMismatch)
+		}
+	}
+	cb.done = size == 0
+	cb.chunk = data
+	return nil
+}
+
+func (cb *chunkedBody) Close() error {
+	return cb.body.Close()
+}
@@ -0,0 +1,262 @@
+package chunkmaster
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBucket keeps files which fileref has no bucket part, i.e. no slash. It uses the layout the ChunkMaster has been created with
+// and has no quota
+const DefaultBucket = "default"
+
+// reservedBucketNames cannot be created, so they do not clash with the default bucket and with API paths
+var reservedBucketNames = map[string]bool{
+	DefaultBucket: true,
+	"admin":       true,
+	"buckets":     true,
+}
+
+// apiPaths are first segments of API paths. A file of the default bucket is addressed as /{fileref}, so a fileref named as one of them
+// could be stored but never read back
+var apiPaths = map[string]bool{
+	"admin":   true,
+	"buckets": true,
+}
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+var (
+	ErrBucketNotFound      = errors.New("bucket not found")
+	ErrBucketExists        = errors.New("bucket already exists")
+	ErrBucketNotEmpty      = errors.New("bucket is not empty")
+	ErrBadBucketName       = errors.New("bad bucket name")
+	ErrDefaultBucket       = errors.New("default bucket cannot be changed")
+	ErrBadFileref          = errors.New("bad object key")
+	ErrBucketQuotaExceeded = errors.New("bucket quota exceeded")
+)
+
+type Bucket struct {
+	Name   string
+	Layout Layout
+	// QuotaBytes limits the size of all chunks of the bucket, parity included and every replica counted once. 0 means no limit
+	QuotaBytes int64
+	Versioning Versioning `json:",omitempty"`
+	Created    time.Time
+}
+
+// BucketInfo is a bucket with its usage. Files which are being streamed are counted too, as they already take space
+type BucketInfo struct {
+	Bucket
+	UsedBytes int64
+	Files     int
+}
+
+type bucketUsage struct {
+	bytes int64
+	files int
+}
+
+func ValidateBucketName(name string) error {
+	if !bucketNameRegexp.MatchString(name) || reservedBucketNames[name] {
+		return fmt.Errorf("%w: %q", ErrBadBucketName, name)
+	}
+	return nil
+}
+
+// ObjectName gives the fileref of key in bucket. Keys may contain slashes, the bucket is always up to the first one,
+// so only a key of the default bucket without slashes is a fileref of its own
+func ObjectName(bucket, key string) string {
+	if bucket == DefaultBucket && !strings.Contains(key, "/") {
+		return key
+	}
+	return bucket + "/" + key
+}
+
+// SplitFileref is the reverse of ObjectName
+func SplitFileref(fileref string) (string, string) {
+	bucket, key, found := strings.Cut(fileref, "/")
+	if !found {
+		return DefaultBucket, fileref
+	}
+	return bucket, key
+}
+
+// storedBytes is what chunks take from a bucket quota
+func storedBytes(chunks []Chunk) int64 {
+	var total int64
+	for _, chunk := range chunks {
+		total += chunk.Size
+	}
+	return total
+}
+
+func (cm *TemporaryChunkMaster) CreateBucket(bucket Bucket) error {
+	if err := ValidateBucketName(bucket.Name); err != nil {
+		return err
+	}
+	if err := bucket.Layout.Validate(); err != nil {
+		return err
+	}
+	if bucket.QuotaBytes < 0 {
+		return fmt.Errorf("quota must not be negative, got %d", bucket.QuotaBytes)
+	}
+	if err := bucket.Versioning.Validate(); err != nil {
+		return err
+	}
+
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	if _, found := cm.buckets[bucket.Name]; found {
+		return ErrBucketExists
+	}
+	if bucket.Created.IsZero() {
+		bucket.Created = now()
+	}
+	cm.buckets[bucket.Name] = bucket
+	return nil
+}
+
+func (cm *TemporaryChunkMaster) DeleteBucket(name string) error {
+	if name == DefaultBucket {
+		return ErrDefaultBucket
+	}
+
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	if _, found := cm.buckets[name]; !found {
+		return ErrBucketNotFound
+	}
+	if cm.usage[name].files > 0 {
+		return ErrBucketNotEmpty
+	}
+	delete(cm.buckets, name)
+	delete(cm.usage, name)
+	cm.dropVersionsOfBucket(name)
+	return nil
+}
+
+func (cm *TemporaryChunkMaster) StatBucket(name string) (BucketInfo, error) {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+
+	bucket, found := cm.bucket(name)
+	if !found {
+		return BucketInfo{}, ErrBucketNotFound
+	}
+	return cm.bucketInfo(bucket), nil
+}
+
+func (cm *TemporaryChunkMaster) Buckets() []BucketInfo {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+
+	infos := make([]BucketInfo, 0, len(cm.buckets)+1)
+	infos = append(infos, cm.bucketInfo(cm.defaultBucket()))
+	for _, bucket := range cm.buckets {
+		infos = append(infos, cm.bucketInfo(bucket))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (cm *TemporaryChunkMaster) defaultBucket() Bucket {
+	return Bucket{Name: DefaultBucket, Layout: cm.layout}
+}
+
+// bucket must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) bucket(name string) (Bucket, bool) {
+	if name == DefaultBucket {
+		return cm.defaultBucket(), true
+	}
+	bucket, found := cm.buckets[name]
+	return bucket, found
+}
+
+// canonicalFileref gives the name the file is kept under in the catalog. Before buckets appeared filerefs with slashes were names
+// of the flat space, so a prefix which is not a bucket still means the default bucket. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) canonicalFileref(fileref string) string {
+	name, key := SplitFileref(fileref)
+	if name != DefaultBucket {
+		if _, found := cm.buckets[name]; found {
+			return fileref
+		}
+		key = fileref
+	}
+	return ObjectName(DefaultBucket, key)
+}
+
+func (cm *TemporaryChunkMaster) resolveFileref(fileref string) string {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+	return cm.canonicalFileref(fileref)
+}
+
+// bucketOf gives the bucket a new file goes to. The fileref must be canonical. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) bucketOf(fileref string) (Bucket, error) {
+	name, key := SplitFileref(fileref)
+	if key == "" {
+		return Bucket{}, fmt.Errorf("%w: key is empty", ErrBadFileref)
+	}
+	bucket, found := cm.bucket(name)
+	if !found {
+		return Bucket{}, ErrBucketNotFound
+	}
+	return bucket, nil
+}
+
+func (cm *TemporaryChunkMaster) bucketInfo(bucket Bucket) BucketInfo {
+	usage := cm.usage[bucket.Name]
+	return BucketInfo{Bucket: bucket, UsedBytes: usage.bytes, Files: usage.files}
+}
+
+// checkQuota must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) checkQuota(bucket Bucket, bytes int64) error {
+	if bucket.QuotaBytes > 0 && cm.usage[bucket.Name].bytes+bytes > bucket.QuotaBytes {
+		return ErrBucketQuotaExceeded
+	}
+	return nil
+}
+
+// setChunks is the only way to put a file into the catalog, so bucket usage always matches it. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) setChunks(fileref string, chunks []Chunk) {
+	name, _ := SplitFileref(fileref)
+	usage := cm.usage[name]
+	previous, found := cm.chunkCatalog[fileref]
+	if !found {
+		usage.files++
+	}
+	usage.bytes += storedBytes(chunks) - storedBytes(previous)
+	cm.usage[name] = usage
+	// new refs come first, so content which the file keeps never looks unreferenced
+	cm.refContents(chunks, 1)
+	cm.refContents(previous, -1)
+	for i := range chunks {
+		if chunks[i].ContentID != "" {
+			// they are kept with the content
+			chunks[i].Replicas = nil
+			chunks[i].Checksum = nil
+		}
+	}
+	cm.chunkCatalog[fileref] = chunks
+}
+
+// removeChunks must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) removeChunks(fileref string) {
+	previous, found := cm.chunkCatalog[fileref]
+	if !found {
+		return
+	}
+	name, _ := SplitFileref(fileref)
+	usage := cm.usage[name]
+	usage.files--
+	usage.bytes -= storedBytes(previous)
+	cm.usage[name] = usage
+	cm.refContents(previous, -1)
+	delete(cm.chunkCatalog, fileref)
+}
@@ -0,0 +1,155 @@
+package chunkmaster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitFileref(t *testing.T) {
+	for _, tc := range []struct {
+		fileref, bucket, key string
+	}{
+		{"file", DefaultBucket, "file"},
+		{"photos/2024/cat.jpg", "photos", "2024/cat.jpg"},
+		{"photos/", "photos", ""},
+		{"default/some/path", DefaultBucket, "some/path"},
+	} {
+		bucket, key := SplitFileref(tc.fileref)
+		assert.Equal(t, tc.bucket, bucket, tc.fileref)
+		assert.Equal(t, tc.key, key, tc.fileref)
+		if key != "" {
+			assert.Equal(t, tc.fileref, ObjectName(bucket, key))
+		}
+	}
+}
+
+func TestCreateBucket(t *testing.T) {
+	chunker, _ := newReadyForTestTmpChunker(6)
+	layout := Layout{Chunks: 2, ReplicationFactor: 2}
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "photos", Layout: layout, QuotaBytes: 1000}))
+	assert.ErrorIs(t, chunker.CreateBucket(Bucket{Name: "photos", Layout: layout}), ErrBucketExists)
+
+	for _, name := range []string{DefaultBucket, "admin", "buckets", "ab", "Photos", "-photos", "photos-", "pho_tos", "pho/tos"} {
+		assert.ErrorIs(t, chunker.CreateBucket(Bucket{Name: name, Layout: layout}), ErrBadBucketName, name)
+	}
+	assert.Error(t, chunker.CreateBucket(Bucket{Name: "bad-layout", Layout: Layout{Chunks: 0, ReplicationFactor: 1}}))
+
+	info, err := chunker.StatBucket("photos")
+	require.NoError(t, err)
+	assert.Equal(t, layout, info.Layout)
+	assert.EqualValues(t, 1000, info.QuotaBytes)
+	assert.False(t, info.Created.IsZero())
+
+	_, err = chunker.StatBucket("missing")
+	assert.ErrorIs(t, err, ErrBucketNotFound)
+
+	buckets := chunker.Buckets()
+	require.Len(t, buckets, 2)
+	assert.Equal(t, DefaultBucket, buckets[0].Name)
+	assert.Equal(t, Layout{Chunks: 6, ReplicationFactor: 1}, buckets[0].Layout)
+	assert.Equal(t, "photos", buckets[1].Name)
+}
+
+func TestBucketLayout(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "photos", Layout: Layout{Chunks: 2, ReplicationFactor: 3}}))
+
+	chunks, err := chunker.SplitToChunks("photos/2024/cat.jpg", 9000, storages)
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	for _, chunk := range chunks {
+		assert.Len(t, chunk.Replicas, 3)
+	}
+
+	chunks, err = chunker.SplitToChunks("cat.jpg", 9000, storages)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 6)
+
+	// a prefix which is not a bucket is a part of a key of the default bucket
+	chunks, err = chunker.SplitToChunks("missing/cat.jpg", 9000, storages)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 6)
+	_, err = chunker.SplitToChunks("default/cat.jpg", 9000, storages)
+	assert.ErrorIs(t, err, ErrFileDuplicate)
+	_, err = chunker.SplitToChunks("photos/", 9000, storages)
+	assert.ErrorIs(t, err, ErrBadFileref)
+}
+
+func TestUnknownPrefixMeansDefaultBucket(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	_, err := chunker.SplitToChunks("some/path", 9000, storages)
+	require.NoError(t, err)
+
+	info, err := chunker.StatFile("some/path")
+	require.NoError(t, err)
+	assert.Equal(t, ObjectName(DefaultBucket, "some/path"), info.Fileref)
+	files := chunker.ListFiles(DefaultBucket, "some/", "", 10)
+	require.Len(t, files, 1)
+	assert.Equal(t, info.Fileref, files[0].Fileref)
+
+	// a bucket created later does not take the file over
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "some", Layout: Layout{Chunks: 2, ReplicationFactor: 1}}))
+	_, err = chunker.ChunksToRestore("some/path")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, err = chunker.ChunksToRestore(ObjectName(DefaultBucket, "some/path"))
+	assert.NoError(t, err)
+	assert.Empty(t, chunker.ListFiles("some", "", "", 10))
+	assert.Len(t, chunker.ListFiles(DefaultBucket, "", "", 10), 1)
+}
+
+func TestSameKeyInDifferentBuckets(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "first", Layout: Layout{Chunks: 6, ReplicationFactor: 1}}))
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "second", Layout: Layout{Chunks: 6, ReplicationFactor: 1}}))
+
+	_, err := chunker.SplitToChunks("first/same/key", 9000, storages)
+	require.NoError(t, err)
+	_, err = chunker.SplitToChunks("second/same/key", 9000, storages)
+	require.NoError(t, err)
+
+	chunker.DeleteChunks("first/same/key")
+	_, err = chunker.ChunksToRestore("second/same/key")
+	assert.NoError(t, err)
+}
+
+func TestBucketQuota(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "small", Layout: Layout{Chunks: 3, ReplicationFactor: 2}, QuotaBytes: 10000}))
+
+	_, err := chunker.SplitToChunks("small/first", 6000, storages)
+	require.NoError(t, err)
+	_, err = chunker.SplitToChunks("small/second", 6000, storages)
+	assert.ErrorIs(t, err, ErrBucketQuotaExceeded)
+	_, err = chunker.AppendChunk("small/stream", 0, 6000, storages)
+	assert.ErrorIs(t, err, ErrBucketQuotaExceeded)
+
+	info, err := chunker.StatBucket("small")
+	require.NoError(t, err)
+	assert.EqualValues(t, 6000, info.UsedBytes)
+	assert.Equal(t, 1, info.Files)
+
+	chunker.DeleteChunks("small/first")
+	_, err = chunker.SplitToChunks("small/second", 6000, storages)
+	require.NoError(t, err)
+}
+
+func TestDeleteBucket(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "photos", Layout: Layout{Chunks: 6, ReplicationFactor: 1}}))
+	_, err := chunker.SplitToChunks("photos/cat.jpg", 9000, storages)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, chunker.DeleteBucket("photos"), ErrBucketNotEmpty)
+	assert.ErrorIs(t, chunker.DeleteBucket(DefaultBucket), ErrDefaultBucket)
+	assert.ErrorIs(t, chunker.DeleteBucket("missing"), ErrBucketNotFound)
+
+	chunker.DeleteChunks("photos/cat.jpg")
+	require.NoError(t, chunker.DeleteBucket("photos"))
+	_, err = chunker.StatBucket("photos")
+	assert.ErrorIs(t, err, ErrBucketNotFound)
+	chunks, err := chunker.SplitToChunks("photos/cat.jpg", 9000, storages)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 6, "the key goes to the default bucket once the bucket is gone")
+}
@@ -2,13 +2,106 @@ package chunkmaster
 
 import (
 	"errors"
+	"fmt"
+	"time"
+)
+
+type ChunkRole int
+
+const (
+	ChunkRoleData ChunkRole = iota
+	// ChunkRoleParity is a Reed-Solomon parity shard. It does not have any original file data
+	ChunkRoleParity
 )
 
 type Chunk struct {
-	Order             uint32
-	StorageInstance   string
+	Order uint32
+	Role  ChunkRole
+	// Replicas are storage instances which keep a copy of the chunk. All of them are distinct
+	Replicas          []string
 	OriginalFileStart int64
-	Size              int64
+	// Size is the number of stored bytes. Erasure coded chunks are padded with zeroes, so all of them have the same size.
+	// A compressed or encrypted chunk keeps LogicalSize bytes of the file in Size bytes
+	Size int64
+	// FileSize is the size of the whole original file. It is UnknownFileSize while the file is being streamed
+	FileSize int64
+	// Checksum is SHA-256 of the stored chunk. It is known only after the chunk has been stored
+	Checksum []byte
+	// FileCreated is the time when the file has been started to be stored
+	FileCreated time.Time
+	// FileChecksum is SHA-256 of the whole original file. It is known only after the file has been stored
+	FileChecksum []byte
+	// ContentID is set for chunks of deduplicated files. Such a chunk is stored once under its content and shared by every file
+	// which has the same data, so its Replicas and Checksum are those of the content
+	ContentID string `json:",omitempty"`
+	// Codec is the compression of the stored data, empty for data stored as it is
+	Codec       string `json:",omitempty"`
+	LogicalSize int64  `json:",omitempty"`
+	// Nonce is set for encrypted chunks, every chunk has its own one. The data key of the file is the same for all its chunks,
+	// it is kept wrapped with the master key MasterKeyID
+	Nonce       []byte `json:",omitempty"`
+	WrappedKey  []byte `json:",omitempty"`
+	MasterKeyID string `json:",omitempty"`
+}
+
+// UnknownFileSize marks chunks of a file which is still being streamed
+const UnknownFileSize int64 = -1
+
+// DataSize is the number of original file bytes in the chunk, i.e. without erasure coding padding
+func (c Chunk) DataSize() int64 {
+	if c.Role == ChunkRoleParity {
+		return 0
+	}
+	return max(0, min(c.plainSize(), c.FileSize-c.OriginalFileStart))
+}
+
+func (c Chunk) Encrypted() bool {
+	return len(c.Nonce) > 0
+}
+
+// plainSize is the number of bytes the chunk has before compression and encryption.
+// LogicalSize is set for every chunk which has been placed with AppendCompressedChunk, whatever has become of its data
+func (c Chunk) plainSize() int64 {
+	if c.Codec != "" || c.LogicalSize > 0 {
+		return c.LogicalSize
+	}
+	return c.Size
+}
+
+// Layout describes how a file is split and spread among storages
+type Layout struct {
+	// Chunks is the number of chunks a file is split to. With erasure coding it includes parity chunks
+	Chunks int
+	// ReplicationFactor is the number of copies of every chunk
+	ReplicationFactor int
+	// ParityChunks turns on Reed-Solomon erasure coding: the last ParityChunks chunks are parity,
+	// and any Chunks-ParityChunks chunks are enough to restore the file
+	ParityChunks int
+	// Dedup cuts files into chunks by their content instead of Chunks equal parts, so data which is stored already is not stored again
+	Dedup bool
+}
+
+func (l Layout) DataChunks() int {
+	return l.Chunks - l.ParityChunks
+}
+
+func (l Layout) Validate() error {
+	if l.Chunks <= 0 {
+		return fmt.Errorf("number of chunks must be positive, got %d", l.Chunks)
+	}
+	if l.ReplicationFactor <= 0 {
+		return fmt.Errorf("replication factor must be positive, got %d", l.ReplicationFactor)
+	}
+	if l.ParityChunks < 0 || l.ParityChunks >= l.Chunks {
+		return fmt.Errorf("number of parity chunks must be in [0, %d), got %d", l.Chunks, l.ParityChunks)
+	}
+	if l.ParityChunks > 0 && l.ReplicationFactor > 1 {
+		return errors.New("erasure coding and replication cannot be used together")
+	}
+	if l.ParityChunks > 0 && l.Dedup {
+		return errors.New("erasure coding and deduplication cannot be used together")
+	}
+	return nil
 }
 
 var (
@@ -16,17 +109,106 @@ var (
 	ErrFileNotFound  = errors.New("not found")
 
 	ErrNotEnoughStorageNodes     = errors.New("not enough storage nodes")
+	ErrChunksMismatch            = errors.New("chunks do not match the stored ones")
 	ErrNotEnoughAvailableStorage = errors.New("not enough free space")
+	ErrStreamingNotSupported     = errors.New("erasure coding needs the file size in advance")
+	ErrPreconditionFailed        = errors.New("precondition failed")
 )
 
+// FileInfo describes a stored file as a whole
+type FileInfo struct {
+	Fileref string
+	// VersionID is set for files of buckets with versioning and for files which have been replaced
+	VersionID string
+	Size      int64
+	Created   time.Time
+	Checksum  []byte
+}
+
+// fileInfoOf describes a file by its catalog entry, a version is described as the file it belongs to
+func fileInfoOf(catalogFileref string, chunks []Chunk) FileInfo {
+	fileref, versionID := SplitVersionFileref(catalogFileref)
+	info := FileInfo{Fileref: fileref, VersionID: versionID}
+	if len(chunks) > 0 {
+		info.Size = chunks[0].FileSize
+		info.Created = chunks[0].FileCreated
+		info.Checksum = append([]byte(nil), chunks[0].FileChecksum...)
+	}
+	return info
+}
+
 type StorageInfo struct {
 	StorageID      string
 	AvailableBytes int64
+	Labels         Labels
 }
 
 type ChunkMaster interface {
 	// splitting functionality
 	SplitToChunks(fileref string, size int64, storages map[string]StorageInfo) ([]Chunk, error)
 	ChunksToRestore(fileref string) ([]Chunk, error)
+	// UpdateChunks replaces chunk information after it has been stored, e.g. when some of replicas failed. Chunk order and sizes must stay the same
+	UpdateChunks(fileref string, chunks []Chunk) error
+	// MoveReplica replaces the replica of a chunk on storage from with the one on storage to in a single step. It fails with ErrChunksMismatch
+	// if the chunk is not on from any more, is on to already or has another checksum, i.e. when the file has changed meanwhile
+	MoveReplica(fileref string, order uint32, from, to string, checksum []byte) error
 	DeleteChunks(fileref string)
+	// RewrapDataKey replaces the wrapped data key of an encrypted file. It fails with ErrChunksMismatch if the file has another wrapped key
+	// than previous, i.e. when it has been rewrapped or stored again meanwhile
+	RewrapDataKey(fileref string, previous []byte, masterKeyID string, wrappedKey []byte) error
+	// ForEachFile calls fn for every stored file until fn returns false. fn must not call the ChunkMaster
+	ForEachFile(fn func(fileref string, chunks []Chunk) bool)
+	// StatFile describes a stored file. Files which are being streamed are not visible yet, the same as for ChunksToRestore
+	StatFile(fileref string) (FileInfo, error)
+	// ListFiles gives up to limit files of the bucket which keys start with prefix, ordered by key and starting right after key after
+	ListFiles(bucket, prefix, after string, limit int) []FileInfo
+
+	// buckets functionality. DefaultBucket always exists and cannot be created or deleted
+	CreateBucket(bucket Bucket) error
+	// DeleteBucket deletes only an empty bucket
+	DeleteBucket(name string) error
+	StatBucket(name string) (BucketInfo, error)
+	// Buckets gives all buckets ordered by name, DefaultBucket included
+	Buckets() []BucketInfo
+
+	// streaming functionality, for files which size is not known in advance.
+	// AppendChunk places the next chunk of at most size bytes. order 0 starts the stream, so it fails with ErrFileDuplicate if the file exists.
+	// A streamed file cannot be restored until FinishStream replaces its chunks with the stored ones, where the last chunk may be shorter
+	AppendChunk(fileref string, order uint32, size int64, storages map[string]StorageInfo) (Chunk, error)
+	// AppendCompressedChunk is AppendChunk for a chunk which keeps logicalSize bytes of the file compressed with codec, encrypted or both, in size bytes.
+	// Such chunks are placed only when their data is ready, so the last one never becomes shorter
+	AppendCompressedChunk(fileref string, order uint32, codec string, logicalSize, size int64, storages map[string]StorageInfo) (Chunk, error)
+	FinishStream(fileref string, chunks []Chunk) error
+
+	// deduplication functionality.
+	// AppendContentChunk is AppendChunk for a chunk of a deduplicated file. If the content is stored already, the chunk refers to it
+	// and true is returned, so the data must not be sent. Otherwise the content is placed and its data must be stored by the caller.
+	// Content which is being stored by another file or is about to be deleted cannot be shared, so the chunk gets its own copy without ContentID
+	AppendContentChunk(fileref string, order uint32, contentID string, size int64, storages map[string]StorageInfo) (Chunk, bool, error)
+	// GarbageContents gives contents which no file refers to any more, their data has to be deleted from replicas
+	GarbageContents() []Content
+	// ForgetContent removes garbage content from the catalog after its data has been deleted
+	ForgetContent(contentID string) error
+	DedupStats() DedupStats
+
+	// versioning functionality, for buckets with Versioning enabled. Data of every version is a file of its own under VersionFileref,
+	// so it is stored, repaired and moved as any other file, and it becomes a version only when it is published.
+	// PublishVersion makes the version current. Its data must be stored already, unless it is a tombstone, which needs a current version to delete
+	PublishVersion(fileref string, version Version) error
+	// ReplaceFile atomically makes the data stored under VersionFileref the current data of the file, if the condition holds for the current file.
+	// In a bucket with versioning it is a new version. Otherwise it is the only version of the file, and the catalog fileref which has kept
+	// the replaced data is returned, so the caller can delete the data once nobody reads it
+	ReplaceFile(fileref string, version Version, condition Condition) (string, error)
+	// ResolveVersion gives the catalog fileref which keeps the data of the version, or of the current version if versionID is empty.
+	// A file of a bucket without versioning is its own catalog fileref. A tombstone is ErrFileNotFound
+	ResolveVersion(fileref, versionID string) (string, error)
+	// Versions gives versions of the file from the oldest to the current one, tombstones included
+	Versions(fileref string) ([]Version, error)
+	// RemoveVersion forgets the version. The data of the version has to be deleted by the caller
+	RemoveVersion(fileref, versionID string) (Version, error)
+	// ExpiredVersions gives versions which are not kept by the retention policies of their buckets any more
+	ExpiredVersions(now time.Time) []FileVersion
+
+	// SetPlacementPolicy changes how chunks of new files are spread among storages. SpreadDomains is used by default
+	SetPlacementPolicy(policy PlacementPolicy)
 }
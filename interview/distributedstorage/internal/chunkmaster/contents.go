@@ -0,0 +1,199 @@
+package chunkmaster
+
+// Content is data of deduplicated chunks. It is stored once, whichever files have it
+type Content struct {
+	// ID is hex SHA-256 of the data
+	ID       string
+	Size     int64
+	Replicas []string
+	// Checksum is known only after the content has been stored
+	Checksum []byte
+}
+
+type contentEntry struct {
+	Content
+	// refs is the number of chunks in the catalog which have the content. Content without refs is garbage
+	refs int
+	// storer is the file which is storing the content for the first time. Only it may refer to the content until it is stored
+	storer string
+}
+
+// DedupStats describes how much space deduplication saves
+type DedupStats struct {
+	// LogicalBytes is the size of deduplicated chunks of all files, as if every file had its own copy
+	LogicalBytes int64
+	// StoredBytes is the size of distinct contents, every replica counted once
+	StoredBytes int64
+	Contents    int
+	// GarbageContents are not referred to any more, but their data has not been deleted yet
+	GarbageContents int
+}
+
+// Ratio is how many times deduplicated data is smaller than it would be without deduplication
+func (s DedupStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.StoredBytes)
+}
+
+func (cm *TemporaryChunkMaster) AppendContentChunk(fileref string, order uint32, contentID string, size int64, storages map[string]StorageInfo) (Chunk, bool, error) {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	entry, found := cm.contents[contentID]
+	if found && entry.refs > 0 && entry.Size == size && (len(entry.Checksum) > 0 || entry.storer == fileref) {
+		chunk, err := cm.appendChunk(fileref, order, size, func(bucket Bucket, chunk *Chunk) error {
+			chunk.ContentID = contentID
+			chunk.Replicas = append([]string(nil), entry.Replicas...)
+			chunk.Checksum = append([]byte(nil), entry.Checksum...)
+			// nothing is going to be stored, so only the quota matters
+			return cm.checkQuota(bucket, size)
+		})
+		return chunk, true, err
+	}
+
+	chunk, err := cm.appendChunk(fileref, order, size, func(bucket Bucket, chunk *Chunk) error {
+		if err := cm.placeChunk(fileref, bucket, chunk, storages); err != nil {
+			return err
+		}
+		if !found {
+			chunk.ContentID = contentID
+		}
+		return nil
+	})
+	if err != nil {
+		return Chunk{}, false, err
+	}
+	if chunk.ContentID != "" {
+		entry = cm.contents[contentID]
+		entry.Replicas = append([]string(nil), chunk.Replicas...)
+		entry.storer = fileref
+	}
+	return chunk, false, nil
+}
+
+func (cm *TemporaryChunkMaster) GarbageContents() []Content {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+	var garbage []Content
+	for _, entry := range cm.contents {
+		if entry.refs == 0 {
+			garbage = append(garbage, cloneContent(entry.Content))
+		}
+	}
+	return garbage
+}
+
+func (cm *TemporaryChunkMaster) ForgetContent(contentID string) error {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	cm.forgetContent(contentID)
+	return nil
+}
+
+// forgetContent must be called with chunkMutex held. Content which is referred to again is kept
+func (cm *TemporaryChunkMaster) forgetContent(contentID string) {
+	if entry, found := cm.contents[contentID]; found && entry.refs == 0 {
+		delete(cm.contents, contentID)
+	}
+}
+
+func (cm *TemporaryChunkMaster) DedupStats() DedupStats {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+	var stats DedupStats
+	for _, entry := range cm.contents {
+		if entry.refs == 0 {
+			stats.GarbageContents++
+			continue
+		}
+		stats.Contents++
+		stats.LogicalBytes += int64(entry.refs) * entry.Size
+		stats.StoredBytes += entry.Size
+	}
+	return stats
+}
+
+// refContents counts chunks which come to the catalog and leave it. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) refContents(chunks []Chunk, delta int) {
+	for _, chunk := range chunks {
+		if chunk.ContentID == "" {
+			continue
+		}
+		entry, found := cm.contents[chunk.ContentID]
+		if !found {
+			entry = &contentEntry{Content: Content{ID: chunk.ContentID, Size: chunk.Size}}
+			cm.contents[chunk.ContentID] = entry
+		}
+		entry.refs += delta
+		if entry.refs == 0 {
+			// the file which has been storing the content is gone
+			entry.storer = ""
+		}
+	}
+}
+
+// resolveContents gives chunks replicas and checksums of their contents. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) resolveContents(chunks []Chunk) {
+	for i, chunk := range chunks {
+		if entry, found := cm.contents[chunk.ContentID]; found {
+			chunks[i].Replicas = append([]string(nil), entry.Replicas...)
+			chunks[i].Checksum = append([]byte(nil), entry.Checksum...)
+		}
+	}
+}
+
+// updateContents takes replicas and checksums of chunks as those of their contents. Content which is still being stored
+// is changed only by FinishStream. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) updateContents(chunks []Chunk) {
+	for _, chunk := range chunks {
+		if entry, found := cm.contents[chunk.ContentID]; found && entry.storer == "" {
+			entry.Replicas = append([]string(nil), chunk.Replicas...)
+			entry.Checksum = append([]byte(nil), chunk.Checksum...)
+		}
+	}
+}
+
+// finishContents takes replicas and checksums of contents which the file has stored, so other files can refer to them from now on.
+// Replicas of contents which have been stored by others stay as they are, chunks have only seen them at some moment.
+// It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) finishContents(fileref string, chunks []Chunk) {
+	for _, chunk := range chunks {
+		if entry, found := cm.contents[chunk.ContentID]; found && entry.storer == fileref {
+			entry.Replicas = append([]string(nil), chunk.Replicas...)
+			entry.Checksum = append([]byte(nil), chunk.Checksum...)
+			entry.storer = ""
+		}
+	}
+}
+
+// contentsOf gives contents which chunks refer to. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) contentsOf(chunks []Chunk) []Content {
+	var contents []Content
+	for _, chunk := range chunks {
+		if entry, found := cm.contents[chunk.ContentID]; found {
+			contents = append(contents, cloneContent(entry.Content))
+		}
+	}
+	return contents
+}
+
+// putContents sets contents as they have been saved, keeping their refs. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) putContents(contents []Content) {
+	for _, content := range contents {
+		entry, found := cm.contents[content.ID]
+		if !found {
+			entry = &contentEntry{}
+			cm.contents[content.ID] = entry
+		}
+		entry.Content = cloneContent(content)
+	}
+}
+
+func cloneContent(content Content) Content {
+	content.Replicas = append([]string(nil), content.Replicas...)
+	content.Checksum = append([]byte(nil), content.Checksum...)
+	return content
+}
@@ -0,0 +1,80 @@
+package chunkmaster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeContentFile appends chunks with the given contents to fileref and finishes it as if every new content has been stored
+func storeContentFile(t *testing.T, cm ChunkMaster, fileref string, contentIDs []string, storages map[string]StorageInfo) []bool {
+	var (
+		chunks     []Chunk
+		duplicates []bool
+	)
+	for i, contentID := range contentIDs {
+		chunk, duplicate, err := cm.AppendContentChunk(fileref, uint32(i), contentID, 100, storages)
+		require.NoError(t, err)
+		if !duplicate {
+			chunk.Checksum = []byte(contentID)
+		}
+		chunks = append(chunks, chunk)
+		duplicates = append(duplicates, duplicate)
+	}
+	require.NoError(t, cm.FinishStream(fileref, chunks))
+	return duplicates
+}
+
+func TestContentRefs(t *testing.T) {
+	cm, storages := newReadyForTestTmpChunker(1)
+	assert.Equal(t, []bool{false, false, true}, storeContentFile(t, cm, "a", []string{"x", "y", "x"}, storages), "a file may share content with itself")
+	assert.Equal(t, []bool{true, false}, storeContentFile(t, cm, "b", []string{"y", "z"}, storages))
+	assert.Equal(t, DedupStats{LogicalBytes: 500, StoredBytes: 300, Contents: 3}, cm.DedupStats())
+
+	a, err := cm.ChunksToRestore("a")
+	require.NoError(t, err)
+	b, err := cm.ChunksToRestore("b")
+	require.NoError(t, err)
+	assert.Equal(t, a[1].Replicas, b[0].Replicas)
+	assert.Equal(t, []byte("y"), b[0].Checksum)
+
+	// a shared chunk moves for every file
+	require.NoError(t, cm.MoveReplica("b", 0, b[0].Replicas[0], "new-storage", []byte("y")))
+	a, err = cm.ChunksToRestore("a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new-storage"}, a[1].Replicas)
+
+	cm.DeleteChunks("a")
+	garbage := cm.GarbageContents()
+	require.Len(t, garbage, 1)
+	assert.Equal(t, "x", garbage[0].ID)
+	require.NoError(t, cm.ForgetContent("x"))
+	assert.Empty(t, cm.GarbageContents())
+	assert.Equal(t, DedupStats{LogicalBytes: 200, StoredBytes: 200, Contents: 2}, cm.DedupStats())
+}
+
+func TestContentBeingStoredIsNotShared(t *testing.T) {
+	cm, storages := newReadyForTestTmpChunker(1)
+	_, duplicate, err := cm.AppendContentChunk("a", 0, "x", 100, storages)
+	require.NoError(t, err)
+	assert.False(t, duplicate)
+
+	chunk, duplicate, err := cm.AppendContentChunk("b", 0, "x", 100, storages)
+	require.NoError(t, err)
+	assert.False(t, duplicate)
+	assert.Empty(t, chunk.ContentID, "the chunk gets its own copy")
+
+	// the file which has been storing the content is gone, so the content is garbage which nobody may share
+	cm.DeleteChunks("a")
+	assert.Len(t, cm.GarbageContents(), 1)
+	chunk, duplicate, err = cm.AppendContentChunk("c", 0, "x", 100, storages)
+	require.NoError(t, err)
+	assert.False(t, duplicate)
+	assert.Empty(t, chunk.ContentID)
+}
+
+func TestDedupCannotBeErasureCoded(t *testing.T) {
+	assert.Error(t, Layout{Chunks: 3, ReplicationFactor: 1, ParityChunks: 1, Dedup: true}.Validate())
+	assert.NoError(t, Layout{Chunks: 3, ReplicationFactor: 2, Dedup: true}.Validate())
+}
@@ -0,0 +1,581 @@
+package chunkmaster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+)
+
+const (
+	walFilename      = "catalog.wal"
+	snapshotFilename = "catalog.snapshot"
+)
+
+// PersistentChunkMaster keeps the same catalog as TemporaryChunkMaster, but every change is written to an append-only log before it is acknowledged.
+// The log is compacted into a snapshot every snapshotEvery records. On start the snapshot is loaded and the log is replayed on top of it
+type PersistentChunkMaster struct {
+	*TemporaryChunkMaster
+
+	dir                  string
+	walMutex             sync.Mutex
+	wal                  *writeAheadLog
+	snapshotEvery        int
+	recordsSinceSnapshot int
+}
+
+var _ ChunkMaster = (*PersistentChunkMaster)(nil)
+
+type catalogSnapshot struct {
+	Catalog  map[string][]Chunk   `json:"catalog"`
+	Buckets  map[string]Bucket    `json:"buckets,omitempty"`
+	Contents []Content            `json:"contents,omitempty"`
+	Versions map[string][]Version `json:"versions,omitempty"`
+}
+
+func NewPersistentChunkMaster(dir string, layout Layout, snapshotEvery int) (*PersistentChunkMaster, error) {
+	if snapshotEvery <= 0 {
+		return nil, fmt.Errorf("snapshot interval must be positive, got %d", snapshotEvery)
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create catalog dir: %w", err)
+	}
+
+	pcm := &PersistentChunkMaster{
+		TemporaryChunkMaster: newTemporaryChunkMaster(layout),
+		dir:                  dir,
+		snapshotEvery:        snapshotEvery,
+	}
+	err = pcm.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	pcm.wal, err = openWriteAheadLog(path.Join(dir, walFilename))
+	if err != nil {
+		return nil, err
+	}
+	replayed, err := pcm.wal.replay(pcm.applyRecord)
+	if err != nil {
+		pcm.wal.close()
+		return nil, fmt.Errorf("wal replay failed: %w", err)
+	}
+	pcm.recordsSinceSnapshot = replayed
+	pcm.dropUnfinishedStreams()
+	slog.Info("catalog restored", "dir", dir, "files", len(pcm.chunkCatalog), "wal_records", replayed)
+	return pcm, nil
+}
+
+func (pcm *PersistentChunkMaster) SplitToChunks(fileref string, size int64, storages map[string]StorageInfo) ([]Chunk, error) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	chunks, err := pcm.TemporaryChunkMaster.SplitToChunks(fileref, size, storages)
+	if err != nil {
+		return nil, err
+	}
+	err = pcm.appendRecord(walRecord{Op: walOpSplit, Fileref: fileref, Chunks: chunks})
+	if err != nil {
+		pcm.TemporaryChunkMaster.DeleteChunks(fileref)
+		return nil, fmt.Errorf("cannot persist chunks of %s: %w", fileref, err)
+	}
+	return chunks, nil
+}
+
+func (pcm *PersistentChunkMaster) UpdateChunks(fileref string, chunks []Chunk) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, found := pcm.fileState(fileref)
+	if !found {
+		return ErrFileNotFound
+	}
+	err := pcm.TemporaryChunkMaster.UpdateChunks(fileref, chunks)
+	if err != nil {
+		return err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpUpdate, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, previous)
+		return fmt.Errorf("cannot persist chunks update of %s: %w", fileref, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) MoveReplica(fileref string, order uint32, from, to string, checksum []byte) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, found := pcm.fileState(fileref)
+	if !found {
+		return ErrFileNotFound
+	}
+	err := pcm.TemporaryChunkMaster.MoveReplica(fileref, order, from, to, checksum)
+	if err != nil {
+		return err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpUpdate, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, previous)
+		return fmt.Errorf("cannot persist replica move of %s: %w", fileref, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) RewrapDataKey(fileref string, previous []byte, masterKeyID string, wrappedKey []byte) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	file, found := pcm.fileState(fileref)
+	if !found {
+		return ErrFileNotFound
+	}
+	err := pcm.TemporaryChunkMaster.RewrapDataKey(fileref, previous, masterKeyID, wrappedKey)
+	if err != nil {
+		return err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpUpdate, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, file)
+		return fmt.Errorf("cannot persist data key of %s: %w", fileref, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) DeleteChunks(fileref string) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, found := pcm.fileState(fileref)
+	if !found {
+		return
+	}
+	pcm.TemporaryChunkMaster.DeleteChunks(fileref)
+	err := pcm.appendRecord(walRecord{Op: walOpDelete, Fileref: fileref})
+	if err != nil {
+		// the deletion is not durable, so keep the catalog consistent with what we'll see after restart
+		pcm.restoreFile(fileref, previous)
+		slog.Error("cannot persist chunks deletion", "fileref", fileref, "err", err)
+	}
+}
+
+func (pcm *PersistentChunkMaster) AppendChunk(fileref string, order uint32, size int64, storages map[string]StorageInfo) (Chunk, error) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, _ := pcm.fileState(fileref)
+	chunk, err := pcm.TemporaryChunkMaster.AppendChunk(fileref, order, size, storages)
+	if err != nil {
+		return Chunk{}, err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpAppend, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, previous)
+		return Chunk{}, fmt.Errorf("cannot persist chunk %d of %s: %w", order, fileref, err)
+	}
+	return chunk, nil
+}
+
+func (pcm *PersistentChunkMaster) AppendCompressedChunk(fileref string, order uint32, codec string, logicalSize, size int64, storages map[string]StorageInfo) (Chunk, error) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, _ := pcm.fileState(fileref)
+	chunk, err := pcm.TemporaryChunkMaster.AppendCompressedChunk(fileref, order, codec, logicalSize, size, storages)
+	if err != nil {
+		return Chunk{}, err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpAppend, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, previous)
+		return Chunk{}, fmt.Errorf("cannot persist chunk %d of %s: %w", order, fileref, err)
+	}
+	return chunk, nil
+}
+
+func (pcm *PersistentChunkMaster) AppendContentChunk(fileref string, order uint32, contentID string, size int64, storages map[string]StorageInfo) (Chunk, bool, error) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, _ := pcm.fileState(fileref)
+	known := pcm.hasContent(contentID)
+	chunk, duplicate, err := pcm.TemporaryChunkMaster.AppendContentChunk(fileref, order, contentID, size, storages)
+	if err != nil {
+		return Chunk{}, false, err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpAppend, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, previous)
+		if !known {
+			pcm.TemporaryChunkMaster.ForgetContent(contentID)
+		}
+		return Chunk{}, false, fmt.Errorf("cannot persist chunk %d of %s: %w", order, fileref, err)
+	}
+	return chunk, duplicate, nil
+}
+
+func (pcm *PersistentChunkMaster) ForgetContent(contentID string) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+
+	content, found := pcm.garbageContent(contentID)
+	if !found {
+		return nil
+	}
+	// the catalog is changed first, so a snapshot written together with the record already has no content
+	pcm.TemporaryChunkMaster.ForgetContent(contentID)
+	err := pcm.appendRecord(walRecord{Op: walOpForgetContent, Contents: []Content{{ID: contentID}}})
+	if err != nil {
+		pcm.chunkMutex.Lock()
+		pcm.putContents([]Content{content})
+		pcm.chunkMutex.Unlock()
+		return fmt.Errorf("cannot persist forgetting of content %s: %w", contentID, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) FinishStream(fileref string, chunks []Chunk) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, found := pcm.fileState(fileref)
+	if !found {
+		return ErrFileNotFound
+	}
+	err := pcm.TemporaryChunkMaster.FinishStream(fileref, chunks)
+	if err != nil {
+		return err
+	}
+	err = pcm.appendRecord(pcm.fileRecord(walOpUpdate, fileref))
+	if err != nil {
+		pcm.restoreFile(fileref, previous)
+		return fmt.Errorf("cannot persist finished stream %s: %w", fileref, err)
+	}
+	return nil
+}
+
+// storedFile is a catalog entry together with contents its chunks refer to
+type storedFile struct {
+	chunks   []Chunk
+	contents []Content
+}
+
+func (pcm *PersistentChunkMaster) fileState(fileref string) (storedFile, bool) {
+	pcm.chunkMutex.RLock()
+	defer pcm.chunkMutex.RUnlock()
+	chunks, found := pcm.chunkCatalog[fileref]
+	if !found {
+		return storedFile{}, false
+	}
+	return storedFile{chunks: cloneChunks(chunks), contents: pcm.contentsOf(chunks)}, true
+}
+
+// fileRecord gives the record with the catalog entry of the file as it is now
+func (pcm *PersistentChunkMaster) fileRecord(op walOp, fileref string) walRecord {
+	file, _ := pcm.fileState(fileref)
+	return walRecord{Op: op, Fileref: fileref, Chunks: file.chunks, Contents: file.contents}
+}
+
+// restoreFile puts back the catalog entry which was there before a change which has not been persisted
+func (pcm *PersistentChunkMaster) restoreFile(fileref string, file storedFile) {
+	pcm.chunkMutex.Lock()
+	defer pcm.chunkMutex.Unlock()
+	pcm.putContents(file.contents)
+	if len(file.chunks) == 0 {
+		pcm.removeChunks(fileref)
+		return
+	}
+	pcm.setChunks(fileref, cloneChunks(file.chunks))
+}
+
+func (pcm *PersistentChunkMaster) hasContent(contentID string) bool {
+	pcm.chunkMutex.RLock()
+	defer pcm.chunkMutex.RUnlock()
+	_, found := pcm.contents[contentID]
+	return found
+}
+
+// garbageContent gives the content if no file refers to it
+func (pcm *PersistentChunkMaster) garbageContent(contentID string) (Content, bool) {
+	pcm.chunkMutex.RLock()
+	defer pcm.chunkMutex.RUnlock()
+	entry, found := pcm.contents[contentID]
+	if !found || entry.refs > 0 {
+		return Content{}, false
+	}
+	return cloneContent(entry.Content), true
+}
+
+// dropUnfinishedStreams forgets files which were being streamed when we stopped. Nobody is going to finish them,
+// and their chunks which have been stored already are left on storages
+func (pcm *PersistentChunkMaster) dropUnfinishedStreams() {
+	for fileref, chunks := range pcm.chunkCatalog {
+		if !isStreaming(chunks) {
+			continue
+		}
+		slog.Warn("dropping unfinished stream", "fileref", fileref, "chunks", len(chunks))
+		pcm.DeleteChunks(fileref)
+	}
+}
+
+func (pcm *PersistentChunkMaster) CreateBucket(bucket Bucket) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+
+	err := pcm.TemporaryChunkMaster.CreateBucket(bucket)
+	if err != nil {
+		return err
+	}
+	created, _ := pcm.TemporaryChunkMaster.StatBucket(bucket.Name)
+	err = pcm.appendRecord(walRecord{Op: walOpCreateBucket, Bucket: &created.Bucket})
+	if err != nil {
+		pcm.TemporaryChunkMaster.DeleteBucket(bucket.Name)
+		return fmt.Errorf("cannot persist bucket %s: %w", bucket.Name, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) DeleteBucket(name string) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+
+	previous, err := pcm.TemporaryChunkMaster.StatBucket(name)
+	if err != nil {
+		return err
+	}
+	previousVersions := pcm.versionsOfBucket(name)
+	err = pcm.TemporaryChunkMaster.DeleteBucket(name)
+	if err != nil {
+		return err
+	}
+	err = pcm.appendRecord(walRecord{Op: walOpDeleteBucket, Bucket: &Bucket{Name: name}})
+	if err != nil {
+		pcm.TemporaryChunkMaster.CreateBucket(previous.Bucket)
+		pcm.restoreVersions(previousVersions)
+		return fmt.Errorf("cannot persist bucket %s deletion: %w", name, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) PublishVersion(fileref string, version Version) error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, _ := pcm.TemporaryChunkMaster.Versions(fileref)
+	err := pcm.TemporaryChunkMaster.PublishVersion(fileref, version)
+	if err != nil {
+		return err
+	}
+	err = pcm.appendRecord(pcm.versionsRecord(fileref))
+	if err != nil {
+		pcm.restoreVersions(map[string][]Version{fileref: previous})
+		return fmt.Errorf("cannot persist version of %s: %w", fileref, err)
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) ReplaceFile(fileref string, version Version, condition Condition) (string, error) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, _ := pcm.TemporaryChunkMaster.Versions(fileref)
+	replaced, err := pcm.TemporaryChunkMaster.ReplaceFile(fileref, version, condition)
+	if err != nil {
+		return "", err
+	}
+	err = pcm.appendRecord(pcm.versionsRecord(fileref))
+	if err != nil {
+		pcm.restoreVersions(map[string][]Version{fileref: previous})
+		return "", fmt.Errorf("cannot persist replacement of %s: %w", fileref, err)
+	}
+	return replaced, nil
+}
+
+func (pcm *PersistentChunkMaster) RemoveVersion(fileref, versionID string) (Version, error) {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	fileref = pcm.resolveFileref(fileref)
+
+	previous, _ := pcm.TemporaryChunkMaster.Versions(fileref)
+	removed, err := pcm.TemporaryChunkMaster.RemoveVersion(fileref, versionID)
+	if err != nil {
+		return Version{}, err
+	}
+	err = pcm.appendRecord(pcm.versionsRecord(fileref))
+	if err != nil {
+		pcm.restoreVersions(map[string][]Version{fileref: previous})
+		return Version{}, fmt.Errorf("cannot persist version removal of %s: %w", fileref, err)
+	}
+	return removed, nil
+}
+
+// versionsRecord carries all versions of the file, an empty list forgets the file. It must be called with walMutex held
+func (pcm *PersistentChunkMaster) versionsRecord(fileref string) walRecord {
+	versions, _ := pcm.TemporaryChunkMaster.Versions(fileref)
+	return walRecord{Op: walOpVersions, Fileref: fileref, Versions: versions}
+}
+
+func (pcm *PersistentChunkMaster) versionsOfBucket(name string) map[string][]Version {
+	pcm.chunkMutex.RLock()
+	defer pcm.chunkMutex.RUnlock()
+	res := make(map[string][]Version)
+	for fileref, versions := range pcm.versions {
+		if bucket, _ := SplitFileref(fileref); bucket == name {
+			res[fileref] = versions
+		}
+	}
+	return res
+}
+
+func (pcm *PersistentChunkMaster) restoreVersions(versions map[string][]Version) {
+	pcm.chunkMutex.Lock()
+	defer pcm.chunkMutex.Unlock()
+	for fileref, fileVersions := range versions {
+		pcm.setVersions(fileref, fileVersions)
+	}
+}
+
+func (pcm *PersistentChunkMaster) Close() error {
+	pcm.walMutex.Lock()
+	defer pcm.walMutex.Unlock()
+	return pcm.wal.close()
+}
+
+// applyRecord is used only during replay, when nobody else has access to the catalog yet
+func (pcm *PersistentChunkMaster) applyRecord(record walRecord) {
+	if record.Op != walOpForgetContent {
+		pcm.putContents(record.Contents)
+	}
+	switch record.Op {
+	case walOpSplit, walOpUpdate, walOpAppend:
+		pcm.setChunks(pcm.canonicalFileref(record.Fileref), record.Chunks)
+	case walOpDelete:
+		pcm.removeChunks(pcm.canonicalFileref(record.Fileref))
+	case walOpCreateBucket:
+		pcm.buckets[record.Bucket.Name] = *record.Bucket
+	case walOpDeleteBucket:
+		delete(pcm.buckets, record.Bucket.Name)
+		pcm.dropVersionsOfBucket(record.Bucket.Name)
+	case walOpVersions:
+		pcm.setVersions(pcm.canonicalFileref(record.Fileref), record.Versions)
+	case walOpForgetContent:
+		for _, content := range record.Contents {
+			pcm.forgetContent(content.ID)
+		}
+	default:
+		slog.Warn("unknown wal record skipped", "op", record.Op, "fileref", record.Fileref)
+	}
+}
+
+// appendRecord must be called with walMutex held
+func (pcm *PersistentChunkMaster) appendRecord(record walRecord) error {
+	err := pcm.wal.append(record)
+	if err != nil {
+		return err
+	}
+	pcm.recordsSinceSnapshot++
+	if pcm.recordsSinceSnapshot >= pcm.snapshotEvery {
+		// the record is already durable, so a failed snapshot only means a longer replay next time
+		if err := pcm.writeSnapshot(); err != nil {
+			slog.Error("catalog snapshot failed", "dir", pcm.dir, "err", err)
+		}
+	}
+	return nil
+}
+
+func (pcm *PersistentChunkMaster) loadSnapshot() error {
+	data, err := os.ReadFile(path.Join(pcm.dir, snapshotFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read catalog snapshot: %w", err)
+	}
+	var snapshot catalogSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("cannot decode catalog snapshot: %w", err)
+	}
+	for name, bucket := range snapshot.Buckets {
+		pcm.buckets[name] = bucket
+	}
+	pcm.putContents(snapshot.Contents)
+	// catalogs written before buckets appeared have slashed filerefs of the default bucket
+	for fileref, versions := range snapshot.Versions {
+		pcm.setVersions(pcm.canonicalFileref(fileref), versions)
+	}
+	for fileref, chunks := range snapshot.Catalog {
+		pcm.setChunks(pcm.canonicalFileref(fileref), chunks)
+	}
+	return nil
+}
+
+// writeSnapshot must be called with walMutex held. The snapshot replaces the previous one atomically via rename,
+// and only then the log is emptied. A crash in between is fine: replaying records over a snapshot which already has them gives the same catalog
+func (pcm *PersistentChunkMaster) writeSnapshot() error {
+	pcm.chunkMutex.RLock()
+	contents := make([]Content, 0, len(pcm.contents))
+	for _, entry := range pcm.contents {
+		contents = append(contents, entry.Content)
+	}
+	data, err := json.Marshal(catalogSnapshot{Catalog: pcm.chunkCatalog, Buckets: pcm.buckets, Contents: contents, Versions: pcm.versions})
+	pcm.chunkMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("cannot encode catalog: %w", err)
+	}
+
+	fullpath := path.Join(pcm.dir, snapshotFilename)
+	tmppath := fullpath + ".tmp"
+	f, err := os.Create(tmppath)
+	if err != nil {
+		return fmt.Errorf("cannot create snapshot: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return fmt.Errorf("cannot write snapshot: %w", err)
+	}
+	if err := os.Rename(tmppath, fullpath); err != nil {
+		return fmt.Errorf("cannot replace snapshot: %w", err)
+	}
+	if err := syncDir(pcm.dir); err != nil {
+		return err
+	}
+
+	if err := pcm.wal.reset(); err != nil {
+		return err
+	}
+	pcm.recordsSinceSnapshot = 0
+	slog.Info("catalog snapshot written", "dir", pcm.dir, "size", len(data))
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open dir for sync: %w", err)
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,348 @@
+package chunkmaster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newReadyForTestPersistentChunker(t *testing.T, dir string, snapshotEvery int) (*PersistentChunkMaster, map[string]StorageInfo) {
+	chunker, err := NewPersistentChunkMaster(dir, Layout{Chunks: 6, ReplicationFactor: 1}, snapshotEvery)
+	require.NoError(t, err)
+	return chunker, randomStorages(6)
+}
+
+func walSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(path.Join(dir, walFilename))
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestPersistentRestoreAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	chunksKept, err := chunker.SplitToChunks("kept-file", 9007, storages)
+	require.NoError(t, err)
+	_, err = chunker.SplitToChunks("deleted-file", 54623, storages)
+	require.NoError(t, err)
+	chunker.DeleteChunks("deleted-file")
+	require.NoError(t, chunker.Close())
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	chunksRestored, err := chunker.ChunksToRestore("kept-file")
+	require.NoError(t, err)
+	assert.EqualValues(t, chunksKept, chunksRestored)
+	_, err = chunker.ChunksToRestore("deleted-file")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestPersistentMoveReplica(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	chunks, err := chunker.SplitToChunks("file", 9007, storages)
+	require.NoError(t, err)
+	require.NoError(t, chunker.MoveReplica("file", 1, chunks[1].Replicas[0], "new-storage", nil))
+	require.NoError(t, chunker.Close())
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	restored, err := chunker.ChunksToRestore("file")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new-storage"}, restored[1].Replicas)
+}
+
+func TestPersistentRewrapDataKey(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	chunks, err := chunker.SplitToChunks("file", 9007, storages)
+	require.NoError(t, err)
+	for i := range chunks {
+		chunks[i].Nonce = []byte{byte(i)}
+		chunks[i].MasterKeyID = "old"
+		chunks[i].WrappedKey = []byte("wrapped with old")
+	}
+	require.NoError(t, chunker.UpdateChunks("file", chunks))
+	require.NoError(t, chunker.RewrapDataKey("file", []byte("wrapped with old"), "new", []byte("wrapped with new")))
+	require.NoError(t, chunker.Close())
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	restored, err := chunker.ChunksToRestore("file")
+	require.NoError(t, err)
+	for i, chunk := range restored {
+		assert.Equal(t, []byte{byte(i)}, chunk.Nonce)
+		assert.Equal(t, "new", chunk.MasterKeyID)
+		assert.Equal(t, []byte("wrapped with new"), chunk.WrappedKey)
+	}
+}
+
+func TestPersistentDuplicatesNotAllowedAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	_, err := chunker.SplitToChunks("same-path", 9007, storages)
+	require.NoError(t, err)
+	require.NoError(t, chunker.Close())
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	_, err = chunker.SplitToChunks("same-path", 1035, storages)
+	assert.ErrorIs(t, err, ErrFileDuplicate)
+}
+
+func TestPersistentRestoreFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 3)
+	for _, fileref := range []string{"a", "b", "c", "d"} {
+		_, err := chunker.SplitToChunks(fileref, 9007, storages)
+		require.NoError(t, err)
+	}
+	chunker.DeleteChunks("b")
+	require.NoError(t, chunker.Close())
+
+	_, err := os.Stat(path.Join(dir, snapshotFilename))
+	require.NoError(t, err, "snapshot is expected after 3 records")
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 3)
+	defer chunker.Close()
+	for _, fileref := range []string{"a", "c", "d"} {
+		_, err := chunker.ChunksToRestore(fileref)
+		assert.NoError(t, err, fileref)
+	}
+	_, err = chunker.ChunksToRestore("b")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestPersistentReplayOverSnapshotIsIdempotent(t *testing.T) {
+	// emulates a crash after the snapshot was renamed, but before the log was emptied
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	_, err := chunker.SplitToChunks("a", 9007, storages)
+	require.NoError(t, err)
+	_, err = chunker.SplitToChunks("b", 9007, storages)
+	require.NoError(t, err)
+	chunker.DeleteChunks("a")
+	walData, err := os.ReadFile(path.Join(dir, walFilename))
+	require.NoError(t, err)
+	chunker.walMutex.Lock()
+	require.NoError(t, chunker.writeSnapshot())
+	chunker.walMutex.Unlock()
+	require.NoError(t, chunker.Close())
+	require.NoError(t, os.WriteFile(path.Join(dir, walFilename), walData, 0o600))
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	_, err = chunker.ChunksToRestore("a")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, err = chunker.ChunksToRestore("b")
+	assert.NoError(t, err)
+}
+
+func TestPersistentCrashInTheMiddleOfRecord(t *testing.T) {
+	for name, cutBytes := range map[string]int64{
+		"payload": 5,
+		"header":  -3, // leaves only 3 bytes of the last record header
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+			chunksFirst, err := chunker.SplitToChunks("first", 9007, storages)
+			require.NoError(t, err)
+			sizeAfterFirst := walSize(t, dir)
+			_, err = chunker.SplitToChunks("second", 9007, storages)
+			require.NoError(t, err)
+			require.NoError(t, chunker.Close())
+
+			cutAt := walSize(t, dir) - cutBytes
+			if cutBytes < 0 {
+				cutAt = sizeAfterFirst - cutBytes
+			}
+			require.NoError(t, os.Truncate(path.Join(dir, walFilename), cutAt))
+
+			chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+			chunksRestored, err := chunker.ChunksToRestore("first")
+			require.NoError(t, err)
+			assert.EqualValues(t, chunksFirst, chunksRestored)
+			_, err = chunker.ChunksToRestore("second")
+			require.ErrorIs(t, err, ErrFileNotFound)
+			assert.EqualValues(t, sizeAfterFirst, walSize(t, dir), "torn tail must be cut off")
+
+			// new records must go right after the last good one and survive the next restart
+			_, err = chunker.SplitToChunks("third", 9007, storages)
+			require.NoError(t, err)
+			require.NoError(t, chunker.Close())
+
+			chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+			defer chunker.Close()
+			_, err = chunker.ChunksToRestore("first")
+			assert.NoError(t, err)
+			_, err = chunker.ChunksToRestore("third")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPersistentCorruptedTailRecord(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	_, err := chunker.SplitToChunks("first", 9007, storages)
+	require.NoError(t, err)
+	sizeAfterFirst := walSize(t, dir)
+	_, err = chunker.SplitToChunks("second", 9007, storages)
+	require.NoError(t, err)
+	require.NoError(t, chunker.Close())
+
+	walPath := path.Join(dir, walFilename)
+	data, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	data[len(data)-2] ^= 0xff
+	require.NoError(t, os.WriteFile(walPath, data, 0o600))
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	_, err = chunker.ChunksToRestore("first")
+	assert.NoError(t, err)
+	_, err = chunker.ChunksToRestore("second")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	assert.EqualValues(t, sizeAfterFirst, walSize(t, dir))
+}
+
+func TestPersistentStreams(t *testing.T) {
+	dir := t.TempDir()
+	chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+	var finished []Chunk
+	for order := range 2 {
+		chunk, err := chunker.AppendChunk("finished", uint32(order), 1000, storages)
+		require.NoError(t, err)
+		finished = append(finished, chunk)
+		_, err = chunker.AppendChunk("unfinished", uint32(order), 1000, storages)
+		require.NoError(t, err)
+	}
+	finished[1].Size = 10
+	require.NoError(t, chunker.FinishStream("finished", finished))
+	require.NoError(t, chunker.Close())
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	restored, err := chunker.ChunksToRestore("finished")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1010, restored[0].FileSize)
+	_, err = chunker.AppendChunk("unfinished", 0, 1000, storages)
+	assert.NoError(t, err, "unfinished stream must be dropped on restart")
+}
+
+func TestPersistentBuckets(t *testing.T) {
+	for _, snapshotEvery := range []int{1000, 2} {
+		dir := t.TempDir()
+		chunker, storages := newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		layout := Layout{Chunks: 2, ReplicationFactor: 3}
+		require.NoError(t, chunker.CreateBucket(Bucket{Name: "photos", Layout: layout, QuotaBytes: 100000}))
+		require.NoError(t, chunker.CreateBucket(Bucket{Name: "deleted", Layout: layout}))
+		require.NoError(t, chunker.DeleteBucket("deleted"))
+		_, err := chunker.SplitToChunks("photos/2024/cat.jpg", 9007, storages)
+		require.NoError(t, err)
+		require.NoError(t, chunker.Close())
+
+		chunker, _ = newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		info, err := chunker.StatBucket("photos")
+		require.NoError(t, err)
+		assert.Equal(t, layout, info.Layout)
+		assert.EqualValues(t, 100000, info.QuotaBytes)
+		assert.EqualValues(t, 9007, info.UsedBytes)
+		assert.Equal(t, 1, info.Files)
+		_, err = chunker.StatBucket("deleted")
+		assert.ErrorIs(t, err, ErrBucketNotFound)
+		_, err = chunker.ChunksToRestore("photos/2024/cat.jpg")
+		assert.NoError(t, err)
+		require.NoError(t, chunker.Close())
+	}
+}
+
+func TestPersistentContents(t *testing.T) {
+	for _, snapshotEvery := range []int{1, 1000} {
+		dir := t.TempDir()
+		chunker, storages := newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		storeContentFile(t, chunker, "a", []string{"x", "y"}, storages)
+		storeContentFile(t, chunker, "b", []string{"y"}, storages)
+		b, err := chunker.ChunksToRestore("b")
+		require.NoError(t, err)
+		require.NoError(t, chunker.MoveReplica("b", 0, b[0].Replicas[0], "new-storage", []byte("y")))
+		chunker.DeleteChunks("a")
+		require.NoError(t, chunker.Close())
+
+		chunker, _ = newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		assert.Equal(t, DedupStats{LogicalBytes: 100, StoredBytes: 100, Contents: 1, GarbageContents: 1}, chunker.DedupStats())
+		b, err = chunker.ChunksToRestore("b")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"new-storage"}, b[0].Replicas)
+		assert.Equal(t, []byte("y"), b[0].Checksum)
+		require.NoError(t, chunker.ForgetContent("x"))
+		require.NoError(t, chunker.Close())
+
+		chunker, _ = newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		assert.Empty(t, chunker.GarbageContents())
+		require.NoError(t, chunker.Close())
+	}
+}
+
+func TestPersistentCorruptedMiddleRecord(t *testing.T) {
+	for name, corrupt := range map[string]func(data []byte, firstSize int){
+		"payload": func(data []byte, firstSize int) { data[firstSize-2] ^= 0xff },
+		// a garbage length must neither be allocated nor make replay drop the records after it
+		"length": func(data []byte, firstSize int) { binary.BigEndian.PutUint32(data[0:4], 0xfffffff0) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			chunker, storages := newReadyForTestPersistentChunker(t, dir, 1000)
+			_, err := chunker.SplitToChunks("first", 9007, storages)
+			require.NoError(t, err)
+			sizeAfterFirst := walSize(t, dir)
+			_, err = chunker.SplitToChunks("second", 9007, storages)
+			require.NoError(t, err)
+			require.NoError(t, chunker.Close())
+
+			walPath := path.Join(dir, walFilename)
+			data, err := os.ReadFile(walPath)
+			require.NoError(t, err)
+			corrupt(data, int(sizeAfterFirst))
+			require.NoError(t, os.WriteFile(walPath, data, 0o600))
+
+			_, err = NewPersistentChunkMaster(dir, Layout{Chunks: 6, ReplicationFactor: 1}, 1000)
+			assert.ErrorIs(t, err, errWalCorrupted, "acknowledged records after a bad one must not be cut off")
+			assert.EqualValues(t, len(data), walSize(t, dir))
+		})
+	}
+}
+
+func TestPersistentCatalogBeforeBuckets(t *testing.T) {
+	dir := t.TempDir()
+	legacy, storages := newReadyForTestTmpChunker(6)
+	chunks, err := legacy.SplitToChunks("snapshot/path", 9007, storages)
+	require.NoError(t, err)
+	data, err := json.Marshal(catalogSnapshot{Catalog: map[string][]Chunk{"snapshot/path": chunks}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, snapshotFilename), data, 0o600))
+	chunker, _ := newReadyForTestPersistentChunker(t, dir, 1000)
+	require.NoError(t, chunker.wal.append(walRecord{Op: walOpSplit, Fileref: "wal/path", Chunks: chunks}))
+	require.NoError(t, chunker.Close())
+
+	// the bucket comes after the record in the log, so the file stays in the default bucket on the next replay too
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "wal", Layout: Layout{Chunks: 2, ReplicationFactor: 1}}))
+	require.NoError(t, chunker.Close())
+
+	chunker, _ = newReadyForTestPersistentChunker(t, dir, 1000)
+	defer chunker.Close()
+	files := chunker.ListFiles(DefaultBucket, "", "", 10)
+	require.Len(t, files, 2)
+	assert.Equal(t, ObjectName(DefaultBucket, "snapshot/path"), files[0].Fileref)
+	assert.Equal(t, ObjectName(DefaultBucket, "wal/path"), files[1].Fileref)
+	_, err = chunker.ChunksToRestore("snapshot/path")
+	assert.NoError(t, err)
+	assert.Empty(t, chunker.ListFiles("wal", "", "", 10))
+}
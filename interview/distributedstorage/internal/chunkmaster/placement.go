@@ -0,0 +1,180 @@
+package chunkmaster
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Labels place a storage in failure domains. Storages of the same host fail together, as do hosts of the same rack and racks of the same zone
+type Labels struct {
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+// PlacementPolicy decides which storages keep chunks of a file. Chunk i is placed on ReplicationFactor storages
+// starting from position i of the order, wrapping around, so neighbours in the order keep replicas of the same chunk
+type PlacementPolicy interface {
+	Order(fileref string, storages map[string]StorageInfo) []string
+}
+
+const (
+	PlacementMostFree   = "most-free"
+	PlacementRendezvous = "rendezvous"
+	PlacementSpread     = "spread"
+)
+
+// ParsePlacementPolicy gives the policy by its name: most-free, rendezvous or spread
+func ParsePlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case PlacementMostFree:
+		return MostFreeSpace{}, nil
+	case PlacementRendezvous:
+		return Rendezvous{}, nil
+	case PlacementSpread:
+		return SpreadDomains{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy %q", name)
+}
+
+// MostFreeSpace puts chunks on storages with the most available bytes. It ignores labels,
+// so a rack of many small storages gets as many chunks as a rack of a few big ones
+type MostFreeSpace struct{}
+
+func (MostFreeSpace) Order(fileref string, storages map[string]StorageInfo) []string {
+	return storageIDs(byFreeSpace(storages))
+}
+
+// Rendezvous is weighted rendezvous hashing: every storage gets a score from the hash of the file and the storage,
+// scaled by its available bytes. The order of remaining storages does not change when a storage comes or goes,
+// so only chunks which have been on it would move
+type Rendezvous struct{}
+
+func (Rendezvous) Order(fileref string, storages map[string]StorageInfo) []string {
+	type scored struct {
+		id    string
+		score float64
+	}
+	list := make([]scored, 0, len(storages))
+	for _, info := range storages {
+		list = append(list, scored{id: info.StorageID, score: rendezvousScore(fileref, info)})
+	}
+	slices.SortFunc(list, func(a, b scored) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), strings.Compare(a.id, b.id))
+	})
+	ids := make([]string, 0, len(list))
+	for _, s := range list {
+		ids = append(ids, s.id)
+	}
+	return ids
+}
+
+// rendezvousScore is -weight/ln(u) with u uniform in (0, 1), so a storage wins with probability proportional to its weight
+func rendezvousScore(fileref string, info StorageInfo) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(fileref))
+	h.Write([]byte{0})
+	h.Write([]byte(info.StorageID))
+	// fnv mixes the last bytes poorly, so the hash is finalized the same way as in splitmix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	weight := float64(max(info.AvailableBytes, 1))
+	return -weight / math.Log(u)
+}
+
+// SpreadDomains interleaves zones, then racks in every zone, then hosts in every rack, so neighbours in the order
+// are in distinct failure domains whenever there are enough domains. Replicas of a chunk and consecutive chunks
+// of a file then land in distinct domains. Domains with more available bytes go first, as do storages within a host.
+// Storages without labels are hosts of their own
+type SpreadDomains struct{}
+
+func (SpreadDomains) Order(fileref string, storages map[string]StorageInfo) []string {
+	levels := []func(StorageInfo) string{
+		func(info StorageInfo) string { return info.Labels.Zone },
+		func(info StorageInfo) string { return info.Labels.Rack },
+		func(info StorageInfo) string {
+			if info.Labels.Host == "" {
+				return info.StorageID
+			}
+			return info.Labels.Host
+		},
+	}
+	return storageIDs(spread(byFreeSpace(storages), levels))
+}
+
+// spread groups storages by the first level and interleaves groups, every group being spread by the next levels
+func spread(storages []StorageInfo, levels []func(StorageInfo) string) []StorageInfo {
+	if len(levels) == 0 || len(storages) <= 1 {
+		return storages
+	}
+	type domain struct {
+		storages       []StorageInfo
+		availableBytes int64
+	}
+	// storages are ordered by free space, so groups are in order of their biggest storages before they are sorted
+	var domains []*domain
+	index := make(map[string]*domain)
+	for _, info := range storages {
+		name := levels[0](info)
+		d, found := index[name]
+		if !found {
+			d = &domain{}
+			index[name] = d
+			domains = append(domains, d)
+		}
+		d.storages = append(d.storages, info)
+		d.availableBytes = saturatingAdd(d.availableBytes, info.AvailableBytes)
+	}
+	slices.SortStableFunc(domains, func(a, b *domain) int {
+		return cmp.Compare(b.availableBytes, a.availableBytes)
+	})
+
+	res := make([]StorageInfo, 0, len(storages))
+	for _, d := range domains {
+		d.storages = spread(d.storages, levels[1:])
+	}
+	for i := 0; len(res) < len(storages); i++ {
+		for _, d := range domains {
+			if i < len(d.storages) {
+				res = append(res, d.storages[i])
+			}
+		}
+	}
+	return res
+}
+
+// saturatingAdd keeps storages which have not reported their space yet, and so have math.MaxInt64 bytes, from overflowing the sum
+func saturatingAdd(a, b int64) int64 {
+	if b > 0 && a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+func byFreeSpace(storages map[string]StorageInfo) []StorageInfo {
+	list := make([]StorageInfo, 0, len(storages))
+	for _, info := range storages {
+		list = append(list, info)
+	}
+	slices.SortFunc(list, func(a, b StorageInfo) int {
+		return cmp.Or(cmp.Compare(b.AvailableBytes, a.AvailableBytes), strings.Compare(a.StorageID, b.StorageID))
+	})
+	return list
+}
+
+func storageIDs(list []StorageInfo) []string {
+	ids := make([]string, 0, len(list))
+	for _, info := range list {
+		ids = append(ids, info.StorageID)
+	}
+	return ids
+}
@@ -0,0 +1,147 @@
+package chunkmaster
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// labeledStorages gives two storages on every host, two hosts in every rack, two racks in every zone
+func labeledStorages(zones int) map[string]StorageInfo {
+	res := make(map[string]StorageInfo)
+	for z := range zones {
+		for r := range 2 {
+			for h := range 2 {
+				for s := range 2 {
+					storageID := fmt.Sprintf("z%d-r%d-h%d-s%d", z, r, h, s)
+					res[storageID] = StorageInfo{
+						StorageID:      storageID,
+						AvailableBytes: 900000,
+						Labels:         Labels{Zone: fmt.Sprintf("z%d", z), Rack: fmt.Sprintf("z%d-r%d", z, r), Host: fmt.Sprintf("z%d-r%d-h%d", z, r, h)},
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+func TestParsePlacementPolicy(t *testing.T) {
+	for name, expected := range map[string]PlacementPolicy{
+		PlacementMostFree:   MostFreeSpace{},
+		PlacementRendezvous: Rendezvous{},
+		PlacementSpread:     SpreadDomains{},
+	} {
+		policy, err := ParsePlacementPolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+	_, err := ParsePlacementPolicy("random")
+	assert.Error(t, err)
+}
+
+func TestMostFreeSpaceOrder(t *testing.T) {
+	storages := map[string]StorageInfo{
+		"a": {StorageID: "a", AvailableBytes: 10},
+		"b": {StorageID: "b", AvailableBytes: 30},
+		"c": {StorageID: "c", AvailableBytes: 20},
+		"d": {StorageID: "d", AvailableBytes: 30},
+	}
+	assert.Equal(t, []string{"b", "d", "c", "a"}, MostFreeSpace{}.Order("file", storages))
+}
+
+func TestSpreadDomainsWithoutLabelsIsMostFreeSpace(t *testing.T) {
+	storages := map[string]StorageInfo{
+		"a": {StorageID: "a", AvailableBytes: 10},
+		"b": {StorageID: "b", AvailableBytes: 30},
+		"c": {StorageID: "c", AvailableBytes: 20},
+	}
+	assert.Equal(t, MostFreeSpace{}.Order("file", storages), SpreadDomains{}.Order("file", storages))
+}
+
+func TestSpreadDomainsInterleavesDomains(t *testing.T) {
+	storages := labeledStorages(2)
+	order := SpreadDomains{}.Order("file", storages)
+	require.Len(t, order, len(storages))
+
+	// every window of two is in distinct zones, of four in distinct racks, of eight on distinct hosts
+	for window, domainOf := range map[int]func(Labels) string{
+		2: func(l Labels) string { return l.Zone },
+		4: func(l Labels) string { return l.Rack },
+		8: func(l Labels) string { return l.Host },
+	} {
+		for i := range order {
+			seen := make(map[string]bool)
+			for j := range window {
+				domain := domainOf(storages[order[(i+j)%len(order)]].Labels)
+				assert.False(t, seen[domain], "window %d at %d has %s twice: %v", window, i, domain, order)
+				seen[domain] = true
+			}
+		}
+	}
+}
+
+func TestSpreadDomainsPrefersFreeDomains(t *testing.T) {
+	storages := map[string]StorageInfo{
+		// a rack of many small storages
+		"small-0": {StorageID: "small-0", AvailableBytes: 10, Labels: Labels{Rack: "small"}},
+		"small-1": {StorageID: "small-1", AvailableBytes: 10, Labels: Labels{Rack: "small"}},
+		"small-2": {StorageID: "small-2", AvailableBytes: 10, Labels: Labels{Rack: "small"}},
+		"big-0":   {StorageID: "big-0", AvailableBytes: 100, Labels: Labels{Rack: "big"}},
+	}
+	order := SpreadDomains{}.Order("file", storages)
+	assert.Equal(t, "big-0", order[0])
+	assert.Equal(t, "small", storages[order[1]].Labels.Rack)
+}
+
+func TestRendezvousIsStable(t *testing.T) {
+	storages := randomStorages(10)
+	order := Rendezvous{}.Order("file", storages)
+	assert.Equal(t, order, Rendezvous{}.Order("file", storages))
+	assert.NotEqual(t, order, Rendezvous{}.Order("another-file", storages), "files should be spread differently")
+
+	// a storage which goes away does not change the order of others
+	delete(storages, order[3])
+	assert.Equal(t, append(order[:3:3], order[4:]...), Rendezvous{}.Order("file", storages))
+
+	// a new storage is only inserted
+	storages["new"] = StorageInfo{StorageID: "new", AvailableBytes: 900000}
+	withNew := Rendezvous{}.Order("file", storages)
+	assert.Equal(t, append(order[:3:3], order[4:]...), slices.DeleteFunc(withNew, func(id string) bool { return id == "new" }))
+}
+
+func TestRendezvousIsWeighted(t *testing.T) {
+	storages := map[string]StorageInfo{
+		"small": {StorageID: "small", AvailableBytes: 100},
+		"big":   {StorageID: "big", AvailableBytes: 300},
+	}
+	first := make(map[string]int)
+	for i := range 4000 {
+		first[Rendezvous{}.Order(fmt.Sprintf("file-%d", i), storages)[0]]++
+	}
+	assert.InDelta(t, 3000, first["big"], 150)
+	assert.InDelta(t, 1000, first["small"], 150)
+}
+
+func TestReplicasAreSpreadAcrossZones(t *testing.T) {
+	chunker := NewTemporaryChunkMaster(Layout{Chunks: 4, ReplicationFactor: 3})
+	chunker.SetPlacementPolicy(SpreadDomains{})
+	storages := labeledStorages(3)
+	chunks, err := chunker.SplitToChunks("some-path", 9000, storages)
+	require.NoError(t, err)
+	require.Len(t, chunks, 4)
+
+	racks := make(map[string]bool)
+	for _, chunk := range chunks {
+		zones := make(map[string]bool)
+		for _, storageID := range chunk.Replicas {
+			zones[storages[storageID].Labels.Zone] = true
+		}
+		assert.Len(t, zones, 3, "replicas of chunk %d are in %v", chunk.Order, chunk.Replicas)
+		racks[storages[chunk.Replicas[0]].Labels.Rack] = true
+	}
+	assert.Len(t, racks, 4, "chunks should start in distinct racks")
+}
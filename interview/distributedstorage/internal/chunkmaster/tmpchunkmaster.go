@@ -1,114 +1,455 @@
 package chunkmaster
 
 import (
+	"bytes"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type TemporaryChunkMaster struct {
 	chunkMutex   sync.RWMutex
 	chunkCatalog map[string][]Chunk
+	// contents of deduplicated chunks are shared by files. They are protected by chunkMutex too
+	contents map[string]*contentEntry
+	// buckets and usage are protected by chunkMutex too, so quota is checked and taken atomically with a catalog change
+	buckets map[string]Bucket
+	usage   map[string]bucketUsage
+	// versions of files of buckets with versioning, from the oldest to the current one. They are protected by chunkMutex too
+	versions map[string][]Version
 
-	splitNumber int
+	// layout is the layout of DefaultBucket
+	layout Layout
+	// placement is protected by chunkMutex too
+	placement PlacementPolicy
 }
 
 var _ ChunkMaster = (*TemporaryChunkMaster)(nil)
 
-func NewTemporaryChunkMaster(chunkSplitNumber int) ChunkMaster {
+func NewTemporaryChunkMaster(layout Layout) ChunkMaster {
+	return newTemporaryChunkMaster(layout)
+}
+
+func newTemporaryChunkMaster(layout Layout) *TemporaryChunkMaster {
 	return &TemporaryChunkMaster{
 		chunkCatalog: make(map[string][]Chunk),
-		splitNumber:  chunkSplitNumber,
+		contents:     make(map[string]*contentEntry),
+		buckets:      make(map[string]Bucket),
+		usage:        make(map[string]bucketUsage),
+		versions:     make(map[string][]Version),
+		layout:       layout,
+		placement:    SpreadDomains{},
 	}
 }
 
 func (cm *TemporaryChunkMaster) SplitToChunks(fileref string, size int64, storages map[string]StorageInfo) ([]Chunk, error) {
-	if len(storages) < cm.splitNumber {
-		return nil, ErrNotEnoughStorageNodes
-	}
-
 	cm.chunkMutex.Lock()
 	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	bucket, err := cm.bucketOf(fileref)
+	if err != nil {
+		return nil, err
+	}
+	layout := bucket.Layout
+	if len(storages) < layout.Chunks || len(storages) < layout.ReplicationFactor {
+		return nil, ErrNotEnoughStorageNodes
+	}
 
-	if _, found := cm.chunkCatalog[fileref]; found {
+	if cm.taken(fileref) {
 		return nil, ErrFileDuplicate
 	}
 
-	prioritizedIds := prioritizeStorages(storages)
+	prioritizedIds := cm.placement.Order(fileref, storages)
+	created := now()
 
-	chunks := make([]Chunk, 0, cm.splitNumber)
-	if size < int64(cm.splitNumber) {
-		// special case when we cannot split even by 1 byte to each storage
-		targetStorageId := prioritizedIds[0]
-		availMem := storages[targetStorageId].AvailableBytes
-		if availMem < size {
-			return nil, ErrNotEnoughAvailableStorage
+	splitNumber := layout.Chunks
+	chunks := make([]Chunk, 0, splitNumber)
+	if layout.ParityChunks > 0 {
+		// erasure coding needs all shards of the same size, even if it means that some data chunks are only padding
+		dataChunks := layout.DataChunks()
+		shardSize := (size + int64(dataChunks) - 1) / int64(dataChunks)
+		for i := range splitNumber {
+			chunk := Chunk{
+				Order:             uint32(i),
+				Replicas:          pickReplicas(prioritizedIds, i, layout.ReplicationFactor),
+				OriginalFileStart: int64(i) * shardSize,
+				Size:              shardSize,
+				FileSize:          size,
+				FileCreated:       created,
+			}
+			if i >= dataChunks {
+				chunk.Role = ChunkRoleParity
+				chunk.OriginalFileStart = 0
+			}
+			chunks = append(chunks, chunk)
 		}
+	} else if size < int64(splitNumber) {
+		// special case when we cannot split even by 1 byte to each storage
 		chunks = append(chunks, Chunk{
 			Order:             0,
-			StorageInstance:   targetStorageId,
+			Replicas:          pickReplicas(prioritizedIds, 0, layout.ReplicationFactor),
 			OriginalFileStart: 0,
 			Size:              size,
+			FileSize:          size,
+			FileCreated:       created,
 		})
 	} else {
 		// normal case - all splitNumber hosts are available
-		chunkSize := size / int64(cm.splitNumber)
-		for i := range cm.splitNumber {
+		chunkSize := size / int64(splitNumber)
+		for i := range splitNumber {
 			chunks = append(chunks, Chunk{
 				Order:             uint32(i),
-				StorageInstance:   prioritizedIds[i],
+				Replicas:          pickReplicas(prioritizedIds, i, layout.ReplicationFactor),
 				OriginalFileStart: int64(i) * chunkSize,
 				Size:              chunkSize,
+				FileSize:          size,
+				FileCreated:       created,
 			})
 		}
-		chunks[len(chunks)-1].Size = size - (chunkSize * int64(cm.splitNumber-1))
+		chunks[len(chunks)-1].Size = size - (chunkSize * int64(splitNumber-1))
 	}
 
-	// checking that we have enough memory
-	isAllMemGood := true
+	// checking that we have enough memory. A storage may keep replicas of several chunks
+	requiredBytes := make(map[string]int64, len(storages))
 	for _, chunk := range chunks {
-		storageAvailable := storages[chunk.StorageInstance].AvailableBytes
-		if storageAvailable < chunk.Size {
-			isAllMemGood = false
+		for _, storageId := range chunk.Replicas {
+			requiredBytes[storageId] += chunk.Size
+		}
+	}
+	for storageId, required := range requiredBytes {
+		if storages[storageId].AvailableBytes < required {
+			return nil, ErrNotEnoughAvailableStorage
 		}
 	}
-	if !isAllMemGood {
-		return nil, ErrNotEnoughAvailableStorage
+	if err := cm.checkQuota(bucket, storedBytes(chunks)); err != nil {
+		return nil, err
 	}
 
-	cm.chunkCatalog[fileref] = chunks
+	cm.setChunks(fileref, chunks)
 
-	return chunks, nil
+	return cloneChunks(chunks), nil
 }
 
-func prioritizeStorages(storages map[string]StorageInfo) []string {
-	list := make([]StorageInfo, 0, len(storages))
-	for _, info := range storages {
-		list = append(list, info)
+// pickReplicas shifts by one storage for every next chunk, so replicas of the same chunk are always on distinct storages
+// while chunks are still spread evenly
+func pickReplicas(prioritizedIds []string, chunkIdx int, replicationFactor int) []string {
+	replicas := make([]string, 0, replicationFactor)
+	for r := range replicationFactor {
+		replicas = append(replicas, prioritizedIds[(chunkIdx+r)%len(prioritizedIds)])
 	}
-	sort.Slice(list, func(i, j int) bool {
-		return list[i].AvailableBytes > list[j].AvailableBytes
+	return replicas
+}
+
+func (cm *TemporaryChunkMaster) SetPlacementPolicy(policy PlacementPolicy) {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	cm.placement = policy
+}
+
+func (cm *TemporaryChunkMaster) AppendChunk(fileref string, order uint32, size int64, storages map[string]StorageInfo) (Chunk, error) {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+	return cm.appendChunk(fileref, order, size, func(bucket Bucket, chunk *Chunk) error {
+		return cm.placeChunk(fileref, bucket, chunk, storages)
 	})
+}
+
+func (cm *TemporaryChunkMaster) AppendCompressedChunk(fileref string, order uint32, codec string, logicalSize, size int64, storages map[string]StorageInfo) (Chunk, error) {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+	return cm.appendChunk(fileref, order, size, func(bucket Bucket, chunk *Chunk) error {
+		chunk.Codec = codec
+		chunk.LogicalSize = logicalSize
+		return cm.placeChunk(fileref, bucket, chunk, storages)
+	})
+}
 
-	ids := make([]string, 0, len(list))
-	for _, info := range list {
-		ids = append(ids, info.StorageID)
+// appendChunk checks that the chunk continues the stream and adds it to the catalog once place has decided where it goes.
+// It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) appendChunk(fileref string, order uint32, size int64, place func(Bucket, *Chunk) error) (Chunk, error) {
+	bucket, err := cm.bucketOf(fileref)
+	if err != nil {
+		return Chunk{}, err
+	}
+	if bucket.Layout.ParityChunks > 0 {
+		return Chunk{}, ErrStreamingNotSupported
+	}
+
+	chunks := cm.chunkCatalog[fileref]
+	if order == 0 && cm.taken(fileref) {
+		return Chunk{}, ErrFileDuplicate
+	}
+	if order > 0 && (!isStreaming(chunks) || len(chunks) != int(order)) {
+		return Chunk{}, ErrChunksMismatch
+	}
+
+	var start int64
+	created := now()
+	if order > 0 {
+		last := chunks[len(chunks)-1]
+		start = last.OriginalFileStart + last.plainSize()
+		created = last.FileCreated
+	}
+	chunk := Chunk{
+		Order:             order,
+		OriginalFileStart: start,
+		Size:              size,
+		FileSize:          UnknownFileSize,
+		FileCreated:       created,
+	}
+	if err := place(bucket, &chunk); err != nil {
+		return Chunk{}, err
+	}
+
+	placed := cloneChunks([]Chunk{chunk})[0]
+	cm.setChunks(fileref, append(chunks, chunk))
+	return placed, nil
+}
+
+// placeChunk picks replicas of a chunk which is going to be stored. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) placeChunk(fileref string, bucket Bucket, chunk *Chunk, storages map[string]StorageInfo) error {
+	if len(storages) < bucket.Layout.ReplicationFactor {
+		return ErrNotEnoughStorageNodes
+	}
+	chunk.Replicas = pickReplicas(cm.placement.Order(fileref, storages), int(chunk.Order), bucket.Layout.ReplicationFactor)
+	for _, storageId := range chunk.Replicas {
+		if storages[storageId].AvailableBytes < chunk.Size {
+			return ErrNotEnoughAvailableStorage
+		}
+	}
+	return cm.checkQuota(bucket, chunk.Size)
+}
+
+func (cm *TemporaryChunkMaster) FinishStream(fileref string, chunks []Chunk) error {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	stored, found := cm.chunkCatalog[fileref]
+	if !found {
+		return ErrFileNotFound
+	}
+	if !isStreaming(stored) || !sameStreamLayout(stored, chunks) {
+		return ErrChunksMismatch
+	}
+	finished := cloneChunks(chunks)
+	last := finished[len(finished)-1]
+	for i := range finished {
+		finished[i].FileSize = last.OriginalFileStart + last.plainSize()
+	}
+	cm.finishContents(fileref, finished)
+	cm.setChunks(fileref, finished)
+	return nil
+}
+
+// now has no monotonic clock reading, so the time is the same after it has been saved and loaded
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+func isStreaming(chunks []Chunk) bool {
+	return len(chunks) > 0 && chunks[0].FileSize == UnknownFileSize
+}
+
+// sameStreamLayout allows only the last chunk to become shorter than it has been placed
+func sameStreamLayout(placed, stored []Chunk) bool {
+	if len(placed) != len(stored) {
+		return false
+	}
+	last := len(placed) - 1
+	if !sameChunkLayout(placed[:last], stored[:last]) {
+		return false
 	}
-	return ids
+	return placed[last].Order == stored[last].Order && placed[last].OriginalFileStart == stored[last].OriginalFileStart &&
+		stored[last].Size >= 0 && stored[last].Size <= placed[last].Size &&
+		placed[last].Codec == stored[last].Codec && stored[last].LogicalSize == placed[last].LogicalSize
 }
 
 func (cm *TemporaryChunkMaster) ChunksToRestore(fileref string) ([]Chunk, error) {
+	chunks, found := cm.storedChunks(fileref)
+	if !found || isStreaming(chunks) {
+		return nil, ErrFileNotFound
+	}
+	return chunks, nil
+}
+
+// storedChunks gives chunks of a file including one which is still being streamed
+func (cm *TemporaryChunkMaster) storedChunks(fileref string) ([]Chunk, bool) {
 	cm.chunkMutex.RLock()
 	defer cm.chunkMutex.RUnlock()
+	fileref = cm.canonicalFileref(fileref)
 
 	chunks, found := cm.chunkCatalog[fileref]
 	if !found {
-		return nil, ErrFileNotFound
+		return nil, false
 	}
-	return chunks, nil
+	chunks = cloneChunks(chunks)
+	cm.resolveContents(chunks)
+	return chunks, true
+}
+
+func (cm *TemporaryChunkMaster) UpdateChunks(fileref string, chunks []Chunk) error {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	stored, found := cm.chunkCatalog[fileref]
+	if !found {
+		return ErrFileNotFound
+	}
+	if !sameChunkLayout(stored, chunks) {
+		return ErrChunksMismatch
+	}
+	cm.updateContents(chunks)
+	cm.setChunks(fileref, cloneChunks(chunks))
+	return nil
+}
+
+func (cm *TemporaryChunkMaster) MoveReplica(fileref string, order uint32, from, to string, checksum []byte) error {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	stored, found := cm.chunkCatalog[fileref]
+	if !found || isStreaming(stored) {
+		return ErrFileNotFound
+	}
+	if int(order) >= len(stored) {
+		return ErrChunksMismatch
+	}
+	moved := cloneChunks(stored)
+	cm.resolveContents(moved)
+	chunk := moved[order]
+	idx := slices.Index(chunk.Replicas, from)
+	if idx < 0 || slices.Contains(chunk.Replicas, to) || !bytes.Equal(chunk.Checksum, checksum) {
+		return ErrChunksMismatch
+	}
+	moved[order].Replicas[idx] = to
+	// a shared chunk moves for every file which has it
+	cm.updateContents(moved[order : order+1])
+	cm.setChunks(fileref, moved)
+	return nil
+}
+
+func (cm *TemporaryChunkMaster) RewrapDataKey(fileref string, previous []byte, masterKeyID string, wrappedKey []byte) error {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	stored, found := cm.chunkCatalog[fileref]
+	if !found || isStreaming(stored) {
+		return ErrFileNotFound
+	}
+	rewrapped := cloneChunks(stored)
+	for i := range rewrapped {
+		if !bytes.Equal(rewrapped[i].WrappedKey, previous) {
+			return ErrChunksMismatch
+		}
+		rewrapped[i].MasterKeyID = masterKeyID
+		rewrapped[i].WrappedKey = append([]byte(nil), wrappedKey...)
+	}
+	cm.setChunks(fileref, rewrapped)
+	return nil
+}
+
+// cloneChunks is used for everything what goes in or out of the catalog, so callers are free to modify their chunks
+func cloneChunks(chunks []Chunk) []Chunk {
+	res := make([]Chunk, len(chunks))
+	for i, chunk := range chunks {
+		res[i] = chunk
+		res[i].Replicas = append([]string(nil), chunk.Replicas...)
+		res[i].Checksum = append([]byte(nil), chunk.Checksum...)
+		res[i].FileChecksum = append([]byte(nil), chunk.FileChecksum...)
+		res[i].Nonce = append([]byte(nil), chunk.Nonce...)
+		res[i].WrappedKey = append([]byte(nil), chunk.WrappedKey...)
+	}
+	return res
+}
+
+func sameChunkLayout(a, b []Chunk) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Order != b[i].Order || a[i].Role != b[i].Role || a[i].OriginalFileStart != b[i].OriginalFileStart || a[i].Size != b[i].Size ||
+			a[i].ContentID != b[i].ContentID || a[i].Codec != b[i].Codec || a[i].LogicalSize != b[i].LogicalSize {
+			return false
+		}
+	}
+	return true
 }
 
 func (cm *TemporaryChunkMaster) DeleteChunks(fileref string) {
 	cm.chunkMutex.Lock()
 	defer cm.chunkMutex.Unlock()
-	delete(cm.chunkCatalog, fileref)
+	fileref = cm.canonicalFileref(fileref)
+	cm.removeChunks(fileref)
+}
+
+func (cm *TemporaryChunkMaster) ForEachFile(fn func(fileref string, chunks []Chunk) bool) {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+	for fileref, chunks := range cm.chunkCatalog {
+		chunks = cloneChunks(chunks)
+		cm.resolveContents(chunks)
+		if !fn(fileref, chunks) {
+			return
+		}
+	}
+}
+
+func (cm *TemporaryChunkMaster) StatFile(fileref string) (FileInfo, error) {
+	fileref = cm.resolveFileref(fileref)
+	chunks, err := cm.ChunksToRestore(fileref)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return fileInfoOf(fileref, chunks), nil
+}
+
+// ListFiles goes through the whole catalog, which is fine while the catalog is a map in memory anyway
+func (cm *TemporaryChunkMaster) ListFiles(bucket, prefix, after string, limit int) []FileInfo {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+
+	type keyedFile struct {
+		key  string
+		info FileInfo
+	}
+	files := make([]keyedFile, 0)
+	for catalogFileref, chunks := range cm.chunkCatalog {
+		fileref, _ := SplitVersionFileref(catalogFileref)
+		fileBucket, key := SplitFileref(fileref)
+		if fileBucket == bucket && strings.HasPrefix(key, prefix) && key > after && !isStreaming(chunks) && cm.isCurrent(catalogFileref) {
+			files = append(files, keyedFile{key: key, info: fileInfoOf(catalogFileref, chunks)})
+		}
+	}
+	// keys of the default bucket with slashes are named with the bucket, so only keys give the order
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].key < files[j].key
+	})
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	infos := make([]FileInfo, 0, len(files))
+	for _, file := range files {
+		infos = append(infos, file.info)
+	}
+	return infos
+}
+
+// isCurrent tells whether the catalog fileref is the file itself or its current version. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) isCurrent(catalogFileref string) bool {
+	fileref, versionID := SplitVersionFileref(catalogFileref)
+	versions := cm.versions[fileref]
+	if versionID == "" {
+		// a file which has been replaced is left under its own fileref until its data is deleted
+		return len(versions) == 0
+	}
+	return len(versions) > 0 && versions[len(versions)-1].ID == versionID && !versions[len(versions)-1].Deleted
 }
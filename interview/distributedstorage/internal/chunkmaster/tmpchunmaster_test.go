@@ -21,11 +21,11 @@ func randomStorages(n int) map[string]StorageInfo {
 }
 
 func newReadyForTestTmpChunker(numberOfChunks int) (ChunkMaster, map[string]StorageInfo) {
-	return NewTemporaryChunkMaster(numberOfChunks), randomStorages(numberOfChunks)
+	return NewTemporaryChunkMaster(Layout{Chunks: numberOfChunks, ReplicationFactor: 1}), randomStorages(numberOfChunks)
 }
 
 func TestNotEnoughStorageHosts(t *testing.T) {
-	chunker := NewTemporaryChunkMaster(6)
+	chunker := NewTemporaryChunkMaster(Layout{Chunks: 6, ReplicationFactor: 1})
 	storages := randomStorages(5)
 	chunks, err := chunker.SplitToChunks("some/path", 9000, storages)
 	assert.Nil(t, chunks)
@@ -99,3 +99,272 @@ func TestFileNotFound(t *testing.T) {
 	_, err := chunker.ChunksToRestore("abc/3424/ty")
 	require.ErrorIs(t, err, ErrFileNotFound)
 }
+
+func TestReplicasAreDistinct(t *testing.T) {
+	chunker := NewTemporaryChunkMaster(Layout{Chunks: 6, ReplicationFactor: 3})
+	storages := randomStorages(6)
+	chunks, err := chunker.SplitToChunks("some/path", 9007, storages)
+	require.NoError(t, err)
+	require.Len(t, chunks, 6)
+	perStorage := make(map[string]int)
+	for _, chunk := range chunks {
+		require.Len(t, chunk.Replicas, 3)
+		seen := make(map[string]bool)
+		for _, storageId := range chunk.Replicas {
+			assert.False(t, seen[storageId], "replica %s repeated for chunk %d", storageId, chunk.Order)
+			seen[storageId] = true
+			perStorage[storageId]++
+		}
+	}
+	for storageId, cnt := range perStorage {
+		assert.Equal(t, 3, cnt, "replicas are not spread evenly on %s", storageId)
+	}
+}
+
+func TestNotEnoughStorageHostsForReplicas(t *testing.T) {
+	chunker := NewTemporaryChunkMaster(Layout{Chunks: 2, ReplicationFactor: 3})
+	chunks, err := chunker.SplitToChunks("some/path", 9000, randomStorages(2))
+	assert.Nil(t, chunks)
+	assert.ErrorIs(t, err, ErrNotEnoughStorageNodes)
+}
+
+func TestNotEnoughSpaceForReplicas(t *testing.T) {
+	// every storage keeps 2 replicas of 300000 bytes, which is over its 500000 bytes
+	chunker := NewTemporaryChunkMaster(Layout{Chunks: 3, ReplicationFactor: 2})
+	storages := randomStorages(3)
+	for id, info := range storages {
+		info.AvailableBytes = 500000
+		storages[id] = info
+	}
+	_, err := chunker.SplitToChunks("some/path", 900000, storages)
+	assert.ErrorIs(t, err, ErrNotEnoughAvailableStorage)
+}
+
+func TestUpdateChunks(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	fileref := "this/is/my/path123"
+	chunks, err := chunker.SplitToChunks(fileref, 54623, storages)
+	require.NoError(t, err)
+
+	chunks[2].Replicas = []string{"another-storage"}
+	require.NoError(t, chunker.UpdateChunks(fileref, chunks))
+	restored, err := chunker.ChunksToRestore(fileref)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"another-storage"}, restored[2].Replicas)
+
+	assert.ErrorIs(t, chunker.UpdateChunks(fileref, chunks[1:]), ErrChunksMismatch)
+	assert.ErrorIs(t, chunker.UpdateChunks("missing", chunks), ErrFileNotFound)
+}
+
+func TestMoveReplica(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	fileref := "this/is/my/path123"
+	chunks, err := chunker.SplitToChunks(fileref, 54623, storages)
+	require.NoError(t, err)
+	chunks[2].Checksum = []byte("checksum")
+	require.NoError(t, chunker.UpdateChunks(fileref, chunks))
+	from := chunks[2].Replicas[0]
+
+	assert.ErrorIs(t, chunker.MoveReplica(fileref, 2, from, "new-storage", []byte("another checksum")), ErrChunksMismatch)
+	assert.ErrorIs(t, chunker.MoveReplica(fileref, 2, "new-storage", "newer-storage", chunks[2].Checksum), ErrChunksMismatch)
+	assert.ErrorIs(t, chunker.MoveReplica(fileref, 2, from, from, chunks[2].Checksum), ErrChunksMismatch)
+	assert.ErrorIs(t, chunker.MoveReplica(fileref, 6, from, "new-storage", chunks[2].Checksum), ErrChunksMismatch)
+	assert.ErrorIs(t, chunker.MoveReplica("missing", 2, from, "new-storage", chunks[2].Checksum), ErrFileNotFound)
+
+	require.NoError(t, chunker.MoveReplica(fileref, 2, from, "new-storage", chunks[2].Checksum))
+	restored, err := chunker.ChunksToRestore(fileref)
+	require.NoError(t, err)
+	chunks[2].Replicas = []string{"new-storage"}
+	assert.Equal(t, chunks, restored)
+}
+
+func TestRewrapDataKey(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	fileref := "this/is/my/path123"
+	chunks, err := chunker.SplitToChunks(fileref, 54623, storages)
+	require.NoError(t, err)
+	for i := range chunks {
+		chunks[i].Nonce = []byte{byte(i)}
+		chunks[i].MasterKeyID = "old"
+		chunks[i].WrappedKey = []byte("wrapped with old")
+	}
+	require.NoError(t, chunker.UpdateChunks(fileref, chunks))
+
+	assert.ErrorIs(t, chunker.RewrapDataKey(fileref, []byte("another key"), "new", []byte("wrapped with new")), ErrChunksMismatch)
+	assert.ErrorIs(t, chunker.RewrapDataKey("missing", []byte("wrapped with old"), "new", []byte("wrapped with new")), ErrFileNotFound)
+	require.NoError(t, chunker.RewrapDataKey(fileref, []byte("wrapped with old"), "new", []byte("wrapped with new")))
+	restored, err := chunker.ChunksToRestore(fileref)
+	require.NoError(t, err)
+	for i := range chunks {
+		chunks[i].MasterKeyID = "new"
+		chunks[i].WrappedKey = []byte("wrapped with new")
+	}
+	assert.Equal(t, chunks, restored, "only the data key changes")
+}
+
+func TestSplitErasureCoded(t *testing.T) {
+	for _, size := range []int64{0, 3, 9007} {
+		chunker := NewTemporaryChunkMaster(Layout{Chunks: 6, ReplicationFactor: 1, ParityChunks: 2})
+		chunks, err := chunker.SplitToChunks("some/path", size, randomStorages(6))
+		require.NoError(t, err)
+		require.Len(t, chunks, 6)
+		shardSize := (size + 3) / 4
+		var sumData int64
+		for i, chunk := range chunks {
+			assert.EqualValues(t, i, chunk.Order)
+			assert.EqualValues(t, shardSize, chunk.Size, "all shards must be of the same size")
+			assert.EqualValues(t, size, chunk.FileSize)
+			if i < 4 {
+				assert.Equal(t, ChunkRoleData, chunk.Role)
+				assert.EqualValues(t, int64(i)*shardSize, chunk.OriginalFileStart)
+			} else {
+				assert.Equal(t, ChunkRoleParity, chunk.Role)
+				assert.Zero(t, chunk.DataSize())
+			}
+			sumData += chunk.DataSize()
+		}
+		assert.EqualValues(t, size, sumData, "padding must not be counted as data")
+	}
+}
+
+func TestForEachFile(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	for _, fileref := range []string{"a", "b", "c"} {
+		_, err := chunker.SplitToChunks(fileref, 9007, storages)
+		require.NoError(t, err)
+	}
+	seen := make(map[string]int)
+	chunker.ForEachFile(func(fileref string, chunks []Chunk) bool {
+		seen[fileref] = len(chunks)
+		return true
+	})
+	assert.Equal(t, map[string]int{"a": 6, "b": 6, "c": 6}, seen)
+
+	calls := 0
+	chunker.ForEachFile(func(string, []Chunk) bool {
+		calls++
+		return false
+	})
+	assert.Equal(t, 1, calls)
+}
+
+func TestStreamChunks(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	var chunks []Chunk
+	for order := range 3 {
+		chunk, err := chunker.AppendChunk("stream", uint32(order), 1000, storages)
+		require.NoError(t, err)
+		assert.EqualValues(t, order, chunk.Order)
+		assert.EqualValues(t, order*1000, chunk.OriginalFileStart)
+		assert.Equal(t, UnknownFileSize, chunk.FileSize)
+		chunks = append(chunks, chunk)
+	}
+	_, err := chunker.ChunksToRestore("stream")
+	assert.ErrorIs(t, err, ErrFileNotFound, "unfinished stream cannot be restored")
+	_, err = chunker.AppendChunk("stream", 0, 1000, storages)
+	assert.ErrorIs(t, err, ErrFileDuplicate)
+	_, err = chunker.AppendChunk("stream", 5, 1000, storages)
+	assert.ErrorIs(t, err, ErrChunksMismatch)
+
+	chunks[2].Size = 1001
+	assert.ErrorIs(t, chunker.FinishStream("stream", chunks), ErrChunksMismatch, "chunk cannot grow")
+	chunks[2].Size = 7
+	chunks[2].Checksum = []byte("checksum")
+	require.NoError(t, chunker.FinishStream("stream", chunks))
+	restored, err := chunker.ChunksToRestore("stream")
+	require.NoError(t, err)
+	require.Len(t, restored, 3)
+	for _, chunk := range restored {
+		assert.EqualValues(t, 2007, chunk.FileSize)
+	}
+	assert.Equal(t, []byte("checksum"), restored[2].Checksum)
+	assert.ErrorIs(t, chunker.FinishStream("stream", restored), ErrChunksMismatch, "stream is finished already")
+}
+
+func TestCompressedStreamChunks(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "logs", Layout: Layout{Chunks: 1, ReplicationFactor: 1}, QuotaBytes: 1500}))
+	var chunks []Chunk
+	for order := range 2 {
+		chunk, err := chunker.AppendCompressedChunk("logs/app.log", uint32(order), "zstd", 1000, 300, storages)
+		require.NoError(t, err)
+		assert.EqualValues(t, order*1000, chunk.OriginalFileStart, "file positions are those of uncompressed data")
+		assert.EqualValues(t, 300, chunk.Size)
+		chunks = append(chunks, chunk)
+	}
+	chunk, err := chunker.AppendChunk("logs/app.log", 2, 700, storages)
+	require.NoError(t, err)
+	chunks = append(chunks, chunk)
+	_, err = chunker.AppendChunk("logs/app.log", 3, 1000, storages)
+	assert.ErrorIs(t, err, ErrBucketQuotaExceeded, "quota counts compressed bytes")
+
+	chunks[1].LogicalSize = 900
+	assert.ErrorIs(t, chunker.FinishStream("logs/app.log", chunks), ErrChunksMismatch)
+	chunks[1].LogicalSize = 1000
+	chunks[2].Size = 10
+	require.NoError(t, chunker.FinishStream("logs/app.log", chunks))
+	info, err := chunker.StatFile("logs/app.log")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2010, info.Size)
+	restored, err := chunker.ChunksToRestore("logs/app.log")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1000, restored[1].DataSize())
+	assert.EqualValues(t, 10, restored[2].DataSize())
+	buckets := chunker.Buckets()
+	assert.EqualValues(t, 610, buckets[len(buckets)-1].UsedBytes)
+}
+
+func TestStreamNotSupportedWithErasureCoding(t *testing.T) {
+	chunker := NewTemporaryChunkMaster(Layout{Chunks: 6, ReplicationFactor: 1, ParityChunks: 2})
+	_, err := chunker.AppendChunk("stream", 0, 1000, randomStorages(6))
+	assert.ErrorIs(t, err, ErrStreamingNotSupported)
+}
+
+func TestStatFile(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	chunks, err := chunker.SplitToChunks("file", 9007, storages)
+	require.NoError(t, err)
+	for i := range chunks {
+		chunks[i].FileChecksum = []byte("checksum")
+	}
+	require.NoError(t, chunker.UpdateChunks("file", chunks))
+
+	info, err := chunker.StatFile("file")
+	require.NoError(t, err)
+	assert.Equal(t, "file", info.Fileref)
+	assert.EqualValues(t, 9007, info.Size)
+	assert.False(t, info.Created.IsZero())
+	assert.Equal(t, []byte("checksum"), info.Checksum)
+
+	_, err = chunker.StatFile("missing")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestListFiles(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(6)
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "bucket", Layout: Layout{Chunks: 6, ReplicationFactor: 1}}))
+	for _, fileref := range []string{"bucket/b/2", "bucket/a/1", "bucket/b/1", "bucket/b/3", "bucket/c", "c"} {
+		_, err := chunker.SplitToChunks(fileref, 9007, storages)
+		require.NoError(t, err)
+	}
+	_, err := chunker.AppendChunk("bucket/b/streaming", 0, 1000, storages)
+	require.NoError(t, err)
+	// a replaced file is kept under the fileref of its version, but it is still listed by its key
+	_, err = chunker.SplitToChunks(VersionFileref("bucket/b/3", "1"), 9007, storages)
+	require.NoError(t, err)
+	_, err = chunker.ReplaceFile("bucket/b/3", Version{ID: "1"}, Condition{Exists: true})
+	require.NoError(t, err)
+
+	filerefs := func(files []FileInfo) []string {
+		res := make([]string, 0, len(files))
+		for _, file := range files {
+			res = append(res, file.Fileref)
+		}
+		return res
+	}
+	assert.Equal(t, []string{"bucket/a/1", "bucket/b/1", "bucket/b/2", "bucket/b/3", "bucket/c"}, filerefs(chunker.ListFiles("bucket", "", "", 100)))
+	assert.Equal(t, []string{"bucket/b/1", "bucket/b/2"}, filerefs(chunker.ListFiles("bucket", "b/", "", 2)))
+	assert.Equal(t, []string{"bucket/b/3"}, filerefs(chunker.ListFiles("bucket", "b/", "b/2", 2)))
+	assert.Empty(t, chunker.ListFiles("bucket", "b/", "b/3", 2))
+	assert.Equal(t, []string{"c"}, filerefs(chunker.ListFiles(DefaultBucket, "", "", 100)))
+}
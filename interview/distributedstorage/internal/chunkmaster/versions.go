@@ -0,0 +1,267 @@
+package chunkmaster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// versionSeparator cannot be a part of a key, so a fileref of a version never clashes with a fileref of a file
+const versionSeparator = "\x00"
+
+var ErrVersioningDisabled = errors.New("bucket has no versioning")
+
+// Versioning keeps old versions of files of a bucket: every upload makes a new version, and a deletion makes a tombstone
+type Versioning struct {
+	Enabled bool
+	// KeepVersions is how many versions which have been replaced are kept for a file. 0 means all of them
+	KeepVersions int `json:",omitempty"`
+	// KeepFor is how long a version is kept after it has been replaced. 0 means forever
+	KeepFor time.Duration `json:",omitempty"`
+}
+
+func (v Versioning) Validate() error {
+	if v.KeepVersions < 0 || v.KeepFor < 0 {
+		return fmt.Errorf("version retention must not be negative, got %d versions for %s", v.KeepVersions, v.KeepFor)
+	}
+	if !v.Enabled && (v.KeepVersions > 0 || v.KeepFor > 0) {
+		return errors.New("version retention needs versioning")
+	}
+	return nil
+}
+
+type Version struct {
+	ID string
+	// Created is the time when the version has become current
+	Created time.Time
+	// Deleted marks a tombstone. It hides older versions, the same way as a file without versioning is gone after deletion
+	Deleted bool `json:",omitempty"`
+}
+
+// Condition restricts which file ReplaceFile may replace, the same way as HTTP conditional requests do
+type Condition struct {
+	// Exists requires a current file, like If-Match: *
+	Exists bool
+	// Checksums, if any, require the current file to have one of them, like If-Match with ETags
+	Checksums [][]byte
+	// Absent requires no current file, like If-None-Match: *
+	Absent bool
+	// Overwrite allows to replace a current file without any of the above, like a plain S3 PUT does
+	Overwrite bool
+}
+
+// FileVersion is a version of the file with fileref
+type FileVersion struct {
+	Fileref string
+	Version
+}
+
+// VersionFileref gives the fileref under which the data of a version is kept in the catalog
+func VersionFileref(fileref, versionID string) string {
+	return fileref + versionSeparator + versionID
+}
+
+// SplitVersionFileref is the reverse of VersionFileref. The version is empty for a fileref of a file without versioning
+func SplitVersionFileref(fileref string) (string, string) {
+	fileref, versionID, _ := strings.Cut(fileref, versionSeparator)
+	return fileref, versionID
+}
+
+// ValidateKey rejects keys of new files which cannot be told from filerefs of versions or from API paths
+func ValidateKey(fileref string) error {
+	if strings.Contains(fileref, versionSeparator) {
+		return fmt.Errorf("%w: key has a zero byte", ErrBadFileref)
+	}
+	if bucket, key := SplitFileref(fileref); bucket == DefaultBucket && apiPaths[key] {
+		return fmt.Errorf("%w: %q is an API path", ErrBadFileref, key)
+	}
+	return nil
+}
+
+func (cm *TemporaryChunkMaster) PublishVersion(fileref string, version Version) error {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	bucket, err := cm.bucketOf(fileref)
+	if err != nil {
+		return err
+	}
+	if !bucket.Versioning.Enabled {
+		return ErrVersioningDisabled
+	}
+	versions := cm.versions[fileref]
+	if slices.ContainsFunc(versions, func(v Version) bool { return v.ID == version.ID }) {
+		return ErrFileDuplicate
+	}
+	if version.Deleted {
+		if len(versions) == 0 || versions[len(versions)-1].Deleted {
+			return ErrFileNotFound
+		}
+	} else if chunks, found := cm.chunkCatalog[VersionFileref(fileref, version.ID)]; !found || isStreaming(chunks) {
+		return ErrFileNotFound
+	}
+	if version.Created.IsZero() {
+		version.Created = now()
+	}
+	cm.versions[fileref] = append(slices.Clone(versions), version)
+	return nil
+}
+
+func (cm *TemporaryChunkMaster) ResolveVersion(fileref, versionID string) (string, error) {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+	fileref = cm.canonicalFileref(fileref)
+	return cm.resolveVersion(fileref, versionID)
+}
+
+// resolveVersion must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) resolveVersion(fileref, versionID string) (string, error) {
+	catalogFileref := fileref
+	if versions, found := cm.versions[fileref]; found {
+		idx := len(versions) - 1
+		if versionID != "" {
+			idx = slices.IndexFunc(versions, func(v Version) bool { return v.ID == versionID })
+		}
+		if idx < 0 || versions[idx].Deleted {
+			return "", ErrFileNotFound
+		}
+		catalogFileref = VersionFileref(fileref, versions[idx].ID)
+	} else if versionID != "" {
+		return "", ErrFileNotFound
+	}
+	if chunks, found := cm.chunkCatalog[catalogFileref]; !found || isStreaming(chunks) {
+		return "", ErrFileNotFound
+	}
+	return catalogFileref, nil
+}
+
+func (cm *TemporaryChunkMaster) ReplaceFile(fileref string, version Version, condition Condition) (string, error) {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	bucket, err := cm.bucketOf(fileref)
+	if err != nil {
+		return "", err
+	}
+	current, err := cm.resolveVersion(fileref, "")
+	if err != nil && !errors.Is(err, ErrFileNotFound) {
+		return "", err
+	}
+	if !condition.Holds(current != "", fileInfoOf(current, cm.chunkCatalog[current]).Checksum) {
+		return "", ErrPreconditionFailed
+	}
+	if chunks, found := cm.chunkCatalog[VersionFileref(fileref, version.ID)]; !found || isStreaming(chunks) || version.Deleted {
+		return "", ErrFileNotFound
+	}
+	versions := cm.versions[fileref]
+	if slices.ContainsFunc(versions, func(v Version) bool { return v.ID == version.ID }) {
+		return "", ErrFileDuplicate
+	}
+	if version.Created.IsZero() {
+		version.Created = now()
+	}
+	if bucket.Versioning.Enabled {
+		cm.versions[fileref] = append(slices.Clone(versions), version)
+		return "", nil
+	}
+	cm.versions[fileref] = []Version{version}
+	return current, nil
+}
+
+// Holds checks the condition against the current file, checksum is empty if there is no file or it has no checksum
+func (c Condition) Holds(exists bool, checksum []byte) bool {
+	if c.Absent && exists || c.Exists && !exists {
+		return false
+	}
+	return len(c.Checksums) == 0 || slices.ContainsFunc(c.Checksums, func(expected []byte) bool {
+		return len(checksum) > 0 && bytes.Equal(expected, checksum)
+	})
+}
+
+// taken tells whether the file exists under its own fileref or as a version. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) taken(fileref string) bool {
+	_, found := cm.chunkCatalog[fileref]
+	return found || len(cm.versions[fileref]) > 0
+}
+
+func (cm *TemporaryChunkMaster) Versions(fileref string) ([]Version, error) {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	versions, found := cm.versions[fileref]
+	if !found {
+		return nil, ErrFileNotFound
+	}
+	return slices.Clone(versions), nil
+}
+
+func (cm *TemporaryChunkMaster) RemoveVersion(fileref, versionID string) (Version, error) {
+	cm.chunkMutex.Lock()
+	defer cm.chunkMutex.Unlock()
+	fileref = cm.canonicalFileref(fileref)
+
+	versions := cm.versions[fileref]
+	idx := slices.IndexFunc(versions, func(v Version) bool { return v.ID == versionID })
+	if idx < 0 {
+		return Version{}, ErrFileNotFound
+	}
+	removed := versions[idx]
+	cm.setVersions(fileref, slices.Delete(slices.Clone(versions), idx, idx+1))
+	return removed, nil
+}
+
+// setVersions must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) setVersions(fileref string, versions []Version) {
+	if len(versions) == 0 {
+		delete(cm.versions, fileref)
+		return
+	}
+	cm.versions[fileref] = versions
+}
+
+// ExpiredVersions goes through the whole catalog, the same as ListFiles. The current version is never expired,
+// unless it is a tombstone which has nothing left to hide
+func (cm *TemporaryChunkMaster) ExpiredVersions(now time.Time) []FileVersion {
+	cm.chunkMutex.RLock()
+	defer cm.chunkMutex.RUnlock()
+
+	var expired []FileVersion
+	for fileref, versions := range cm.versions {
+		name, _ := SplitFileref(fileref)
+		bucket, found := cm.bucket(name)
+		if !found {
+			continue
+		}
+		policy := bucket.Versioning
+		replaced := len(versions) - 1
+		kept := 0
+		for i := range replaced {
+			tooMany := policy.KeepVersions > 0 && i < replaced-policy.KeepVersions
+			tooOld := policy.KeepFor > 0 && now.Sub(versions[i+1].Created) >= policy.KeepFor
+			if tooMany || tooOld {
+				expired = append(expired, FileVersion{Fileref: fileref, Version: versions[i]})
+			} else {
+				kept++
+			}
+		}
+		if current := versions[replaced]; current.Deleted && kept == 0 {
+			expired = append(expired, FileVersion{Fileref: fileref, Version: current})
+		}
+	}
+	return expired
+}
+
+// dropVersionsOfBucket forgets tombstones of a bucket which has no files left. It must be called with chunkMutex held
+func (cm *TemporaryChunkMaster) dropVersionsOfBucket(name string) {
+	for fileref := range cm.versions {
+		if bucket, _ := SplitFileref(fileref); bucket == name {
+			delete(cm.versions, fileref)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package chunkmaster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newVersionedChunker(t *testing.T, cm ChunkMaster, versioning Versioning) {
+	versioning.Enabled = true
+	require.NoError(t, cm.CreateBucket(Bucket{Name: "docs", Layout: Layout{Chunks: 1, ReplicationFactor: 1}, Versioning: versioning}))
+}
+
+func storeVersion(t *testing.T, cm ChunkMaster, fileref string, version Version, storages map[string]StorageInfo) {
+	_, err := cm.SplitToChunks(VersionFileref(fileref, version.ID), 100, storages)
+	require.NoError(t, err)
+	require.NoError(t, cm.PublishVersion(fileref, version))
+}
+
+func TestVersioningValidation(t *testing.T) {
+	chunker, _ := newReadyForTestTmpChunker(1)
+	layout := Layout{Chunks: 1, ReplicationFactor: 1}
+	assert.Error(t, chunker.CreateBucket(Bucket{Name: "docs", Layout: layout, Versioning: Versioning{KeepVersions: 2}}))
+	assert.Error(t, chunker.CreateBucket(Bucket{Name: "docs", Layout: layout, Versioning: Versioning{Enabled: true, KeepFor: -time.Hour}}))
+	assert.ErrorIs(t, ValidateKey("docs/a\x00b"), ErrBadFileref)
+
+	require.NoError(t, chunker.CreateBucket(Bucket{Name: "plain", Layout: layout}))
+	assert.ErrorIs(t, chunker.PublishVersion("plain/file", Version{ID: "1"}), ErrVersioningDisabled)
+}
+
+func TestVersions(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(1)
+	newVersionedChunker(t, chunker, Versioning{})
+
+	assert.ErrorIs(t, chunker.PublishVersion("docs/a", Version{ID: "1"}), ErrFileNotFound, "data must be stored first")
+	assert.ErrorIs(t, chunker.PublishVersion("docs/a", Version{ID: "1", Deleted: true}), ErrFileNotFound, "nothing to delete")
+	storeVersion(t, chunker, "docs/a", Version{ID: "1"}, storages)
+	storeVersion(t, chunker, "docs/a", Version{ID: "2"}, storages)
+	assert.ErrorIs(t, chunker.PublishVersion("docs/a", Version{ID: "2"}), ErrFileDuplicate)
+
+	current, err := chunker.ResolveVersion("docs/a", "")
+	require.NoError(t, err)
+	assert.Equal(t, VersionFileref("docs/a", "2"), current)
+	first, err := chunker.ResolveVersion("docs/a", "1")
+	require.NoError(t, err)
+	assert.Equal(t, VersionFileref("docs/a", "1"), first)
+	_, err = chunker.ResolveVersion("docs/a", "3")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	info, err := chunker.StatFile(current)
+	require.NoError(t, err)
+	assert.Equal(t, "docs/a", info.Fileref)
+	assert.Equal(t, "2", info.VersionID)
+	files := chunker.ListFiles("docs", "", "", 10)
+	require.Len(t, files, 1)
+	assert.Equal(t, "2", files[0].VersionID)
+
+	require.NoError(t, chunker.PublishVersion("docs/a", Version{ID: "3", Deleted: true}))
+	_, err = chunker.ResolveVersion("docs/a", "")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, err = chunker.ResolveVersion("docs/a", "3")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, err = chunker.ResolveVersion("docs/a", "1")
+	assert.NoError(t, err, "older versions stay after deletion")
+	assert.Empty(t, chunker.ListFiles("docs", "", "", 10))
+
+	versions, err := chunker.Versions("docs/a")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.True(t, versions[2].Deleted)
+
+	removed, err := chunker.RemoveVersion("docs/a", "3")
+	require.NoError(t, err)
+	assert.True(t, removed.Deleted)
+	current, err = chunker.ResolveVersion("docs/a", "")
+	require.NoError(t, err)
+	assert.Equal(t, VersionFileref("docs/a", "2"), current, "removing the tombstone brings back the previous version")
+}
+
+func TestExpiredVersions(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(1)
+	newVersionedChunker(t, chunker, Versioning{KeepVersions: 1, KeepFor: time.Hour})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"1", "2", "3"} {
+		storeVersion(t, chunker, "docs/a", Version{ID: id, Created: start.Add(time.Duration(i) * time.Minute)}, storages)
+	}
+	expired := chunker.ExpiredVersions(start.Add(10 * time.Minute))
+	require.Len(t, expired, 1, "one replaced version is kept")
+	assert.Equal(t, FileVersion{Fileref: "docs/a", Version: Version{ID: "1", Created: start}}, expired[0])
+
+	require.NoError(t, chunker.PublishVersion("docs/a", Version{ID: "4", Deleted: true, Created: start.Add(3 * time.Minute)}))
+	assert.Len(t, chunker.ExpiredVersions(start.Add(10*time.Minute)), 2)
+	expired = chunker.ExpiredVersions(start.Add(2 * time.Hour))
+	assert.Len(t, expired, 4, "a tombstone goes away with the versions it hides")
+}
+
+func TestPersistentVersions(t *testing.T) {
+	for _, snapshotEvery := range []int{1000, 2} {
+		dir := t.TempDir()
+		chunker, storages := newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		newVersionedChunker(t, chunker, Versioning{KeepVersions: 3})
+		storeVersion(t, chunker, "docs/a", Version{ID: "1"}, storages)
+		storeVersion(t, chunker, "docs/a", Version{ID: "2"}, storages)
+		require.NoError(t, chunker.PublishVersion("docs/a", Version{ID: "3", Deleted: true}))
+		_, err := chunker.RemoveVersion("docs/a", "1")
+		require.NoError(t, err)
+		require.NoError(t, chunker.Close())
+
+		chunker, _ = newReadyForTestPersistentChunker(t, dir, snapshotEvery)
+		info, err := chunker.StatBucket("docs")
+		require.NoError(t, err)
+		assert.Equal(t, Versioning{Enabled: true, KeepVersions: 3}, info.Versioning)
+		versions, err := chunker.Versions("docs/a")
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		assert.Equal(t, "2", versions[0].ID)
+		assert.True(t, versions[1].Deleted)
+		_, err = chunker.ResolveVersion("docs/a", "")
+		assert.ErrorIs(t, err, ErrFileNotFound)
+		require.NoError(t, chunker.Close())
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	chunker, storages := newReadyForTestTmpChunker(1)
+	chunks, err := chunker.SplitToChunks("file", 100, storages)
+	require.NoError(t, err)
+	for i := range chunks {
+		chunks[i].FileChecksum = []byte("old")
+	}
+	require.NoError(t, chunker.UpdateChunks("file", chunks))
+	_, err = chunker.SplitToChunks(VersionFileref("file", "1"), 200, storages)
+	require.NoError(t, err)
+
+	_, err = chunker.ReplaceFile("file", Version{ID: "1"}, Condition{Absent: true})
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	_, err = chunker.ReplaceFile("file", Version{ID: "1"}, Condition{Checksums: [][]byte{[]byte("other")}})
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	_, err = chunker.ReplaceFile("missing", Version{ID: "1"}, Condition{Exists: true})
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	_, err = chunker.ReplaceFile("file", Version{ID: "2"}, Condition{Exists: true})
+	assert.ErrorIs(t, err, ErrFileNotFound, "data must be stored first")
+
+	replaced, err := chunker.ReplaceFile("file", Version{ID: "1"}, Condition{Exists: true, Checksums: [][]byte{[]byte("other"), []byte("old")}})
+	require.NoError(t, err)
+	assert.Equal(t, "file", replaced)
+	current, err := chunker.ResolveVersion("file", "")
+	require.NoError(t, err)
+	assert.Equal(t, VersionFileref("file", "1"), current)
+	files := chunker.ListFiles(DefaultBucket, "", "", 10)
+	require.Len(t, files, 1, "the replaced data is not listed even before it is deleted")
+	assert.EqualValues(t, 200, files[0].Size)
+	_, err = chunker.SplitToChunks("file", 100, storages)
+	assert.ErrorIs(t, err, ErrFileDuplicate, "a replaced file still exists")
+
+	chunker.DeleteChunks("file")
+	_, err = chunker.SplitToChunks(VersionFileref("file", "2"), 300, storages)
+	require.NoError(t, err)
+	replaced, err = chunker.ReplaceFile("file", Version{ID: "2"}, Condition{})
+	require.NoError(t, err)
+	assert.Equal(t, VersionFileref("file", "1"), replaced)
+	versions, err := chunker.Versions("file")
+	require.NoError(t, err)
+	assert.Len(t, versions, 1, "a bucket without versioning keeps only the current data")
+}
@@ -0,0 +1,196 @@
+package chunkmaster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+type walOp string
+
+const (
+	walOpSplit  walOp = "split"
+	walOpUpdate walOp = "update"
+	walOpDelete walOp = "delete"
+	walOpAppend walOp = "append"
+
+	walOpCreateBucket walOp = "create_bucket"
+	walOpDeleteBucket walOp = "delete_bucket"
+
+	walOpForgetContent walOp = "forget_content"
+
+	walOpVersions walOp = "versions"
+)
+
+// walRecord describes a single catalog mutation. Every record carries the full new value for its fileref or bucket,
+// and for contents which chunks of the file refer to, so replaying records which are already included into a snapshot is harmless
+type walRecord struct {
+	Op       walOp     `json:"op"`
+	Fileref  string    `json:"fileref"`
+	Chunks   []Chunk   `json:"chunks,omitempty"`
+	Bucket   *Bucket   `json:"bucket,omitempty"`
+	Contents []Content `json:"contents,omitempty"`
+	Versions []Version `json:"versions,omitempty"`
+}
+
+// each record on disk is: 4 bytes payload length | 4 bytes crc32 of payload | json payload
+const walHeaderSize = 8
+
+// maxWalPayloadSize bounds a record, so a garbage length does not make replay allocate gigabytes. append never writes a bigger one
+const maxWalPayloadSize = 256 << 20
+
+var (
+	errWalTornRecord = errors.New("torn wal record")
+	errWalCorrupted  = errors.New("corrupted wal record")
+)
+
+type writeAheadLog struct {
+	f    *os.File
+	size int64
+}
+
+func openWriteAheadLog(fullpath string) (*writeAheadLog, error) {
+	f, err := os.OpenFile(fullpath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open wal at %s: %w", fullpath, err)
+	}
+	return &writeAheadLog{f: f}, nil
+}
+
+// replay calls apply for every complete record in the log. A torn or corrupted tail (e.g. after a crash in the middle of append)
+// is cut off, so the next append continues right after the last good record. A bad record which is followed by more data cannot be
+// left by a crash, and cutting it off would lose acknowledged changes after it, so replay fails instead
+func (wal *writeAheadLog) replay(apply func(walRecord)) (int, error) {
+	info, err := wal.f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("cannot stat wal: %w", err)
+	}
+	if _, err := wal.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(wal.f)
+	var (
+		goodOffset int64
+		replayed   int
+	)
+	for {
+		record, size, err := readWalRecord(reader, info.Size()-goodOffset)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errWalTornRecord) {
+			if goodOffset+size < info.Size() {
+				return replayed, fmt.Errorf("%w at offset %d, %d bytes follow it: %w", errWalCorrupted, goodOffset, info.Size()-goodOffset-size, err)
+			}
+			if err := wal.f.Truncate(goodOffset); err != nil {
+				return replayed, fmt.Errorf("cannot cut torn wal tail at %d: %w", goodOffset, err)
+			}
+			break
+		}
+		if errors.Is(err, errWalCorrupted) {
+			return replayed, fmt.Errorf("wal record at offset %d: %w", goodOffset, err)
+		}
+		if err != nil {
+			return replayed, err
+		}
+		apply(record)
+		goodOffset += size
+		replayed++
+	}
+	wal.size = goodOffset
+	_, err = wal.f.Seek(goodOffset, io.SeekStart)
+	return replayed, err
+}
+
+// readWalRecord reads a record out of remaining bytes of the log. With errWalTornRecord the size is what the header claims,
+// which tells whether the bad record is the last one
+func readWalRecord(reader io.Reader, remaining int64) (walRecord, int64, error) {
+	var record walRecord
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return record, 0, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return record, int64(n), fmt.Errorf("%w: header has only %d bytes", errWalTornRecord, n)
+	}
+	if err != nil {
+		return record, 0, err
+	}
+	payloadLen := binary.BigEndian.Uint32(header[0:4])
+	expectedCrc := binary.BigEndian.Uint32(header[4:8])
+	size := walHeaderSize + int64(payloadLen)
+	// a crash tears only the payload of a record which append has allowed, so any other wrong length is a damaged header,
+	// and records after it must not be dropped with it
+	if payloadLen > maxWalPayloadSize {
+		return record, size, fmt.Errorf("%w: payload of %d bytes is too big", errWalCorrupted, payloadLen)
+	}
+	if size > remaining {
+		if remaining >= walHeaderSize+maxWalPayloadSize {
+			return record, size, fmt.Errorf("%w: payload of %d bytes is beyond the end of the log with %d bytes left", errWalCorrupted, payloadLen, remaining)
+		}
+		return record, size, fmt.Errorf("%w: payload of %d bytes is beyond the end of the log", errWalTornRecord, payloadLen)
+	}
+
+	payload := make([]byte, payloadLen)
+	_, err = io.ReadFull(reader, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return record, size, fmt.Errorf("%w: payload is shorter than %d bytes", errWalTornRecord, payloadLen)
+	}
+	if err != nil {
+		return record, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != expectedCrc {
+		return record, size, fmt.Errorf("%w: crc mismatch", errWalTornRecord)
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, size, fmt.Errorf("%w: %w", errWalTornRecord, err)
+	}
+	return record, size, nil
+}
+
+// append writes the record and syncs it to disk, so the record survives a crash once append returns
+func (wal *writeAheadLog) append(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot encode wal record: %w", err)
+	}
+	if len(payload) > maxWalPayloadSize {
+		return fmt.Errorf("wal record of %d bytes is too big", len(payload))
+	}
+	data := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	data = append(data, payload...)
+	_, err = wal.f.Write(data)
+	if err == nil {
+		err = wal.f.Sync()
+	}
+	if err != nil {
+		// do not leave a half-written record in the middle of the log, otherwise everything after it is lost on replay.
+		// The caller is going to undo the in-memory change, so the record must not survive either
+		wal.f.Truncate(wal.size)
+		wal.f.Seek(wal.size, io.SeekStart)
+		return fmt.Errorf("wal append failed: %w", err)
+	}
+	wal.size += int64(len(data))
+	return nil
+}
+
+func (wal *writeAheadLog) reset() error {
+	if err := wal.f.Truncate(0); err != nil {
+		return fmt.Errorf("wal truncate failed: %w", err)
+	}
+	wal.size = 0
+	_, err := wal.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (wal *writeAheadLog) close() error {
+	return wal.f.Close()
+}
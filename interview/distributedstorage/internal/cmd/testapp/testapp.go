@@ -19,8 +19,10 @@ const (
 
 func main() {
 	argApiHost := flag.String("apihost", "localhost:7001", "apiservice to connect to")
+	argApiKey := flag.String("apikey", "", "<key id>:<secret> if apiservice checks credentials")
+	flag.Parse()
 	for _, filesize := range []int{1, 5, 6, 7, kb, mb, gb, 30 * gb} {
-		err := runTest(filesize, *argApiHost)
+		err := runTest(filesize, *argApiHost, *argApiKey)
 		if err != nil {
 			slog.Error("test failed", "filesize", filesize, "err", err)
 			os.Exit(3)
@@ -28,7 +30,7 @@ func main() {
 	}
 }
 
-func runTest(filesize int, connectTo string) error {
+func runTest(filesize int, connectTo, apiKey string) error {
 	slog.Info("new random data", "filesize", filesize)
 	random, err := os.Open("/dev/random")
 	if err != nil {
@@ -45,6 +47,7 @@ func runTest(filesize int, connectTo string) error {
 		return err
 	}
 	reqWrite.ContentLength = int64(filesize)
+	setApiKey(reqWrite, apiKey)
 
 	_, err = http.DefaultClient.Do(reqWrite)
 	if err != nil {
@@ -59,6 +62,7 @@ func runTest(filesize int, connectTo string) error {
 	if err != nil {
 		return err
 	}
+	setApiKey(reqRead, apiKey)
 	respRead, err := http.DefaultClient.Do(reqRead)
 	if err != nil {
 		return err
@@ -88,3 +92,9 @@ func runTest(filesize int, connectTo string) error {
 
 	return nil
 }
+
+func setApiKey(req *http.Request, apiKey string) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
@@ -0,0 +1,371 @@
+package datadistributor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone = ""
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// minCompressedChunkSize keeps small files in few chunks: compression of tiny chunks gains nothing
+const minCompressedChunkSize = 64 * 1024
+
+// sniffSize is how much of a chunk is tried to be compressed to find out whether the whole chunk is worth it
+const sniffSize = 64 * 1024
+
+// Compression chooses codecs for chunks of new files. Chunks of erasure coded and deduplicated files are never compressed
+type Compression struct {
+	// Prefixes are codecs by fileref prefixes, the longest matching prefix wins. CodecNone turns compression off under a prefix
+	Prefixes map[string]string
+	// Sniff is the codec for chunks of other files which data looks compressible. CodecNone turns sniffing off
+	Sniff string
+}
+
+func ParseCodec(name string) (string, error) {
+	switch name {
+	case "", "none":
+		return CodecNone, nil
+	case CodecGzip, CodecZstd:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown codec %q, expected none, gzip or zstd", name)
+}
+
+// ParseCompressionPrefixes reads comma separated prefix=codec pairs, e.g. "logs/=zstd,logs/archive/=none"
+func ParseCompressionPrefixes(value string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	if value == "" {
+		return prefixes, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		prefix, name, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("%q is not prefix=codec", pair)
+		}
+		codec, err := ParseCodec(name)
+		if err != nil {
+			return nil, fmt.Errorf("prefix %q: %w", prefix, err)
+		}
+		prefixes[prefix] = codec
+	}
+	return prefixes, nil
+}
+
+// codecFor gives the codec configured for the file. sniff means that the codec is used only for data which looks compressible
+func (dd *DataDistributor) codecFor(inputFilename string) (codec string, sniff bool) {
+	// prefixes were given before slashed keys of the default bucket got the bucket name, so they are matched without it
+	if bucket, key := chunkmaster.SplitFileref(inputFilename); bucket == chunkmaster.DefaultBucket {
+		inputFilename = key
+	}
+	matched := -1
+	for prefix, prefixCodec := range dd.config.Compression.Prefixes {
+		if strings.HasPrefix(inputFilename, prefix) && len(prefix) > matched {
+			matched, codec = len(prefix), prefixCodec
+		}
+	}
+	if matched >= 0 {
+		return codec, false
+	}
+	return dd.config.Compression.Sniff, true
+}
+
+// compresses tells whether chunks of the file may be compressed
+func (dd *DataDistributor) compresses(inputFilename string) bool {
+	if codec, _ := dd.codecFor(inputFilename); codec == CodecNone {
+		return false
+	}
+	bucket, _ := chunkmaster.SplitFileref(inputFilename)
+	info, err := dd.chunkMaster.StatBucket(bucket)
+	return err == nil && info.Layout.ParityChunks == 0 && !info.Layout.Dedup
+}
+
+func (dd *DataDistributor) streamChunkSize() int64 {
+	if dd.config.StreamChunkSize <= 0 {
+		return DefaultStreamChunkSize
+	}
+	return dd.config.StreamChunkSize
+}
+
+// transforms tells whether chunks of the file are compressed or encrypted before they are sent
+func (dd *DataDistributor) transforms(inputFilename string) bool {
+	return dd.compresses(inputFilename) || dd.encrypts(inputFilename)
+}
+
+// transformedChunkSize spreads a file of known size among the chunks of its layout, the same way as other files are spread.
+// Every chunk is buffered in memory, so a chunk is never bigger than StreamChunkSize
+func (dd *DataDistributor) transformedChunkSize(inputFilename string, size int64) int64 {
+	chunkSize := dd.streamChunkSize()
+	bucket, _ := chunkmaster.SplitFileref(inputFilename)
+	info, err := dd.chunkMaster.StatBucket(bucket)
+	if err != nil {
+		return chunkSize
+	}
+	chunks := int64(info.Layout.Chunks)
+	return min(chunkSize, max((size+chunks-1)/chunks, minCompressedChunkSize))
+}
+
+// distributeTransformed stores a file which chunks are compressed or encrypted before they are sent. Every chunk is transformed in memory,
+// so it is placed only when its stored size is known, and storages, leases and quotas get only what is actually stored.
+// Chunks are read, transformed and placed one after another, but up to parallelism of them are sent at once, and a chunk is held
+// in memory only while it has a slot of the pool. It returns the size of the stored file
+func (dd *DataDistributor) distributeTransformed(ctx context.Context, inputFilename string, reader io.Reader, chunkSize int64) (int64, error) {
+	var (
+		dataKey, wrappedKey []byte
+		masterKeyID         string
+	)
+	if dd.encrypts(inputFilename) {
+		var err error
+		dataKey, masterKeyID, wrappedKey, err = dd.config.Keyring.NewDataKey()
+		if err != nil {
+			return 0, err
+		}
+	}
+	hasher := sha256.New()
+	reader = io.TeeReader(reader, hasher)
+	pool := newTransferPool(ctx, dd.parallelism())
+	var (
+		// transfers fill in their own chunks while new ones are appended here
+		mutex  sync.Mutex
+		chunks []chunkmaster.Chunk
+		size   int64
+	)
+	for order := uint32(0); ; order++ {
+		if !pool.acquire() {
+			break
+		}
+		data, err := io.ReadAll(io.LimitReader(reader, chunkSize))
+		if err == nil && len(data) == 0 && order > 0 {
+			pool.release()
+			break
+		}
+		if err != nil {
+			pool.release()
+			pool.fail(fmt.Errorf("cannot read chunk %d: %w", order, err))
+			break
+		}
+
+		codec, stored, err := dd.compressChunk(inputFilename, data)
+		var nonce []byte
+		if err == nil && dataKey != nil {
+			nonce, stored, err = sealChunk(dataKey, stored)
+		}
+		if err != nil {
+			pool.release()
+			pool.fail(fmt.Errorf("cannot transform chunk %d: %w", order, err))
+			break
+		}
+		chunk, err := dd.appendCompressedChunkReserveQuota(inputFilename, order, codec, int64(len(data)), int64(len(stored)))
+		if err != nil {
+			pool.release()
+			pool.fail(fmt.Errorf("quoting failed: %w", err))
+			break
+		}
+		chunk.Nonce = nonce
+		mutex.Lock()
+		chunks = append(chunks, chunk)
+		mutex.Unlock()
+		if full, err := dd.reserveLeases(ctx, inputFilename, []chunkmaster.Chunk{chunk}); err != nil {
+			pool.release()
+			dd.markFull(full)
+			pool.fail(fmt.Errorf("quoting failed: %w", err))
+			break
+		}
+
+		pool.run(func(ctx context.Context) error {
+			defer pool.release()
+			replicas, checksum, _, err := dd.storeChunkReplicas(ctx, chunkFileIdOf(inputFilename, chunk), chunk.Replicas, bytes.NewReader(stored))
+			if err != nil {
+				return fmt.Errorf("cannot save chunk %d with error: %w", chunk.Order, err)
+			}
+			if len(replicas) < len(chunk.Replicas) {
+				slog.Warn("chunk is under-replicated", "filename", inputFilename, "chunk", chunk.Order, "replicas", chunk.Replicas, "stored", replicas)
+			}
+			mutex.Lock()
+			chunks[order].Replicas = replicas
+			chunks[order].Checksum = checksum
+			settled := chunks[order]
+			mutex.Unlock()
+			dd.settleLeases(ctx, inputFilename, []chunkmaster.Chunk{chunk}, []chunkmaster.Chunk{settled})
+			return nil
+		})
+		size += int64(len(data))
+		if int64(len(data)) < chunkSize {
+			break
+		}
+	}
+	if err := pool.wait(); err != nil {
+		if len(chunks) > 0 {
+			dd.rollbackSave(ctx, inputFilename, chunks, len(chunks))
+		}
+		return 0, err
+	}
+
+	setFileChecksum(chunks, hasher.Sum(nil))
+	if dataKey != nil {
+		setDataKey(chunks, masterKeyID, wrappedKey)
+	}
+	err := dd.chunkMaster.FinishStream(inputFilename, chunks)
+	if err != nil {
+		dd.rollbackSave(ctx, inputFilename, chunks, len(chunks))
+		return 0, fmt.Errorf("cannot finish stream: %w", err)
+	}
+	return size, nil
+}
+
+func (dd *DataDistributor) appendCompressedChunkReserveQuota(inputFilename string, order uint32, codec string, logicalSize, size int64) (chunkmaster.Chunk, error) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	chunk, err := dd.chunkMaster.AppendCompressedChunk(inputFilename, order, codec, logicalSize, size, dd.aliveStorageInfo())
+	if err != nil {
+		return chunkmaster.Chunk{}, fmt.Errorf("cannot place chunk %d of %s: %w", order, inputFilename, err)
+	}
+	for _, storageID := range chunk.Replicas {
+		dd.knownStorages[storageID].availableBytes -= size
+	}
+	return chunk, nil
+}
+
+// compressChunk gives the codec and the data to store. Data which does not become smaller is stored as it is
+func (dd *DataDistributor) compressChunk(inputFilename string, data []byte) (string, []byte, error) {
+	codec, sniff := dd.codecFor(inputFilename)
+	if codec == CodecNone || (sniff && !looksCompressible(data)) {
+		return CodecNone, data, nil
+	}
+	compressed, err := compress(codec, data)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(compressed) >= len(data) {
+		return CodecNone, data, nil
+	}
+	return codec, compressed, nil
+}
+
+// zstdEncoder is safe for concurrent EncodeAll calls
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CodecGzip:
+		var buffer bytes.Buffer
+		w := gzip.NewWriter(&buffer)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+func decompressor(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// compressedMagics start data which is compressed already: gzip, zstd, zip, xz, bzip2, png, jpeg
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b}, {0x28, 0xb5, 0x2f, 0xfd}, []byte("PK\x03\x04"), {0xfd, '7', 'z', 'X', 'Z'}, []byte("BZh"),
+	{0x89, 'P', 'N', 'G'}, {0xff, 0xd8, 0xff},
+}
+
+// looksCompressible compresses the beginning of the data with the fastest level and checks that it shrinks by at least a tenth
+func looksCompressible(data []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(data, magic) {
+			return false
+		}
+	}
+	sample := data[:min(len(data), sniffSize)]
+	var buffer bytes.Buffer
+	w, _ := flate.NewWriter(&buffer, flate.BestSpeed)
+	w.Write(sample)
+	w.Close()
+	return buffer.Len() < len(sample)*9/10
+}
+
+// retrieveTransformedChunk reads a chunk which stored data differs from the data of the file. A compressed chunk is read as a whole,
+// as a position in the file says nothing about its position in compressed data, and is verified against its checksum.
+// Only the segments which have the range are read of an encrypted chunk which is not compressed, they are verified by decryption.
+// dataKey is nil for a chunk which is not encrypted. Only length bytes starting from offset are written
+func retrieveTransformedChunk(ctx context.Context, st storage.Storage, chunkFileId string, chunk chunkmaster.Chunk, dataKey []byte, offset, length int64, writer io.Writer) error {
+	if length == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	retrieve := func(w io.Writer) error {
+		return st.RetrieveChunk(ctx, chunkFileId, chunk.Checksum, w)
+	}
+	var segment uint64
+	if chunk.Codec == CodecNone && dataKey != nil {
+		var from, to int64
+		from, to, segment = sealedRange(offset, length)
+		to = min(to, chunk.Size)
+		offset -= int64(segment) * encryptionSegmentSize
+		if from > 0 || to < chunk.Size {
+			retrieve = func(w io.Writer) error {
+				// segments are verified by decryption, the whole chunk is not read for them
+				return st.RetrieveChunkRange(ctx, chunkFileId, nil, from, to-from, w)
+			}
+		}
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(retrieve(pipeWriter))
+	}()
+	defer pipeReader.Close()
+
+	var data io.Reader = pipeReader
+	if dataKey != nil {
+		opened, err := newOpeningReader(dataKey, chunk.Nonce, segment, data)
+		if err != nil {
+			return fmt.Errorf("cannot decrypt %s: %w", chunkFileId, err)
+		}
+		data = opened
+	}
+	if chunk.Codec != CodecNone {
+		decompressed, err := decompressor(chunk.Codec, data)
+		if err != nil {
+			return fmt.Errorf("cannot decompress %s: %w", chunkFileId, err)
+		}
+		defer decompressed.Close()
+		data = decompressed
+	}
+	if _, err := io.CopyN(io.Discard, data, offset); err != nil {
+		return fmt.Errorf("cannot read %s: %w", chunkFileId, err)
+	}
+	if _, err := io.CopyN(writer, data, length); err != nil {
+		return fmt.Errorf("cannot read %s: %w", chunkFileId, err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCompressionCluster(t *testing.T, compression Compression) (*testCluster, chunkmaster.ChunkMaster) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2})
+	cluster := newTestClusterWithConfig(t, 4, chunkMaster, Config{StreamChunkSize: 100_000, Compression: compression})
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "logs", Layout: chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2}}))
+	return cluster, chunkMaster
+}
+
+// logLines compress well, but still are different all over the place
+func logLines(size int) []byte {
+	var buffer bytes.Buffer
+	for i := 0; buffer.Len() < size; i++ {
+		fmt.Fprintf(&buffer, `{"level":"info","msg":"request served","request_id":%d,"status":%d}`+"\n", i*7919, 200+i%3)
+	}
+	return buffer.Bytes()[:size]
+}
+
+func TestCompressedFileIsRestored(t *testing.T) {
+	for _, codec := range []string{CodecZstd, CodecGzip} {
+		cluster, chunkMaster := newCompressionCluster(t, Compression{Prefixes: map[string]string{"logs/": codec}})
+		data := logLines(250_000)
+		require.NoError(t, cluster.store("logs/app.log", data))
+
+		chunks, err := chunkMaster.ChunksToRestore("logs/app.log")
+		require.NoError(t, err)
+		require.Len(t, chunks, 3, "the file is spread by its layout")
+		var logical int64
+		for _, chunk := range chunks {
+			assert.Equal(t, codec, chunk.Codec)
+			assert.Less(t, 5*chunk.Size, chunk.LogicalSize)
+			logical += chunk.LogicalSize
+		}
+		assert.EqualValues(t, len(data), logical)
+		assert.Less(t, cluster.storages["storage-0"].storedBytes()+cluster.storages["storage-1"].storedBytes()+
+			cluster.storages["storage-2"].storedBytes()+cluster.storages["storage-3"].storedBytes(), int64(len(data)/2))
+
+		restored, err := cluster.retrieve("logs/app.log")
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, codec)
+		for _, r := range []struct{ offset, length int64 }{{0, 10}, {83_330, 10}, {83_000, 100_000}, {249_990, 10}, {12345, 0}} {
+			part, err := cluster.retrieveRange("logs/app.log", r.offset, r.length)
+			require.NoError(t, err)
+			assert.Equal(t, data[r.offset:r.offset+r.length], part, "%s offset %d length %d", codec, r.offset, r.length)
+		}
+	}
+}
+
+func TestIncompressibleChunksAreStoredAsTheyAre(t *testing.T) {
+	cluster, chunkMaster := newCompressionCluster(t, Compression{Sniff: CodecZstd, Prefixes: map[string]string{"logs/raw/": CodecNone}})
+	files := map[string][]byte{
+		"logs/random.bin":  randomData(200_000),
+		"logs/app.log":     logLines(200_000),
+		"logs/raw/app.log": logLines(200_001),
+	}
+	for fileref, data := range files {
+		require.NoError(t, cluster.store(fileref, data))
+		restored, err := cluster.retrieve(fileref)
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, fileref)
+	}
+
+	codecs := func(fileref string) []string {
+		chunks, err := chunkMaster.ChunksToRestore(fileref)
+		require.NoError(t, err)
+		var codecs []string
+		for _, chunk := range chunks {
+			codecs = append(codecs, chunk.Codec)
+		}
+		return codecs
+	}
+	assert.Equal(t, []string{CodecNone, CodecNone, CodecNone}, codecs("logs/random.bin"))
+	assert.Equal(t, []string{CodecZstd, CodecZstd, CodecZstd}, codecs("logs/app.log"))
+	assert.Equal(t, []string{CodecNone, CodecNone, CodecNone}, codecs("logs/raw/app.log"))
+}
+
+func TestCompressedStream(t *testing.T) {
+	cluster, chunkMaster := newCompressionCluster(t, Compression{Prefixes: map[string]string{"logs/": CodecZstd}})
+	data := logLines(250_000)
+	stored, err := cluster.dd.DistributeStream(context.Background(), "logs/app.log", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), stored)
+	chunks, err := chunkMaster.ChunksToRestore("logs/app.log")
+	require.NoError(t, err)
+	assert.Len(t, chunks, 3, "chunks are of stream chunk size")
+	info, err := cluster.dd.StatFile("logs/app.log")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), info.Size)
+
+	restored, err := cluster.retrieve("logs/app.log")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestCompressedChunksAreTransferredConcurrently(t *testing.T) {
+	compression := Compression{Prefixes: map[string]string{"": CodecZstd}}
+	cluster, meter := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}, Config{Parallelism: 3, StreamChunkSize: 100_000, Compression: compression}, 10*time.Millisecond)
+	data := logLines(600_000)
+	_, err := cluster.dd.DistributeStream(context.Background(), "app.log", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 3, meter.peakValue(), "streamed chunks are stored at once too, but no more than parallelism")
+	chunks, err := cluster.dd.chunkMaster.ChunksToRestore("app.log")
+	require.NoError(t, err)
+	require.Len(t, chunks, 6)
+	for _, chunk := range chunks {
+		assert.Equal(t, CodecZstd, chunk.Codec)
+	}
+	restored, err := cluster.retrieve("app.log")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestBucketQuotaCountsCompressedBytes(t *testing.T) {
+	cluster, _ := newCompressionCluster(t, Compression{Prefixes: map[string]string{"small/": CodecZstd}})
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "small", Layout: chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1}, QuotaBytes: 50_000}))
+	require.NoError(t, cluster.store("small/app.log", logLines(200_000)))
+	info, err := cluster.dd.StatBucket("small")
+	require.NoError(t, err)
+	assert.Less(t, info.UsedBytes, int64(50_000))
+	assert.ErrorIs(t, cluster.store("small/random.bin", randomData(60_000)), chunkmaster.ErrBucketQuotaExceeded)
+}
+
+func TestCompressedReadSurvivesReplicaLoss(t *testing.T) {
+	cluster, chunkMaster := newCompressionCluster(t, Compression{Prefixes: map[string]string{"logs/": CodecZstd}})
+	data := logLines(250_000)
+	require.NoError(t, cluster.store("logs/app.log", data))
+	chunks, err := chunkMaster.ChunksToRestore("logs/app.log")
+	require.NoError(t, err)
+	cluster.storages[chunks[1].Replicas[0]].setDown(true)
+
+	part, err := cluster.retrieveRange("logs/app.log", 90_000, 100_000)
+	require.NoError(t, err)
+	assert.Equal(t, data[90_000:190_000], part)
+}
+
+func TestCorruptedCompressedReplicaIsRepaired(t *testing.T) {
+	cluster, chunkMaster := newCompressionCluster(t, Compression{Prefixes: map[string]string{"logs/": CodecZstd}})
+	data := logLines(250_000)
+	require.NoError(t, cluster.store("logs/app.log", data))
+	chunks, err := chunkMaster.ChunksToRestore("logs/app.log")
+	require.NoError(t, err)
+
+	chunkFileId := chunkFileIdOf("logs/app.log", chunks[0])
+	corrupted, healthy := cluster.storages[chunks[0].Replicas[0]], cluster.storages[chunks[0].Replicas[1]]
+	corrupted.corruptAll()
+	cluster.repair(t, chunks[0].Replicas[0], chunkFileId)
+	assert.Equal(t, healthy.chunk(chunkFileId), corrupted.chunk(chunkFileId))
+	healthy.setDown(true)
+	restored, err := cluster.retrieveRange("logs/app.log", 0, chunks[0].LogicalSize)
+	require.NoError(t, err)
+	assert.Equal(t, data[:chunks[0].LogicalSize], restored)
+}
+
+func TestParseCompressionPrefixes(t *testing.T) {
+	prefixes, err := ParseCompressionPrefixes("logs/=zstd,logs/archive/=none,json/=gzip")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"logs/": CodecZstd, "logs/archive/": CodecNone, "json/": CodecGzip}, prefixes)
+	prefixes, err = ParseCompressionPrefixes("")
+	require.NoError(t, err)
+	assert.Empty(t, prefixes)
+	for _, bad := range []string{"logs/", "logs/=lz4", "logs/=zstd,"} {
+		_, err = ParseCompressionPrefixes(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -1,144 +1,650 @@
 package datadistributor
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/keyring"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls"
 	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
 	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
+var ErrInvalidRange = errors.New("range is outside of the file")
+
 type storageMeta struct {
 	storageID      string
 	storage        storage.Storage
 	availableBytes int64
+	labels         chunkmaster.Labels
+	state          StorageState
+	// draining storage gets no new chunks, its chunks are being moved away
+	draining      bool
+	lastHeartbeat time.Time
 }
 
 type ConnectStorageFunc func(string) (storage.Storage, error)
 
+type Config struct {
+	// WriteQuorum is the number of replicas which must store a chunk for the chunk to be accepted. 0 means a majority of replicas
+	WriteQuorum int
+	// SuspectAfter is the heartbeat silence after which a storage is not used for new chunks. 0 disables liveness tracking
+	SuspectAfter time.Duration
+	// DeadAfter is the heartbeat silence after which chunks on a storage are considered lost
+	DeadAfter time.Duration
+	// StreamChunkSize is the size of chunks of a file which size is not known in advance. 0 means DefaultStreamChunkSize
+	StreamChunkSize int64
+	// Parallelism is the number of chunks of a file which are stored or read at once. 0 means DefaultParallelism
+	Parallelism int
+	// ChunkBufferSize is the number of bytes buffered in memory for every chunk being transferred. 0 means DefaultChunkBufferSize
+	ChunkBufferSize int
+	// DedupChunkSize is the average size of chunks of files in deduplicated buckets. 0 means DefaultDedupChunkSize
+	DedupChunkSize int
+	// Compression is off unless codecs are set
+	Compression Compression
+	// Keyring turns on encryption of chunks of new files. Files which have been encrypted cannot be read without it
+	Keyring *keyring.Keyring
+}
+
+const DefaultStreamChunkSize = 64 * 1024 * 1024
+
 type DataDistributor struct {
 	inventorypb.UnsafeStorageInventoryServer
-	knownStorages  map[string]*storageMeta
+	knownStorages map[string]*storageMeta
+	// decommissioned storages have been drained and forgotten, they must not come back by sending a heartbeat
+	decommissioned map[string]bool
 	storageCreator ConnectStorageFunc
 	storageMutex   sync.Mutex
 
 	chunkMaster chunkmaster.ChunkMaster
+	config      Config
+	now         func() time.Time
+
+	// skippedChunks and storedChunks count chunks of deduplicated uploads
+	skippedChunks atomic.Int64
+	storedChunks  atomic.Int64
+	// rollbacks counts uploads which chunks have been removed after a failure
+	rollbacks atomic.Int64
+
+	// readers counts reads by catalog fileref, and data which has been replaced is deleted only after the last of them, see PinVersion
+	readMutex sync.Mutex
+	readers   map[string]int
+	unread    map[string]bool
 }
 
-func NewDataDistributor(chunkMaster chunkmaster.ChunkMaster, connectFunc ConnectStorageFunc) *DataDistributor {
+func NewDataDistributor(chunkMaster chunkmaster.ChunkMaster, connectFunc ConnectStorageFunc, config Config) *DataDistributor {
 	return &DataDistributor{
 		chunkMaster:    chunkMaster,
 		storageCreator: connectFunc,
 		knownStorages:  make(map[string]*storageMeta),
+		decommissioned: make(map[string]bool),
+		readers:        make(map[string]int),
+		unread:         make(map[string]bool),
+		config:         config,
+		now:            time.Now,
 	}
 }
 
+// DistributeData stores a new file of known size. In a bucket with versioning it becomes a new current version of the file
 func (dd *DataDistributor) DistributeData(ctx context.Context, inputFilename string, size int64, reader io.Reader) error {
-	chunks, err := dd.determineChunksReserveQuota(inputFilename, size)
+	return dd.DistributeDataIf(ctx, inputFilename, chunkmaster.Condition{}, size, reader)
+}
+
+// DistributeDataIf is DistributeData which stores the file only if the condition holds for the current one, see storeVersion
+func (dd *DataDistributor) DistributeDataIf(ctx context.Context, inputFilename string, condition chunkmaster.Condition, size int64, reader io.Reader) error {
+	if err := chunkmaster.ValidateKey(inputFilename); err != nil {
+		return err
+	}
+	_, err := dd.storeVersion(ctx, inputFilename, condition, func(catalogFileref string) (int64, error) {
+		return size, dd.distributeData(ctx, catalogFileref, size, reader)
+	})
+	return err
+}
+
+func (dd *DataDistributor) distributeData(ctx context.Context, inputFilename string, size int64, reader io.Reader) error {
+	if dd.deduplicates(inputFilename) {
+		_, err := dd.distributeContent(ctx, inputFilename, exactReader(reader, size))
+		return err
+	}
+	if dd.transforms(inputFilename) {
+		_, err := dd.distributeTransformed(ctx, inputFilename, exactReader(reader, size), dd.transformedChunkSize(inputFilename, size))
+		return err
+	}
+	chunks, err := dd.determineChunksReserveQuota(ctx, inputFilename, size)
 	if err != nil {
 		return fmt.Errorf("quoting failed: %w", err)
 	}
+	// storeChunks replaces replicas of chunks with those which have stored them, but leases are held by all planned ones
+	planned := slices.Clone(chunks)
+
+	var parity *parityBuilder
+	dataShards, parityShards := erasureShards(chunks)
+	if parityShards > 0 {
+		parity, err = newParityBuilder(dataShards, parityShards, chunks[0].Size)
+		if err != nil {
+			dd.rollbackSave(ctx, inputFilename, planned, 0)
+			return err
+		}
+		defer parity.close()
+	}
+
+	hasher := sha256.New()
+	err = dd.storeChunks(ctx, inputFilename, chunks, io.TeeReader(reader, hasher), parity)
+	if err != nil {
+		dd.rollbackSave(ctx, inputFilename, planned, len(chunks))
+		return err
+	}
+	setFileChecksum(chunks, hasher.Sum(nil))
 
+	// checksums become known only now. Also replicas which failed must not be used for reading
+	err = dd.chunkMaster.UpdateChunks(inputFilename, chunks)
+	if err != nil {
+		dd.rollbackSave(ctx, inputFilename, planned, len(chunks))
+		return fmt.Errorf("cannot update chunks: %w", err)
+	}
+	dd.settleLeases(ctx, inputFilename, planned, chunks)
+	return nil
+}
+
+func setFileChecksum(chunks []chunkmaster.Chunk, checksum []byte) {
+	for i := range chunks {
+		chunks[i].FileChecksum = checksum
+	}
+}
+
+// storeChunks reads data of chunks one after another, but stores up to parallelism chunks at once.
+// Every chunk being stored buffers up to chunkBufferSize bytes, so reading of the next chunk can start while the previous one is still being sent.
+// Data chunks go first, so parity is complete by the time parity chunks are stored
+func (dd *DataDistributor) storeChunks(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk, reader io.Reader, parity *parityBuilder) error {
+	dataShards, _ := erasureShards(chunks)
+	pool := newTransferPool(ctx, dd.parallelism())
 	for i, chunk := range chunks {
 		if i != int(chunk.Order) {
 			panic("chunks are not ordered")
 		}
+		if !pool.acquire() {
+			break
+		}
 
-		storage, found := dd.knownStorages[chunk.StorageInstance]
-		if !found {
-			dd.rollbackSave(ctx, inputFilename, chunks, i)
-			return fmt.Errorf("storage instance %s missing", chunk.StorageInstance)
+		pipe := newChunkPipe(pool.ctx, dd.chunkBufferSize())
+		pool.run(func(ctx context.Context) error {
+			defer pool.release()
+			chunkFileId := chunkFileIdOf(inputFilename, chunk)
+			stored, checksum, _, err := dd.storeChunkReplicas(ctx, chunkFileId, chunk.Replicas, pipe)
+			if err != nil {
+				pipe.CloseRead(err)
+				return fmt.Errorf("cannot save chunk %d with error: %w", chunk.Order, err)
+			}
+			if len(stored) < len(chunk.Replicas) {
+				slog.Warn("chunk is under-replicated", "filename", inputFilename, "chunk", chunk.Order, "replicas", chunk.Replicas, "stored", stored)
+			}
+			// every transfer owns its own element
+			chunks[i].Replicas = stored
+			chunks[i].Checksum = checksum
+			return nil
+		})
+
+		chunkReader := reader
+		if parity != nil {
+			if chunk.Role == chunkmaster.ChunkRoleParity {
+				chunkReader = parity.parityReader(i - dataShards)
+			} else {
+				chunkReader = parity.dataReader(i, paddedReader(reader, chunk.DataSize(), chunk.Size))
+			}
 		}
-		// I don't think it is worth paralleling things here. Concurrent execution would help only if access to our storages is a bottleneck
-		chunkReader := io.LimitReader(reader, chunk.Size)
-		chunkFileId := incomingFilenameToChunkFileId(inputFilename, chunk.Order)
-		err := storage.storage.StoreChunk(ctx, chunkFileId, chunkReader)
+		_, err := io.Copy(pipe, exactReader(chunkReader, chunk.Size))
+		pipe.CloseWithError(err)
 		if err != nil {
-			dd.rollbackSave(ctx, inputFilename, chunks, i)
-			return fmt.Errorf("cannot save chunk %d on instance %s with error: %w", chunk.Order, chunk.StorageInstance, err)
+			pool.fail(fmt.Errorf("cannot read chunk %d: %w", chunk.Order, err))
+			break
 		}
 	}
-	return nil
+	return pool.wait()
 }
 
-func (dd *DataDistributor) determineChunksReserveQuota(inputFilename string, size int64) ([]chunkmaster.Chunk, error) {
-	// we're going to reserve the quotas from instances
+// storeChunkReplicas streams everything from reader to all replicas at once. It succeeds when at least write quorum of replicas has stored the data
+// and returns those replicas with the checksum and the size of the data. If the quorum is not reached, the replicas which managed to store the data are cleaned up
+func (dd *DataDistributor) storeChunkReplicas(ctx context.Context, chunkFileId string, replicas []string, reader io.Reader) ([]string, []byte, int64, error) {
+	type replicaResult struct {
+		storageID string
+		checksum  []byte
+		err       error
+	}
+	results := make(chan replicaResult, len(replicas))
+	fanout := &fanoutWriter{}
+	for _, storageID := range replicas {
+		meta, found := dd.lookupStorage(storageID)
+		if !found {
+			results <- replicaResult{storageID: storageID, err: fmt.Errorf("storage instance %s missing", storageID)}
+			continue
+		}
+		pipeReader, pipeWriter := io.Pipe()
+		fanout.add(pipeWriter)
+		go func() {
+			checksum, err := meta.storage.StoreChunk(ctx, chunkFileId, pipeReader)
+			if err != nil {
+				pipeReader.CloseWithError(err)
+			} else {
+				pipeReader.CloseWithError(errReplicaStoppedReading)
+			}
+			results <- replicaResult{storageID: storageID, checksum: checksum, err: err}
+		}()
+	}
+
+	written, copyErr := io.Copy(fanout, reader)
+	if errors.Is(copyErr, errNoLiveReplicas) {
+		// every replica has already reported its own error
+		copyErr = nil
+	}
+	fanout.close(copyErr)
+
+	stored := make([]string, 0, len(replicas))
+	var (
+		checksum []byte
+		errs     []error
+	)
+	for range replicas {
+		res := <-results
+		if res.err == nil && checksum != nil && !bytes.Equal(checksum, res.checksum) {
+			// all replicas get the same stream, so this is a bug rather than corruption
+			res.err = fmt.Errorf("%w: replica has stored different data", storage.ErrChecksumMismatch)
+		}
+		if res.err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", res.storageID, res.err))
+			continue
+		}
+		stored = append(stored, res.storageID)
+		checksum = res.checksum
+	}
+
+	quorum := dd.quorumFor(len(replicas))
+	if copyErr == nil && len(stored) < quorum {
+		copyErr = fmt.Errorf("write quorum %d not reached, stored %d of %d: %w", quorum, len(stored), len(replicas), errors.Join(errs...))
+	}
+	if copyErr != nil {
+		for _, storageID := range stored {
+			meta, _ := dd.lookupStorage(storageID)
+			meta.storage.DeleteChunk(ctx, chunkFileId)
+		}
+		return nil, nil, 0, copyErr
+	}
+	if len(errs) > 0 {
+		slog.Warn("some replicas failed", "file_id", chunkFileId, "err", errors.Join(errs...))
+	}
+	return stored, checksum, written, nil
+}
+
+func (dd *DataDistributor) quorumFor(replicas int) int {
+	if dd.config.WriteQuorum > 0 {
+		return min(dd.config.WriteQuorum, replicas)
+	}
+	return replicas/2 + 1
+}
+
+func (dd *DataDistributor) lookupStorage(storageID string) (*storageMeta, bool) {
 	dd.storageMutex.Lock()
 	defer dd.storageMutex.Unlock()
-	storageInfo := make(map[string]chunkmaster.StorageInfo, len(dd.knownStorages))
-	for _, storageMeta := range dd.knownStorages {
-		storageInfo[storageMeta.storageID] = chunkmaster.StorageInfo{
-			StorageID:      storageMeta.storageID,
-			AvailableBytes: storageMeta.availableBytes,
+	meta, found := dd.knownStorages[storageID]
+	return meta, found
+}
+
+// determineChunksReserveQuota places chunks and makes storages lease space for them. If a storage turns out to have
+// less space than it has reported, chunks are placed again without it
+func (dd *DataDistributor) determineChunksReserveQuota(ctx context.Context, inputFilename string, size int64) ([]chunkmaster.Chunk, error) {
+	for attempt := 1; ; attempt++ {
+		chunks, err := dd.splitToChunks(inputFilename, size)
+		if err != nil {
+			return nil, err
+		}
+		full, err := dd.reserveLeases(ctx, inputFilename, chunks)
+		if err == nil {
+			return chunks, nil
 		}
+		dd.rollbackSave(ctx, inputFilename, chunks, 0)
+		dd.markFull(full)
+		if !errors.Is(err, storage.ErrNotEnoughSpace) || attempt == reserveAttempts {
+			return nil, err
+		}
+		slog.Info("storage has refused to reserve space, placing chunks again", "filename", inputFilename, "attempt", attempt, "err", err)
 	}
+}
 
-	chunks, err := dd.chunkMaster.SplitToChunks(inputFilename, size, storageInfo)
+// splitToChunks places chunks among storages which seem to have enough space and takes the space from the estimate
+func (dd *DataDistributor) splitToChunks(inputFilename string, size int64) ([]chunkmaster.Chunk, error) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	chunks, err := dd.chunkMaster.SplitToChunks(inputFilename, size, dd.aliveStorageInfo())
 	if err != nil {
 		return nil, fmt.Errorf("split to chunks failed for %s: %w", inputFilename, err)
 	}
 
 	for _, chunk := range chunks {
-		storageMeta := dd.knownStorages[chunk.StorageInstance]
-		storageMeta.availableBytes -= chunk.Size
-		// it is likely OK that we have negative here, though it's undesirable.
-		// The storage will reject the payload
+		for _, storageID := range chunk.Replicas {
+			dd.knownStorages[storageID].availableBytes -= chunk.Size
+		}
 	}
 
 	return chunks, nil
 }
 
+// aliveStorageInfo gives storages which can take new chunks. It must be called with storageMutex held
+func (dd *DataDistributor) aliveStorageInfo() map[string]chunkmaster.StorageInfo {
+	storageInfo := make(map[string]chunkmaster.StorageInfo, len(dd.knownStorages))
+	for _, storageMeta := range dd.knownStorages {
+		if storageMeta.state != StorageAlive || storageMeta.draining {
+			continue
+		}
+		storageInfo[storageMeta.storageID] = chunkmaster.StorageInfo{
+			StorageID:      storageMeta.storageID,
+			AvailableBytes: storageMeta.availableBytes,
+			Labels:         storageMeta.labels,
+		}
+	}
+	return storageInfo
+}
+
 func (dd *DataDistributor) rollbackSave(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk, failedChunk int) {
 	slog.Warn("rollback", "filename", inputFilename, "failed_chunk", failedChunk)
+	dd.rollbacks.Add(1)
+	// the upload may have failed exactly because it has been cancelled, but its chunks must be removed anyway
+	ctx = context.WithoutCancel(ctx)
 	dd.storageMutex.Lock()
 	for i, chunk := range chunks {
-		storage := dd.knownStorages[chunk.StorageInstance]
-		storage.availableBytes -= chunk.Size
-		if i < failedChunk {
-			storage.storage.DeleteChunk(ctx, incomingFilenameToChunkFileId(inputFilename, uint32(i)))
+		for _, storageID := range chunk.Replicas {
+			storage, found := dd.knownStorages[storageID]
+			if !found {
+				continue
+			}
+			storage.giveBack(chunk.Size)
+			// data of deduplicated chunks is deleted once nobody refers to it
+			if i < failedChunk && chunk.ContentID == "" {
+				storage.storage.DeleteChunk(ctx, chunkFileIdOf(inputFilename, chunk))
+			}
 		}
 	}
 	dd.storageMutex.Unlock()
+	dd.releaseLeases(ctx, inputFilename, chunks)
 	dd.chunkMaster.DeleteChunks(inputFilename)
+	dd.collectGarbage(ctx)
 }
 
+// ReconstructData gives the whole file, or its current version in a bucket with versioning
 func (dd *DataDistributor) ReconstructData(ctx context.Context, inputFilename string, writer io.Writer) error {
-	chunks, err := dd.chunkMaster.ChunksToRestore(inputFilename)
+	catalogFileref, release, err := dd.PinVersion(ctx, inputFilename, "")
+	if err != nil {
+		return err
+	}
+	defer release()
+	chunks, err := dd.chunkMaster.ChunksToRestore(catalogFileref)
 	if err != nil {
 		return fmt.Errorf("cannot restore chunks for %s: %w", inputFilename, err)
 	}
+	return dd.reconstruct(ctx, catalogFileref, chunks, 0, fileSize(chunks), writer)
+}
 
+// ReconstructRange gives length bytes of the file starting from offset. Only chunks which overlap with the range are read
+func (dd *DataDistributor) ReconstructRange(ctx context.Context, inputFilename string, offset, length int64, writer io.Writer) error {
+	catalogFileref, release, err := dd.PinVersion(ctx, inputFilename, "")
+	if err != nil {
+		return err
+	}
+	defer release()
+	chunks, err := dd.chunkMaster.ChunksToRestore(catalogFileref)
+	if err != nil {
+		return fmt.Errorf("cannot restore chunks for %s: %w", inputFilename, err)
+	}
+	size := fileSize(chunks)
+	if offset < 0 || length < 0 || offset+length > size {
+		return fmt.Errorf("%w: offset %d length %d, file size %d", ErrInvalidRange, offset, length, size)
+	}
+	return dd.reconstruct(ctx, catalogFileref, chunks, offset, length, writer)
+}
+
+func (dd *DataDistributor) FileSize(inputFilename string) (int64, error) {
+	catalogFileref, err := dd.ResolveVersion(inputFilename, "")
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := dd.chunkMaster.ChunksToRestore(catalogFileref)
+	if err != nil {
+		return 0, fmt.Errorf("cannot find chunks for %s: %w", inputFilename, err)
+	}
+	return fileSize(chunks), nil
+}
+
+func (dd *DataDistributor) StatFile(inputFilename string) (chunkmaster.FileInfo, error) {
+	catalogFileref, err := dd.ResolveVersion(inputFilename, "")
+	if err != nil {
+		return chunkmaster.FileInfo{}, err
+	}
+	return dd.chunkMaster.StatFile(catalogFileref)
+}
+
+func (dd *DataDistributor) ListFiles(bucket, prefix, after string, limit int) []chunkmaster.FileInfo {
+	return dd.chunkMaster.ListFiles(bucket, prefix, after, limit)
+}
+
+func (dd *DataDistributor) CreateBucket(bucket chunkmaster.Bucket) error {
+	return dd.chunkMaster.CreateBucket(bucket)
+}
+
+func (dd *DataDistributor) DeleteBucket(name string) error {
+	return dd.chunkMaster.DeleteBucket(name)
+}
+
+func (dd *DataDistributor) StatBucket(name string) (chunkmaster.BucketInfo, error) {
+	return dd.chunkMaster.StatBucket(name)
+}
+
+func (dd *DataDistributor) Buckets() []chunkmaster.BucketInfo {
+	return dd.chunkMaster.Buckets()
+}
+
+// DeleteData removes the file. In a bucket with versioning it only makes a tombstone, so older versions can still be read
+func (dd *DataDistributor) DeleteData(ctx context.Context, inputFilename string) error {
+	if dd.versions(inputFilename) {
+		return dd.publishTombstone(inputFilename)
+	}
+	catalogFileref, err := dd.ResolveVersion(inputFilename, "")
+	if err != nil {
+		return err
+	}
+	// a file which has been replaced keeps its data as its only version
+	if _, versionID := chunkmaster.SplitVersionFileref(catalogFileref); versionID != "" {
+		return dd.DeleteVersion(ctx, inputFilename, versionID)
+	}
+	return dd.deleteFile(ctx, inputFilename)
+}
+
+// deleteFile removes chunks of the file from every replica and then the file from the catalog.
+// A replica which cannot delete its chunk right now (e.g. it is dead) does not stop the deletion; the chunk is left there as garbage.
+// Deduplicated chunks are deleted only when no other file refers to their content
+func (dd *DataDistributor) deleteFile(ctx context.Context, inputFilename string) error {
+	chunks, err := dd.chunkMaster.ChunksToRestore(inputFilename)
+	if err != nil {
+		return fmt.Errorf("cannot find chunks for %s: %w", inputFilename, err)
+	}
+	for _, chunk := range chunks {
+		if chunk.ContentID != "" {
+			continue
+		}
+		chunkFileId := incomingFilenameToChunkFileId(inputFilename, chunk.Order)
+		for _, storageID := range chunk.Replicas {
+			meta, found := dd.lookupStorage(storageID)
+			if !found {
+				slog.Warn("storage instance missing, chunk is left", "file_id", chunkFileId, "storage_id", storageID)
+				continue
+			}
+			if err := meta.storage.DeleteChunk(ctx, chunkFileId); err != nil {
+				slog.Warn("cannot delete chunk, it is left", "file_id", chunkFileId, "storage_id", storageID, "err", err)
+			}
+		}
+	}
+	dd.chunkMaster.DeleteChunks(inputFilename)
+	dd.collectGarbage(ctx)
+	return nil
+}
+
+func fileSize(chunks []chunkmaster.Chunk) int64 {
+	if len(chunks) == 0 {
+		return 0
+	}
+	return chunks[0].FileSize
+}
+
+// reconstruct reads up to parallelism chunks at once and writes them to writer in order. Every chunk being read buffers up to chunkBufferSize bytes
+// until writer gets to it; its slot is freed only when writer has got all of it, so memory stays bounded however slow writer is
+func (dd *DataDistributor) reconstruct(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk, offset, length int64, writer io.Writer) error {
+	type chunkPart struct {
+		idx            int
+		offset, length int64
+	}
+	end := offset + length
+	parts := make([]chunkPart, 0, len(chunks))
 	for i, chunk := range chunks {
 		if i != int(chunk.Order) {
 			panic("incorrect chunk order")
 		}
+		if chunk.Role == chunkmaster.ChunkRoleParity {
+			break
+		}
+		dataSize := chunk.DataSize()
+		from := max(offset, chunk.OriginalFileStart)
+		to := min(end, chunk.OriginalFileStart+dataSize)
+		if from >= to {
+			continue
+		}
+		parts = append(parts, chunkPart{idx: i, offset: from - chunk.OriginalFileStart, length: to - from})
+	}
 
-		storageMeta, found := dd.knownStorages[chunk.StorageInstance]
-		if !found {
-			return fmt.Errorf("storage instance %s missing", chunk.StorageInstance)
+	pool := newTransferPool(ctx, dd.parallelism())
+	pipes := make([]*chunkPipe, len(parts))
+	for i := range parts {
+		pipes[i] = newChunkPipe(pool.ctx, dd.chunkBufferSize())
+	}
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for i, part := range parts {
+			if !pool.acquire() {
+				return
+			}
+			pool.run(func(ctx context.Context) error {
+				err := dd.retrieveChunk(ctx, inputFilename, chunks, part.idx, part.offset, part.length, pipes[i])
+				pipes[i].CloseWithError(err)
+				return err
+			})
 		}
+	}()
 
-		chunkFileId := incomingFilenameToChunkFileId(inputFilename, chunk.Order)
-		err := storageMeta.storage.RetrieveChunk(ctx, chunkFileId, writer)
-		if err != nil {
-			return fmt.Errorf("cannot retrieve chunk %d on instance %s with error: %w", chunk.Order, chunk.StorageInstance, err)
+	var writeErr error
+	for i := range parts {
+		_, writeErr = io.Copy(writer, pipes[i])
+		if writeErr != nil {
+			pool.fail(writeErr)
+			break
 		}
+		pool.release()
+	}
+	<-dispatched
+	if err := pool.wait(); err != nil {
+		return err
+	}
+	return writeErr
+}
+
+func (dd *DataDistributor) retrieveChunk(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk, idx int, chunkOffset, chunkLength int64, writer io.Writer) error {
+	_, parityShards := erasureShards(chunks)
+	chunk := chunks[idx]
+	progress := &progressWriter{w: writer}
+	if dataSize := chunk.DataSize(); chunkOffset == 0 && chunkLength == dataSize && chunk.Codec == CodecNone && !chunk.Encrypted() {
+		// the whole chunk is read, so it can be verified against its checksum. Erasure coding padding is dropped
+		chunkLength = chunk.Size
+		progress.w = &truncatingWriter{w: writer, left: dataSize}
+	}
+	chunkFileId := chunkFileIdOf(inputFilename, chunk)
+	err := dd.retrieveChunkReplicas(ctx, chunkFileId, chunk, chunkOffset, chunkLength, progress)
+	if err != nil && parityShards > 0 && progress.err == nil && ctx.Err() == nil {
+		slog.Warn("data chunk is not available, restoring it from parity", "filename", inputFilename, "chunk", chunk.Order, "err", err)
+		err = dd.rebuildShard(ctx, inputFilename, chunks, idx, chunkOffset, chunkLength, progress)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot retrieve chunk %d with error: %w", chunk.Order, err)
 	}
 	return nil
 }
 
-func (dd *DataDistributor) UpdateStorageInfo(_ context.Context, info *inventorypb.StorageInfo) (*emptypb.Empty, error) {
+// retrieveChunkReplicas reads length bytes of the chunk starting from offset from the first replica which is able to give them.
+// If a replica fails in the middle or has a corrupted copy, the next one continues from the same position.
+// offset and length of a compressed or encrypted chunk are those of its data in the file
+func (dd *DataDistributor) retrieveChunkReplicas(ctx context.Context, chunkFileId string, chunk chunkmaster.Chunk, offset, length int64, progress *progressWriter) error {
+	dataKey, err := dd.dataKey(chunk)
+	if err != nil {
+		return fmt.Errorf("cannot unwrap data key of %s: %w", chunkFileId, err)
+	}
+	errs := []error{errNoReplicas}
+	for _, storageID := range dd.orderByLiveness(chunk.Replicas) {
+		meta, found := dd.lookupStorage(storageID)
+		if !found {
+			errs = append(errs, fmt.Errorf("storage instance %s missing", storageID))
+			continue
+		}
+		if chunk.Codec != CodecNone || dataKey != nil {
+			err = retrieveTransformedChunk(ctx, meta.storage, chunkFileId, chunk, dataKey, offset, length, progress.resume())
+		} else if offset == 0 && length == chunk.Size {
+			// a whole chunk is verified by the storage before sending, so it is sent from the beginning every time
+			err = meta.storage.RetrieveChunk(ctx, chunkFileId, chunk.Checksum, progress.resume())
+		} else {
+			// the storage verifies the whole chunk before sending a range of it too
+			err = meta.storage.RetrieveChunkRange(ctx, chunkFileId, chunk.Checksum, offset+progress.written, length-progress.written, progress.proceed())
+		}
+		if err == nil && progress.written < length {
+			err = fmt.Errorf("%w: got %d of %d bytes", errShortRead, progress.written, length)
+		}
+		if err == nil {
+			return nil
+		}
+		if progress.err != nil {
+			// the receiver is gone, other replicas won't help
+			return progress.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Warn("replica retrieve failed, trying next one", "file_id", chunkFileId, "storage_id", storageID, "retrieved", progress.written, "err", err)
+		errs = append(errs, fmt.Errorf("replica %s: %w", storageID, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (dd *DataDistributor) UpdateStorageInfo(ctx context.Context, info *inventorypb.StorageInfo) (*emptypb.Empty, error) {
+	storageID := info.GetIam()
+	if err := checkPeer(ctx, storageID); err != nil {
+		return nil, err
+	}
+
 	dd.storageMutex.Lock()
 	defer dd.storageMutex.Unlock()
 
-	storageID := info.GetIam()
+	if dd.decommissioned[storageID] {
+		return nil, status.Errorf(codes.FailedPrecondition, "storage %s has been decommissioned", storageID)
+	}
 	meta, found := dd.knownStorages[storageID]
 	if !found {
 		rs, err := dd.storageCreator(storageID)
@@ -147,24 +653,88 @@ func (dd *DataDistributor) UpdateStorageInfo(_ context.Context, info *inventoryp
 			return nil, err
 		}
 		meta = &storageMeta{
-			storageID:      storageID,
-			storage:        rs,
-			availableBytes: math.MaxInt64,
+			storageID: storageID,
+			storage:   rs,
 		}
 		dd.knownStorages[storageID] = meta
 		slog.Info("added new storage", "storage_id", storageID)
+		// we might have been restarted while the catalog remembers this storage, then it is checked the same way as a returning one.
+		// Finding that out takes a scan of the whole catalog, so it is left to the check, which runs without the lock
+		dd.startInventoryCheck(meta)
 	}
-	availBytesNow := meta.availableBytes
-	slog.Debug("heartbeat received", "from", storageID, "available_bytes_received", info.GetAvailableBytes(), "available_bytes_known", availBytesNow)
-	// TODO: here we'll be getting a race condition when a chunk is being uploaded/removed, which can easily lead to overbooking of space.
-	// But it should self-recover! ..probably.
-	// Using our quotation calculation should be prevailing over what we have reported from host if we detect shortage
-	if info.GetAvailableBytes() < availBytesNow {
-		meta.availableBytes = info.GetAvailableBytes()
+	meta.lastHeartbeat = dd.now()
+	meta.labels = chunkmaster.Labels{
+		Zone: info.GetLabels().GetZone(),
+		Rack: info.GetLabels().GetRack(),
+		Host: info.GetLabels().GetHost(),
 	}
+	switch meta.state {
+	case StorageSuspect:
+		slog.Info("storage is alive again", "storage_id", storageID)
+		meta.state = StorageAlive
+	case StorageDead:
+		dd.startInventoryCheck(meta)
+	}
+
+	slog.Debug("heartbeat received", "from", storageID, "available_bytes_received", info.GetAvailableBytes(), "available_bytes_known", meta.availableBytes)
+	// the storage reports space which is not leased, so it replaces our estimate. The estimate only ranks storages
+	// between heartbeats, space itself is guaranteed by leases
+	meta.availableBytes = info.GetAvailableBytes()
 	return nil, nil
 }
 
+// checkPeer makes sure that a storage speaks only for itself when mTLS is on. Otherwise anyone with a valid certificate
+// could send heartbeats on behalf of another storage, or report its chunks as corrupted
+func checkPeer(ctx context.Context, storageID string) error {
+	if err := mtls.CheckPeer(ctx, storageID); err != nil {
+		slog.Warn("storage identity rejected", "storage_id", storageID, "err", err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// chunkFileIdOf gives the id the chunk is kept under on storages
+func chunkFileIdOf(inputFilename string, chunk chunkmaster.Chunk) string {
+	if chunk.ContentID != "" {
+		return contentFileIdPrefix + chunk.ContentID
+	}
+	return incomingFilenameToChunkFileId(inputFilename, chunk.Order)
+}
+
+// incomingFilenameToChunkFileId keeps the bucket in the id, so the same key in different buckets gives different chunk files.
+// Files of the default bucket keep ids they had before buckets appeared, slashed keys included
 func incomingFilenameToChunkFileId(incomingFilename string, chunk uint32) string {
-	return fmt.Sprintf("%s.part.%d", base64.StdEncoding.EncodeToString([]byte(incomingFilename)), chunk)
+	bucket, key := chunkmaster.SplitFileref(incomingFilename)
+	if bucket == chunkmaster.DefaultBucket {
+		return fmt.Sprintf("%s.part.%d", base64.StdEncoding.EncodeToString([]byte(key)), chunk)
+	}
+	// neither bucket names nor base64 have dots, so the first dot always ends the bucket
+	return fmt.Sprintf("%s.%s.part.%d", bucket, base64.RawURLEncoding.EncodeToString([]byte(key)), chunk)
+}
+
+func chunkFileIdToIncomingFilename(chunkFileId string) (string, uint32, error) {
+	idx := strings.LastIndex(chunkFileId, ".part.")
+	if idx < 0 {
+		return "", 0, fmt.Errorf("%s is not a chunk file id", chunkFileId)
+	}
+	encoded, order := chunkFileId[:idx], chunkFileId[idx+len(".part."):]
+	var incomingFilename string
+	if bucket, encodedKey, found := strings.Cut(encoded, "."); found {
+		key, err := base64.RawURLEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return "", 0, fmt.Errorf("%s has bad key: %w", chunkFileId, err)
+		}
+		incomingFilename = chunkmaster.ObjectName(bucket, string(key))
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", 0, fmt.Errorf("%s has bad filename: %w", chunkFileId, err)
+		}
+		incomingFilename = chunkmaster.ObjectName(chunkmaster.DefaultBucket, string(decoded))
+	}
+	chunk, err := strconv.ParseUint(order, 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s has bad chunk order: %w", chunkFileId, err)
+	}
+	return incomingFilename, uint32(chunk), nil
 }
@@ -0,0 +1,792 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls/mtlstest"
+	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var errStorageDown = errors.New("storage is down")
+
+// memStorage keeps chunks in memory and can emulate failures
+type memStorage struct {
+	mutex  sync.Mutex
+	chunks map[string][]byte
+
+	down bool
+	// brokenRead makes retrieve fail after sending half of the chunk
+	brokenRead bool
+	// reads counts retrieve requests
+	reads int
+	// latency is added to every store and retrieve, like a round trip and fsync of a real storage
+	latency time.Duration
+	// meter, if set, watches how many transfers are running at once
+	meter *concurrencyMeter
+	// peers are storages which chunks can be copied from
+	peers map[string]*memStorage
+	// capacity, if set, limits bytes which are stored and leased
+	capacity int64
+	// leases are reserved bytes by file id
+	leases map[string]int64
+}
+
+type concurrencyMeter struct {
+	mutex   sync.Mutex
+	current int
+	peak    int
+}
+
+func (cm *concurrencyMeter) enter() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.current++
+	cm.peak = max(cm.peak, cm.current)
+}
+
+func (cm *concurrencyMeter) leave() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.current--
+}
+
+func (cm *concurrencyMeter) peakValue() int {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	return cm.peak
+}
+
+// transfer emulates the cost of a single store or retrieve. A store pays for its latency after the data is received, a retrieve before sending it
+func (ms *memStorage) transfer(store bool) func() {
+	ms.mutex.Lock()
+	latency, meter := ms.latency, ms.meter
+	ms.mutex.Unlock()
+	if meter != nil {
+		meter.enter()
+	}
+	if !store {
+		time.Sleep(latency)
+	}
+	return func() {
+		if store {
+			time.Sleep(latency)
+		}
+		if meter != nil {
+			meter.leave()
+		}
+	}
+}
+
+var _ storage.Storage = (*memStorage)(nil)
+
+func newMemStorage() *memStorage {
+	return &memStorage{chunks: make(map[string][]byte), leases: make(map[string]int64)}
+}
+
+func (ms *memStorage) isDown() bool {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.down
+}
+
+func (ms *memStorage) setDown(down bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.down = down
+}
+
+func (ms *memStorage) chunksCount() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return len(ms.chunks)
+}
+
+// corruptAll flips a bit in every stored chunk
+func (ms *memStorage) corruptAll() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, data := range ms.chunks {
+		if len(data) > 0 {
+			data[len(data)/2] ^= 1
+		}
+	}
+}
+
+func (ms *memStorage) StoreChunk(_ context.Context, fileId string, reader io.Reader) ([]byte, error) {
+	if ms.isDown() {
+		return nil, errStorageDown
+	}
+	defer ms.transfer(true)()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.chunks[fileId] = data
+	checksum := sha256.Sum256(data)
+	return checksum[:], nil
+}
+
+func (ms *memStorage) RetrieveChunk(_ context.Context, fileId string, checksum []byte, writer io.Writer) error {
+	if ms.isDown() {
+		return errStorageDown
+	}
+	defer ms.transfer(false)()
+	ms.mutex.Lock()
+	data, found := ms.chunks[fileId]
+	brokenRead := ms.brokenRead
+	ms.reads++
+	ms.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("chunk %s not found", fileId)
+	}
+	if actual := sha256.Sum256(data); len(checksum) > 0 && !bytes.Equal(actual[:], checksum) {
+		return storage.ErrChecksumMismatch
+	}
+	if brokenRead {
+		writer.Write(data[:len(data)/2])
+		return errStorageDown
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func (ms *memStorage) RetrieveChunkRange(_ context.Context, fileId string, checksum []byte, offset, length int64, writer io.Writer) error {
+	if ms.isDown() {
+		return errStorageDown
+	}
+	defer ms.transfer(false)()
+	ms.mutex.Lock()
+	data, found := ms.chunks[fileId]
+	brokenRead := ms.brokenRead
+	ms.reads++
+	ms.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("chunk %s not found", fileId)
+	}
+	if actual := sha256.Sum256(data); len(checksum) > 0 && !bytes.Equal(actual[:], checksum) {
+		return storage.ErrChecksumMismatch
+	}
+	data = data[min(offset, int64(len(data))):min(offset+length, int64(len(data)))]
+	if brokenRead {
+		writer.Write(data[:len(data)/2])
+		return errStorageDown
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func (ms *memStorage) ListChunks(_ context.Context) ([]string, error) {
+	if ms.isDown() {
+		return nil, errStorageDown
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	list := make([]string, 0, len(ms.chunks))
+	for fileId := range ms.chunks {
+		list = append(list, fileId)
+	}
+	return list, nil
+}
+
+func (ms *memStorage) DeleteChunk(_ context.Context, fileId string) error {
+	if ms.isDown() {
+		return errStorageDown
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.chunks, fileId)
+	return nil
+}
+
+func (ms *memStorage) CopyChunk(ctx context.Context, fileId string, checksum []byte, source string) error {
+	if ms.isDown() {
+		return errStorageDown
+	}
+	peer, found := ms.peers[source]
+	if !found {
+		return fmt.Errorf("storage %s is unknown", source)
+	}
+	var buffer bytes.Buffer
+	if err := peer.RetrieveChunk(ctx, fileId, checksum, &buffer); err != nil {
+		return err
+	}
+	_, err := ms.StoreChunk(ctx, fileId, &buffer)
+	return err
+}
+
+func (ms *memStorage) Reserve(_ context.Context, reservations map[string]int64) error {
+	if ms.isDown() {
+		return errStorageDown
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var used, required int64
+	for fileId, data := range ms.chunks {
+		used += max(int64(len(data)), ms.leases[fileId])
+	}
+	for fileId, bytes := range ms.leases {
+		if _, stored := ms.chunks[fileId]; !stored {
+			used += bytes
+		}
+	}
+	for _, bytes := range reservations {
+		required += bytes
+	}
+	if ms.capacity > 0 && used+required > ms.capacity {
+		return fmt.Errorf("%w: %d bytes required, %d used of %d", storage.ErrNotEnoughSpace, required, used, ms.capacity)
+	}
+	for fileId, bytes := range reservations {
+		ms.leases[fileId] = bytes
+	}
+	return nil
+}
+
+func (ms *memStorage) Commit(_ context.Context, fileIds []string) error {
+	return ms.endLeases(fileIds)
+}
+
+func (ms *memStorage) Release(_ context.Context, fileIds []string) error {
+	return ms.endLeases(fileIds)
+}
+
+func (ms *memStorage) endLeases(fileIds []string) error {
+	if ms.isDown() {
+		return errStorageDown
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, fileId := range fileIds {
+		delete(ms.leases, fileId)
+	}
+	return nil
+}
+
+func (ms *memStorage) leasesCount() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return len(ms.leases)
+}
+
+func (ms *memStorage) storedBytes() int64 {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var stored int64
+	for _, data := range ms.chunks {
+		stored += int64(len(data))
+	}
+	return stored
+}
+
+type testCluster struct {
+	dd       *DataDistributor
+	storages map[string]*memStorage
+}
+
+func newTestCluster(t *testing.T, storagesNum int, chunkMaster chunkmaster.ChunkMaster, writeQuorum int) *testCluster {
+	return newTestClusterWithConfig(t, storagesNum, chunkMaster, Config{WriteQuorum: writeQuorum})
+}
+
+func newTestClusterWithConfig(t testing.TB, storagesNum int, chunkMaster chunkmaster.ChunkMaster, config Config) *testCluster {
+	cluster := &testCluster{storages: make(map[string]*memStorage, storagesNum)}
+	connect := func(storageID string) (storage.Storage, error) {
+		return cluster.storages[storageID], nil
+	}
+	cluster.dd = NewDataDistributor(chunkMaster, connect, config)
+	for i := range storagesNum {
+		storageID := fmt.Sprintf("storage-%d", i)
+		cluster.storages[storageID] = newMemStorage()
+		cluster.storages[storageID].peers = cluster.storages
+		cluster.heartbeat(t, storageID)
+		cluster.waitAlive(t, storageID)
+	}
+	return cluster
+}
+
+// waitAlive waits until the inventory check of a new storage lets it into service
+func (tc *testCluster) waitAlive(t testing.TB, storageID string) {
+	require.Eventually(t, func() bool {
+		return stateOf(tc.dd, storageID) == StorageAlive
+	}, 5*time.Second, time.Millisecond)
+}
+
+func (tc *testCluster) heartbeat(t testing.TB, storageID string) {
+	_, err := tc.dd.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: storageID, AvailableBytes: 1 << 30})
+	require.NoError(t, err)
+}
+
+func (tc *testCluster) totalReads() int {
+	total := 0
+	for _, ms := range tc.storages {
+		ms.mutex.Lock()
+		total += ms.reads
+		ms.mutex.Unlock()
+	}
+	return total
+}
+
+func (tc *testCluster) totalChunks() int {
+	total := 0
+	for _, ms := range tc.storages {
+		total += ms.chunksCount()
+	}
+	return total
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func (tc *testCluster) store(fileref string, data []byte) error {
+	return tc.dd.DistributeData(context.Background(), fileref, int64(len(data)), bytes.NewReader(data))
+}
+
+func (tc *testCluster) retrieve(fileref string) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := tc.dd.ReconstructData(context.Background(), fileref, &buffer)
+	return append([]byte{}, buffer.Bytes()...), err
+}
+
+func TestDistributeAndReconstruct(t *testing.T) {
+	for _, size := range []int{0, 1, 5, 6, 7, 1024, 1024*1024 + 3} {
+		cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}), 0)
+		data := randomData(size)
+		fileref := fmt.Sprintf("file-%d", size)
+		require.NoError(t, cluster.store(fileref, data))
+		restored, err := cluster.retrieve(fileref)
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, "size %d", size)
+	}
+}
+
+func TestReplicatedReadSurvivesStorageLoss(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), 0)
+	data := randomData(54623)
+	require.NoError(t, cluster.store("file", data))
+
+	cluster.storages["storage-3"].setDown(true)
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestReplicaFailsInTheMiddleOfRead(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), 0)
+	data := randomData(54623)
+	require.NoError(t, cluster.store("file", data))
+
+	// every storage is the first replica for one of chunks
+	cluster.storages["storage-2"].brokenRead = true
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestWriteQuorumReached(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 3})
+	cluster := newTestCluster(t, 6, chunkMaster, 2)
+	cluster.storages["storage-1"].setDown(true)
+	data := randomData(9007)
+	require.NoError(t, cluster.store("file", data))
+
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		assert.NotContains(t, chunk.Replicas, "storage-1", "failed replica must be dropped")
+	}
+
+	cluster.storages["storage-1"].setDown(false)
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestWriteQuorumNotReached(t *testing.T) {
+	// with 3 of 6 storages down at least one chunk has 2 of its 3 replicas down
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 3}), 0)
+	for _, storageID := range []string{"storage-1", "storage-2", "storage-3"} {
+		cluster.storages[storageID].setDown(true)
+	}
+	err := cluster.store("file", randomData(9007))
+	require.Error(t, err)
+
+	assert.Zero(t, cluster.totalChunks(), "everything must be rolled back")
+	assert.EqualValues(t, 1, cluster.dd.Rollbacks())
+	_, err = cluster.retrieve("file")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+}
+
+func TestShortInputIsNotStored(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), 0)
+	data := randomData(9007)
+	err := cluster.dd.DistributeData(context.Background(), "file", int64(len(data)+100), bytes.NewReader(data))
+	require.Error(t, err)
+	assert.Zero(t, cluster.totalChunks())
+}
+
+func erasureLayout() chunkmaster.Layout {
+	return chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1, ParityChunks: 2}
+}
+
+func TestErasureCodedDistributeAndReconstruct(t *testing.T) {
+	for _, size := range []int{0, 1, 3, 5, 7, 9007, 6*erasurePortionSize + 5} {
+		cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(erasureLayout()), 0)
+		data := randomData(size)
+		require.NoError(t, cluster.store("file", data))
+		assert.Equal(t, 6, cluster.totalChunks(), "size %d", size)
+		restored, err := cluster.retrieve("file")
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, "size %d", size)
+	}
+}
+
+func TestErasureCodedSurvivesStoppedStorages(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(erasureLayout()), 0)
+	data := randomData(6*erasurePortionSize + 5)
+	require.NoError(t, cluster.store("file", data))
+
+	for first := range 6 {
+		for second := first; second < 6; second++ {
+			// first == second checks a single stopped storage
+			stopped := []string{fmt.Sprintf("storage-%d", first), fmt.Sprintf("storage-%d", second)}
+			for _, storageID := range stopped {
+				cluster.storages[storageID].setDown(true)
+			}
+			restored, err := cluster.retrieve("file")
+			require.NoError(t, err, "stopped %v", stopped)
+			assert.Equal(t, data, restored, "stopped %v", stopped)
+			for _, storageID := range stopped {
+				cluster.storages[storageID].setDown(false)
+			}
+		}
+	}
+}
+
+func TestErasureCodedShardFailsInTheMiddleOfRead(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(erasureLayout()), 0)
+	data := randomData(3*erasurePortionSize + 5)
+	require.NoError(t, cluster.store("file", data))
+
+	cluster.storages["storage-0"].brokenRead = true
+	cluster.storages["storage-4"].setDown(true)
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestErasureCodedTooManyStoppedStorages(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(erasureLayout()), 0)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+
+	for _, storageID := range []string{"storage-1", "storage-3", "storage-5"} {
+		cluster.storages[storageID].setDown(true)
+	}
+	_, err := cluster.retrieve("file")
+	assert.ErrorIs(t, err, ErrNotEnoughShards)
+}
+
+func TestChecksumsAreRecorded(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	data := randomData(54623)
+	require.NoError(t, cluster.store("file", data))
+
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		expected := sha256.Sum256(data[chunk.OriginalFileStart : chunk.OriginalFileStart+chunk.Size])
+		assert.Equal(t, expected[:], chunk.Checksum, "chunk %d", chunk.Order)
+	}
+}
+
+func TestCorruptedReplicaIsSkipped(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	data := randomData(54623)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	cluster.storages[chunks[0].Replicas[0]].corruptAll()
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+
+	cluster.storages[chunks[0].Replicas[1]].corruptAll()
+	_, err = cluster.retrieve("file")
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+}
+
+func TestErasureCodedCorruptedShardIsRebuilt(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(erasureLayout()), 0)
+	data := randomData(3*erasurePortionSize + 5)
+	require.NoError(t, cluster.store("file", data))
+
+	cluster.storages["storage-1"].corruptAll()
+	cluster.storages["storage-5"].corruptAll()
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func (tc *testCluster) retrieveRange(fileref string, offset, length int64) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := tc.dd.ReconstructRange(context.Background(), fileref, offset, length, &buffer)
+	return append([]byte{}, buffer.Bytes()...), err
+}
+
+func TestReconstructRange(t *testing.T) {
+	for name, layout := range map[string]chunkmaster.Layout{
+		"replicated":    {Chunks: 6, ReplicationFactor: 2},
+		"erasure coded": erasureLayout(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(layout), 0)
+			data := randomData(4*erasurePortionSize + 7)
+			require.NoError(t, cluster.store("file", data))
+			size := int64(len(data))
+			chunkSize := (size + 3) / 4
+
+			for _, r := range [][2]int64{
+				{0, size},
+				{0, 0},
+				{size, 0},
+				{0, 1},
+				{size - 1, 1},
+				{chunkSize - 10, 20},
+				{chunkSize, chunkSize},
+				{5, size - 10},
+				{erasurePortionSize + 3, 2 * erasurePortionSize},
+			} {
+				restored, err := cluster.retrieveRange("file", r[0], r[1])
+				require.NoError(t, err, "range %v", r)
+				assert.Equal(t, data[r[0]:r[0]+r[1]], restored, "range %v", r)
+			}
+
+			_, err := cluster.retrieveRange("file", size-5, 6)
+			assert.ErrorIs(t, err, ErrInvalidRange)
+			_, err = cluster.retrieveRange("file", -1, 6)
+			assert.ErrorIs(t, err, ErrInvalidRange)
+		})
+	}
+}
+
+func TestRangeTouchesOnlyOverlappingChunks(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}), 0)
+	data := randomData(6000)
+	require.NoError(t, cluster.store("file", data))
+
+	restored, err := cluster.retrieveRange("file", 1990, 20)
+	require.NoError(t, err)
+	assert.Equal(t, data[1990:2010], restored)
+	assert.Equal(t, 2, cluster.totalReads())
+}
+
+func TestCorruptedReplicaIsSkippedInRange(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	data := randomData(54623)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	// the range is far from the corrupted bytes, but the replica is still not trusted
+	cluster.storages[chunks[0].Replicas[0]].corruptAll()
+	restored, err := cluster.retrieveRange("file", 5000, 20)
+	require.NoError(t, err)
+	assert.Equal(t, data[5000:5020], restored)
+
+	cluster.storages[chunks[0].Replicas[1]].corruptAll()
+	_, err = cluster.retrieveRange("file", 5000, 20)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+}
+
+func TestErasureCodedRangeSurvivesStoppedStorages(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(erasureLayout())
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	data := randomData(4*erasurePortionSize + 7)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	cluster.storages[chunks[1].Replicas[0]].setDown(true)
+	cluster.storages[chunks[2].Replicas[0]].brokenRead = true
+	offset, length := chunks[1].OriginalFileStart+erasurePortionSize/2, 2*erasurePortionSize
+	restored, err := cluster.retrieveRange("file", offset, int64(length))
+	require.NoError(t, err)
+	assert.Equal(t, data[offset:offset+int64(length)], restored)
+}
+
+func TestFileChecksumIsRecorded(t *testing.T) {
+	for _, layout := range []chunkmaster.Layout{
+		{Chunks: 6, ReplicationFactor: 2},
+		{Chunks: 6, ReplicationFactor: 1, ParityChunks: 2},
+	} {
+		cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(layout), 0)
+		data := randomData(9007)
+		require.NoError(t, cluster.store("file", data))
+		info, err := cluster.dd.StatFile("file")
+		require.NoError(t, err)
+		expected := sha256.Sum256(data)
+		assert.Equal(t, expected[:], info.Checksum)
+		assert.EqualValues(t, 9007, info.Size)
+	}
+
+	cluster := newTestClusterWithConfig(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}), Config{StreamChunkSize: 1000})
+	data := randomData(2500)
+	_, err := cluster.dd.DistributeStream(context.Background(), "stream", bytes.NewReader(data))
+	require.NoError(t, err)
+	info, err := cluster.dd.StatFile("stream")
+	require.NoError(t, err)
+	expected := sha256.Sum256(data)
+	assert.Equal(t, expected[:], info.Checksum)
+}
+
+func TestDeleteData(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), 0)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+	require.NoError(t, cluster.store("kept", randomData(9007)))
+	down := cluster.storages["storage-0"]
+	down.setDown(true)
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "file"))
+	_, err := cluster.dd.StatFile("file")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	down.setDown(false)
+	for storageID, ms := range cluster.storages {
+		fileIds, err := ms.ListChunks(context.Background())
+		require.NoError(t, err)
+		for _, fileId := range fileIds {
+			fileref, _, err := chunkFileIdToIncomingFilename(fileId)
+			require.NoError(t, err)
+			if storageID != "storage-0" {
+				assert.Equal(t, "kept", fileref, "only chunks of the dead storage are left")
+			}
+		}
+	}
+	restored, err := cluster.retrieve("kept")
+	require.NoError(t, err)
+	assert.Equal(t, randomData(9007), restored)
+
+	assert.ErrorIs(t, cluster.dd.DeleteData(context.Background(), "file"), chunkmaster.ErrFileNotFound)
+}
+
+func TestSameKeyInDifferentBuckets(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}), 0)
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "first", Layout: chunkmaster.Layout{Chunks: 2, ReplicationFactor: 3}}))
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "second", Layout: erasureLayout()}))
+	files := map[string][]byte{
+		"file":            randomData(9007),
+		"first/dir/file":  randomData(10007),
+		"second/dir/file": randomData(11007),
+	}
+	for fileref, data := range files {
+		require.NoError(t, cluster.store(fileref, data), fileref)
+	}
+	assert.Equal(t, 6+2*3+6, cluster.totalChunks())
+	for fileref, data := range files {
+		restored, err := cluster.retrieve(fileref)
+		require.NoError(t, err, fileref)
+		assert.Equal(t, data, restored, fileref)
+	}
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "first/dir/file"))
+	restored, err := cluster.retrieve("second/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, files["second/dir/file"], restored)
+}
+
+func TestStorageIdentityIsCheckedWithMTLS(t *testing.T) {
+	ca := mtlstest.NewCA(t)
+	cluster := newTestCluster(t, 0, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1}), 0)
+	cluster.storages["storage-0:45346"] = newMemStorage()
+	cluster.storages["storage-1:45346"] = newMemStorage()
+
+	serverCreds, err := mtls.ServerCredentials(ca.Issue(t, "apiservice", "127.0.0.1"))
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer(grpc.Creds(serverCreds))
+	inventorypb.RegisterStorageInventoryServer(gsrv, cluster.dd)
+	go gsrv.Serve(listener)
+	t.Cleanup(gsrv.Stop)
+
+	connect := func(creds credentials.TransportCredentials) inventorypb.StorageInventoryClient {
+		conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return inventorypb.NewStorageInventoryClient(conn)
+	}
+	clientCreds, err := mtls.ClientCredentials(ca.Issue(t, "storage-0", "storage-0"))
+	require.NoError(t, err)
+	client := connect(clientCreds)
+
+	_, err = client.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: "storage-0:45346", AvailableBytes: 1 << 30})
+	require.NoError(t, err)
+	_, err = client.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: "storage-1:45346", AvailableBytes: 1 << 30})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "a storage cannot send heartbeats for another one")
+	_, err = client.ReportCorruptedChunks(context.Background(), &inventorypb.CorruptedChunks{Iam: "storage-1:45346", FileIds: []string{"chunk"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, found := cluster.dd.lookupStorage("storage-1:45346")
+	assert.False(t, found)
+
+	anotherCA := mtlstest.NewCA(t)
+	strangerCreds, err := mtls.ClientCredentials(anotherCA.Issue(t, "storage-1", "storage-1"))
+	require.NoError(t, err)
+	for name, creds := range map[string]credentials.TransportCredentials{
+		"plaintext":      insecure.NewCredentials(),
+		"another CA":     strangerCreds,
+		"no client cert": credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}),
+	} {
+		_, err = connect(creds).UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: "storage-1:45346", AvailableBytes: 1 << 30})
+		assert.Equal(t, codes.Unavailable, status.Code(err), name)
+	}
+}
+
+func TestReplicasAreSpreadByReportedLabels(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 2, ReplicationFactor: 2})
+	tc := newTestCluster(t, 4, chunkMaster, 0)
+	// storage-0 and storage-1 have more space, so without labels they would keep both replicas of a chunk
+	for i, rack := range []string{"r0", "r0", "r1", "r1"} {
+		storageID := fmt.Sprintf("storage-%d", i)
+		info := &inventorypb.StorageInfo{Iam: storageID, AvailableBytes: int64(4-i) << 20, Labels: &inventorypb.Labels{Rack: rack}}
+		_, err := tc.dd.UpdateStorageInfo(context.Background(), info)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tc.store("some-file", randomData(1000)))
+
+	rackOf := make(map[string]string)
+	for _, status := range tc.dd.StorageStatuses() {
+		rackOf[status.StorageID] = status.Labels.Rack
+	}
+	chunks, err := chunkMaster.ChunksToRestore("some-file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		require.Len(t, chunk.Replicas, 2)
+		assert.NotEqual(t, rackOf[chunk.Replicas[0]], rackOf[chunk.Replicas[1]], "replicas of chunk %d are in one rack", chunk.Order)
+	}
+}
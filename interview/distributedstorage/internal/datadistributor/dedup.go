@@ -0,0 +1,226 @@
+package datadistributor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+const DefaultDedupChunkSize = 1024 * 1024
+
+// contentFileIdPrefix starts ids of deduplicated chunks. Ids of other chunks always have ".part." in them, so they never clash
+const contentFileIdPrefix = "cas."
+
+// DedupStats describes deduplication of all files together with chunks of uploads since start
+type DedupStats struct {
+	LogicalBytes    int64   `json:"logical_bytes"`
+	StoredBytes     int64   `json:"stored_bytes"`
+	Ratio           float64 `json:"ratio"`
+	Contents        int     `json:"contents"`
+	GarbageContents int     `json:"garbage_contents"`
+	// SkippedChunks have been found stored already, StoredChunks have been sent to storages
+	SkippedChunks int64 `json:"skipped_chunks"`
+	StoredChunks  int64 `json:"stored_chunks"`
+}
+
+func (dd *DataDistributor) DedupStats() DedupStats {
+	stats := dd.chunkMaster.DedupStats()
+	return DedupStats{
+		LogicalBytes:    stats.LogicalBytes,
+		StoredBytes:     stats.StoredBytes,
+		Ratio:           stats.Ratio(),
+		Contents:        stats.Contents,
+		GarbageContents: stats.GarbageContents,
+		SkippedChunks:   dd.skippedChunks.Load(),
+		StoredChunks:    dd.storedChunks.Load(),
+	}
+}
+
+func (dd *DataDistributor) dedupChunkSize() int {
+	if dd.config.DedupChunkSize <= 0 {
+		return DefaultDedupChunkSize
+	}
+	return dd.config.DedupChunkSize
+}
+
+// deduplicates tells whether the bucket of the file has deduplication on
+func (dd *DataDistributor) deduplicates(inputFilename string) bool {
+	bucket, _ := chunkmaster.SplitFileref(inputFilename)
+	info, err := dd.chunkMaster.StatBucket(bucket)
+	return err == nil && info.Layout.Dedup
+}
+
+// distributeContent stores a file of a deduplicated bucket. Data is cut into chunks by content, and a chunk which data is stored
+// already only refers to it, so nothing is sent. Every chunk is buffered in memory, as its hash must be known before it is placed.
+// It returns the size of the stored file
+func (dd *DataDistributor) distributeContent(ctx context.Context, inputFilename string, reader io.Reader) (int64, error) {
+	hasher := sha256.New()
+	chunker := newContentChunker(io.TeeReader(reader, hasher), dd.dedupChunkSize())
+	var (
+		chunks []chunkmaster.Chunk
+		// placed are chunks which data is stored by this file
+		placed []chunkmaster.Chunk
+	)
+	for order := uint32(0); ; order++ {
+		data, err := chunker.next()
+		if err == io.EOF && order > 0 {
+			break
+		}
+		// an empty file still has its single empty chunk
+		if err != nil && err != io.EOF {
+			if order > 0 {
+				dd.rollbackSave(ctx, inputFilename, placed, len(placed))
+			}
+			return 0, fmt.Errorf("cannot read chunk %d: %w", order, err)
+		}
+
+		sum := sha256.Sum256(data)
+		chunk, duplicate, err := dd.appendContentChunkReserveQuota(inputFilename, order, hex.EncodeToString(sum[:]), int64(len(data)))
+		if err != nil {
+			if order > 0 {
+				dd.rollbackSave(ctx, inputFilename, placed, len(placed))
+			}
+			return 0, fmt.Errorf("quoting failed: %w", err)
+		}
+		chunks = append(chunks, chunk)
+		if duplicate {
+			dd.skippedChunks.Add(1)
+			continue
+		}
+		placed = append(placed, chunk)
+		if full, err := dd.reserveLeases(ctx, inputFilename, []chunkmaster.Chunk{chunk}); err != nil {
+			dd.rollbackSave(ctx, inputFilename, placed, len(placed)-1)
+			dd.markFull(full)
+			return 0, fmt.Errorf("quoting failed: %w", err)
+		}
+
+		stored, checksum, _, err := dd.storeChunkReplicas(ctx, chunkFileIdOf(inputFilename, chunk), chunk.Replicas, bytes.NewReader(data))
+		if err != nil {
+			dd.rollbackSave(ctx, inputFilename, placed, len(placed)-1)
+			return 0, fmt.Errorf("cannot save chunk %d with error: %w", chunk.Order, err)
+		}
+		if len(stored) < len(chunk.Replicas) {
+			slog.Warn("chunk is under-replicated", "filename", inputFilename, "chunk", chunk.Order, "replicas", chunk.Replicas, "stored", stored)
+		}
+		chunks[order].Replicas = stored
+		chunks[order].Checksum = checksum
+		dd.settleLeases(ctx, inputFilename, []chunkmaster.Chunk{chunk}, chunks[order:])
+		dd.storedChunks.Add(1)
+	}
+
+	setFileChecksum(chunks, hasher.Sum(nil))
+	err := dd.chunkMaster.FinishStream(inputFilename, chunks)
+	if err != nil {
+		dd.rollbackSave(ctx, inputFilename, placed, len(placed))
+		return 0, fmt.Errorf("cannot finish stream: %w", err)
+	}
+	return fileSize(chunks), nil
+}
+
+// appendContentChunkReserveQuota takes space from the estimate only for a chunk which data is going to be stored
+func (dd *DataDistributor) appendContentChunkReserveQuota(inputFilename string, order uint32, contentID string, size int64) (chunkmaster.Chunk, bool, error) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	chunk, duplicate, err := dd.chunkMaster.AppendContentChunk(inputFilename, order, contentID, size, dd.aliveStorageInfo())
+	if err != nil {
+		return chunkmaster.Chunk{}, false, fmt.Errorf("cannot place chunk %d of %s: %w", order, inputFilename, err)
+	}
+	if !duplicate {
+		for _, storageID := range chunk.Replicas {
+			dd.knownStorages[storageID].availableBytes -= size
+		}
+	}
+	return chunk, duplicate, nil
+}
+
+// collectGarbage deletes data of contents which no file refers to any more. Content which cannot be deleted from some replica
+// stays in the catalog, so it is neither shared nor stored again until the next attempt
+func (dd *DataDistributor) collectGarbage(ctx context.Context) {
+	for _, content := range dd.chunkMaster.GarbageContents() {
+		chunkFileId := contentFileIdPrefix + content.ID
+		deleted := true
+		for _, storageID := range content.Replicas {
+			meta, found := dd.lookupStorage(storageID)
+			if !found {
+				// the storage has been removed together with everything on it
+				continue
+			}
+			if err := meta.storage.DeleteChunk(ctx, chunkFileId); err != nil {
+				slog.Warn("cannot delete unreferenced content, will try again", "file_id", chunkFileId, "storage_id", storageID, "err", err)
+				deleted = false
+			}
+		}
+		if !deleted {
+			continue
+		}
+		if err := dd.chunkMaster.ForgetContent(content.ID); err != nil {
+			slog.Warn("cannot forget deleted content", "file_id", chunkFileId, "err", err)
+		}
+	}
+}
+
+// gearTable gives every byte a random value for the rolling hash. It is generated from a fixed seed: chunk boundaries
+// must not change between restarts, otherwise new files would not share anything with files stored before
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	state := uint64(0)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// contentChunker cuts data where the gear hash of the last 64 bytes has its top bits zero, so the same data gives the same chunks
+// wherever it is in a file. Chunks are from a quarter to four times of the average size
+type contentChunker struct {
+	r                *bufio.Reader
+	minSize, maxSize int
+	// shift leaves only the bits of the hash which must be zero at a boundary
+	shift int
+}
+
+func newContentChunker(reader io.Reader, avgSize int) *contentChunker {
+	zeroBits := max(bits.Len(uint(avgSize))-1, 1)
+	return &contentChunker{
+		r:       bufio.NewReader(reader),
+		minSize: avgSize / 4,
+		maxSize: max(avgSize*4, 1),
+		shift:   64 - zeroBits,
+	}
+}
+
+// next gives the next chunk or io.EOF when there is no data left
+func (cc *contentChunker) next() ([]byte, error) {
+	var (
+		chunk []byte
+		hash  uint64
+	)
+	for len(chunk) < cc.maxSize {
+		b, err := cc.r.ReadByte()
+		if err == io.EOF && len(chunk) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, b)
+		hash = hash<<1 + gearTable[b]
+		if len(chunk) >= cc.minSize && hash>>cc.shift == 0 {
+			break
+		}
+	}
+	return chunk, nil
+}
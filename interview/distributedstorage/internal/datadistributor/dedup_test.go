@@ -0,0 +1,151 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDedupChunkSize = 1024
+
+func newDedupCluster(t *testing.T, storagesNum int) (*testCluster, chunkmaster.ChunkMaster) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1})
+	cluster := newTestClusterWithConfig(t, storagesNum, chunkMaster, Config{DedupChunkSize: testDedupChunkSize})
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "dedup", Layout: chunkmaster.Layout{Chunks: 1, ReplicationFactor: 2, Dedup: true}}))
+	return cluster, chunkMaster
+}
+
+func chunkSizes(t *testing.T, data []byte, avgSize int) []int {
+	chunker := newContentChunker(bytes.NewReader(data), avgSize)
+	var sizes []int
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			return sizes
+		}
+		require.NoError(t, err)
+		sizes = append(sizes, len(chunk))
+	}
+}
+
+func TestContentChunkerBoundaries(t *testing.T) {
+	data := randomData(200_000)
+	sizes := chunkSizes(t, data, testDedupChunkSize)
+	total := 0
+	for i, size := range sizes {
+		if i < len(sizes)-1 {
+			assert.GreaterOrEqual(t, size, testDedupChunkSize/4)
+		}
+		assert.LessOrEqual(t, size, testDedupChunkSize*4)
+		total += size
+	}
+	assert.Equal(t, len(data), total)
+	assert.Greater(t, len(sizes), len(data)/(testDedupChunkSize*4))
+
+	// an insertion moves only the boundaries around it
+	shifted := chunkSizes(t, append([]byte("inserted"), data...), testDedupChunkSize)
+	assert.Equal(t, sizes[len(sizes)-10:], shifted[len(shifted)-10:])
+}
+
+func TestDedupStoresSameDataOnce(t *testing.T) {
+	cluster, chunkMaster := newDedupCluster(t, 4)
+	data := randomData(50_000)
+	require.NoError(t, cluster.store("dedup/first", data))
+	stored := cluster.totalChunks()
+	require.Positive(t, stored)
+
+	require.NoError(t, cluster.store("dedup/second", data))
+	assert.Equal(t, stored, cluster.totalChunks(), "nothing new must be stored")
+	stats := cluster.dd.DedupStats()
+	assert.InDelta(t, 2.0, stats.Ratio, 0.001)
+	assert.Equal(t, int64(2*len(data)), stats.LogicalBytes)
+	assert.Equal(t, stats.StoredChunks, stats.SkippedChunks)
+
+	for _, fileref := range []string{"dedup/first", "dedup/second"} {
+		restored, err := cluster.retrieve(fileref)
+		require.NoError(t, err)
+		assert.Equal(t, data, restored)
+		part, err := cluster.retrieveRange(fileref, 12345, 20000)
+		require.NoError(t, err)
+		assert.Equal(t, data[12345:32345], part)
+	}
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+}
+
+func TestDedupSharesChunksBetweenDifferentFiles(t *testing.T) {
+	cluster, _ := newDedupCluster(t, 4)
+	data := randomData(50_000)
+	require.NoError(t, cluster.store("dedup/first", data))
+	stored := cluster.totalChunks()
+
+	edited := append(append([]byte{}, data[:20_000]...), append([]byte("edited"), data[20_000:]...)...)
+	require.NoError(t, cluster.store("dedup/second", edited))
+	assert.Less(t, cluster.totalChunks()-stored, stored/2, "only chunks around the edit are new")
+	restored, err := cluster.retrieve("dedup/second")
+	require.NoError(t, err)
+	assert.Equal(t, edited, restored)
+}
+
+func TestDedupDeleteKeepsSharedChunks(t *testing.T) {
+	cluster, chunkMaster := newDedupCluster(t, 4)
+	data := randomData(30_000)
+	require.NoError(t, cluster.store("dedup/first", data))
+	require.NoError(t, cluster.store("dedup/second", data))
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "dedup/first"))
+	restored, err := cluster.retrieve("dedup/second")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "dedup/second"))
+	assert.Zero(t, cluster.totalChunks())
+	assert.Equal(t, chunkmaster.DedupStats{}, chunkMaster.DedupStats())
+}
+
+func TestDedupFailedUploadKeepsSharedChunks(t *testing.T) {
+	cluster, chunkMaster := newDedupCluster(t, 4)
+	data := randomData(30_000)
+	require.NoError(t, cluster.store("dedup/first", data))
+	stored := cluster.totalChunks()
+
+	reader := io.MultiReader(bytes.NewReader(data), bytes.NewReader(randomData(10_000)), iotest.ErrReader(fmt.Errorf("connection reset")))
+	_, err := cluster.dd.DistributeStream(context.Background(), "dedup/failed", reader)
+	require.Error(t, err)
+	_, err = cluster.dd.StatFile("dedup/failed")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	assert.Equal(t, stored, cluster.totalChunks(), "only chunks of the failed upload are deleted")
+	assert.Zero(t, chunkMaster.DedupStats().GarbageContents)
+
+	restored, err := cluster.retrieve("dedup/first")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestDrainMovesSharedChunksOfAllFiles(t *testing.T) {
+	cluster, chunkMaster := newDedupCluster(t, 4)
+	data := randomData(30_000)
+	for i := range 3 {
+		require.NoError(t, cluster.store(fmt.Sprintf("dedup/file-%d", i), data))
+	}
+	require.Positive(t, cluster.storages["storage-0"].chunksCount())
+
+	var last DrainProgress
+	require.NoError(t, cluster.dd.Drain(context.Background(), "storage-0", 0, func(progress DrainProgress) { last = progress }))
+	assert.True(t, last.Removed)
+	assert.Zero(t, last.Failed)
+	delete(cluster.storages, "storage-0")
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+	for i := range 3 {
+		restored, err := cluster.retrieve(fmt.Sprintf("dedup/file-%d", i))
+		require.NoError(t, err)
+		assert.Equal(t, data, restored)
+	}
+}
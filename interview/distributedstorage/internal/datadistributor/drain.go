@@ -0,0 +1,235 @@
+package datadistributor
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+var (
+	ErrStorageNotFound = errors.New("storage not found")
+	ErrStorageDraining = errors.New("storage is draining already")
+)
+
+// drainRetryInterval is the pause before the next pass when nothing could be moved, e.g. chunks are still being uploaded
+// or there is no storage to take them
+const drainRetryInterval = 5 * time.Second
+
+type DrainProgress struct {
+	// Remaining is the number of chunks which are still kept on the storage
+	Remaining  int
+	Moved      int
+	Failed     int
+	MovedBytes int64
+	// Removed is set when the storage has been forgotten
+	Removed bool
+}
+
+// Drain decommissions a storage: it gets no new chunks, all its chunks are moved to other alive storages, no faster than
+// bytesPerSecond (0 means no limit), and then it is forgotten. Heartbeats of a forgotten storage are rejected.
+// Chunks which cannot be moved yet, e.g. of files being uploaded, are retried until none is left.
+// progress is called after every pass planning and every move. Cancelling ctx puts the storage back in service
+func (dd *DataDistributor) Drain(ctx context.Context, storageID string, bytesPerSecond int64, progress func(DrainProgress)) error {
+	if err := dd.startDraining(storageID); err != nil {
+		return err
+	}
+	removed := false
+	defer func() {
+		if !removed {
+			dd.stopDraining(storageID)
+		}
+	}()
+	slog.Info("draining started", "storage_id", storageID)
+
+	var state DrainProgress
+	start := time.Now()
+	for {
+		moves, stuck := dd.planDrain(storageID)
+		state.Remaining = len(moves) + stuck
+		progress(state)
+		if state.Remaining == 0 && dd.removeStorage(storageID) {
+			removed = true
+			state.Removed = true
+			progress(state)
+			slog.Info("storage is drained and removed", "storage_id", storageID, "moved", state.Moved, "moved_bytes", state.MovedBytes, "took", time.Since(start))
+			return nil
+		}
+
+		movedBefore := state.Moved
+		for _, move := range moves {
+			if err := waitForPace(ctx, start, state.MovedBytes, bytesPerSecond); err != nil {
+				return err
+			}
+			err := dd.MoveReplica(ctx, move)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				slog.Warn("replica move failed", "fileref", move.Fileref, "order", move.Order, "from", move.From, "to", move.To, "err", err)
+				state.Failed++
+			} else {
+				state.Moved++
+				state.MovedBytes += move.Size
+				state.Remaining--
+			}
+			progress(state)
+		}
+		if state.Moved > movedBefore {
+			continue
+		}
+		slog.Warn("no chunks could be moved from the draining storage, waiting", "storage_id", storageID, "remaining", state.Remaining)
+		timer := time.NewTimer(drainRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (dd *DataDistributor) startDraining(storageID string) error {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	meta, found := dd.knownStorages[storageID]
+	if !found {
+		return ErrStorageNotFound
+	}
+	if meta.draining {
+		return ErrStorageDraining
+	}
+	meta.draining = true
+	return nil
+}
+
+func (dd *DataDistributor) stopDraining(storageID string) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	if meta, found := dd.knownStorages[storageID]; found {
+		meta.draining = false
+		slog.Info("draining stopped, storage is back in service", "storage_id", storageID)
+	}
+}
+
+// removeStorage forgets the storage unless the catalog still has something on it.
+// The check is done under storageMutex, so no upload can choose the storage in between
+func (dd *DataDistributor) removeStorage(storageID string) bool {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	if dd.isReferenced(storageID) {
+		return false
+	}
+	delete(dd.knownStorages, storageID)
+	dd.decommissioned[storageID] = true
+	return true
+}
+
+// planDrain gives moves of every chunk kept on the storage. Chunks which cannot be moved now are only counted:
+// chunks of files being streamed may still change, chunks without a checksum cannot be verified after a copy,
+// and some chunks may have no storage to go to
+func (dd *DataDistributor) planDrain(storageID string) ([]RebalanceMove, int) {
+	// labels of all storages are needed to see how replicas are spread, but only alive ones can take chunks
+	nodes := make(map[string]*rebalanceNode)
+	free := make(map[string]int64)
+	dd.storageMutex.Lock()
+	for _, meta := range dd.knownStorages {
+		nodes[meta.storageID] = &rebalanceNode{id: meta.storageID, labels: meta.labels}
+		if meta.state == StorageAlive && !meta.draining {
+			free[meta.storageID] = meta.availableBytes
+		}
+	}
+	dd.storageMutex.Unlock()
+
+	type candidate struct {
+		fileref string
+		chunks  []chunkmaster.Chunk
+		order   int
+	}
+	var (
+		candidates []candidate
+		stuck      int
+	)
+	// a deduplicated chunk is moved once, whichever files have it
+	seen := make(map[string]bool)
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		for i, chunk := range chunks {
+			if !slices.Contains(chunk.Replicas, storageID) || chunk.ContentID != "" && seen[chunk.ContentID] {
+				continue
+			}
+			if chunk.ContentID != "" {
+				seen[chunk.ContentID] = true
+			}
+			if chunk.FileSize == chunkmaster.UnknownFileSize || len(chunk.Checksum) == 0 {
+				stuck++
+				continue
+			}
+			candidates = append(candidates, candidate{fileref: fileref, chunks: chunks, order: i})
+		}
+		return true
+	})
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(strings.Compare(a.fileref, b.fileref), cmp.Compare(a.order, b.order))
+	})
+
+	var moves []RebalanceMove
+	for _, c := range candidates {
+		chunk := c.chunks[c.order]
+		target := pickDrainTarget(nodes, free, c.chunks, c.order, storageID)
+		if target == "" {
+			stuck++
+			continue
+		}
+		moves = append(moves, RebalanceMove{Fileref: c.fileref, Order: chunk.Order, From: storageID, To: target, Size: chunk.Size, Checksum: chunk.Checksum, ContentID: chunk.ContentID})
+		free[target] -= chunk.Size
+		// later moves of the same file must see this one
+		c.chunks[c.order].Replicas = slices.Clone(chunk.Replicas)
+		c.chunks[c.order].Replicas[slices.Index(chunk.Replicas, storageID)] = target
+	}
+	return moves, stuck
+}
+
+// pickDrainTarget prefers the storage which keeps replicas of the chunk spread over most zones, racks and hosts,
+// then the one with fewest chunks of the file, then the one with most free space
+func pickDrainTarget(nodes map[string]*rebalanceNode, free map[string]int64, chunks []chunkmaster.Chunk, order int, from string) string {
+	chunk := chunks[order]
+	fileChunksOn := make(map[string]int)
+	for _, other := range chunks {
+		for _, storageID := range other.Replicas {
+			fileChunksOn[storageID]++
+		}
+	}
+
+	var (
+		best       string
+		bestSpread [3]int
+	)
+	for storageID, available := range free {
+		if available < chunk.Size || slices.Contains(chunk.Replicas, storageID) {
+			continue
+		}
+		moved := slices.Clone(chunk.Replicas)
+		moved[slices.Index(moved, from)] = storageID
+		spread := replicaSpread(nodes, moved)
+		if best != "" {
+			better := cmp.Or(
+				cmp.Compare(spread[0], bestSpread[0]),
+				cmp.Compare(spread[1], bestSpread[1]),
+				cmp.Compare(spread[2], bestSpread[2]),
+				cmp.Compare(fileChunksOn[best], fileChunksOn[storageID]),
+				cmp.Compare(available, free[best]),
+				strings.Compare(best, storageID),
+			)
+			if better <= 0 {
+				continue
+			}
+		}
+		best, bestSpread = storageID, spread
+	}
+	return best
+}
@@ -0,0 +1,119 @@
+package datadistributor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDrainMovesChunksAndRemovesStorage(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 2, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 4, chunkMaster, 0)
+	files := make(map[string][]byte)
+	for i := range 10 {
+		fileref := fmt.Sprintf("file-%d", i)
+		files[fileref] = randomData(2000 + i)
+		require.NoError(t, cluster.store(fileref, files[fileref]))
+	}
+	kept := cluster.storages["storage-0"].chunksCount()
+	require.Positive(t, kept)
+
+	var last DrainProgress
+	err := cluster.dd.Drain(context.Background(), "storage-0", 0, func(progress DrainProgress) {
+		if progress.Removed {
+			assert.Equal(t, last, DrainProgress{Moved: kept, MovedBytes: last.MovedBytes})
+		}
+		last = progress
+	})
+	require.NoError(t, err)
+	assert.True(t, last.Removed)
+	assert.Zero(t, last.Remaining)
+	assert.Zero(t, last.Failed)
+
+	assert.Zero(t, cluster.storages["storage-0"].chunksCount())
+	for _, status := range cluster.dd.StorageStatuses() {
+		assert.NotEqual(t, "storage-0", status.StorageID)
+	}
+	delete(cluster.storages, "storage-0")
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+	for fileref, data := range files {
+		chunks, err := chunkMaster.ChunksToRestore(fileref)
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			assert.Len(t, chunk.Replicas, 2)
+			assert.NotEqual(t, chunk.Replicas[0], chunk.Replicas[1])
+		}
+		retrieved, err := cluster.retrieve(fileref)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+	}
+
+	_, err = cluster.dd.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: "storage-0", AvailableBytes: 1 << 30})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "decommissioned storage must not come back")
+}
+
+func TestDrainingStorageGetsNoNewChunks(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 2, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 3, chunkMaster, 0)
+	require.NoError(t, cluster.store("file", randomData(2000)))
+	require.NoError(t, cluster.store("another-file", randomData(2000)))
+
+	storeWhileDraining := true
+	err := cluster.dd.Drain(context.Background(), "storage-0", 0, func(progress DrainProgress) {
+		if !storeWhileDraining {
+			return
+		}
+		storeWhileDraining = false
+		assert.True(t, cluster.dd.StorageStatuses()[0].Draining)
+		for i := range 5 {
+			require.NoError(t, cluster.store(fmt.Sprintf("new-file-%d", i), randomData(2000)))
+		}
+	})
+	require.NoError(t, err)
+	for i := range 5 {
+		chunks, err := chunkMaster.ChunksToRestore(fmt.Sprintf("new-file-%d", i))
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			assert.NotContains(t, chunk.Replicas, "storage-0")
+		}
+	}
+}
+
+func TestCancelledDrainPutsStorageBack(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 2, chunkMaster, 0)
+	for i := range 10 {
+		require.NoError(t, cluster.store(fmt.Sprintf("file-%d", i), randomData(1000)))
+	}
+	kept := cluster.storages["storage-0"].chunksCount()
+	require.Greater(t, kept, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := cluster.dd.Drain(ctx, "storage-0", 0, func(progress DrainProgress) {
+		if progress.Moved == 1 {
+			cancel()
+		}
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, kept-1, cluster.storages["storage-0"].chunksCount())
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+
+	statuses := cluster.dd.StorageStatuses()
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "storage-0", statuses[0].StorageID)
+	assert.False(t, statuses[0].Draining)
+}
+
+func TestDrainOfUnknownStorage(t *testing.T) {
+	cluster := newTestCluster(t, 2, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1}), 0)
+	err := cluster.dd.Drain(context.Background(), "storage-5", 0, func(DrainProgress) {})
+	assert.ErrorIs(t, err, ErrStorageNotFound)
+}
@@ -0,0 +1,223 @@
+package datadistributor
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/keyring"
+)
+
+// A chunk is encrypted in segments of encryptionSegmentSize, so a range of it can be read and verified without reading the whole chunk.
+// Every segment is sealed with AES-GCM under the data key of the file and the nonce of the chunk with the segment number mixed in,
+// so segments cannot be reordered or moved to another chunk
+const (
+	encryptionSegmentSize = 64 * 1024
+	encryptionOverhead    = 16
+	sealedSegmentSize     = encryptionSegmentSize + encryptionOverhead
+	nonceSize             = 12
+)
+
+var errNoKeyring = errors.New("chunk is encrypted, but there is no keyfile")
+
+// encrypts tells whether chunks of the file are encrypted. Chunks of erasure coded and deduplicated files are not:
+// parity is computed over stored data, and deduplication needs the same data to be stored the same way for every file
+func (dd *DataDistributor) encrypts(inputFilename string) bool {
+	if dd.config.Keyring == nil {
+		return false
+	}
+	bucket, _ := chunkmaster.SplitFileref(inputFilename)
+	info, err := dd.chunkMaster.StatBucket(bucket)
+	return err == nil && info.Layout.ParityChunks == 0 && !info.Layout.Dedup
+}
+
+// dataKey unwraps the data key of an encrypted chunk, nil for a chunk which is not encrypted
+func (dd *DataDistributor) dataKey(chunk chunkmaster.Chunk) ([]byte, error) {
+	if !chunk.Encrypted() {
+		return nil, nil
+	}
+	if dd.config.Keyring == nil {
+		return nil, errNoKeyring
+	}
+	return dd.config.Keyring.Unwrap(chunk.MasterKeyID, chunk.WrappedKey)
+}
+
+func setDataKey(chunks []chunkmaster.Chunk, masterKeyID string, wrappedKey []byte) {
+	for i := range chunks {
+		chunks[i].MasterKeyID = masterKeyID
+		chunks[i].WrappedKey = wrappedKey
+	}
+}
+
+func sealedSize(size int64) int64 {
+	segments := (size + encryptionSegmentSize - 1) / encryptionSegmentSize
+	return size + segments*encryptionOverhead
+}
+
+func segmentNonce(nonce []byte, segment uint64) []byte {
+	res := make([]byte, nonceSize)
+	copy(res, nonce)
+	binary.BigEndian.PutUint64(res[nonceSize-8:], binary.BigEndian.Uint64(nonce[nonceSize-8:])^segment)
+	return res
+}
+
+// sealChunk encrypts data of a chunk with a new random nonce
+func sealChunk(dataKey, data []byte) (nonce []byte, sealed []byte, err error) {
+	aead, err := keyring.NewAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	sealed = make([]byte, 0, sealedSize(int64(len(data))))
+	for segment := uint64(0); len(data) > 0; segment++ {
+		n := min(len(data), encryptionSegmentSize)
+		sealed = aead.Seal(sealed, segmentNonce(nonce, segment), data[:n], nil)
+		data = data[n:]
+	}
+	return nonce, sealed, nil
+}
+
+// openingReader decrypts sealed segments of a chunk read from source, starting from segment
+type openingReader struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	segment uint64
+	source  io.Reader
+	buffer  []byte
+	plain   []byte
+}
+
+func newOpeningReader(dataKey, nonce []byte, segment uint64, source io.Reader) (*openingReader, error) {
+	aead, err := keyring.NewAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != nonceSize {
+		return nil, fmt.Errorf("nonce must be %d bytes, got %d", nonceSize, len(nonce))
+	}
+	return &openingReader{aead: aead, nonce: nonce, segment: segment, source: source, buffer: make([]byte, sealedSegmentSize)}, nil
+}
+
+func (r *openingReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		n, err := io.ReadFull(r.source, r.buffer)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		sealed := r.buffer[:n]
+		r.plain, err = r.aead.Open(sealed[:0], segmentNonce(r.nonce, r.segment), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decrypt segment %d: %w", r.segment, err)
+		}
+		r.segment++
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// sealedRange gives the stored bytes of an encrypted chunk which have the plain range, and the number of the first segment
+func sealedRange(offset, length int64) (from, to int64, segment uint64) {
+	first := offset / encryptionSegmentSize
+	last := (offset + length - 1) / encryptionSegmentSize
+	return first * sealedSegmentSize, (last + 1) * sealedSegmentSize, uint64(first)
+}
+
+type KeyRotation struct {
+	// Rewrapped is the number of files which data keys have been wrapped with the current master key
+	Rewrapped int
+	// Failed files keep their data keys as they have been, e.g. because their master key is not in the keyfile any more
+	Failed map[string]string `json:",omitempty"`
+}
+
+// RotateKeys wraps data keys of all encrypted files with the current master key. The data is not touched.
+// A file which is deleted or stored again meanwhile is skipped, a new file gets the current master key anyway
+func (dd *DataDistributor) RotateKeys() (KeyRotation, error) {
+	if dd.config.Keyring == nil {
+		return KeyRotation{}, errNoKeyring
+	}
+	current := dd.config.Keyring.CurrentID()
+	type wrappedKey struct {
+		fileref     string
+		masterKeyID string
+		wrapped     []byte
+	}
+	var stale []wrappedKey
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		if len(chunks) > 0 && chunks[0].Encrypted() && chunks[0].MasterKeyID != current && chunks[0].FileSize != chunkmaster.UnknownFileSize {
+			stale = append(stale, wrappedKey{fileref: fileref, masterKeyID: chunks[0].MasterKeyID, wrapped: chunks[0].WrappedKey})
+		}
+		return true
+	})
+
+	rotation := KeyRotation{Failed: make(map[string]string)}
+	for _, key := range stale {
+		err := dd.rewrap(key.fileref, key.masterKeyID, key.wrapped)
+		if errors.Is(err, chunkmaster.ErrFileNotFound) || errors.Is(err, chunkmaster.ErrChunksMismatch) {
+			continue
+		}
+		if err != nil {
+			slog.Error("data key is not rewrapped", "fileref", key.fileref, "master_key_id", key.masterKeyID, "err", err)
+			rotation.Failed[key.fileref] = err.Error()
+			continue
+		}
+		rotation.Rewrapped++
+	}
+	slog.Info("data keys rotated", "master_key_id", current, "rewrapped", rotation.Rewrapped, "failed", len(rotation.Failed))
+	return rotation, nil
+}
+
+func (dd *DataDistributor) rewrap(fileref, masterKeyID string, wrapped []byte) error {
+	dataKey, err := dd.config.Keyring.Unwrap(masterKeyID, wrapped)
+	if err != nil {
+		return err
+	}
+	newKeyID, rewrapped, err := dd.config.Keyring.Wrap(dataKey)
+	if err != nil {
+		return err
+	}
+	return dd.chunkMaster.RewrapDataKey(fileref, wrapped, newKeyID, rewrapped)
+}
+
+type MasterKeyUsage struct {
+	MasterKeyID string
+	Current     bool
+	Files       int
+}
+
+// MasterKeys tells how many files have data keys wrapped with every master key. A master key can be removed from the keyfile
+// once no file uses it
+func (dd *DataDistributor) MasterKeys() []MasterKeyUsage {
+	files := make(map[string]int)
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		if len(chunks) > 0 && chunks[0].Encrypted() {
+			files[chunks[0].MasterKeyID]++
+		}
+		return true
+	})
+	current := ""
+	if dd.config.Keyring != nil {
+		current = dd.config.Keyring.CurrentID()
+	}
+	usage := make([]MasterKeyUsage, 0, len(files))
+	for masterKeyID, n := range files {
+		usage = append(usage, MasterKeyUsage{MasterKeyID: masterKeyID, Current: masterKeyID == current, Files: n})
+	}
+	slices.SortFunc(usage, func(a, b MasterKeyUsage) int {
+		return strings.Compare(a.MasterKeyID, b.MasterKeyID)
+	})
+	return usage
+}
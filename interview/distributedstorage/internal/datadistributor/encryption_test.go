@@ -0,0 +1,236 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/keyring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyfile makes a keyfile with the given master keys, the last one is current
+func writeKeyfile(t *testing.T, keyfilePath string, ids ...string) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), keyring.KeySize))
+		keys = append(keys, fmt.Sprintf(`{"id": %q, "key": %q}`, id, key))
+	}
+	keyfile := fmt.Sprintf(`{"current": %q, "keys": [%s]}`, ids[len(ids)-1], strings.Join(keys, ","))
+	require.NoError(t, os.WriteFile(keyfilePath, []byte(keyfile), 0o600))
+}
+
+func newEncryptionCluster(t *testing.T, compression Compression) (*testCluster, chunkmaster.ChunkMaster, string) {
+	keyfilePath := path.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, keyfilePath, "a-key")
+	keys, err := keyring.NewKeyring(keyfilePath)
+	require.NoError(t, err)
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2})
+	cluster := newTestClusterWithConfig(t, 4, chunkMaster, Config{StreamChunkSize: 200_000, Compression: compression, Keyring: keys})
+	return cluster, chunkMaster, keyfilePath
+}
+
+func (tc *testCluster) storedChunk(fileref string, chunk chunkmaster.Chunk) []byte {
+	return tc.storages[chunk.Replicas[0]].chunk(chunkFileIdOf(fileref, chunk))
+}
+
+func TestEncryptedFileIsRestored(t *testing.T) {
+	cluster, chunkMaster, _ := newEncryptionCluster(t, Compression{})
+	data := logLines(400_000)
+	require.NoError(t, cluster.store("app.log", data))
+
+	chunks, err := chunkMaster.ChunksToRestore("app.log")
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	for _, chunk := range chunks {
+		assert.True(t, chunk.Encrypted())
+		assert.Equal(t, "a-key", chunk.MasterKeyID)
+		assert.Equal(t, chunks[0].WrappedKey, chunk.WrappedKey, "the data key is the same for the whole file")
+		assert.Equal(t, sealedSize(chunk.LogicalSize), chunk.Size)
+		stored := cluster.storedChunk("app.log", chunk)
+		assert.EqualValues(t, chunk.Size, len(stored))
+		assert.NotContains(t, string(stored), `"msg":"request served"`)
+	}
+	assert.NotEqual(t, chunks[0].Nonce, chunks[1].Nonce)
+
+	restored, err := cluster.retrieve("app.log")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 10}, {65_530, 10}, {65_536, 65_536}, {133_330, 10}, {100_000, 200_000}, {399_990, 10}, {12345, 0},
+	} {
+		part, err := cluster.retrieveRange("app.log", r.offset, r.length)
+		require.NoError(t, err)
+		assert.Equal(t, data[r.offset:r.offset+r.length], part, "offset %d length %d", r.offset, r.length)
+	}
+}
+
+func TestEncryptedRangeReadsOnlyItsSegments(t *testing.T) {
+	cluster, chunkMaster, _ := newEncryptionCluster(t, Compression{})
+	data := randomData(200_000)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	// the first segment of the chunk is broken, but it is not needed
+	for _, storageID := range chunks[0].Replicas {
+		cluster.storages[storageID].mutex.Lock()
+		cluster.storages[storageID].chunks[chunkFileIdOf("file", chunks[0])][0] ^= 1
+		cluster.storages[storageID].mutex.Unlock()
+	}
+	part, err := cluster.retrieveRange("file", encryptionSegmentSize, 100)
+	require.NoError(t, err)
+	assert.Equal(t, data[encryptionSegmentSize:encryptionSegmentSize+100], part)
+	_, err = cluster.retrieveRange("file", 10, 100)
+	assert.Error(t, err, "tampered data is never returned")
+}
+
+func TestEncryptedAndCompressedFileIsRestored(t *testing.T) {
+	cluster, chunkMaster, _ := newEncryptionCluster(t, Compression{Sniff: CodecZstd})
+	data := logLines(250_000)
+	stored, err := cluster.dd.DistributeStream(context.Background(), "app.log", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), stored)
+
+	chunks, err := chunkMaster.ChunksToRestore("app.log")
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	for _, chunk := range chunks {
+		assert.True(t, chunk.Encrypted())
+		assert.Equal(t, CodecZstd, chunk.Codec)
+		assert.Less(t, 5*chunk.Size, chunk.LogicalSize, "data is compressed before it is encrypted")
+	}
+	restored, err := cluster.retrieve("app.log")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+	part, err := cluster.retrieveRange("app.log", 199_990, 20)
+	require.NoError(t, err)
+	assert.Equal(t, data[199_990:200_010], part)
+}
+
+func TestEmptyEncryptedFile(t *testing.T) {
+	cluster, _, _ := newEncryptionCluster(t, Compression{})
+	require.NoError(t, cluster.store("empty", nil))
+	restored, err := cluster.retrieve("empty")
+	require.NoError(t, err)
+	assert.Empty(t, restored)
+}
+
+func TestKeyRotationDoesNotRewriteData(t *testing.T) {
+	cluster, chunkMaster, keyfilePath := newEncryptionCluster(t, Compression{})
+	files := map[string][]byte{"a": randomData(100_000), "b": logLines(50_000)}
+	stored := make(map[string][][]byte)
+	for fileref, data := range files {
+		require.NoError(t, cluster.store(fileref, data))
+		chunks, err := chunkMaster.ChunksToRestore(fileref)
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			stored[fileref] = append(stored[fileref], cluster.storedChunk(fileref, chunk))
+		}
+	}
+	assert.Equal(t, []MasterKeyUsage{{MasterKeyID: "a-key", Current: true, Files: 2}}, cluster.dd.MasterKeys())
+
+	writeKeyfile(t, keyfilePath, "a-key", "b-key")
+	require.NoError(t, cluster.dd.config.Keyring.Reload())
+	require.NoError(t, cluster.store("c", randomData(10)))
+	assert.Equal(t, []MasterKeyUsage{{MasterKeyID: "a-key", Files: 2}, {MasterKeyID: "b-key", Current: true, Files: 1}}, cluster.dd.MasterKeys())
+	rotation, err := cluster.dd.RotateKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 2, rotation.Rewrapped)
+	assert.Empty(t, rotation.Failed)
+	assert.Equal(t, []MasterKeyUsage{{MasterKeyID: "b-key", Current: true, Files: 3}}, cluster.dd.MasterKeys())
+
+	// the old master key is not needed any more
+	writeKeyfile(t, keyfilePath, "b-key")
+	require.NoError(t, cluster.dd.config.Keyring.Reload())
+	for fileref, data := range files {
+		chunks, err := chunkMaster.ChunksToRestore(fileref)
+		require.NoError(t, err)
+		for i, chunk := range chunks {
+			assert.Equal(t, "b-key", chunk.MasterKeyID)
+			assert.Equal(t, stored[fileref][i], cluster.storedChunk(fileref, chunk), "data is not rewritten")
+		}
+		restored, err := cluster.retrieve(fileref)
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, fileref)
+	}
+}
+
+func TestRotationReportsUnknownMasterKeys(t *testing.T) {
+	cluster, _, keyfilePath := newEncryptionCluster(t, Compression{})
+	require.NoError(t, cluster.store("file", randomData(1000)))
+	writeKeyfile(t, keyfilePath, "b-key")
+	require.NoError(t, cluster.dd.config.Keyring.Reload())
+
+	rotation, err := cluster.dd.RotateKeys()
+	require.NoError(t, err)
+	assert.Zero(t, rotation.Rewrapped)
+	assert.Contains(t, rotation.Failed["file"], keyring.ErrUnknownKey.Error())
+	_, err = cluster.retrieve("file")
+	assert.ErrorIs(t, err, keyring.ErrUnknownKey)
+}
+
+func TestErasureCodedFilesAreNotEncrypted(t *testing.T) {
+	cluster, chunkMaster, _ := newEncryptionCluster(t, Compression{})
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "parity", Layout: chunkmaster.Layout{Chunks: 4, ReplicationFactor: 1, ParityChunks: 1}}))
+	data := randomData(10_000)
+	require.NoError(t, cluster.store("parity/file", data))
+	chunks, err := chunkMaster.ChunksToRestore("parity/file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		assert.False(t, chunk.Encrypted())
+	}
+	restored, err := cluster.retrieve("parity/file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+}
+
+func TestCorruptedEncryptedReplicaIsRepaired(t *testing.T) {
+	cluster, chunkMaster, _ := newEncryptionCluster(t, Compression{})
+	data := randomData(200_000)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	chunkFileId := chunkFileIdOf("file", chunks[1])
+	corrupted, healthy := cluster.storages[chunks[1].Replicas[0]], cluster.storages[chunks[1].Replicas[1]]
+	corrupted.corruptAll()
+	cluster.repair(t, chunks[1].Replicas[0], chunkFileId)
+	assert.Equal(t, healthy.chunk(chunkFileId), corrupted.chunk(chunkFileId))
+	healthy.setDown(true)
+	part, err := cluster.retrieveRange("file", chunks[1].OriginalFileStart, chunks[1].LogicalSize)
+	require.NoError(t, err)
+	assert.Equal(t, data[chunks[1].OriginalFileStart:chunks[1].OriginalFileStart+chunks[1].LogicalSize], part)
+}
+
+func TestEncryptedChunksAreTransferredConcurrently(t *testing.T) {
+	keyfilePath := path.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, keyfilePath, "a-key")
+	keys, err := keyring.NewKeyring(keyfilePath)
+	require.NoError(t, err)
+	cluster, meter := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}, Config{Parallelism: 3, Keyring: keys}, 10*time.Millisecond)
+	data := randomData(6 * minCompressedChunkSize)
+	require.NoError(t, cluster.store("file", data))
+	assert.Equal(t, 3, meter.peakValue(), "stores must run at once, but no more than parallelism")
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+
+	// chunks which have been sent before one fails are rolled back too
+	chunksOfOne := cluster.totalChunks()
+	for _, storageID := range []string{"storage-3", "storage-4", "storage-5"} {
+		cluster.storages[storageID].setDown(true)
+	}
+	assert.Error(t, cluster.store("failed", data))
+	assert.Equal(t, chunksOfOne, cluster.totalChunks())
+	_, err = cluster.dd.StatFile("failed")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+}
@@ -0,0 +1,250 @@
+package datadistributor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/klauspost/reedsolomon"
+)
+
+// shards are processed by portions of this size when parity is used for restoring data
+const erasurePortionSize = 1024 * 1024
+
+var ErrNotEnoughShards = errors.New("not enough shards to restore data")
+
+// erasureShards returns the number of data and parity chunks. parity is 0 when the file is not erasure coded
+func erasureShards(chunks []chunkmaster.Chunk) (data int, parity int) {
+	for _, chunk := range chunks {
+		if chunk.Role == chunkmaster.ChunkRoleParity {
+			parity++
+		} else {
+			data++
+		}
+	}
+	return data, parity
+}
+
+// parityBuilder calculates parity shards while data shards are being streamed one by one.
+// Parity is accumulated in temporary files, so memory usage does not depend on file size
+type parityBuilder struct {
+	encoder   reedsolomon.Encoder
+	shardSize int64
+	files     []*os.File
+	buffers   [][]byte
+}
+
+func newParityBuilder(dataShards, parityShards int, shardSize int64) (*parityBuilder, error) {
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create erasure encoder: %w", err)
+	}
+	pb := &parityBuilder{
+		encoder:   encoder,
+		shardSize: shardSize,
+		buffers:   make([][]byte, parityShards),
+	}
+	for range parityShards {
+		f, err := os.CreateTemp("", "parity-*")
+		if err != nil {
+			pb.close()
+			return nil, fmt.Errorf("cannot create parity file: %w", err)
+		}
+		pb.files = append(pb.files, f)
+		// parity must start zeroed
+		if err := f.Truncate(shardSize); err != nil {
+			pb.close()
+			return nil, fmt.Errorf("cannot allocate parity file: %w", err)
+		}
+	}
+	return pb, nil
+}
+
+// add mixes a portion of data shard into parity. Every portion of a data shard must be added exactly once
+func (pb *parityBuilder) add(shardIdx int, offset int64, data []byte) error {
+	parity := make([][]byte, len(pb.files))
+	for i, f := range pb.files {
+		if cap(pb.buffers[i]) < len(data) {
+			pb.buffers[i] = make([]byte, len(data))
+		}
+		parity[i] = pb.buffers[i][:len(data)]
+		if _, err := f.ReadAt(parity[i], offset); err != nil {
+			return fmt.Errorf("parity read failed: %w", err)
+		}
+	}
+	if err := pb.encoder.EncodeIdx(data, shardIdx, parity); err != nil {
+		return fmt.Errorf("parity encoding failed: %w", err)
+	}
+	for i, f := range pb.files {
+		if _, err := f.WriteAt(parity[i], offset); err != nil {
+			return fmt.Errorf("parity write failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// dataReader passes data shard through and adds it to parity on the way
+func (pb *parityBuilder) dataReader(shardIdx int, reader io.Reader) io.Reader {
+	return &parityTeeReader{builder: pb, shardIdx: shardIdx, reader: reader}
+}
+
+// parityReader must be used only after all data shards have been read
+func (pb *parityBuilder) parityReader(parityIdx int) io.Reader {
+	return io.NewSectionReader(pb.files[parityIdx], 0, pb.shardSize)
+}
+
+func (pb *parityBuilder) close() {
+	for _, f := range pb.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+type parityTeeReader struct {
+	builder  *parityBuilder
+	shardIdx int
+	reader   io.Reader
+	offset   int64
+}
+
+func (tr *parityTeeReader) Read(p []byte) (int, error) {
+	n, err := tr.reader.Read(p)
+	if n > 0 {
+		if addErr := tr.builder.add(tr.shardIdx, tr.offset, p[:n]); addErr != nil {
+			return n, addErr
+		}
+		tr.offset += int64(n)
+	}
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// paddedReader gives dataSize bytes from reader and then pads them with zeroes up to shard size
+func paddedReader(reader io.Reader, dataSize, shardSize int64) io.Reader {
+	return io.MultiReader(io.LimitReader(reader, dataSize), io.LimitReader(zeroReader{}, shardSize-dataSize))
+}
+
+// truncatingWriter drops erasure coding padding
+type truncatingWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (tw *truncatingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > tw.left {
+		p = p[:tw.left]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	written, err := tw.w.Write(p)
+	tw.left -= int64(written)
+	if err != nil {
+		return written, err
+	}
+	return n, nil
+}
+
+// rebuildShard restores length bytes of a shard starting from offset. Data is taken from other shards and written to progress,
+// continuing from what progress already has. If one of the helper shards fails, another set of shards is tried
+func (dd *DataDistributor) rebuildShard(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk, target int, offset, length int64, progress *progressWriter) error {
+	dataShards, parityShards := erasureShards(chunks)
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return fmt.Errorf("cannot create erasure decoder: %w", err)
+	}
+
+	failed := map[int]bool{target: true}
+	var errs []error
+	for {
+		helpers := make([]int, 0, dataShards)
+		for i := range chunks {
+			if !failed[i] && len(helpers) < dataShards {
+				helpers = append(helpers, i)
+			}
+		}
+		if len(helpers) < dataShards {
+			return fmt.Errorf("%w: chunk %d, %w", ErrNotEnoughShards, target, errors.Join(errs...))
+		}
+
+		// every byte of a shard depends only on the bytes at the same position in other shards
+		from := offset + progress.written
+		slog.Info("rebuilding shard", "filename", inputFilename, "chunk", target, "helpers", helpers, "from", from)
+		failedHelper, err := dd.rebuildShardFrom(ctx, inputFilename, chunks, encoder, helpers, target, from, offset+length, progress.proceed())
+		if err == nil {
+			return nil
+		}
+		if failedHelper < 0 || progress.err != nil || ctx.Err() != nil {
+			return err
+		}
+		failed[failedHelper] = true
+		errs = append(errs, err)
+	}
+}
+
+// rebuildShardFrom reads [from, to) of all helpers at once by portions and decodes the same part of the target from them.
+// Returns the index of a helper if it is the reason of failure
+func (dd *DataDistributor) rebuildShardFrom(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk, encoder reedsolomon.Encoder, helpers []int, target int, from, to int64, writer io.Writer) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	readers := make([]*io.PipeReader, len(helpers))
+	for i, helper := range helpers {
+		pipeReader, pipeWriter := io.Pipe()
+		readers[i] = pipeReader
+		chunk := chunks[helper]
+		go func() {
+			progress := &progressWriter{w: pipeWriter}
+			err := dd.retrieveChunkReplicas(ctx, chunkFileIdOf(inputFilename, chunk), chunk, from, to-from, progress)
+			pipeWriter.CloseWithError(err)
+		}()
+	}
+	defer func() {
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+
+	shards := make([][]byte, len(chunks))
+	buffers := make([][]byte, len(chunks))
+	for _, i := range append(helpers, target) {
+		buffers[i] = make([]byte, min(erasurePortionSize, to-from))
+	}
+	required := make([]bool, len(chunks))
+	required[target] = true
+	reconstruct := func() error { return encoder.ReconstructSome(shards, required) }
+	if chunks[target].Role == chunkmaster.ChunkRoleParity {
+		// ReconstructSome restores only data shards
+		reconstruct = func() error { return encoder.Reconstruct(shards) }
+	}
+	for offset := from; offset < to; offset += erasurePortionSize {
+		portionSize := min(erasurePortionSize, to-offset)
+		clear(shards)
+		for i, helper := range helpers {
+			_, err := io.ReadFull(readers[i], buffers[helper][:portionSize])
+			if err != nil {
+				return helper, fmt.Errorf("helper chunk %d failed: %w", helper, err)
+			}
+			shards[helper] = buffers[helper][:portionSize]
+		}
+		shards[target] = buffers[target][:0]
+		if err := reconstruct(); err != nil {
+			return -1, fmt.Errorf("shard decoding failed: %w", err)
+		}
+		if _, err := writer.Write(shards[target]); err != nil {
+			return -1, err
+		}
+	}
+	return -1, nil
+}
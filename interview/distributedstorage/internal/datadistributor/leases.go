@@ -0,0 +1,138 @@
+package datadistributor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+)
+
+// reserveAttempts is how many times chunks of a file are placed again when a storage refuses to reserve space for them
+const reserveAttempts = 3
+
+// leasesOf groups chunk file ids and sizes by storages which keep replicas of them
+func leasesOf(inputFilename string, chunks []chunkmaster.Chunk) map[string]map[string]int64 {
+	leases := make(map[string]map[string]int64)
+	for _, chunk := range chunks {
+		chunkFileId := chunkFileIdOf(inputFilename, chunk)
+		for _, storageID := range chunk.Replicas {
+			if leases[storageID] == nil {
+				leases[storageID] = make(map[string]int64)
+			}
+			leases[storageID][chunkFileId] = chunk.Size
+		}
+	}
+	return leases
+}
+
+// reserveLeases makes every storage chosen for chunks lease space for them. When some storages have no space, leases granted
+// by others are released, and those storages are returned. A storage which cannot be asked at all is left to fail while storing,
+// so write quorum decides whether the file can be stored without it
+func (dd *DataDistributor) reserveLeases(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk) ([]string, error) {
+	leases := leasesOf(inputFilename, chunks)
+	type reserveResult struct {
+		storageID string
+		err       error
+	}
+	results := make(chan reserveResult, len(leases))
+	for storageID, reservations := range leases {
+		meta, found := dd.lookupStorage(storageID)
+		if !found {
+			results <- reserveResult{storageID: storageID, err: fmt.Errorf("storage instance %s missing", storageID)}
+			continue
+		}
+		go func() {
+			results <- reserveResult{storageID: storageID, err: meta.storage.Reserve(ctx, reservations)}
+		}()
+	}
+
+	var (
+		full []string
+		errs []error
+	)
+	for range leases {
+		res := <-results
+		if res.err == nil {
+			continue
+		}
+		if !errors.Is(res.err, storage.ErrNotEnoughSpace) {
+			slog.Warn("cannot reserve space", "storage_id", res.storageID, "filename", inputFilename, "err", res.err)
+			continue
+		}
+		full = append(full, res.storageID)
+		errs = append(errs, fmt.Errorf("replica %s: %w", res.storageID, res.err))
+	}
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	// releasing a lease which has not been granted is harmless
+	dd.releaseLeases(ctx, inputFilename, chunks)
+	return full, fmt.Errorf("cannot reserve space: %w", errors.Join(errs...))
+}
+
+// markFull makes storages which have refused to reserve space get no chunks until their next heartbeat
+func (dd *DataDistributor) markFull(storageIDs []string) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	for _, storageID := range storageIDs {
+		if meta, found := dd.knownStorages[storageID]; found {
+			meta.availableBytes = 0
+		}
+	}
+}
+
+// settleLeases commits leases of replicas which have stored their chunks and releases leases of those which have failed
+func (dd *DataDistributor) settleLeases(ctx context.Context, inputFilename string, planned, stored []chunkmaster.Chunk) {
+	committed := make(map[string][]string)
+	released := make(map[string][]string)
+	for i, chunk := range planned {
+		chunkFileId := chunkFileIdOf(inputFilename, chunk)
+		for _, storageID := range chunk.Replicas {
+			if slices.Contains(stored[i].Replicas, storageID) {
+				committed[storageID] = append(committed[storageID], chunkFileId)
+			} else {
+				released[storageID] = append(released[storageID], chunkFileId)
+			}
+		}
+	}
+	dd.endLeases(ctx, committed, storage.Storage.Commit)
+	dd.endLeases(ctx, released, storage.Storage.Release)
+}
+
+func (dd *DataDistributor) releaseLeases(ctx context.Context, inputFilename string, chunks []chunkmaster.Chunk) {
+	released := make(map[string][]string)
+	for storageID, reservations := range leasesOf(inputFilename, chunks) {
+		for chunkFileId := range reservations {
+			released[storageID] = append(released[storageID], chunkFileId)
+		}
+	}
+	dd.endLeases(ctx, released, storage.Storage.Release)
+}
+
+// endLeases does not fail: a lease which has not been ended expires on its own
+func (dd *DataDistributor) endLeases(ctx context.Context, leases map[string][]string, end func(storage.Storage, context.Context, []string) error) {
+	ctx = context.WithoutCancel(ctx)
+	for storageID, chunkFileIds := range leases {
+		meta, found := dd.lookupStorage(storageID)
+		if !found {
+			continue
+		}
+		if err := end(meta.storage, ctx, chunkFileIds); err != nil {
+			slog.Warn("cannot end leases, they will expire", "storage_id", storageID, "file_ids", chunkFileIds, "err", err)
+		}
+	}
+}
+
+// giveBack returns reserved space to the estimate of available space. It must be called with storageMutex held
+func (meta *storageMeta) giveBack(size int64) {
+	if meta.availableBytes > math.MaxInt64-size {
+		meta.availableBytes = math.MaxInt64
+		return
+	}
+	meta.availableBytes += size
+}
@@ -0,0 +1,100 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentUploadsDoNotOvercommit(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 2, chunkMaster, 0)
+	// both storages report much more space than they have
+	for _, ms := range cluster.storages {
+		ms.capacity = 10000
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		stored int
+	)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cluster.store(fmt.Sprintf("file-%d", i), randomData(3000))
+			if err != nil {
+				assert.True(t, errors.Is(err, storage.ErrNotEnoughSpace) || errors.Is(err, chunkmaster.ErrNotEnoughAvailableStorage), err)
+				return
+			}
+			mutex.Lock()
+			stored++
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 6, stored, "every storage has space for 3 files")
+	for storageID, ms := range cluster.storages {
+		assert.LessOrEqual(t, ms.storedBytes(), ms.capacity, "storage %s", storageID)
+		assert.Zero(t, ms.leasesCount(), "storage %s", storageID)
+	}
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+}
+
+func TestFullStorageIsAvoided(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 2, chunkMaster, 0)
+	// the storage reports more space than the other one, but has almost none
+	cluster.storages["storage-0"].capacity = 100
+	_, err := cluster.dd.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: "storage-0", AvailableBytes: 1 << 31})
+	require.NoError(t, err)
+
+	require.NoError(t, cluster.store("file", randomData(1000)), "the storage which has refused is not used again")
+	assert.Zero(t, cluster.storages["storage-0"].chunksCount())
+	assert.Equal(t, 1, cluster.storages["storage-1"].chunksCount())
+}
+
+func TestFailedUploadReturnsReservedSpace(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 3, chunkMaster, 0)
+	before := cluster.dd.StorageStatuses()
+
+	cluster.storages["storage-1"].setDown(true)
+	require.Error(t, cluster.store("file", randomData(3000)))
+	assert.Equal(t, before, cluster.dd.StorageStatuses())
+	for storageID, ms := range cluster.storages {
+		assert.Zero(t, ms.leasesCount(), "storage %s", storageID)
+		assert.Zero(t, ms.chunksCount(), "storage %s", storageID)
+	}
+
+	cluster.storages["storage-1"].setDown(false)
+	require.NoError(t, cluster.store("file", randomData(3000)))
+	for storageID, ms := range cluster.storages {
+		assert.Zero(t, ms.leasesCount(), "leases must be committed on storage %s", storageID)
+	}
+}
+
+func TestStreamedChunksAreLeased(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestClusterWithConfig(t, 1, chunkMaster, Config{StreamChunkSize: 1000})
+	cluster.storages["storage-0"].capacity = 3000
+
+	_, err := cluster.dd.DistributeStream(context.Background(), "file", bytes.NewReader(randomData(2400)))
+	require.NoError(t, err)
+	assert.Zero(t, cluster.storages["storage-0"].leasesCount())
+
+	_, err = cluster.dd.DistributeStream(context.Background(), "another-file", bytes.NewReader(randomData(1000)))
+	assert.ErrorIs(t, err, storage.ErrNotEnoughSpace)
+	assert.Equal(t, 3, cluster.storages["storage-0"].chunksCount(), "chunks of the failed file are removed")
+}
@@ -0,0 +1,302 @@
+package datadistributor
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+type StorageState string
+
+const (
+	StorageAlive StorageState = "alive"
+	// StorageSuspect has missed heartbeats for a while. It does not get new chunks, but its chunks are still considered readable
+	StorageSuspect StorageState = "suspect"
+	// StorageDead has been silent for too long, its chunks are considered lost
+	StorageDead StorageState = "dead"
+	// StorageRecovering has come back or has just been added, and stays out of service until its chunks are checked against the catalog
+	StorageRecovering StorageState = "recovering"
+)
+
+const inventoryCheckTimeout = 30 * time.Second
+
+type StorageStatus struct {
+	StorageID      string             `json:"storage_id"`
+	State          StorageState       `json:"state"`
+	AvailableBytes int64              `json:"available_bytes"`
+	Draining       bool               `json:"draining"`
+	Labels         chunkmaster.Labels `json:"labels"`
+	LastHeartbeat  time.Time          `json:"last_heartbeat"`
+}
+
+type UnreadableFile struct {
+	Fileref string `json:"fileref"`
+	// VersionID is set when the file is a version of a file of a bucket with versioning
+	VersionID string `json:"version_id,omitempty"`
+	// UnavailableChunks have no replica on a live storage
+	UnavailableChunks []uint32 `json:"unavailable_chunks"`
+}
+
+// MonitorLiveness periodically moves silent storages to suspect and then to dead state
+func (dd *DataDistributor) MonitorLiveness(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dd.checkLiveness()
+		}
+	}
+}
+
+func (dd *DataDistributor) checkLiveness() {
+	if dd.config.SuspectAfter <= 0 {
+		return
+	}
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+
+	now := dd.now()
+	for _, meta := range dd.knownStorages {
+		silence := now.Sub(meta.lastHeartbeat)
+		switch {
+		case silence >= dd.config.DeadAfter && meta.state != StorageDead:
+			slog.Warn("storage is dead", "storage_id", meta.storageID, "silence", silence)
+			meta.state = StorageDead
+		case silence >= dd.config.SuspectAfter && meta.state == StorageAlive:
+			slog.Warn("storage is suspect", "storage_id", meta.storageID, "silence", silence)
+			meta.state = StorageSuspect
+		}
+	}
+}
+
+// isReferenced scans the whole catalog, so it must not be called with storageMutex held
+func (dd *DataDistributor) isReferenced(storageID string) bool {
+	referenced := false
+	dd.chunkMaster.ForEachFile(func(_ string, chunks []chunkmaster.Chunk) bool {
+		for _, chunk := range chunks {
+			if slices.Contains(chunk.Replicas, storageID) {
+				referenced = true
+				return false
+			}
+		}
+		return true
+	})
+	return referenced
+}
+
+// startInventoryCheck must be called with storageMutex held
+func (dd *DataDistributor) startInventoryCheck(meta *storageMeta) {
+	slog.Info("checking chunks of storage", "storage_id", meta.storageID)
+	meta.state = StorageRecovering
+	go dd.checkInventory(meta)
+}
+
+// checkInventory compares chunks which the storage actually has with the catalog.
+// Chunks which the storage has lost are removed from the catalog, so nobody tries to read them from there
+func (dd *DataDistributor) checkInventory(meta *storageMeta) {
+	if !dd.isReferenced(meta.storageID) {
+		// a new storage, or one which has nothing in the catalog, cannot have lost anything
+		dd.finishInventoryCheck(meta)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryCheckTimeout)
+	defer cancel()
+	stored, err := meta.storage.ListChunks(ctx)
+	if err != nil {
+		slog.Error("inventory check failed, storage stays out of service", "storage_id", meta.storageID, "err", err)
+		dd.storageMutex.Lock()
+		if meta.state == StorageRecovering {
+			// the next heartbeat will start another check
+			meta.state = StorageDead
+		}
+		dd.storageMutex.Unlock()
+		return
+	}
+
+	present := make(map[string]bool, len(stored))
+	for _, chunkFileId := range stored {
+		present[chunkFileId] = true
+	}
+	// deduplicated chunks are shared by files, so a chunk which has been matched may be met again
+	matched := make(map[string]bool, len(stored))
+	type fileUpdate struct {
+		fileref string
+		chunks  []chunkmaster.Chunk
+	}
+	var (
+		updates    []fileUpdate
+		lostChunks int
+	)
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		changed := false
+		for i, chunk := range chunks {
+			if !slices.Contains(chunk.Replicas, meta.storageID) {
+				continue
+			}
+			chunkFileId := chunkFileIdOf(fileref, chunk)
+			if present[chunkFileId] {
+				matched[chunkFileId] = true
+				continue
+			}
+			chunks[i].Replicas = slices.DeleteFunc(chunks[i].Replicas, func(storageID string) bool {
+				return storageID == meta.storageID
+			})
+			changed = true
+			lostChunks++
+		}
+		if changed {
+			updates = append(updates, fileUpdate{fileref: fileref, chunks: chunks})
+		}
+		return true
+	})
+	for _, update := range updates {
+		err := dd.chunkMaster.UpdateChunks(update.fileref, update.chunks)
+		if err != nil {
+			slog.Warn("cannot drop lost replicas", "storage_id", meta.storageID, "fileref", update.fileref, "err", err)
+		}
+	}
+	// orphans are likely leftovers of failed deletes. They are harmless, so we only report them
+	slog.Info("inventory check done", "storage_id", meta.storageID, "stored_chunks", len(stored), "lost_chunks", lostChunks, "orphan_chunks", len(present)-len(matched))
+	dd.finishInventoryCheck(meta)
+}
+
+func (dd *DataDistributor) finishInventoryCheck(meta *storageMeta) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	if meta.state == StorageRecovering {
+		meta.state = StorageAlive
+	}
+}
+
+func livenessRank(state StorageState) int {
+	switch state {
+	case StorageAlive:
+		return 0
+	case StorageSuspect:
+		return 1
+	case StorageRecovering:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// orderByLiveness puts replicas on healthy storages first, so reading does not waste time on timeouts
+func (dd *DataDistributor) orderByLiveness(replicas []string) []string {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	rank := func(storageID string) int {
+		meta, found := dd.knownStorages[storageID]
+		if !found {
+			return livenessRank(StorageDead) + 1
+		}
+		return livenessRank(meta.state)
+	}
+	ordered := slices.Clone(replicas)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return rank(a) - rank(b)
+	})
+	return ordered
+}
+
+func (dd *DataDistributor) StorageStatuses() []StorageStatus {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	statuses := make([]StorageStatus, 0, len(dd.knownStorages))
+	for _, meta := range dd.knownStorages {
+		statuses = append(statuses, StorageStatus{
+			StorageID:      meta.storageID,
+			State:          meta.state,
+			AvailableBytes: meta.availableBytes,
+			Draining:       meta.draining,
+			Labels:         meta.labels,
+			LastHeartbeat:  meta.lastHeartbeat,
+		})
+	}
+	slices.SortFunc(statuses, func(a, b StorageStatus) int {
+		return strings.Compare(a.StorageID, b.StorageID)
+	})
+	return statuses
+}
+
+// ChunksPerStorage counts chunk replicas which the catalog keeps on every storage. A deduplicated chunk is counted once however
+// many files refer to it
+func (dd *DataDistributor) ChunksPerStorage() map[string]int {
+	counts := make(map[string]int)
+	dd.storageMutex.Lock()
+	for storageID := range dd.knownStorages {
+		counts[storageID] = 0
+	}
+	dd.storageMutex.Unlock()
+
+	contents := make(map[string]bool)
+	dd.chunkMaster.ForEachFile(func(_ string, chunks []chunkmaster.Chunk) bool {
+		for _, chunk := range chunks {
+			if chunk.ContentID != "" {
+				if contents[chunk.ContentID] {
+					continue
+				}
+				contents[chunk.ContentID] = true
+			}
+			for _, storageID := range chunk.Replicas {
+				counts[storageID]++
+			}
+		}
+		return true
+	})
+	return counts
+}
+
+// Rollbacks is the number of uploads which have failed and have been rolled back since start
+func (dd *DataDistributor) Rollbacks() int64 {
+	return dd.rollbacks.Load()
+}
+
+// UnreadableFiles reports files which cannot be restored from alive and suspect storages
+func (dd *DataDistributor) UnreadableFiles() []UnreadableFile {
+	available := make(map[string]bool)
+	dd.storageMutex.Lock()
+	for storageID, meta := range dd.knownStorages {
+		available[storageID] = meta.state == StorageAlive || meta.state == StorageSuspect
+	}
+	dd.storageMutex.Unlock()
+
+	unreadable := make([]UnreadableFile, 0)
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		if fileSize(chunks) == chunkmaster.UnknownFileSize {
+			// being streamed right now, nobody reads it yet
+			return true
+		}
+		var (
+			unavailable    []uint32
+			dataIsAffected bool
+		)
+		_, parityShards := erasureShards(chunks)
+		for _, chunk := range chunks {
+			if slices.ContainsFunc(chunk.Replicas, func(storageID string) bool { return available[storageID] }) {
+				continue
+			}
+			unavailable = append(unavailable, chunk.Order)
+			// erasure coded chunks which are only padding are never read
+			if chunk.Role == chunkmaster.ChunkRoleData && (chunk.DataSize() > 0 || parityShards == 0) {
+				dataIsAffected = true
+			}
+		}
+		if len(unavailable) > parityShards && dataIsAffected {
+			fileref, versionID := chunkmaster.SplitVersionFileref(fileref)
+			unreadable = append(unreadable, UnreadableFile{Fileref: fileref, VersionID: versionID, UnavailableChunks: unavailable})
+		}
+		return true
+	})
+	slices.SortFunc(unreadable, func(a, b UnreadableFile) int {
+		return strings.Compare(a.Fileref, b.Fileref)
+	})
+	return unreadable
+}
@@ -0,0 +1,217 @@
+package datadistributor
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) get() time.Time {
+	return fc.now
+}
+
+func newLivenessCluster(t *testing.T, storagesNum int, chunkMaster chunkmaster.ChunkMaster) (*testCluster, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cluster := newTestClusterWithConfig(t, storagesNum, chunkMaster, Config{SuspectAfter: 3 * time.Second, DeadAfter: 10 * time.Second})
+	cluster.dd.now = clock.get
+	for storageID := range cluster.storages {
+		cluster.heartbeat(t, storageID)
+	}
+	return cluster, clock
+}
+
+// elapse moves the clock forward, while every storage except silent ones keeps sending heartbeats
+func (tc *testCluster) elapse(t *testing.T, clock *fakeClock, d time.Duration, silent ...string) {
+	clock.now = clock.now.Add(d)
+	for storageID := range tc.storages {
+		if !slices.Contains(silent, storageID) {
+			tc.heartbeat(t, storageID)
+		}
+	}
+	tc.dd.checkLiveness()
+}
+
+func stateOf(dd *DataDistributor, storageID string) StorageState {
+	for _, status := range dd.StorageStatuses() {
+		if status.StorageID == storageID {
+			return status.State
+		}
+	}
+	return ""
+}
+
+func TestSilentStorageBecomesSuspectThenDead(t *testing.T) {
+	cluster, clock := newLivenessCluster(t, 3, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1}))
+
+	cluster.elapse(t, clock, 2*time.Second, "storage-1")
+	assert.Equal(t, StorageAlive, stateOf(cluster.dd, "storage-1"))
+	cluster.elapse(t, clock, 2*time.Second, "storage-1")
+	assert.Equal(t, StorageSuspect, stateOf(cluster.dd, "storage-1"))
+	cluster.elapse(t, clock, 7*time.Second, "storage-1")
+	assert.Equal(t, StorageDead, stateOf(cluster.dd, "storage-1"))
+	assert.Equal(t, StorageAlive, stateOf(cluster.dd, "storage-0"))
+}
+
+func TestSuspectStorageComesBackWithoutCheck(t *testing.T) {
+	cluster, clock := newLivenessCluster(t, 3, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1}))
+
+	cluster.elapse(t, clock, 4*time.Second, "storage-1")
+	require.Equal(t, StorageSuspect, stateOf(cluster.dd, "storage-1"))
+	cluster.elapse(t, clock, time.Second)
+	assert.Equal(t, StorageAlive, stateOf(cluster.dd, "storage-1"))
+}
+
+func TestSilentStorageIsExcludedFromPlacement(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1})
+	cluster, clock := newLivenessCluster(t, 4, chunkMaster)
+
+	cluster.elapse(t, clock, 4*time.Second, "storage-2")
+	require.Equal(t, StorageSuspect, stateOf(cluster.dd, "storage-2"))
+	for _, fileref := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, cluster.store(fileref, randomData(9007)))
+		chunks, err := chunkMaster.ChunksToRestore(fileref)
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			assert.NotContains(t, chunk.Replicas, "storage-2")
+		}
+	}
+	assert.Zero(t, cluster.storages["storage-2"].chunksCount())
+}
+
+func TestNotEnoughLiveStorages(t *testing.T) {
+	cluster, clock := newLivenessCluster(t, 3, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1}))
+
+	cluster.elapse(t, clock, 11*time.Second, "storage-0")
+	err := cluster.store("file", randomData(9007))
+	assert.ErrorIs(t, err, chunkmaster.ErrNotEnoughStorageNodes)
+}
+
+func TestDeadStorageMakesFilesUnreadable(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2})
+	cluster, clock := newLivenessCluster(t, 3, chunkMaster)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+
+	cluster.elapse(t, clock, 11*time.Second, "storage-0")
+	assert.Empty(t, cluster.dd.UnreadableFiles(), "every chunk still has a live replica")
+
+	cluster.elapse(t, clock, 11*time.Second, "storage-0", "storage-1")
+	unreadable := cluster.dd.UnreadableFiles()
+	require.Len(t, unreadable, 1)
+	assert.Equal(t, "file", unreadable[0].Fileref)
+	assert.NotEmpty(t, unreadable[0].UnavailableChunks)
+}
+
+func TestErasureCodedFileIsReadableWithinParity(t *testing.T) {
+	cluster, clock := newLivenessCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(erasureLayout()))
+	require.NoError(t, cluster.store("file", randomData(9007)))
+
+	cluster.elapse(t, clock, 11*time.Second, "storage-0", "storage-1")
+	assert.Empty(t, cluster.dd.UnreadableFiles())
+	cluster.elapse(t, clock, 11*time.Second, "storage-0", "storage-1", "storage-2")
+	assert.Len(t, cluster.dd.UnreadableFiles(), 1)
+}
+
+func TestReturningStorageIsCheckedBeforeReadmission(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2})
+	cluster, clock := newLivenessCluster(t, 3, chunkMaster)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+
+	cluster.elapse(t, clock, 11*time.Second, "storage-1")
+	require.Equal(t, StorageDead, stateOf(cluster.dd, "storage-1"))
+
+	// the storage has lost its disk while being away
+	returning := cluster.storages["storage-1"]
+	returning.mutex.Lock()
+	clear(returning.chunks)
+	returning.mutex.Unlock()
+
+	cluster.elapse(t, clock, time.Second)
+	require.Eventually(t, func() bool {
+		return stateOf(cluster.dd, "storage-1") == StorageAlive
+	}, 5*time.Second, 10*time.Millisecond)
+
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		assert.NotContains(t, chunk.Replicas, "storage-1", "lost replicas must be dropped from the catalog")
+		assert.NotEmpty(t, chunk.Replicas)
+	}
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, randomData(9007), restored)
+}
+
+func TestRememberedStorageIsCheckedAfterRestart(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 3, chunkMaster, 0)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+	// the storage has lost its disk while the service has been down
+	lost := cluster.storages["storage-1"]
+	lost.mutex.Lock()
+	clear(lost.chunks)
+	lost.mutex.Unlock()
+
+	restarted := &testCluster{storages: cluster.storages}
+	restarted.dd = NewDataDistributor(chunkMaster, func(storageID string) (storage.Storage, error) {
+		return restarted.storages[storageID], nil
+	}, Config{})
+	restarted.storages["storage-3"] = newMemStorage()
+	restarted.storages["storage-3"].peers = restarted.storages
+	for storageID := range restarted.storages {
+		restarted.heartbeat(t, storageID)
+	}
+	for storageID := range restarted.storages {
+		restarted.waitAlive(t, storageID)
+	}
+
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		assert.NotContains(t, chunk.Replicas, "storage-1", "lost replicas must be dropped from the catalog")
+		assert.NotEmpty(t, chunk.Replicas)
+	}
+	restored, err := restarted.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, randomData(9007), restored)
+}
+
+func TestReturningStorageStaysOutWhileInventoryFails(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 2})
+	cluster, clock := newLivenessCluster(t, 3, chunkMaster)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+
+	cluster.elapse(t, clock, 11*time.Second, "storage-1")
+	cluster.storages["storage-1"].setDown(true)
+	cluster.elapse(t, clock, time.Second)
+	require.Eventually(t, func() bool {
+		return stateOf(cluster.dd, "storage-1") == StorageDead
+	}, 5*time.Second, 10*time.Millisecond)
+
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	for _, chunk := range chunks {
+		assert.Len(t, chunk.Replicas, 2, "catalog must not change without inventory")
+	}
+}
+
+func TestChunksPerStorage(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), 0)
+	require.NoError(t, cluster.store("file", randomData(9007)))
+	counts := cluster.dd.ChunksPerStorage()
+	require.Len(t, counts, 6, "storages without chunks are counted too")
+	total := 0
+	for storageID, count := range counts {
+		assert.Equal(t, cluster.storages[storageID].chunksCount(), count)
+		total += count
+	}
+	assert.Equal(t, 12, total)
+}
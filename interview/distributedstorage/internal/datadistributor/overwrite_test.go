@@ -0,0 +1,96 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (tc *testCluster) storeIf(fileref string, condition chunkmaster.Condition, data []byte) error {
+	return tc.dd.DistributeDataIf(context.Background(), fileref, condition, int64(len(data)), bytes.NewReader(data))
+}
+
+func checksumOf(data []byte) []byte {
+	checksum := sha256.Sum256(data)
+	return checksum[:]
+}
+
+func TestConditionalOverwrite(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), 0)
+	first, second, third := randomData(9007), randomData(5000), randomData(7000)
+	require.NoError(t, cluster.storeIf("file", chunkmaster.Condition{Absent: true}, first))
+	chunksOfOne := cluster.totalChunks()
+	assert.ErrorIs(t, cluster.storeIf("file", chunkmaster.Condition{Absent: true}, second), chunkmaster.ErrPreconditionFailed)
+	assert.ErrorIs(t, cluster.store("file", second), chunkmaster.ErrFileDuplicate, "an unconditional upload does not overwrite")
+	assert.ErrorIs(t, cluster.storeIf("missing", chunkmaster.Condition{Exists: true}, second), chunkmaster.ErrPreconditionFailed)
+
+	stale := chunkmaster.Condition{Exists: true, Checksums: [][]byte{checksumOf(second)}}
+	assert.ErrorIs(t, cluster.storeIf("file", stale, second), chunkmaster.ErrPreconditionFailed)
+	assert.Equal(t, chunksOfOne, cluster.totalChunks(), "a failed upload leaves nothing behind")
+
+	require.NoError(t, cluster.storeIf("file", chunkmaster.Condition{Exists: true, Checksums: [][]byte{checksumOf(first)}}, second))
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, second, restored)
+	assert.Equal(t, chunksOfOne, cluster.totalChunks(), "chunks of the replaced data are deleted")
+
+	_, err = cluster.dd.DistributeStreamIf(context.Background(), "file", chunkmaster.Condition{Exists: true}, bytes.NewReader(third))
+	require.NoError(t, err)
+	info, err := cluster.dd.StatFile("file")
+	require.NoError(t, err)
+	assert.Equal(t, checksumOf(third), info.Checksum)
+	assert.Len(t, cluster.dd.ListFiles(chunkmaster.DefaultBucket, "", "", 10), 1)
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "file"))
+	_, err = cluster.dd.StatFile("file")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	assert.Zero(t, cluster.totalChunks())
+	require.NoError(t, cluster.storeIf("file", chunkmaster.Condition{Absent: true}, first), "a deleted file can be created again")
+
+	overwrite := chunkmaster.Condition{Overwrite: true}
+	require.NoError(t, cluster.storeIf("file", overwrite, second))
+	restored, err = cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, second, restored)
+	assert.Equal(t, chunksOfOne, cluster.totalChunks(), "chunks of the overwritten data are deleted")
+	require.NoError(t, cluster.storeIf("new", overwrite, third), "nothing has to exist to be overwritten")
+	overwrite.Absent = true
+	assert.ErrorIs(t, cluster.storeIf("file", overwrite, first), chunkmaster.ErrPreconditionFailed, "If-None-Match still holds")
+}
+
+func TestOverwriteWaitsForReaders(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}), 0)
+	old, updated := randomData(9007), randomData(6000)
+	require.NoError(t, cluster.store("file", old))
+	chunksOfOld := cluster.totalChunks()
+
+	reader, writer := io.Pipe()
+	readDone := make(chan error)
+	go func() {
+		err := cluster.dd.ReconstructData(context.Background(), "file", writer)
+		writer.CloseWithError(err)
+		readDone <- err
+	}()
+	// the read is blocked after its first chunk
+	head := make([]byte, 100)
+	_, err := io.ReadFull(reader, head)
+	require.NoError(t, err)
+
+	require.NoError(t, cluster.storeIf("file", chunkmaster.Condition{Exists: true}, updated))
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, updated, restored, "new reads see the new data")
+	assert.Equal(t, chunksOfOld+6, cluster.totalChunks(), "the old data is kept while it is read")
+
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, <-readDone)
+	assert.Equal(t, old, append(head, rest...), "the started read sees the whole old data")
+	assert.Equal(t, 6, cluster.totalChunks(), "the old data is deleted after its last read")
+}
@@ -0,0 +1,194 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+const (
+	DefaultParallelism     = 6
+	DefaultChunkBufferSize = 4 * 1024 * 1024
+)
+
+func (dd *DataDistributor) parallelism() int {
+	if dd.config.Parallelism <= 0 {
+		return DefaultParallelism
+	}
+	return dd.config.Parallelism
+}
+
+func (dd *DataDistributor) chunkBufferSize() int {
+	if dd.config.ChunkBufferSize <= 0 {
+		return DefaultChunkBufferSize
+	}
+	return dd.config.ChunkBufferSize
+}
+
+// transferPool runs chunk transfers concurrently. At most size slots are taken at once; it is up to the caller when a slot is freed,
+// so memory which a transfer holds can be counted too. The first failure cancels the context of all transfers
+type transferPool struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mutex sync.Mutex
+	err   error
+}
+
+func newTransferPool(ctx context.Context, size int) *transferPool {
+	poolCtx, cancel := context.WithCancel(ctx)
+	return &transferPool{
+		parent: ctx,
+		ctx:    poolCtx,
+		cancel: cancel,
+		slots:  make(chan struct{}, size),
+	}
+}
+
+// acquire waits for a free slot. It returns false if the pool has failed meanwhile
+func (tp *transferPool) acquire() bool {
+	select {
+	case tp.slots <- struct{}{}:
+		return true
+	case <-tp.ctx.Done():
+		return false
+	}
+}
+
+func (tp *transferPool) release() {
+	<-tp.slots
+}
+
+func (tp *transferPool) run(transfer func(ctx context.Context) error) {
+	tp.wg.Add(1)
+	go func() {
+		defer tp.wg.Done()
+		if err := transfer(tp.ctx); err != nil {
+			tp.fail(err)
+		}
+	}()
+}
+
+// fail remembers the first error, which is the cause of everything what fails after it, and stops the rest of transfers
+func (tp *transferPool) fail(err error) {
+	tp.mutex.Lock()
+	if tp.err == nil {
+		tp.err = err
+	}
+	tp.mutex.Unlock()
+	tp.cancel()
+}
+
+// wait returns the first error of all transfers once all of them are done
+func (tp *transferPool) wait() error {
+	tp.wg.Wait()
+	tp.cancel()
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	if tp.err == nil {
+		return tp.parent.Err()
+	}
+	return tp.err
+}
+
+// chunkPipe is an in-memory pipe which keeps up to limit bytes, so its writer can run ahead of its reader.
+// Both sides are unblocked with an error when ctx is done
+type chunkPipe struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	buffer  bytes.Buffer
+	limit   int
+	closed  bool
+	err     error
+	readErr error
+}
+
+func newChunkPipe(ctx context.Context, limit int) *chunkPipe {
+	cp := &chunkPipe{limit: limit}
+	cp.cond = sync.NewCond(&cp.mutex)
+	context.AfterFunc(ctx, func() {
+		cp.mutex.Lock()
+		defer cp.mutex.Unlock()
+		if !cp.closed {
+			cp.closed = true
+			cp.err = ctx.Err()
+		}
+		if cp.readErr == nil {
+			cp.readErr = ctx.Err()
+		}
+		cp.cond.Broadcast()
+	})
+	return cp
+}
+
+func (cp *chunkPipe) Write(p []byte) (int, error) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	written := 0
+	for len(p) > 0 {
+		for cp.buffer.Len() >= cp.limit && cp.readErr == nil && !cp.closed {
+			cp.cond.Wait()
+		}
+		if cp.readErr != nil {
+			return written, cp.readErr
+		}
+		if cp.closed {
+			return written, io.ErrClosedPipe
+		}
+		n := min(len(p), cp.limit-cp.buffer.Len())
+		cp.buffer.Write(p[:n])
+		p = p[n:]
+		written += n
+		cp.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (cp *chunkPipe) Read(p []byte) (int, error) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	for cp.buffer.Len() == 0 && !cp.closed && cp.readErr == nil {
+		cp.cond.Wait()
+	}
+	if cp.readErr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if cp.buffer.Len() > 0 {
+		n, _ := cp.buffer.Read(p)
+		cp.cond.Broadcast()
+		return n, nil
+	}
+	if cp.err != nil {
+		return 0, cp.err
+	}
+	return 0, io.EOF
+}
+
+// CloseWithError finishes writing. The reader gets err after the buffered data, or io.EOF if err is nil
+func (cp *chunkPipe) CloseWithError(err error) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if cp.closed {
+		return
+	}
+	cp.closed = true
+	cp.err = err
+	cp.cond.Broadcast()
+}
+
+// CloseRead tells the writer that nobody is going to read anymore
+func (cp *chunkPipe) CloseRead(err error) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	if cp.readErr == nil {
+		cp.readErr = err
+	}
+	cp.cond.Broadcast()
+}
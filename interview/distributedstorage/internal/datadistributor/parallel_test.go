@@ -0,0 +1,187 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newParallelCluster(t testing.TB, layout chunkmaster.Layout, config Config, latency time.Duration) (*testCluster, *concurrencyMeter) {
+	cluster := newTestClusterWithConfig(t, 6, chunkmaster.NewTemporaryChunkMaster(layout), config)
+	meter := &concurrencyMeter{}
+	for _, ms := range cluster.storages {
+		ms.latency = latency
+		ms.meter = meter
+	}
+	return cluster, meter
+}
+
+func TestChunkPipeIsBounded(t *testing.T) {
+	pipe := newChunkPipe(context.Background(), 10)
+	written := make(chan int)
+	go func() {
+		n, _ := pipe.Write(make([]byte, 25))
+		written <- n
+	}()
+	select {
+	case <-written:
+		t.Fatal("writer must wait while the pipe is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	data, err := io.ReadAll(io.LimitReader(pipe, 25))
+	require.NoError(t, err)
+	assert.Len(t, data, 25)
+	assert.Equal(t, 25, <-written)
+
+	pipe.CloseWithError(errStorageDown)
+	_, err = pipe.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, errStorageDown)
+}
+
+func TestChunkPipeIsUnblockedByContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pipe := newChunkPipe(ctx, 1)
+	written := make(chan error)
+	go func() {
+		_, err := pipe.Write(make([]byte, 2))
+		written <- err
+	}()
+	cancel()
+	assert.ErrorIs(t, <-written, context.Canceled)
+}
+
+func TestChunksAreTransferredConcurrently(t *testing.T) {
+	for _, layout := range []chunkmaster.Layout{
+		{Chunks: 6, ReplicationFactor: 1},
+		{Chunks: 6, ReplicationFactor: 1, ParityChunks: 2},
+	} {
+		cluster, meter := newParallelCluster(t, layout, Config{Parallelism: 3, ChunkBufferSize: 1024}, 10*time.Millisecond)
+		data := randomData(60000)
+		require.NoError(t, cluster.store("file", data))
+		assert.Equal(t, 3, meter.peakValue(), "stores must run at once, but no more than parallelism")
+
+		meter.peak = 0
+		restored, err := cluster.retrieve("file")
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, "chunks must be reordered")
+		assert.Equal(t, 3, meter.peakValue(), "retrieves must run at once, but no more than parallelism")
+	}
+}
+
+func TestReconstructKeepsOrderWithTinyBuffers(t *testing.T) {
+	cluster, _ := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}, Config{Parallelism: 6, ChunkBufferSize: 7}, 0)
+	data := randomData(100003)
+	require.NoError(t, cluster.store("file", data))
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+	restored, err = cluster.retrieveRange("file", 12345, 54321)
+	require.NoError(t, err)
+	assert.Equal(t, data[12345:12345+54321], restored)
+}
+
+// cancellingReader cancels the upload when its data is read up to a point, like a client which has gone away
+type cancellingReader struct {
+	r      io.Reader
+	left   int
+	cancel context.CancelFunc
+}
+
+func (cr *cancellingReader) Read(p []byte) (int, error) {
+	if cr.left <= 0 {
+		cr.cancel()
+		return 0, context.Canceled
+	}
+	p = p[:min(len(p), cr.left)]
+	n, err := cr.r.Read(p)
+	cr.left -= n
+	return n, err
+}
+
+func TestCancelledUploadIsRolledBack(t *testing.T) {
+	cluster, _ := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}, Config{Parallelism: 3, ChunkBufferSize: 100}, time.Millisecond)
+	data := randomData(60000)
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &cancellingReader{r: bytes.NewReader(data), left: 35000, cancel: cancel}
+	err := cluster.dd.DistributeData(ctx, "file", int64(len(data)), reader)
+	require.ErrorIs(t, err, context.Canceled)
+
+	assert.Zero(t, cluster.totalChunks(), "chunks which have been stored already must be removed")
+	_, err = cluster.dd.FileSize("file")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	require.NoError(t, cluster.store("file", data), "the same name can be used after rollback")
+}
+
+func TestFailedChunkStopsUpload(t *testing.T) {
+	cluster, _ := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}, Config{}, 0)
+	cluster.storages["storage-3"].setDown(true)
+	err := cluster.store("file", randomData(60000))
+	require.ErrorIs(t, err, errStorageDown)
+	assert.Zero(t, cluster.totalChunks())
+}
+
+// failingWriter accepts limit bytes and then fails, like a client which has gone away in the middle of a download
+type failingWriter struct {
+	limit int
+}
+
+var errWriterGone = errors.New("writer is gone")
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.limit {
+		n := fw.limit
+		fw.limit = 0
+		return n, errWriterGone
+	}
+	fw.limit -= len(p)
+	return len(p), nil
+}
+
+func TestReconstructStopsWhenWriterFails(t *testing.T) {
+	cluster, _ := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}, Config{ChunkBufferSize: 100}, 0)
+	require.NoError(t, cluster.store("file", randomData(60000)))
+	err := cluster.dd.ReconstructData(context.Background(), "file", &failingWriter{limit: 15000})
+	assert.ErrorIs(t, err, errWriterGone)
+}
+
+func TestReconstructReportsFailedChunk(t *testing.T) {
+	cluster, _ := newParallelCluster(t, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}, Config{}, 0)
+	data := randomData(60000)
+	require.NoError(t, cluster.store("file", data))
+	for _, ms := range cluster.storages {
+		ms.setDown(true)
+		break
+	}
+	var buffer bytes.Buffer
+	err := cluster.dd.ReconstructData(context.Background(), "file", &buffer)
+	assert.ErrorIs(t, err, errStorageDown)
+	assert.Equal(t, data[:buffer.Len()], buffer.Bytes(), "whatever has been written must be in order")
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	data := randomData(6 * 1024 * 1024)
+	for _, parallelism := range []int{1, 6} {
+		b.Run(fmt.Sprintf("parallelism-%d", parallelism), func(b *testing.B) {
+			cluster, _ := newParallelCluster(b, chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1}, Config{Parallelism: parallelism}, 5*time.Millisecond)
+			b.SetBytes(int64(2 * len(data)))
+			b.ResetTimer()
+			for i := range b.N {
+				fileref := fmt.Sprintf("file-%d", i)
+				if err := cluster.store(fileref, data); err != nil {
+					b.Fatal(err)
+				}
+				if err := cluster.dd.ReconstructData(context.Background(), fileref, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package datadistributor
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+// RebalanceMove moves one replica of a chunk from a storage which is fuller than others to an emptier one
+type RebalanceMove struct {
+	Fileref  string
+	Order    uint32
+	From     string
+	To       string
+	Size     int64
+	Checksum []byte
+	// ContentID is set for a deduplicated chunk, which moves for every file which has it
+	ContentID string
+}
+
+func (move RebalanceMove) chunkFileId() string {
+	return chunkFileIdOf(move.Fileref, chunkmaster.Chunk{Order: move.Order, ContentID: move.ContentID})
+}
+
+type RebalanceProgress struct {
+	PlannedMoves int
+	Moved        int
+	Failed       int
+	MovedBytes   int64
+}
+
+// Rebalance plans moves which even out disk usage of alive storages and makes them one by one, copying no faster than
+// bytesPerSecond (0 means no limit). progress is called after planning and after every move. A failed move is skipped,
+// its chunk stays where it has been. Cancelling ctx stops after the move in flight, the catalog is consistent at any point
+func (dd *DataDistributor) Rebalance(ctx context.Context, bytesPerSecond int64, progress func(RebalanceProgress)) error {
+	moves := dd.PlanRebalance()
+	state := RebalanceProgress{PlannedMoves: len(moves)}
+	progress(state)
+	slog.Info("rebalancing started", "moves", len(moves))
+
+	start := time.Now()
+	for _, move := range moves {
+		if err := waitForPace(ctx, start, state.MovedBytes, bytesPerSecond); err != nil {
+			return err
+		}
+		err := dd.MoveReplica(ctx, move)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			slog.Warn("replica move failed", "fileref", move.Fileref, "order", move.Order, "from", move.From, "to", move.To, "err", err)
+			state.Failed++
+		} else {
+			state.Moved++
+			state.MovedBytes += move.Size
+		}
+		progress(state)
+	}
+	slog.Info("rebalancing done", "moved", state.Moved, "failed", state.Failed, "moved_bytes", state.MovedBytes, "took", time.Since(start))
+	return nil
+}
+
+// waitForPace holds on until moving bytes since start fits into bytesPerSecond
+func waitForPace(ctx context.Context, start time.Time, bytes int64, bytesPerSecond int64) error {
+	if bytesPerSecond <= 0 {
+		return ctx.Err()
+	}
+	due := start.Add(time.Duration(float64(bytes) / float64(bytesPerSecond) * float64(time.Second)))
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// MoveReplica makes the target storage copy the chunk from the source one, switches the catalog to the copy
+// and only then deletes the original. If the file has changed meanwhile, the copy is deleted instead
+func (dd *DataDistributor) MoveReplica(ctx context.Context, move RebalanceMove) error {
+	source, found := dd.lookupStorage(move.From)
+	if !found {
+		return fmt.Errorf("storage %s is unknown", move.From)
+	}
+	target, found := dd.lookupStorage(move.To)
+	if !found {
+		return fmt.Errorf("storage %s is unknown", move.To)
+	}
+
+	chunkFileId := move.chunkFileId()
+	err := target.storage.CopyChunk(ctx, chunkFileId, move.Checksum, move.From)
+	if err != nil {
+		// a partial copy is removed by the target itself
+		return fmt.Errorf("cannot copy %s to %s: %w", chunkFileId, move.To, err)
+	}
+	// from now on one of the copies must be removed whatever happens to the caller
+	ctx = context.WithoutCancel(ctx)
+	err = dd.chunkMaster.MoveReplica(move.Fileref, move.Order, move.From, move.To, move.Checksum)
+	if err != nil {
+		target.storage.DeleteChunk(ctx, chunkFileId)
+		return fmt.Errorf("cannot switch %s to %s: %w", chunkFileId, move.To, err)
+	}
+
+	dd.storageMutex.Lock()
+	target.availableBytes -= move.Size
+	source.giveBack(move.Size)
+	dd.storageMutex.Unlock()
+
+	if err := source.storage.DeleteChunk(ctx, chunkFileId); err != nil {
+		slog.Warn("moved replica is left on the old storage as garbage", "file_id", chunkFileId, "storage_id", move.From, "err", err)
+	}
+	slog.Info("replica moved", "file_id", chunkFileId, "from", move.From, "to", move.To, "size", move.Size)
+	return nil
+}
+
+// rebalanceNode is a storage as the planner sees it: used is what the catalog puts on it,
+// capacity is used plus what the storage reports as available
+type rebalanceNode struct {
+	id       string
+	labels   chunkmaster.Labels
+	used     int64
+	capacity int64
+	// excess is how far used is above the fair share of capacity, it is negative for storages below it
+	excess float64
+}
+
+// PlanRebalance gives moves after which every alive storage is filled to about the same fraction of its capacity.
+// Biggest chunks are moved first. A move never puts two replicas of a chunk on one storage, never makes replicas
+// of a chunk span fewer zones, racks or hosts, and never makes a storage keep more chunks of a file than the source did
+func (dd *DataDistributor) PlanRebalance() []RebalanceMove {
+	nodes := make(map[string]*rebalanceNode)
+	dd.storageMutex.Lock()
+	for _, meta := range dd.knownStorages {
+		// a draining storage is emptied by Drain
+		if meta.state != StorageAlive || meta.draining {
+			continue
+		}
+		nodes[meta.storageID] = &rebalanceNode{id: meta.storageID, labels: meta.labels, capacity: max(meta.availableBytes, 0)}
+	}
+	dd.storageMutex.Unlock()
+	if len(nodes) < 2 {
+		return nil
+	}
+
+	type candidate struct {
+		fileref string
+		chunks  []chunkmaster.Chunk
+		order   int
+	}
+	var candidates []candidate
+	// a deduplicated chunk takes space once, whichever files have it
+	seen := make(map[string]bool)
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		for i, chunk := range chunks {
+			if chunk.ContentID != "" {
+				if seen[chunk.ContentID] {
+					continue
+				}
+				seen[chunk.ContentID] = true
+			}
+			for _, storageID := range chunk.Replicas {
+				if node, found := nodes[storageID]; found {
+					node.used += chunk.Size
+					node.capacity += chunk.Size
+				}
+			}
+			// chunks of files being streamed may still change, and chunks without a checksum cannot be verified after a copy
+			if chunk.FileSize != chunkmaster.UnknownFileSize && len(chunk.Checksum) > 0 && chunk.Size > 0 {
+				candidates = append(candidates, candidate{fileref: fileref, chunks: chunks, order: i})
+			}
+		}
+		return true
+	})
+
+	var totalUsed, totalCapacity float64
+	for _, node := range nodes {
+		totalUsed += float64(node.used)
+		totalCapacity += float64(node.capacity)
+	}
+	if totalCapacity == 0 {
+		return nil
+	}
+	for _, node := range nodes {
+		node.excess = float64(node.used) - totalUsed/totalCapacity*float64(node.capacity)
+	}
+
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(b.chunks[b.order].Size, a.chunks[a.order].Size), strings.Compare(a.fileref, b.fileref), cmp.Compare(a.order, b.order))
+	})
+	var moves []RebalanceMove
+	for _, c := range candidates {
+		chunk := c.chunks[c.order]
+		for _, from := range chunk.Replicas {
+			source, found := nodes[from]
+			if !found || source.excess <= 0 {
+				continue
+			}
+			target := pickRebalanceTarget(nodes, c.chunks, c.order, source)
+			if target == nil {
+				continue
+			}
+			moves = append(moves, RebalanceMove{Fileref: c.fileref, Order: chunk.Order, From: from, To: target.id, Size: chunk.Size, Checksum: chunk.Checksum, ContentID: chunk.ContentID})
+			source.excess -= float64(chunk.Size)
+			target.excess += float64(chunk.Size)
+			// later moves of the same file must see this one
+			c.chunks[c.order].Replicas = slices.Clone(chunk.Replicas)
+			c.chunks[c.order].Replicas[slices.Index(chunk.Replicas, from)] = target.id
+			chunk = c.chunks[c.order]
+		}
+	}
+	return moves
+}
+
+// pickRebalanceTarget gives the storage furthest below its fair share. The move must not leave the target fuller than the source,
+// relative to their shares, otherwise the next rebalancing would move the chunk back
+func pickRebalanceTarget(nodes map[string]*rebalanceNode, chunks []chunkmaster.Chunk, order int, source *rebalanceNode) *rebalanceNode {
+	from := source.id
+	chunk := chunks[order]
+	fileChunksOn := make(map[string]int)
+	for _, other := range chunks {
+		for _, storageID := range other.Replicas {
+			fileChunksOn[storageID]++
+		}
+	}
+	spreadBefore := replicaSpread(nodes, chunk.Replicas)
+
+	var best *rebalanceNode
+	for _, node := range nodes {
+		if 2*float64(chunk.Size) > source.excess-node.excess || slices.Contains(chunk.Replicas, node.id) || fileChunksOn[node.id]+1 > fileChunksOn[from] {
+			continue
+		}
+		if best != nil && (node.excess > best.excess || node.excess == best.excess && node.id > best.id) {
+			continue
+		}
+		moved := slices.Clone(chunk.Replicas)
+		moved[slices.Index(moved, from)] = node.id
+		spreadAfter := replicaSpread(nodes, moved)
+		if spreadAfter[0] < spreadBefore[0] || spreadAfter[1] < spreadBefore[1] || spreadAfter[2] < spreadBefore[2] {
+			continue
+		}
+		best = node
+	}
+	return best
+}
+
+// replicaSpread counts distinct zones, racks and hosts of replicas. Replicas on storages which are not planned for
+// are counted as distinct everywhere, nothing is known about them
+func replicaSpread(nodes map[string]*rebalanceNode, replicas []string) [3]int {
+	var spread [3]int
+	seen := [3]map[string]bool{{}, {}, {}}
+	for _, storageID := range replicas {
+		labels := chunkmaster.Labels{Zone: storageID, Rack: storageID, Host: storageID}
+		if node, found := nodes[storageID]; found {
+			labels = node.labels
+			if labels.Host == "" {
+				labels.Host = storageID
+			}
+		}
+		// racks and hosts are named within their zone and rack
+		domains := [3]string{labels.Zone, labels.Zone + "/" + labels.Rack, labels.Zone + "/" + labels.Rack + "/" + labels.Host}
+		for level, domain := range domains {
+			if !seen[level][domain] {
+				seen[level][domain] = true
+				spread[level]++
+			}
+		}
+	}
+	return spread
+}
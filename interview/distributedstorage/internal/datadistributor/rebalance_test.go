@@ -0,0 +1,159 @@
+package datadistributor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (tc *testCluster) addStorage(t *testing.T, storageID string, labels *inventorypb.Labels) {
+	tc.storages[storageID] = newMemStorage()
+	tc.storages[storageID].peers = tc.storages
+	_, err := tc.dd.UpdateStorageInfo(context.Background(), &inventorypb.StorageInfo{Iam: storageID, AvailableBytes: 1 << 30, Labels: labels})
+	require.NoError(t, err)
+	tc.waitAlive(t, storageID)
+}
+
+// checkCatalogMatchesStorages makes sure that every replica in the catalog is stored and nothing else is.
+// A deduplicated chunk is stored once, however many files have it
+func (tc *testCluster) checkCatalogMatchesStorages(t *testing.T, chunkMaster chunkmaster.ChunkMaster) {
+	expected := make(map[string]map[string]bool)
+	chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		for _, chunk := range chunks {
+			chunkFileId := chunkFileIdOf(fileref, chunk)
+			for _, storageID := range chunk.Replicas {
+				assert.NotNil(t, tc.storages[storageID].chunk(chunkFileId), "%s is not on %s", chunkFileId, storageID)
+				if expected[storageID] == nil {
+					expected[storageID] = make(map[string]bool)
+				}
+				expected[storageID][chunkFileId] = true
+			}
+		}
+		return true
+	})
+	for storageID, ms := range tc.storages {
+		assert.Equal(t, len(expected[storageID]), ms.chunksCount(), "storage %s", storageID)
+	}
+}
+
+func TestRebalanceFillsNewStorages(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 3, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 3, chunkMaster, 0)
+	files := make(map[string][]byte)
+	for i := range 20 {
+		fileref := fmt.Sprintf("file-%d", i)
+		files[fileref] = randomData(3000 + i)
+		require.NoError(t, cluster.store(fileref, files[fileref]))
+	}
+	for i := 3; i < 6; i++ {
+		cluster.addStorage(t, fmt.Sprintf("storage-%d", i), nil)
+	}
+
+	var last RebalanceProgress
+	err := cluster.dd.Rebalance(context.Background(), 0, func(progress RebalanceProgress) { last = progress })
+	require.NoError(t, err)
+	assert.Positive(t, last.PlannedMoves)
+	assert.Equal(t, last.PlannedMoves, last.Moved)
+	assert.Zero(t, last.Failed)
+
+	for storageID, ms := range cluster.storages {
+		assert.InDelta(t, 10, ms.chunksCount(), 1, "storage %s", storageID)
+	}
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+	for fileref, data := range files {
+		chunks, err := chunkMaster.ChunksToRestore(fileref)
+		require.NoError(t, err)
+		assert.NotEqual(t, chunks[0].Replicas, chunks[1].Replicas, "chunks of a file must stay on distinct storages")
+		retrieved, err := cluster.retrieve(fileref)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+	}
+
+	// nothing is left to do
+	assert.Empty(t, cluster.dd.PlanRebalance())
+}
+
+func TestRebalanceKeepsReplicasInDistinctRacks(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 0, chunkMaster, 0)
+	cluster.addStorage(t, "old-r0", &inventorypb.Labels{Rack: "r0"})
+	cluster.addStorage(t, "old-r1", &inventorypb.Labels{Rack: "r1"})
+	for i := range 10 {
+		require.NoError(t, cluster.store(fmt.Sprintf("file-%d", i), randomData(1000)))
+	}
+	cluster.addStorage(t, "new-r0", &inventorypb.Labels{Rack: "r0"})
+	cluster.addStorage(t, "new-r1", &inventorypb.Labels{Rack: "r1"})
+
+	moves := cluster.dd.PlanRebalance()
+	require.NotEmpty(t, moves)
+	for _, move := range moves {
+		assert.Equal(t, move.From[len(move.From)-2:], move.To[len(move.To)-2:], "replica must stay in its rack: %+v", move)
+	}
+}
+
+func TestRebalanceIsThrottled(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 1, chunkMaster, 0)
+	for i := range 4 {
+		require.NoError(t, cluster.store(fmt.Sprintf("file-%d", i), randomData(1000)))
+	}
+	cluster.addStorage(t, "storage-1", nil)
+
+	start := time.Now()
+	var last RebalanceProgress
+	err := cluster.dd.Rebalance(context.Background(), 10000, func(progress RebalanceProgress) { last = progress })
+	require.NoError(t, err)
+	assert.Equal(t, 2, last.Moved)
+	// the second move waits until the first 1000 bytes fit into the rate
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRebalanceIsCancellable(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 1, chunkMaster, 0)
+	for i := range 10 {
+		require.NoError(t, cluster.store(fmt.Sprintf("file-%d", i), randomData(1000)))
+	}
+	cluster.addStorage(t, "storage-1", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last RebalanceProgress
+	err := cluster.dd.Rebalance(ctx, 0, func(progress RebalanceProgress) {
+		last = progress
+		if progress.Moved == 2 {
+			cancel()
+		}
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 2, last.Moved)
+	assert.Equal(t, 2, cluster.storages["storage-1"].chunksCount())
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+}
+
+func TestMoveOfChangedFileIsUndone(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 1, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 1, chunkMaster, 0)
+	require.NoError(t, cluster.store("file", randomData(1000)))
+	require.NoError(t, cluster.store("another-file", randomData(1000)))
+	cluster.addStorage(t, "storage-1", nil)
+	moves := cluster.dd.PlanRebalance()
+	require.Len(t, moves, 1)
+
+	// the file is replaced after the move has been planned
+	fileref := moves[0].Fileref
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), fileref))
+	require.NoError(t, cluster.store(fileref, randomData(1001)))
+	err := cluster.dd.MoveReplica(context.Background(), moves[0])
+	assert.Error(t, err)
+	cluster.checkCatalogMatchesStorages(t, chunkMaster)
+	retrieved, err := cluster.retrieve(fileref)
+	require.NoError(t, err)
+	assert.Equal(t, randomData(1001), retrieved)
+}
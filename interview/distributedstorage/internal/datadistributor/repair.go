@@ -0,0 +1,145 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	inventorypb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storageinventory"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const repairTimeout = 10 * time.Minute
+
+// ReportCorruptedChunks receives chunks which a storage has found corrupted and repairs them in background
+func (dd *DataDistributor) ReportCorruptedChunks(ctx context.Context, report *inventorypb.CorruptedChunks) (*emptypb.Empty, error) {
+	if err := checkPeer(ctx, report.GetIam()); err != nil {
+		return nil, err
+	}
+	meta, found := dd.lookupStorage(report.GetIam())
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "storage %s is unknown", report.GetIam())
+	}
+	slog.Warn("storage reports corrupted chunks", "storage_id", meta.storageID, "file_ids", report.GetFileIds())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), repairTimeout)
+		defer cancel()
+		dd.repairChunks(ctx, meta, report.GetFileIds())
+	}()
+	return nil, nil
+}
+
+func (dd *DataDistributor) repairChunks(ctx context.Context, meta *storageMeta, chunkFileIds []string) {
+	for _, chunkFileId := range chunkFileIds {
+		err := dd.repairChunk(ctx, meta, chunkFileId)
+		if err != nil {
+			slog.Error("chunk repair failed", "storage_id", meta.storageID, "file_id", chunkFileId, "err", err)
+			continue
+		}
+		slog.Info("chunk repaired", "storage_id", meta.storageID, "file_id", chunkFileId)
+	}
+}
+
+// repairChunk replaces the corrupted copy with a good one, taken from another replica or restored from parity.
+// If there is no good copy, the corrupted replica is removed from the catalog, so the loss becomes visible
+func (dd *DataDistributor) repairChunk(ctx context.Context, meta *storageMeta, chunkFileId string) error {
+	inputFilename, order, err := dd.chunkOwner(chunkFileId)
+	if err != nil {
+		return err
+	}
+	chunks, err := dd.chunkMaster.ChunksToRestore(inputFilename)
+	if err != nil {
+		return fmt.Errorf("cannot find chunks of %s: %w", inputFilename, err)
+	}
+	if int(order) >= len(chunks) || !slices.Contains(chunks[order].Replicas, meta.storageID) {
+		slog.Warn("corrupted chunk is not in the catalog, ignoring it", "storage_id", meta.storageID, "file_id", chunkFileId)
+		return nil
+	}
+
+	// the storage never overwrites chunks
+	err = meta.storage.DeleteChunk(ctx, chunkFileId)
+	if err == nil {
+		err = dd.copyGoodChunk(ctx, meta, inputFilename, chunks, int(order))
+	}
+	if err == nil {
+		return nil
+	}
+
+	meta.storage.DeleteChunk(ctx, chunkFileId)
+	chunks[order].Replicas = slices.DeleteFunc(chunks[order].Replicas, func(storageID string) bool {
+		return storageID == meta.storageID
+	})
+	if updateErr := dd.chunkMaster.UpdateChunks(inputFilename, chunks); updateErr != nil {
+		return fmt.Errorf("%w; cannot drop corrupted replica: %w", err, updateErr)
+	}
+	return fmt.Errorf("corrupted replica is dropped: %w", err)
+}
+
+func (dd *DataDistributor) copyGoodChunk(ctx context.Context, meta *storageMeta, inputFilename string, chunks []chunkmaster.Chunk, target int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunkFileId := chunkFileIdOf(inputFilename, chunks[target])
+	source := chunks[target]
+	// stored bytes are copied as they are, compressed, encrypted or not
+	source.Codec = CodecNone
+	source.Nonce = nil
+	source.Replicas = slices.DeleteFunc(slices.Clone(source.Replicas), func(storageID string) bool {
+		return storageID == meta.storageID
+	})
+	_, parityShards := erasureShards(chunks)
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		progress := &progressWriter{w: pipeWriter}
+		err := dd.retrieveChunkReplicas(ctx, chunkFileId, source, 0, source.Size, progress)
+		if err != nil && parityShards > 0 && progress.err == nil && ctx.Err() == nil {
+			err = dd.rebuildShard(ctx, inputFilename, chunks, target, 0, source.Size, progress)
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+	checksum, err := meta.storage.StoreChunk(ctx, chunkFileId, pipeReader)
+	pipeReader.Close()
+	if err != nil {
+		return fmt.Errorf("cannot store good copy: %w", err)
+	}
+	if len(source.Checksum) > 0 && !bytes.Equal(checksum, source.Checksum) {
+		return fmt.Errorf("%w: good copy has been stored with a different checksum", storage.ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// chunkOwner gives a file which has the chunk. A deduplicated chunk is shared, and any of its files will do,
+// as its replicas are the same for all of them
+func (dd *DataDistributor) chunkOwner(chunkFileId string) (string, uint32, error) {
+	contentID, found := strings.CutPrefix(chunkFileId, contentFileIdPrefix)
+	if !found {
+		return chunkFileIdToIncomingFilename(chunkFileId)
+	}
+	var (
+		owner string
+		order uint32
+	)
+	dd.chunkMaster.ForEachFile(func(fileref string, chunks []chunkmaster.Chunk) bool {
+		for _, chunk := range chunks {
+			if chunk.ContentID == contentID && chunk.FileSize != chunkmaster.UnknownFileSize {
+				owner, order = fileref, chunk.Order
+				return false
+			}
+		}
+		return true
+	})
+	if owner == "" {
+		return "", 0, fmt.Errorf("no file has content %s", contentID)
+	}
+	return owner, order, nil
+}
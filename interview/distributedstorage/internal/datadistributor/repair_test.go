@@ -0,0 +1,96 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (ms *memStorage) chunk(fileId string) []byte {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return bytes.Clone(ms.chunks[fileId])
+}
+
+func (tc *testCluster) repair(t *testing.T, storageID string, chunkFileIds ...string) {
+	meta, found := tc.dd.lookupStorage(storageID)
+	require.True(t, found)
+	tc.dd.repairChunks(context.Background(), meta, chunkFileIds)
+}
+
+func TestChunkFileIdIsReversible(t *testing.T) {
+	for _, fileref := range []string{"file", "bucket/dir/file.part.3", "bucket/part", chunkmaster.ObjectName(chunkmaster.DefaultBucket, "dir/file"), ""} {
+		chunkFileId := incomingFilenameToChunkFileId(fileref, 17)
+		restored, order, err := chunkFileIdToIncomingFilename(chunkFileId)
+		require.NoError(t, err)
+		assert.Equal(t, fileref, restored)
+		assert.EqualValues(t, 17, order)
+	}
+	_, _, err := chunkFileIdToIncomingFilename("something")
+	assert.Error(t, err)
+	// slashed keys of the default bucket keep ids of chunk files written before buckets appeared
+	legacy := base64.StdEncoding.EncodeToString([]byte("dir/file")) + ".part.17"
+	assert.Equal(t, legacy, incomingFilenameToChunkFileId(chunkmaster.ObjectName(chunkmaster.DefaultBucket, "dir/file"), 17))
+}
+
+func TestCorruptedReplicaIsRepairedFromAnotherOne(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2})
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	data := randomData(54623)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	chunkFileId := incomingFilenameToChunkFileId("file", 2)
+	corrupted, healthy := cluster.storages[chunks[2].Replicas[0]], cluster.storages[chunks[2].Replicas[1]]
+	corrupted.corruptAll()
+	require.NotEqual(t, healthy.chunk(chunkFileId), corrupted.chunk(chunkFileId))
+
+	cluster.repair(t, chunks[2].Replicas[0], chunkFileId)
+	assert.Equal(t, healthy.chunk(chunkFileId), corrupted.chunk(chunkFileId))
+	repaired, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	assert.Equal(t, chunks, repaired, "catalog must stay the same")
+}
+
+func TestErasureCodedShardIsRepairedFromParity(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(erasureLayout())
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	data := randomData(3*erasurePortionSize + 5)
+	require.NoError(t, cluster.store("file", data))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	for _, chunk := range []chunkmaster.Chunk{chunks[1], chunks[5]} {
+		chunkFileId := incomingFilenameToChunkFileId("file", chunk.Order)
+		ms := cluster.storages[chunk.Replicas[0]]
+		original := ms.chunk(chunkFileId)
+		ms.corruptAll()
+		cluster.repair(t, chunk.Replicas[0], chunkFileId)
+		assert.Equal(t, original, ms.chunk(chunkFileId), "chunk %d", chunk.Order)
+	}
+}
+
+func TestUnrepairableReplicaIsDropped(t *testing.T) {
+	chunkMaster := chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1})
+	cluster := newTestCluster(t, 6, chunkMaster, 0)
+	require.NoError(t, cluster.store("file", randomData(54623)))
+	chunks, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+
+	storageID := chunks[3].Replicas[0]
+	cluster.storages[storageID].corruptAll()
+	cluster.repair(t, storageID, incomingFilenameToChunkFileId("file", 3))
+
+	repaired, err := chunkMaster.ChunksToRestore("file")
+	require.NoError(t, err)
+	assert.Empty(t, repaired[3].Replicas)
+	unreadable := cluster.dd.UnreadableFiles()
+	require.Len(t, unreadable, 1)
+	assert.Equal(t, []uint32{3}, unreadable[0].UnavailableChunks)
+}
@@ -0,0 +1,115 @@
+package datadistributor
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	errNoReplicas            = errors.New("no replica is able to give the chunk")
+	errNoLiveReplicas        = errors.New("all replicas failed")
+	errReplicaStoppedReading = errors.New("replica stopped reading")
+	errShortRead             = errors.New("replica has given less data than requested")
+)
+
+// exactReader gives exactly size bytes of reader and fails if reader ends earlier
+func exactReader(reader io.Reader, size int64) io.Reader {
+	return &sizedReader{r: reader, left: size}
+}
+
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	if sr.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > sr.left {
+		p = p[:sr.left]
+	}
+	n, err := sr.r.Read(p)
+	sr.left -= int64(n)
+	if err == io.EOF && sr.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// fanoutWriter copies data to every replica. A replica which fails is dropped, the rest continue to receive the data
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (fw *fanoutWriter) add(w *io.PipeWriter) {
+	fw.writers = append(fw.writers, w)
+	fw.failed = append(fw.failed, false)
+}
+
+func (fw *fanoutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for i, w := range fw.writers {
+		if fw.failed[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			fw.failed[i] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errNoLiveReplicas
+	}
+	return len(p), nil
+}
+
+// close finishes the data for all replicas. A non-nil err makes replicas fail instead of storing incomplete data
+func (fw *fanoutWriter) close(err error) {
+	for _, w := range fw.writers {
+		w.CloseWithError(err)
+	}
+}
+
+// progressWriter remembers how much has been passed to the receiver, so reading can be resumed from another replica
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	err     error
+}
+
+// resume returns a writer for the next attempt. It drops the bytes which the receiver already has
+func (pw *progressWriter) resume() io.Writer {
+	return &resumeWriter{progress: pw, skip: pw.written}
+}
+
+// proceed returns a writer for the next attempt which starts right where the receiver has stopped
+func (pw *progressWriter) proceed() io.Writer {
+	return &resumeWriter{progress: pw}
+}
+
+type resumeWriter struct {
+	progress *progressWriter
+	skip     int64
+}
+
+func (rw *resumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if rw.skip > 0 {
+		if int64(len(p)) <= rw.skip {
+			rw.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[rw.skip:]
+		rw.skip = 0
+	}
+	written, err := rw.progress.w.Write(p)
+	rw.progress.written += int64(written)
+	if err != nil {
+		rw.progress.err = err
+		return n - len(p) + written, err
+	}
+	return n, nil
+}
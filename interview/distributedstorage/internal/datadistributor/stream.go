@@ -0,0 +1,120 @@
+package datadistributor
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+// DistributeStream stores a file which size is not known in advance, e.g. an upload without Content-Length.
+// Data is cut into chunks of StreamChunkSize, and storages for every next chunk are picked only when data for it arrives.
+// The file becomes readable when the stream ends. It returns the size of the stored file
+func (dd *DataDistributor) DistributeStream(ctx context.Context, inputFilename string, reader io.Reader) (int64, error) {
+	return dd.DistributeStreamIf(ctx, inputFilename, chunkmaster.Condition{}, reader)
+}
+
+// DistributeStreamIf is DistributeStream which stores the file only if the condition holds for the current one, see storeVersion
+func (dd *DataDistributor) DistributeStreamIf(ctx context.Context, inputFilename string, condition chunkmaster.Condition, reader io.Reader) (int64, error) {
+	if err := chunkmaster.ValidateKey(inputFilename); err != nil {
+		return 0, err
+	}
+	return dd.storeVersion(ctx, inputFilename, condition, func(catalogFileref string) (int64, error) {
+		return dd.distributeStream(ctx, catalogFileref, reader)
+	})
+}
+
+func (dd *DataDistributor) distributeStream(ctx context.Context, inputFilename string, reader io.Reader) (int64, error) {
+	if dd.deduplicates(inputFilename) {
+		return dd.distributeContent(ctx, inputFilename, reader)
+	}
+	if dd.transforms(inputFilename) {
+		return dd.distributeTransformed(ctx, inputFilename, reader, dd.streamChunkSize())
+	}
+	chunkSize := dd.streamChunkSize()
+	hasher := sha256.New()
+	buffered := bufio.NewReader(io.TeeReader(reader, hasher))
+	chunks := make([]chunkmaster.Chunk, 0)
+	for order := uint32(0); ; order++ {
+		if order > 0 {
+			// an empty file still has its single empty chunk, but there must be no empty chunk in the end of a non-empty one
+			_, err := buffered.Peek(1)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				dd.rollbackSave(ctx, inputFilename, chunks, len(chunks))
+				return 0, fmt.Errorf("cannot read chunk %d: %w", order, err)
+			}
+		}
+
+		chunk, err := dd.appendChunkReserveQuota(inputFilename, order, chunkSize)
+		if err != nil {
+			if order > 0 {
+				dd.rollbackSave(ctx, inputFilename, chunks, len(chunks))
+			}
+			return 0, fmt.Errorf("quoting failed: %w", err)
+		}
+		chunks = append(chunks, chunk)
+		if full, err := dd.reserveLeases(ctx, inputFilename, chunks[order:]); err != nil {
+			dd.rollbackSave(ctx, inputFilename, chunks, len(chunks)-1)
+			dd.markFull(full)
+			return 0, fmt.Errorf("quoting failed: %w", err)
+		}
+
+		chunkFileId := chunkFileIdOf(inputFilename, chunk)
+		stored, checksum, written, err := dd.storeChunkReplicas(ctx, chunkFileId, chunk.Replicas, io.LimitReader(buffered, chunk.Size))
+		if err != nil {
+			dd.rollbackSave(ctx, inputFilename, chunks, len(chunks)-1)
+			return 0, fmt.Errorf("cannot save chunk %d with error: %w", chunk.Order, err)
+		}
+		if len(stored) < len(chunk.Replicas) {
+			slog.Warn("chunk is under-replicated", "filename", inputFilename, "chunk", chunk.Order, "replicas", chunk.Replicas, "stored", stored)
+		}
+		dd.returnQuota(chunk.Replicas, chunk.Size-written)
+		chunks[order].Replicas = stored
+		chunks[order].Size = written
+		chunks[order].Checksum = checksum
+		dd.settleLeases(ctx, inputFilename, []chunkmaster.Chunk{chunk}, chunks[order:])
+		if written < chunkSize {
+			break
+		}
+	}
+
+	setFileChecksum(chunks, hasher.Sum(nil))
+	err := dd.chunkMaster.FinishStream(inputFilename, chunks)
+	if err != nil {
+		dd.rollbackSave(ctx, inputFilename, chunks, len(chunks))
+		return 0, fmt.Errorf("cannot finish stream: %w", err)
+	}
+	last := chunks[len(chunks)-1]
+	return last.OriginalFileStart + last.Size, nil
+}
+
+func (dd *DataDistributor) appendChunkReserveQuota(inputFilename string, order uint32, size int64) (chunkmaster.Chunk, error) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	chunk, err := dd.chunkMaster.AppendChunk(inputFilename, order, size, dd.aliveStorageInfo())
+	if err != nil {
+		return chunkmaster.Chunk{}, fmt.Errorf("cannot place chunk %d of %s: %w", order, inputFilename, err)
+	}
+	for _, storageID := range chunk.Replicas {
+		dd.knownStorages[storageID].availableBytes -= size
+	}
+	return chunk, nil
+}
+
+// returnQuota gives back space which has been reserved, but not used
+func (dd *DataDistributor) returnQuota(storageIDs []string, size int64) {
+	dd.storageMutex.Lock()
+	defer dd.storageMutex.Unlock()
+	for _, storageID := range storageIDs {
+		if meta, found := dd.knownStorages[storageID]; found {
+			meta.giveBack(size)
+		}
+	}
+}
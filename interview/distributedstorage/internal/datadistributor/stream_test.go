@@ -0,0 +1,98 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStreamCluster(t *testing.T) *testCluster {
+	return newTestClusterWithConfig(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 2}), Config{StreamChunkSize: 1000})
+}
+
+func TestDistributeStream(t *testing.T) {
+	for _, size := range []int{0, 1, 999, 1000, 1001, 3500} {
+		cluster := newStreamCluster(t)
+		data := randomData(size)
+		stored, err := cluster.dd.DistributeStream(context.Background(), "file", bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.EqualValues(t, size, stored)
+
+		restored, err := cluster.retrieve("file")
+		require.NoError(t, err)
+		assert.Equal(t, data, restored, "size %d", size)
+		fileSize, err := cluster.dd.FileSize("file")
+		require.NoError(t, err)
+		assert.EqualValues(t, size, fileSize)
+		expectedChunks := max(1, (size+999)/1000)
+		assert.Equal(t, 2*expectedChunks, cluster.totalChunks(), "size %d", size)
+	}
+}
+
+func TestDistributeStreamDuplicate(t *testing.T) {
+	cluster := newStreamCluster(t)
+	require.NoError(t, cluster.store("file", randomData(10)))
+	_, err := cluster.dd.DistributeStream(context.Background(), "file", bytes.NewReader(randomData(2500)))
+	assert.ErrorIs(t, err, chunkmaster.ErrFileDuplicate)
+	restored, err := cluster.retrieve("file")
+	require.NoError(t, err)
+	assert.Equal(t, randomData(10), restored)
+}
+
+// failingReader gives data and then fails instead of io.EOF, like a dropped client connection
+type failingReader struct {
+	r io.Reader
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestDistributeStreamRollback(t *testing.T) {
+	cluster := newStreamCluster(t)
+	_, err := cluster.dd.DistributeStream(context.Background(), "file", &failingReader{r: bytes.NewReader(randomData(2500))})
+	require.Error(t, err)
+	assert.Zero(t, cluster.totalChunks(), "stored chunks must be removed")
+	_, err = cluster.dd.FileSize("file")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+
+	_, err = cluster.dd.DistributeStream(context.Background(), "file", bytes.NewReader(randomData(2500)))
+	require.NoError(t, err, "the same name can be used after rollback")
+}
+
+func TestDistributeStreamIsNotReadableUntilFinished(t *testing.T) {
+	cluster := newStreamCluster(t)
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := cluster.dd.DistributeStream(context.Background(), "file", pipeReader)
+		done <- err
+	}()
+	_, err := pipeWriter.Write(randomData(1500))
+	require.NoError(t, err)
+	_, err = cluster.dd.FileSize("file")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	assert.Empty(t, cluster.dd.UnreadableFiles())
+
+	pipeWriter.Close()
+	require.NoError(t, <-done)
+	_, err = cluster.dd.FileSize("file")
+	assert.NoError(t, err)
+}
+
+func TestDistributeStreamWithErasureCoding(t *testing.T) {
+	cluster := newTestCluster(t, 6, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 6, ReplicationFactor: 1, ParityChunks: 2}), 0)
+	_, err := cluster.dd.DistributeStream(context.Background(), "file", bytes.NewReader(randomData(10)))
+	assert.ErrorIs(t, err, chunkmaster.ErrStreamingNotSupported)
+	assert.Zero(t, cluster.totalChunks())
+}
@@ -0,0 +1,198 @@
+package datadistributor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+)
+
+// versions tells whether the bucket of the file keeps versions of its files
+func (dd *DataDistributor) versions(inputFilename string) bool {
+	bucket, _ := chunkmaster.SplitFileref(inputFilename)
+	info, err := dd.chunkMaster.StatBucket(bucket)
+	return err == nil && info.Versioning.Enabled
+}
+
+// newVersionID starts with the time, so ids of versions of a file are ordered the same way as the versions are
+func newVersionID(now time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("cannot generate version id: %w", err)
+	}
+	return fmt.Sprintf("%016x%s", now.UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// storeVersion stores the file with store. A new file of a bucket without versioning is stored under its own fileref, and the catalog
+// refuses a second one. Otherwise, in a bucket with versioning or when an existing file may be replaced, the data is stored as a file
+// of its own first, and the catalog is switched to it only when it is stored completely and the condition still holds, so readers see
+// either the whole old data or the whole new one. Data which has been replaced is deleted after that
+func (dd *DataDistributor) storeVersion(ctx context.Context, inputFilename string, condition chunkmaster.Condition, store func(catalogFileref string) (int64, error)) (int64, error) {
+	if !dd.versions(inputFilename) && !condition.Overwrite && !condition.Exists && len(condition.Checksums) == 0 {
+		size, err := store(inputFilename)
+		if condition.Absent && errors.Is(err, chunkmaster.ErrFileDuplicate) {
+			return 0, fmt.Errorf("%w: %s exists", chunkmaster.ErrPreconditionFailed, inputFilename)
+		}
+		return size, err
+	}
+	// a failing condition is checked in advance too, so a big upload is not sent for nothing
+	if err := dd.checkCondition(inputFilename, condition); err != nil {
+		return 0, err
+	}
+	versionID, err := newVersionID(dd.now())
+	if err != nil {
+		return 0, err
+	}
+	catalogFileref := chunkmaster.VersionFileref(inputFilename, versionID)
+	size, err := store(catalogFileref)
+	if err != nil {
+		return 0, err
+	}
+	replaced, err := dd.chunkMaster.ReplaceFile(inputFilename, chunkmaster.Version{ID: versionID, Created: dd.now().UTC()}, condition)
+	if err != nil {
+		if err := dd.deleteFile(ctx, catalogFileref); err != nil {
+			slog.Warn("unpublished version is left", "fileref", inputFilename, "version_id", versionID, "err", err)
+		}
+		return 0, fmt.Errorf("cannot publish version %s of %s: %w", versionID, inputFilename, err)
+	}
+	slog.Info("version published", "fileref", inputFilename, "version_id", versionID, "replaced", replaced != "")
+	if replaced != "" {
+		if err := dd.deleteUnread(ctx, replaced); err != nil {
+			slog.Warn("replaced data is left", "fileref", inputFilename, "err", err)
+		}
+	}
+	return size, nil
+}
+
+func (dd *DataDistributor) checkCondition(inputFilename string, condition chunkmaster.Condition) error {
+	info, err := dd.StatFile(inputFilename)
+	if err != nil && !errors.Is(err, chunkmaster.ErrFileNotFound) {
+		return err
+	}
+	if !condition.Holds(err == nil, info.Checksum) {
+		return fmt.Errorf("%w: %s", chunkmaster.ErrPreconditionFailed, inputFilename)
+	}
+	return nil
+}
+
+// publishTombstone makes the file look deleted, while its versions are kept
+func (dd *DataDistributor) publishTombstone(inputFilename string) error {
+	versionID, err := newVersionID(dd.now())
+	if err != nil {
+		return err
+	}
+	err = dd.chunkMaster.PublishVersion(inputFilename, chunkmaster.Version{ID: versionID, Created: dd.now().UTC(), Deleted: true})
+	if err != nil {
+		return fmt.Errorf("cannot delete %s: %w", inputFilename, err)
+	}
+	slog.Info("tombstone published", "fileref", inputFilename, "version_id", versionID)
+	return nil
+}
+
+// ResolveVersion gives the fileref which keeps the data of the version, or of the current version if versionID is empty.
+// It can be passed to any read function to keep reading the same version while newer ones are uploaded
+func (dd *DataDistributor) ResolveVersion(inputFilename, versionID string) (string, error) {
+	catalogFileref, err := dd.chunkMaster.ResolveVersion(inputFilename, versionID)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve version %q of %s: %w", versionID, inputFilename, err)
+	}
+	return catalogFileref, nil
+}
+
+func (dd *DataDistributor) Versions(inputFilename string) ([]chunkmaster.Version, error) {
+	return dd.chunkMaster.Versions(inputFilename)
+}
+
+// DeleteVersion removes a single version together with its data. Removing the current version makes the previous one current
+func (dd *DataDistributor) DeleteVersion(ctx context.Context, inputFilename, versionID string) error {
+	version, err := dd.chunkMaster.RemoveVersion(inputFilename, versionID)
+	if err != nil {
+		return fmt.Errorf("cannot remove version %s of %s: %w", versionID, inputFilename, err)
+	}
+	slog.Info("version removed", "fileref", inputFilename, "version_id", versionID, "tombstone", version.Deleted)
+	if version.Deleted {
+		return nil
+	}
+	return dd.deleteUnread(ctx, chunkmaster.VersionFileref(inputFilename, versionID))
+}
+
+// PinVersion is ResolveVersion which also keeps the data of the version until release is called, even if the version is replaced
+// or deleted meanwhile. Resolving and pinning are done together, so the data cannot be deleted in between
+func (dd *DataDistributor) PinVersion(ctx context.Context, inputFilename, versionID string) (string, func(), error) {
+	dd.readMutex.Lock()
+	defer dd.readMutex.Unlock()
+	catalogFileref, err := dd.ResolveVersion(inputFilename, versionID)
+	if err != nil {
+		return "", nil, err
+	}
+	dd.readers[catalogFileref]++
+	return catalogFileref, func() { dd.finishRead(ctx, catalogFileref) }, nil
+}
+
+// finishRead deletes data which has been replaced while it has been read
+func (dd *DataDistributor) finishRead(ctx context.Context, catalogFileref string) {
+	dd.readMutex.Lock()
+	dd.readers[catalogFileref]--
+	if dd.readers[catalogFileref] > 0 {
+		dd.readMutex.Unlock()
+		return
+	}
+	delete(dd.readers, catalogFileref)
+	unread := dd.unread[catalogFileref]
+	delete(dd.unread, catalogFileref)
+	dd.readMutex.Unlock()
+
+	if unread {
+		if err := dd.deleteFile(context.WithoutCancel(ctx), catalogFileref); err != nil {
+			slog.Warn("replaced data is left", "fileref", catalogFileref, "err", err)
+		}
+	}
+}
+
+// deleteUnread deletes data which nobody can find in the catalog any more, e.g. replaced by a new version. Reads which have found it
+// before are finished first, the last of them deletes it
+func (dd *DataDistributor) deleteUnread(ctx context.Context, catalogFileref string) error {
+	dd.readMutex.Lock()
+	if dd.readers[catalogFileref] > 0 {
+		dd.unread[catalogFileref] = true
+		dd.readMutex.Unlock()
+		slog.Info("data is deleted after it is read", "fileref", catalogFileref)
+		return nil
+	}
+	dd.readMutex.Unlock()
+	return dd.deleteFile(ctx, catalogFileref)
+}
+
+// PruneVersions removes versions which retention policies of their buckets do not keep any more. It returns the number of removed versions
+func (dd *DataDistributor) PruneVersions(ctx context.Context) int {
+	pruned := 0
+	for _, expired := range dd.chunkMaster.ExpiredVersions(dd.now()) {
+		if err := dd.DeleteVersion(ctx, expired.Fileref, expired.ID); err != nil {
+			slog.Warn("expired version is not pruned", "fileref", expired.Fileref, "version_id", expired.ID, "err", err)
+			continue
+		}
+		pruned++
+	}
+	return pruned
+}
+
+// RunVersionPruner periodically prunes versions which are not kept any more
+func (dd *DataDistributor) RunVersionPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if pruned := dd.PruneVersions(ctx); pruned > 0 {
+				slog.Info("versions pruned", "count", pruned)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package datadistributor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/chunkmaster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newVersioningCluster(t *testing.T, versioning chunkmaster.Versioning) (*testCluster, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cluster := newTestClusterWithConfig(t, 3, chunkmaster.NewTemporaryChunkMaster(chunkmaster.Layout{Chunks: 2, ReplicationFactor: 2}), Config{})
+	cluster.dd.now = clock.get
+	versioning.Enabled = true
+	require.NoError(t, cluster.dd.CreateBucket(chunkmaster.Bucket{Name: "docs", Layout: chunkmaster.Layout{Chunks: 2, ReplicationFactor: 2}, Versioning: versioning}))
+	return cluster, clock
+}
+
+func (tc *testCluster) retrieveVersion(t *testing.T, fileref, versionID string) []byte {
+	catalogFileref, err := tc.dd.ResolveVersion(fileref, versionID)
+	require.NoError(t, err)
+	restored, err := tc.retrieve(catalogFileref)
+	require.NoError(t, err)
+	return restored
+}
+
+func TestVersionedUploads(t *testing.T) {
+	cluster, clock := newVersioningCluster(t, chunkmaster.Versioning{})
+	first, second := randomData(1000), randomData(2000)
+	require.NoError(t, cluster.store("docs/report", first))
+	clock.now = clock.now.Add(time.Second)
+	stored, err := cluster.dd.DistributeStream(context.Background(), "docs/report", bytes.NewReader(second))
+	require.NoError(t, err)
+	assert.EqualValues(t, len(second), stored)
+
+	restored, err := cluster.retrieve("docs/report")
+	require.NoError(t, err)
+	assert.Equal(t, second, restored, "the latest version is read by default")
+	versions, err := cluster.dd.Versions("docs/report")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Less(t, versions[0].ID, versions[1].ID)
+	assert.Equal(t, first, cluster.retrieveVersion(t, "docs/report", versions[0].ID))
+
+	info, err := cluster.dd.StatFile("docs/report")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/report", info.Fileref)
+	assert.Equal(t, versions[1].ID, info.VersionID)
+	assert.EqualValues(t, len(second), info.Size)
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "docs/report"))
+	_, err = cluster.retrieve("docs/report")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	assert.Empty(t, cluster.dd.ListFiles("docs", "", "", 10))
+	assert.ErrorIs(t, cluster.dd.DeleteData(context.Background(), "docs/report"), chunkmaster.ErrFileNotFound)
+	assert.Equal(t, first, cluster.retrieveVersion(t, "docs/report", versions[0].ID), "deletion keeps versions")
+
+	require.NoError(t, cluster.dd.DeleteVersion(context.Background(), "docs/report", versions[0].ID))
+	_, err = cluster.dd.ResolveVersion("docs/report", versions[0].ID)
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+}
+
+func TestVersionKeysAreValidated(t *testing.T) {
+	cluster, _ := newVersioningCluster(t, chunkmaster.Versioning{})
+	assert.ErrorIs(t, cluster.store("docs/a\x00b", randomData(10)), chunkmaster.ErrBadFileref)
+}
+
+func TestFailedUploadKeepsCurrentVersion(t *testing.T) {
+	cluster, _ := newVersioningCluster(t, chunkmaster.Versioning{})
+	data := randomData(1000)
+	require.NoError(t, cluster.store("docs/report", data))
+	for _, storage := range cluster.storages {
+		storage.setDown(true)
+	}
+	assert.Error(t, cluster.store("docs/report", randomData(3000)))
+	for _, storage := range cluster.storages {
+		storage.setDown(false)
+	}
+	restored, err := cluster.retrieve("docs/report")
+	require.NoError(t, err)
+	assert.Equal(t, data, restored)
+	versions, err := cluster.dd.Versions("docs/report")
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
+
+func TestVersionsArePruned(t *testing.T) {
+	cluster, clock := newVersioningCluster(t, chunkmaster.Versioning{KeepVersions: 1, KeepFor: time.Hour})
+	for i := range 3 {
+		require.NoError(t, cluster.store("docs/report", randomData(1000+i)))
+		clock.now = clock.now.Add(time.Minute)
+	}
+	chunksOfThree := cluster.totalChunks()
+	assert.Equal(t, 1, cluster.dd.PruneVersions(context.Background()))
+	versions, err := cluster.dd.Versions("docs/report")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, chunksOfThree*2/3, cluster.totalChunks(), "chunks of the pruned version are deleted")
+
+	require.NoError(t, cluster.dd.DeleteData(context.Background(), "docs/report"))
+	assert.Equal(t, 1, cluster.dd.PruneVersions(context.Background()), "the tombstone replaces a version too")
+	clock.now = clock.now.Add(2 * time.Hour)
+	assert.Equal(t, 2, cluster.dd.PruneVersions(context.Background()), "the tombstone goes away with the last version")
+	_, err = cluster.dd.Versions("docs/report")
+	assert.ErrorIs(t, err, chunkmaster.ErrFileNotFound)
+	assert.Zero(t, cluster.totalChunks())
+	assert.NoError(t, cluster.dd.DeleteBucket("docs"))
+}
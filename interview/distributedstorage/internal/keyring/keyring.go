@@ -0,0 +1,161 @@
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// KeySize is the size of master keys and data keys, AES-256
+const KeySize = 32
+
+var (
+	ErrUnknownKey = errors.New("unknown master key")
+	ErrBadWrap    = errors.New("wrapped key cannot be opened")
+)
+
+type masterKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+type config struct {
+	Current string      `json:"current"`
+	Keys    []masterKey `json:"keys"`
+}
+
+func (cfg *config) validate() error {
+	ids := make(map[string]bool, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		if key.ID == "" {
+			return errors.New("key without id")
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("duplicate key %q", key.ID)
+		}
+		ids[key.ID] = true
+	}
+	if !ids[cfg.Current] {
+		return fmt.Errorf("current key %q is not in keys", cfg.Current)
+	}
+	return nil
+}
+
+type masterKeys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// Keyring wraps data keys with master keys from a keyfile:
+//
+//	{"current": "2024-06", "keys": [{"id": "2024-01", "key": "<base64 of 32 bytes>"}, {"id": "2024-06", "key": "..."}]}
+//
+// New data keys are wrapped with the current master key. Older master keys stay in the file until no data key is wrapped with them,
+// so they still can be unwrapped. Keys are replaced as a whole by Reload
+type Keyring struct {
+	path string
+	keys atomic.Pointer[masterKeys]
+}
+
+func NewKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the keyfile again. Keys are kept as they are if the file is broken
+func (k *Keyring) Reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("cannot read keyfile: %w", err)
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("cannot decode keyfile: %w", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("bad keyfile: %w", err)
+	}
+	keys := &masterKeys{current: cfg.Current, aeads: make(map[string]cipher.AEAD, len(cfg.Keys))}
+	for _, key := range cfg.Keys {
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return fmt.Errorf("bad keyfile: key %q is not base64: %w", key.ID, err)
+		}
+		aead, err := NewAEAD(raw)
+		if err != nil {
+			return fmt.Errorf("bad keyfile: key %q: %w", key.ID, err)
+		}
+		keys.aeads[key.ID] = aead
+	}
+	k.keys.Store(keys)
+	slog.Info("keyfile loaded", "path", k.path, "keys", len(keys.aeads), "current", keys.current)
+	return nil
+}
+
+// CurrentID is the id of the master key which wraps new data keys
+func (k *Keyring) CurrentID() string {
+	return k.keys.Load().current
+}
+
+// NewDataKey generates a data key and wraps it with the current master key
+func (k *Keyring) NewDataKey() (dataKey []byte, keyID string, wrapped []byte, err error) {
+	dataKey = make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", nil, fmt.Errorf("cannot generate data key: %w", err)
+	}
+	keyID, wrapped, err = k.Wrap(dataKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return dataKey, keyID, wrapped, nil
+}
+
+// Wrap encrypts the data key with the current master key. The wrapped key is nonce | ciphertext, and the master key id is
+// authenticated with it, so it cannot be unwrapped as if another master key had wrapped it
+func (k *Keyring) Wrap(dataKey []byte) (string, []byte, error) {
+	keys := k.keys.Load()
+	aead := keys.aeads[keys.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	return keys.current, aead.Seal(nonce, nonce, dataKey, []byte(keys.current)), nil
+}
+
+// Unwrap decrypts a data key which has been wrapped with the master key keyID
+func (k *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, found := k.keys.Load().aeads[keyID]
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrBadWrap
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w with master key %q", ErrBadWrap, keyID)
+	}
+	return dataKey, nil
+}
+
+// NewAEAD gives AES-GCM for a 32 bytes key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
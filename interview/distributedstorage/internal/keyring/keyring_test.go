@@ -0,0 +1,95 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func masterKeyOf(seed byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{seed}, KeySize))
+}
+
+func writeKeyfile(t *testing.T, keyfilePath, current string, ids ...string) {
+	keys := ""
+	for i, id := range ids {
+		if i > 0 {
+			keys += ","
+		}
+		keys += fmt.Sprintf(`{"id": %q, "key": %q}`, id, masterKeyOf(byte(i+1)))
+	}
+	keyfile := fmt.Sprintf(`{"current": %q, "keys": [%s]}`, current, keys)
+	require.NoError(t, os.WriteFile(keyfilePath, []byte(keyfile), 0o600))
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	keyfilePath := path.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, keyfilePath, "k1", "k1")
+	keyring, err := NewKeyring(keyfilePath)
+	require.NoError(t, err)
+
+	dataKey, keyID, wrapped, err := keyring.NewDataKey()
+	require.NoError(t, err)
+	assert.Len(t, dataKey, KeySize)
+	assert.Equal(t, "k1", keyID)
+	assert.NotContains(t, string(wrapped), string(dataKey))
+	unwrapped, err := keyring.Unwrap(keyID, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	_, err = keyring.Unwrap("k2", wrapped)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = keyring.Unwrap(keyID, wrapped)
+	assert.ErrorIs(t, err, ErrBadWrap)
+}
+
+func TestRotatedKeyring(t *testing.T) {
+	keyfilePath := path.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, keyfilePath, "k1", "k1")
+	keyring, err := NewKeyring(keyfilePath)
+	require.NoError(t, err)
+	dataKey, _, wrapped, err := keyring.NewDataKey()
+	require.NoError(t, err)
+
+	writeKeyfile(t, keyfilePath, "k2", "k1", "k2")
+	require.NoError(t, keyring.Reload())
+	assert.Equal(t, "k2", keyring.CurrentID())
+	unwrapped, err := keyring.Unwrap("k1", wrapped)
+	require.NoError(t, err, "old master keys still unwrap")
+	keyID, rewrapped, err := keyring.Wrap(unwrapped)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keyID)
+	_, err = keyring.Unwrap("k1", rewrapped)
+	assert.ErrorIs(t, err, ErrBadWrap, "the master key id is bound to the wrapped key")
+	unwrapped, err = keyring.Unwrap("k2", rewrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+}
+
+func TestBrokenKeyfileKeepsKeys(t *testing.T) {
+	keyfilePath := path.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, keyfilePath, "k1", "k1")
+	keyring, err := NewKeyring(keyfilePath)
+	require.NoError(t, err)
+
+	for _, broken := range []string{
+		`{"current": "k2", "keys": [{"id": "k1", "key": "` + masterKeyOf(1) + `"}]}`,
+		`{"current": "k1", "keys": [{"id": "k1", "key": "c2hvcnQ="}]}`,
+		`{"current": "k1", "keys": [{"id": "k1", "key": "!"}]}`,
+		`{"current": "k1", "keys": [{"id": "k1", "key": "` + masterKeyOf(1) + `"}, {"id": "k1", "key": "` + masterKeyOf(2) + `"}]}`,
+		`not json`,
+	} {
+		require.NoError(t, os.WriteFile(keyfilePath, []byte(broken), 0o600))
+		assert.Error(t, keyring.Reload(), broken)
+		assert.Equal(t, "k1", keyring.CurrentID())
+	}
+	_, err = NewKeyring(path.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
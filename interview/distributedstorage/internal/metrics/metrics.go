@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Namespace starts names of all metrics of the services
+const Namespace = "diststorage"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by server, route and status",
+	}, []string{"server", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time from the start of an HTTP request until its response is sent, by server, route and status",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"server", "route", "status"})
+	httpReceivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_received_bytes_total",
+		Help:      "Bytes of HTTP request bodies by server and route",
+	}, []string{"server", "route"})
+	httpSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_sent_bytes_total",
+		Help:      "Bytes of HTTP response bodies by server and route",
+	}, []string{"server", "route"})
+
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "grpc_requests_total",
+		Help:      "Served gRPC calls by method and status code",
+	}, []string{"method", "code"})
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Time of served gRPC calls by method and status code, streams included",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"method", "code"})
+	grpcReceivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "grpc_received_bytes_total",
+		Help:      "Bytes of protobuf messages received by served gRPC calls by method",
+	}, []string{"method"})
+	grpcSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "grpc_sent_bytes_total",
+		Help:      "Bytes of protobuf messages sent by served gRPC calls by method",
+	}, []string{"method"})
+	grpcStreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "grpc_stream_errors_total",
+		Help:      "gRPC streams which have failed, by side (client or server), method and status code",
+	}, []string{"side", "method", "code"})
+)
+
+// Serve exports metrics of the default registry at /metrics of the port. It returns only when the server fails
+func Serve(port int) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	slog.Info("metrics listening", "port", port)
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+}
+
+// InstrumentMux counts requests of the mux by the pattern which has matched them, so files do not make labels of their own
+func InstrumentMux(server string, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		if route == "" {
+			route = "unmatched"
+		}
+		start := time.Now()
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = body
+		}
+		rw := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		mux.ServeHTTP(rw, req)
+
+		statusCode := strconv.Itoa(rw.statusCode)
+		httpRequests.WithLabelValues(server, route, statusCode).Inc()
+		httpDuration.WithLabelValues(server, route, statusCode).Observe(time.Since(start).Seconds())
+		httpReceivedBytes.WithLabelValues(server, route).Add(float64(body.bytes))
+		httpSentBytes.WithLabelValues(server, route).Add(float64(rw.bytes))
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// responseRecorder remembers the status and counts the body. Unwrap lets http.ResponseController reach the original writer
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if !rr.wroteHeader {
+		rr.statusCode = statusCode
+		rr.wroteHeader = true
+	}
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.wroteHeader = true
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+func messageSize(m any) float64 {
+	if msg, ok := m.(proto.Message); ok {
+		return float64(proto.Size(msg))
+	}
+	return 0
+}
+
+func observeServed(method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	grpcRequests.WithLabelValues(method, code).Inc()
+	grpcDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+// ServerOptions instrument every call of a gRPC server
+func ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryServerInterceptor),
+		grpc.ChainStreamInterceptor(streamServerInterceptor),
+	}
+}
+
+// ClientOptions count failed streams of a gRPC client
+func ClientOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithChainStreamInterceptor(streamClientInterceptor)}
+}
+
+func unaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	grpcReceivedBytes.WithLabelValues(info.FullMethod).Add(messageSize(req))
+	resp, err := handler(ctx, req)
+	if err == nil {
+		grpcSentBytes.WithLabelValues(info.FullMethod).Add(messageSize(resp))
+	}
+	observeServed(info.FullMethod, start, err)
+	return resp, err
+}
+
+func streamServerInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, &countingServerStream{ServerStream: ss, method: info.FullMethod})
+	if err != nil {
+		grpcStreamErrors.WithLabelValues("server", info.FullMethod, status.Code(err).String()).Inc()
+	}
+	observeServed(info.FullMethod, start, err)
+	return err
+}
+
+type countingServerStream struct {
+	grpc.ServerStream
+	method string
+}
+
+func (cs *countingServerStream) RecvMsg(m any) error {
+	err := cs.ServerStream.RecvMsg(m)
+	if err == nil {
+		grpcReceivedBytes.WithLabelValues(cs.method).Add(messageSize(m))
+	}
+	return err
+}
+
+func (cs *countingServerStream) SendMsg(m any) error {
+	err := cs.ServerStream.SendMsg(m)
+	if err == nil {
+		grpcSentBytes.WithLabelValues(cs.method).Add(messageSize(m))
+	}
+	return err
+}
+
+func streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		countClientStreamError(method, err)
+		return nil, err
+	}
+	return &failureCountingClientStream{ClientStream: stream, method: method}, nil
+}
+
+func countClientStreamError(method string, err error) {
+	grpcStreamErrors.WithLabelValues("client", method, status.Code(err).String()).Inc()
+}
+
+// failureCountingClientStream counts a stream once, on its first error. io.EOF is the normal end of a stream, and on SendMsg
+// it only tells that the real error is to be received
+type failureCountingClientStream struct {
+	grpc.ClientStream
+	method string
+	failed atomic.Bool
+}
+
+func (cs *failureCountingClientStream) observe(err error) error {
+	if err != nil && !errors.Is(err, io.EOF) && cs.failed.CompareAndSwap(false, true) {
+		countClientStreamError(cs.method, err)
+	}
+	return err
+}
+
+func (cs *failureCountingClientStream) SendMsg(m any) error {
+	return cs.observe(cs.ClientStream.SendMsg(m))
+}
+
+func (cs *failureCountingClientStream) RecvMsg(m any) error {
+	return cs.observe(cs.ClientStream.RecvMsg(m))
+}
+
+func (cs *failureCountingClientStream) CloseSend() error {
+	return cs.observe(cs.ClientStream.CloseSend())
+}
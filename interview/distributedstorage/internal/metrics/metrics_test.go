@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInstrumentMux(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /{fileref}", func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("stored"))
+	})
+	srv := httptest.NewServer(InstrumentMux("test", mux))
+	t.Cleanup(srv.Close)
+
+	for _, fileref := range []string{"a", "b"} {
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/"+fileref, strings.NewReader("12345"))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	resp, err := http.Get(srv.URL + "/a")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(httpRequests.WithLabelValues("test", "PUT /{fileref}", "201")), "files share the route")
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("test", "unmatched", "405")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(httpReceivedBytes.WithLabelValues("test", "PUT /{fileref}")))
+	assert.Equal(t, 12.0, testutil.ToFloat64(httpSentBytes.WithLabelValues("test", "PUT /{fileref}")))
+	assert.Equal(t, 2, testutil.CollectAndCount(httpDuration), "latencies are kept by route and status")
+}
+
+type failingClientStream struct {
+	grpc.ClientStream
+	err error
+}
+
+func (fs *failingClientStream) SendMsg(any) error {
+	return io.EOF
+}
+
+func (fs *failingClientStream) RecvMsg(any) error {
+	return fs.err
+}
+
+func TestClientStreamErrorsAreCounted(t *testing.T) {
+	const method = "/test.Service/Stream"
+	streamer := func(err error) grpc.Streamer {
+		return func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+			return &failingClientStream{err: err}, nil
+		}
+	}
+	stream, err := streamClientInterceptor(context.Background(), &grpc.StreamDesc{}, nil, method, streamer(status.Error(codes.Unavailable, "gone")))
+	require.NoError(t, err)
+	assert.ErrorIs(t, stream.SendMsg(nil), io.EOF)
+	assert.Error(t, stream.RecvMsg(nil))
+	assert.Error(t, stream.RecvMsg(nil))
+	assert.Equal(t, 1.0, testutil.ToFloat64(grpcStreamErrors.WithLabelValues("client", method, "Unavailable")), "a stream fails once")
+
+	stream, err = streamClientInterceptor(context.Background(), &grpc.StreamDesc{}, nil, method, streamer(io.EOF))
+	require.NoError(t, err)
+	assert.ErrorIs(t, stream.RecvMsg(nil), io.EOF)
+	assert.Equal(t, 1.0, testutil.ToFloat64(grpcStreamErrors.WithLabelValues("client", method, "Unavailable")), "the end of a stream is no error")
+}
@@ -0,0 +1,112 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+)
+
+// Files are PEM files of a service. The same certificate is used both to serve and to connect to other services,
+// so it needs both server and client auth extended key usage. Its DNS names or IP addresses are the identity of the service
+type Files struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+func (f Files) Enabled() bool {
+	return f.CA != "" || f.Cert != "" || f.Key != ""
+}
+
+func (f Files) Validate() error {
+	if f.Enabled() && (f.CA == "" || f.Cert == "" || f.Key == "") {
+		return errors.New("CA, certificate and key must be set all together")
+	}
+	return nil
+}
+
+func (f Files) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("cannot load certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(f.CA)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("cannot read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificates found in CA file %s", f.CA)
+	}
+	return cert, pool, nil
+}
+
+// ServerCredentials accept only clients with a certificate signed by the CA. Without files the connection is plaintext
+func ServerCredentials(f Files) (credentials.TransportCredentials, error) {
+	if !f.Enabled() {
+		return insecure.NewCredentials(), nil
+	}
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}), nil
+}
+
+// ClientCredentials present the certificate and check that the server has a certificate signed by the CA for the host it is dialed by.
+// Without files the connection is plaintext
+func ClientCredentials(f Files) (credentials.TransportCredentials, error) {
+	if !f.Enabled() {
+		return insecure.NewCredentials(), nil
+	}
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+	}), nil
+}
+
+var ErrIdentityMismatch = errors.New("peer certificate does not match")
+
+// CheckPeer verifies that the peer of a gRPC call has a certificate for the host of addr. Calls over plaintext are not checked:
+// a server with ServerCredentials never has them, so they come only when mTLS is off
+func CheckPeer(ctx context.Context, addr string) error {
+	p, found := peer.FromContext(ctx)
+	if !found {
+		return nil
+	}
+	tlsInfo, secured := p.AuthInfo.(credentials.TLSInfo)
+	if !secured {
+		return nil
+	}
+	if len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("%w: no verified certificate", ErrIdentityMismatch)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	// the same check as a TLS client does for a server: DNS names with wildcards and IP addresses, but not the common name
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	if err := cert.VerifyHostname(host); err != nil {
+		return fmt.Errorf("%w: %w", ErrIdentityMismatch, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package mtls_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls"
+	"github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/mtls/mtlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, mtls.Files{}.Validate())
+	assert.False(t, mtls.Files{}.Enabled())
+	assert.NoError(t, mtls.Files{CA: "ca", Cert: "cert", Key: "key"}.Validate())
+	assert.Error(t, mtls.Files{CA: "ca", Cert: "cert"}.Validate())
+	assert.Error(t, mtls.Files{Key: "key"}.Validate())
+}
+
+func TestBadFiles(t *testing.T) {
+	files := mtlstest.NewCA(t).Issue(t, "storage", "storage")
+	_, err := mtls.ServerCredentials(mtls.Files{CA: files.CA, Cert: files.Cert, Key: files.Cert})
+	assert.Error(t, err)
+	_, err = mtls.ClientCredentials(mtls.Files{CA: files.Key, Cert: files.Cert, Key: files.Key})
+	assert.Error(t, err)
+	_, err = mtls.ClientCredentials(mtls.Files{CA: "missing", Cert: files.Cert, Key: files.Key})
+	assert.Error(t, err)
+}
+
+func TestCheckPeer(t *testing.T) {
+	ca := mtlstest.NewCA(t)
+	withCert := func(files mtls.Files) context.Context {
+		pair, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+		state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{}, AuthInfo: credentials.TLSInfo{State: state}})
+	}
+
+	ctx := withCert(ca.Issue(t, "storage", "storage-0", "*.storages.local", "10.0.0.1"))
+	for _, addr := range []string{"storage-0:45346", "a.storages.local:45346", "10.0.0.1:45346", "storage-0"} {
+		assert.NoError(t, mtls.CheckPeer(ctx, addr), addr)
+	}
+	for _, addr := range []string{"storage-1:45346", "a.b.storages.local:45346", "10.0.0.2:45346", "storage:45346"} {
+		assert.ErrorIs(t, mtls.CheckPeer(ctx, addr), mtls.ErrIdentityMismatch, addr)
+	}
+
+	unverified := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{}, AuthInfo: credentials.TLSInfo{}})
+	assert.ErrorIs(t, mtls.CheckPeer(unverified, "storage-0:45346"), mtls.ErrIdentityMismatch)
+	plaintext := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{}})
+	assert.NoError(t, mtls.CheckPeer(plaintext, "storage-1:45346"), "nothing is checked without TLS")
+	assert.NoError(t, mtls.CheckPeer(context.Background(), "storage-1:45346"))
+}
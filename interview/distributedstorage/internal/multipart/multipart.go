@@ -0,0 +1,398 @@
+package multipart
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MinPartNumber = 1
+	MaxPartNumber = 10000
+
+	metaFilename = "upload.json"
+	partPrefix   = "part."
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrBadPartNumber  = fmt.Errorf("part number must be in [%d, %d]", MinPartNumber, MaxPartNumber)
+	ErrPartNotFound   = errors.New("part not found")
+	ErrPartMismatch   = errors.New("part etag does not match")
+	ErrBadPartOrder   = errors.New("parts must be listed in ascending order")
+	ErrNoParts        = errors.New("upload has no parts")
+	// ErrUploadBusy means that the upload is being completed right now
+	ErrUploadBusy = errors.New("upload is being completed")
+)
+
+type Part struct {
+	Number int    `json:"part_number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+type Upload struct {
+	ID      string    `json:"upload_id"`
+	Fileref string    `json:"fileref"`
+	Created time.Time `json:"created"`
+}
+
+// StoreFunc places the assembled file. It is called when an upload is completed
+type StoreFunc func(ctx context.Context, fileref string, size int64, reader io.Reader) error
+
+type upload struct {
+	Upload
+	// lastActivity is used for garbage collection of abandoned uploads
+	lastActivity time.Time
+	completing   bool
+}
+
+// Manager keeps parts of multipart uploads in a local directory until the upload is completed.
+// Chunks are placed only on completion, when the whole size is known. Uploads survive restarts
+type Manager struct {
+	dir string
+	ttl time.Duration
+	now func() time.Time
+
+	mutex   sync.Mutex
+	uploads map[string]*upload
+}
+
+func NewManager(dir string, ttl time.Duration) (*Manager, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create multipart dir: %w", err)
+	}
+	m := &Manager{
+		dir:     dir,
+		ttl:     ttl,
+		now:     time.Now,
+		uploads: make(map[string]*upload),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load restores uploads which have been left by the previous run
+func (m *Manager) load() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return fmt.Errorf("cannot list multipart dir: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		uploadDir := path.Join(m.dir, entry.Name())
+		data, err := os.ReadFile(path.Join(uploadDir, metaFilename))
+		if err != nil {
+			slog.Warn("dropping broken multipart upload", "dir", uploadDir, "err", err)
+			os.RemoveAll(uploadDir)
+			continue
+		}
+		u := &upload{}
+		if err := json.Unmarshal(data, &u.Upload); err != nil || u.ID != entry.Name() {
+			slog.Warn("dropping broken multipart upload", "dir", uploadDir, "err", err)
+			os.RemoveAll(uploadDir)
+			continue
+		}
+		u.lastActivity = u.Created
+		parts, _ := os.ReadDir(uploadDir)
+		for _, part := range parts {
+			if info, err := part.Info(); err == nil && info.ModTime().After(u.lastActivity) {
+				u.lastActivity = info.ModTime()
+			}
+		}
+		m.uploads[u.ID] = u
+	}
+	slog.Info("multipart uploads loaded", "uploads", len(m.uploads))
+	return nil
+}
+
+func (m *Manager) uploadDir(uploadID string) string {
+	return path.Join(m.dir, uploadID)
+}
+
+// partPath has etag in the name, so a retried part never overwrites a part which is being read
+func (m *Manager) partPath(uploadID string, partNumber int, etag string) string {
+	return path.Join(m.uploadDir(uploadID), fmt.Sprintf("%s%d.%s", partPrefix, partNumber, etag))
+}
+
+func (m *Manager) Initiate(fileref string) (Upload, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Upload{}, fmt.Errorf("cannot generate upload id: %w", err)
+	}
+	u := &upload{
+		Upload: Upload{
+			ID:      hex.EncodeToString(idBytes),
+			Fileref: fileref,
+			Created: m.now(),
+		},
+	}
+	u.lastActivity = u.Created
+
+	data, err := json.Marshal(u.Upload)
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := os.Mkdir(m.uploadDir(u.ID), 0o700); err != nil {
+		return Upload{}, fmt.Errorf("cannot create upload dir: %w", err)
+	}
+	if err := os.WriteFile(path.Join(m.uploadDir(u.ID), metaFilename), data, 0o600); err != nil {
+		os.RemoveAll(m.uploadDir(u.ID))
+		return Upload{}, fmt.Errorf("cannot write upload meta: %w", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.uploads[u.ID] = u
+	slog.Info("multipart upload initiated", "upload_id", u.ID, "fileref", fileref)
+	return u.Upload, nil
+}
+
+// lookup returns the upload if it exists and is not being completed
+func (m *Manager) lookup(uploadID, fileref string) (*upload, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lookupLocked(uploadID, fileref)
+}
+
+func (m *Manager) lookupLocked(uploadID, fileref string) (*upload, error) {
+	u, found := m.uploads[uploadID]
+	if !found || u.Fileref != fileref {
+		return nil, ErrUploadNotFound
+	}
+	if u.completing {
+		return nil, ErrUploadBusy
+	}
+	u.lastActivity = m.now()
+	return u, nil
+}
+
+// PutPart stores a part. A part with the same number replaces the previous one, so a failed part can simply be sent again
+func (m *Manager) PutPart(uploadID, fileref string, partNumber int, reader io.Reader) (Part, error) {
+	if partNumber < MinPartNumber || partNumber > MaxPartNumber {
+		return Part{}, ErrBadPartNumber
+	}
+	if _, err := m.lookup(uploadID, fileref); err != nil {
+		return Part{}, err
+	}
+
+	// the part appears only when it is complete, so an interrupted upload does not leave a truncated part
+	f, err := os.CreateTemp(m.uploadDir(uploadID), "incoming-*")
+	if err != nil {
+		return Part{}, fmt.Errorf("cannot create part file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), reader)
+	if err != nil {
+		return Part{}, fmt.Errorf("cannot receive part %d: %w", partNumber, err)
+	}
+	if err := f.Close(); err != nil {
+		return Part{}, fmt.Errorf("cannot save part %d: %w", partNumber, err)
+	}
+
+	etag := hex.EncodeToString(hash.Sum(nil))
+	if err := m.keepPart(f.Name(), uploadID, fileref, partNumber, etag); err != nil {
+		return Part{}, err
+	}
+	slog.Info("multipart part stored", "upload_id", uploadID, "part", partNumber, "size", size)
+	return Part{Number: partNumber, ETag: etag, Size: size}, nil
+}
+
+// keepPart makes the received file the only copy of the part. It is done under the lock, so of concurrent uploads of the same part
+// the last one wins instead of each deleting the copy of the other
+func (m *Manager) keepPart(received, uploadID, fileref string, partNumber int, etag string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// the upload might have been completed or aborted meanwhile
+	if _, err := m.lookupLocked(uploadID, fileref); err != nil {
+		return err
+	}
+	if err := os.Rename(received, m.partPath(uploadID, partNumber, etag)); err != nil {
+		return fmt.Errorf("cannot save part %d: %w", partNumber, err)
+	}
+	for _, part := range m.listParts(uploadID) {
+		if part.Number == partNumber && part.ETag != etag {
+			os.Remove(m.partPath(uploadID, partNumber, part.ETag))
+		}
+	}
+	return nil
+}
+
+// listParts reads parts from disk. Part files are named part.<number>.<etag>
+func (m *Manager) listParts(uploadID string) []Part {
+	entries, _ := os.ReadDir(m.uploadDir(uploadID))
+	parts := make([]Part, 0, len(entries))
+	for _, entry := range entries {
+		numberAndETag, found := strings.CutPrefix(entry.Name(), partPrefix)
+		if !found {
+			continue
+		}
+		number, etag, found := strings.Cut(numberAndETag, ".")
+		partNumber, err := strconv.Atoi(number)
+		if !found || err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		parts = append(parts, Part{Number: partNumber, ETag: etag, Size: info.Size()})
+	}
+	slices.SortFunc(parts, func(a, b Part) int {
+		return a.Number - b.Number
+	})
+	return parts
+}
+
+func (m *Manager) Parts(uploadID, fileref string) ([]Part, error) {
+	if _, err := m.lookup(uploadID, fileref); err != nil {
+		return nil, err
+	}
+	return m.listParts(uploadID), nil
+}
+
+// Complete assembles the file from the listed parts and stores it. If selected is empty, all uploaded parts are used.
+// The upload is kept if storing fails, so completion can be retried
+func (m *Manager) Complete(ctx context.Context, uploadID, fileref string, selected []Part, store StoreFunc) error {
+	u, err := m.lookup(uploadID, fileref)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	if u.completing {
+		m.mutex.Unlock()
+		return ErrUploadBusy
+	}
+	u.completing = true
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		u.completing = false
+		u.lastActivity = m.now()
+		m.mutex.Unlock()
+	}()
+
+	parts, err := m.pickParts(uploadID, selected)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		f, err := os.Open(m.partPath(uploadID, part.Number, part.ETag))
+		if err != nil {
+			return fmt.Errorf("cannot open part %d: %w", part.Number, err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		size += part.Size
+	}
+	err = store(ctx, fileref, size, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+
+	m.remove(uploadID)
+	slog.Info("multipart upload completed", "upload_id", uploadID, "fileref", fileref, "parts", len(parts), "size", size)
+	return nil
+}
+
+func (m *Manager) pickParts(uploadID string, selected []Part) ([]Part, error) {
+	uploaded := m.listParts(uploadID)
+	if len(selected) == 0 {
+		if len(uploaded) == 0 {
+			return nil, ErrNoParts
+		}
+		return uploaded, nil
+	}
+
+	parts := make([]Part, 0, len(selected))
+	for i, want := range selected {
+		if i > 0 && want.Number <= selected[i-1].Number {
+			return nil, ErrBadPartOrder
+		}
+		idx := slices.IndexFunc(uploaded, func(p Part) bool { return p.Number == want.Number })
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: %d", ErrPartNotFound, want.Number)
+		}
+		if want.ETag != "" && strings.Trim(want.ETag, `"`) != uploaded[idx].ETag {
+			return nil, fmt.Errorf("%w: %d", ErrPartMismatch, want.Number)
+		}
+		parts = append(parts, uploaded[idx])
+	}
+	return parts, nil
+}
+
+func (m *Manager) Abort(uploadID, fileref string) error {
+	if _, err := m.lookup(uploadID, fileref); err != nil {
+		return err
+	}
+	m.remove(uploadID)
+	slog.Info("multipart upload aborted", "upload_id", uploadID, "fileref", fileref)
+	return nil
+}
+
+func (m *Manager) remove(uploadID string) {
+	m.mutex.Lock()
+	delete(m.uploads, uploadID)
+	m.mutex.Unlock()
+	err := os.RemoveAll(m.uploadDir(uploadID))
+	if err != nil {
+		slog.Warn("cannot remove upload dir", "upload_id", uploadID, "err", err)
+	}
+}
+
+// RunGC periodically removes uploads which have not been touched for longer than TTL
+func (m *Manager) RunGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.collectGarbage()
+		}
+	}
+}
+
+func (m *Manager) collectGarbage() {
+	m.mutex.Lock()
+	var abandoned []string
+	deadline := m.now().Add(-m.ttl)
+	for id, u := range m.uploads {
+		if !u.completing && u.lastActivity.Before(deadline) {
+			abandoned = append(abandoned, id)
+			delete(m.uploads, id)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, id := range abandoned {
+		slog.Info("removing abandoned multipart upload", "upload_id", id)
+		if err := os.RemoveAll(m.uploadDir(id)); err != nil {
+			slog.Warn("cannot remove upload dir", "upload_id", id, "err", err)
+		}
+	}
+}
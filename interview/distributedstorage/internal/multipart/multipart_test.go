@@ -0,0 +1,267 @@
+package multipart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type storedFile struct {
+	fileref string
+	size    int64
+	data    []byte
+}
+
+func storeTo(stored *storedFile) StoreFunc {
+	return func(_ context.Context, fileref string, size int64, reader io.Reader) error {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		*stored = storedFile{fileref: fileref, size: size, data: data}
+		return nil
+	}
+}
+
+func putParts(t *testing.T, m *Manager, u Upload, parts ...string) []Part {
+	var res []Part
+	for i, data := range parts {
+		part, err := m.PutPart(u.ID, u.Fileref, i+1, strings.NewReader(data))
+		require.NoError(t, err)
+		res = append(res, part)
+	}
+	return res
+}
+
+func TestCompleteAssemblesPartsInOrder(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+
+	// parts may come in any order
+	_, err = m.PutPart(u.ID, "file", 3, strings.NewReader("ccc"))
+	require.NoError(t, err)
+	_, err = m.PutPart(u.ID, "file", 1, strings.NewReader("a"))
+	require.NoError(t, err)
+	_, err = m.PutPart(u.ID, "file", 2, strings.NewReader("bb"))
+	require.NoError(t, err)
+
+	parts, err := m.Parts(u.ID, "file")
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+	assert.Equal(t, []int{1, 2, 3}, []int{parts[0].Number, parts[1].Number, parts[2].Number})
+	assert.Equal(t, "0cc175b9c0f1b6a831c399e269772661", parts[0].ETag, "md5 of the part")
+
+	var stored storedFile
+	require.NoError(t, m.Complete(context.Background(), u.ID, "file", nil, storeTo(&stored)))
+	assert.Equal(t, storedFile{fileref: "file", size: 6, data: []byte("abbccc")}, stored)
+
+	_, err = m.Parts(u.ID, "file")
+	assert.ErrorIs(t, err, ErrUploadNotFound, "completed upload is gone")
+	entries, err := os.ReadDir(m.dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPartIsReplacedOnRetry(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	putParts(t, m, u, "first", "second")
+
+	_, err = m.PutPart(u.ID, "file", 1, io.MultiReader(strings.NewReader("broken"), &failingReader{}))
+	require.Error(t, err)
+	retried, err := m.PutPart(u.ID, "file", 1, strings.NewReader("FIRST"))
+	require.NoError(t, err)
+
+	parts, err := m.Parts(u.ID, "file")
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+	assert.Equal(t, retried, parts[0])
+
+	var stored storedFile
+	require.NoError(t, m.Complete(context.Background(), u.ID, "file", nil, storeTo(&stored)))
+	assert.Equal(t, "FIRSTsecond", string(stored.data))
+}
+
+func TestConcurrentUploadsOfSamePart(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+
+	for round := 0; round < 200; round++ {
+		var wg sync.WaitGroup
+		// both bodies end at once, so the parts are saved at the same time
+		received := make(chan struct{})
+		for _, data := range []string{"first", "second"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := m.PutPart(u.ID, "file", 1, io.MultiReader(strings.NewReader(data), waitingReader(received)))
+				assert.NoError(t, err)
+			}()
+		}
+		close(received)
+		wg.Wait()
+		parts, err := m.Parts(u.ID, "file")
+		require.NoError(t, err)
+		require.Len(t, parts, 1, "one of the uploads wins")
+	}
+
+	var stored storedFile
+	require.NoError(t, m.Complete(context.Background(), u.ID, "file", nil, storeTo(&stored)))
+	assert.Contains(t, []string{"first", "second"}, string(stored.data))
+}
+
+type waitingReader chan struct{}
+
+func (r waitingReader) Read([]byte) (int, error) {
+	<-r
+	return 0, io.EOF
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection dropped")
+}
+
+func TestCompleteWithSelectedParts(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	parts := putParts(t, m, u, "a", "b", "c")
+
+	var stored storedFile
+	err = m.Complete(context.Background(), u.ID, "file", []Part{parts[2], parts[0]}, storeTo(&stored))
+	assert.ErrorIs(t, err, ErrBadPartOrder)
+	err = m.Complete(context.Background(), u.ID, "file", []Part{{Number: 4}}, storeTo(&stored))
+	assert.ErrorIs(t, err, ErrPartNotFound)
+	err = m.Complete(context.Background(), u.ID, "file", []Part{{Number: 1, ETag: "bad"}}, storeTo(&stored))
+	assert.ErrorIs(t, err, ErrPartMismatch)
+
+	err = m.Complete(context.Background(), u.ID, "file", []Part{parts[0], {Number: 3, ETag: `"` + parts[2].ETag + `"`}}, storeTo(&stored))
+	require.NoError(t, err)
+	assert.Equal(t, "ac", string(stored.data))
+}
+
+func TestFailedCompleteCanBeRetried(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	putParts(t, m, u, "a", "b")
+
+	err = m.Complete(context.Background(), u.ID, "file", nil, func(context.Context, string, int64, io.Reader) error {
+		return errors.New("not enough storages")
+	})
+	require.Error(t, err)
+
+	var stored storedFile
+	require.NoError(t, m.Complete(context.Background(), u.ID, "file", nil, storeTo(&stored)))
+	assert.Equal(t, "ab", string(stored.data))
+}
+
+func TestEmptyUploadCannotBeCompleted(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	var stored storedFile
+	assert.ErrorIs(t, m.Complete(context.Background(), u.ID, "file", nil, storeTo(&stored)), ErrNoParts)
+}
+
+func TestAbort(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	putParts(t, m, u, "a")
+
+	assert.ErrorIs(t, m.Abort(u.ID, "other"), ErrUploadNotFound, "upload id is bound to the fileref")
+	require.NoError(t, m.Abort(u.ID, "file"))
+	_, err = m.PutPart(u.ID, "file", 2, strings.NewReader("b"))
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	assert.NoDirExists(t, m.uploadDir(u.ID))
+}
+
+func TestBadPartNumber(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	for _, number := range []int{0, -1, MaxPartNumber + 1} {
+		_, err = m.PutPart(u.ID, "file", number, strings.NewReader("a"))
+		assert.ErrorIs(t, err, ErrBadPartNumber)
+	}
+}
+
+func TestUploadsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	putParts(t, m, u, "a", "b")
+
+	m, err = NewManager(dir, time.Hour)
+	require.NoError(t, err)
+	_, err = m.PutPart(u.ID, "file", 3, strings.NewReader("c"))
+	require.NoError(t, err)
+	var stored storedFile
+	require.NoError(t, m.Complete(context.Background(), u.ID, "file", nil, storeTo(&stored)))
+	assert.Equal(t, "abc", string(stored.data))
+}
+
+func TestAbandonedUploadsAreCollected(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	abandoned, err := m.Initiate("abandoned")
+	require.NoError(t, err)
+	active, err := m.Initiate("active")
+	require.NoError(t, err)
+
+	now = now.Add(50 * time.Minute)
+	putParts(t, m, active, "a")
+	now = now.Add(50 * time.Minute)
+	m.collectGarbage()
+
+	_, err = m.Parts(abandoned.ID, "abandoned")
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	assert.NoDirExists(t, m.uploadDir(abandoned.ID))
+	_, err = m.Parts(active.ID, "active")
+	assert.NoError(t, err)
+}
+
+func TestPartsCannotBeChangedWhileCompleting(t *testing.T) {
+	m, err := NewManager(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	u, err := m.Initiate("file")
+	require.NoError(t, err)
+	putParts(t, m, u, "a")
+
+	err = m.Complete(context.Background(), u.ID, "file", nil, func(_ context.Context, _ string, _ int64, reader io.Reader) error {
+		_, err := m.PutPart(u.ID, "file", 1, bytes.NewReader([]byte("b")))
+		assert.ErrorIs(t, err, ErrUploadBusy)
+		assert.ErrorIs(t, m.Abort(u.ID, "file"), ErrUploadBusy)
+		_, err = io.ReadAll(reader)
+		return err
+	})
+	require.NoError(t, err)
+}
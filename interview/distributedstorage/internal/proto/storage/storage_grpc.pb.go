@@ -23,6 +23,11 @@ const (
 	Storage_StoreData_FullMethodName    = "/storage.Storage/StoreData"
 	Storage_RetrieveData_FullMethodName = "/storage.Storage/RetrieveData"
 	Storage_DeleteData_FullMethodName   = "/storage.Storage/DeleteData"
+	Storage_ListData_FullMethodName     = "/storage.Storage/ListData"
+	Storage_CopyData_FullMethodName     = "/storage.Storage/CopyData"
+	Storage_Reserve_FullMethodName      = "/storage.Storage/Reserve"
+	Storage_Commit_FullMethodName       = "/storage.Storage/Commit"
+	Storage_Release_FullMethodName      = "/storage.Storage/Release"
 )
 
 // StorageClient is the client API for Storage service.
@@ -32,6 +37,15 @@ type StorageClient interface {
 	StoreData(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StoredUnit, emptypb.Empty], error)
 	RetrieveData(ctx context.Context, in *FileInfo, opts ...grpc.CallOption) (grpc.ServerStreamingClient[StoredUnit], error)
 	DeleteData(ctx context.Context, in *FileInfo, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListData(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileList, error)
+	CopyData(ctx context.Context, in *CopyRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Reserve grants leases for chunks which are about to be stored. Data stored under a file id is taken from its lease.
+	// A lease expires if it is not used, otherwise it is kept until Commit or Release
+	Reserve(ctx context.Context, in *ReserveRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Commit ends leases of chunks which have been stored and are kept
+	Commit(ctx context.Context, in *FileList, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Release ends leases of chunks which are not going to be stored
+	Release(ctx context.Context, in *FileList, opts ...grpc.CallOption) (*emptypb.Empty, error)
 }
 
 type storageClient struct {
@@ -84,6 +98,56 @@ func (c *storageClient) DeleteData(ctx context.Context, in *FileInfo, opts ...gr
 	return out, nil
 }
 
+func (c *storageClient) ListData(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileList, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FileList)
+	err := c.cc.Invoke(ctx, Storage_ListData_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) CopyData(ctx context.Context, in *CopyRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Storage_CopyData_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Reserve(ctx context.Context, in *ReserveRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Storage_Reserve_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Commit(ctx context.Context, in *FileList, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Storage_Commit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Release(ctx context.Context, in *FileList, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Storage_Release_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // StorageServer is the server API for Storage service.
 // All implementations must embed UnimplementedStorageServer
 // for forward compatibility.
@@ -91,6 +155,15 @@ type StorageServer interface {
 	StoreData(grpc.ClientStreamingServer[StoredUnit, emptypb.Empty]) error
 	RetrieveData(*FileInfo, grpc.ServerStreamingServer[StoredUnit]) error
 	DeleteData(context.Context, *FileInfo) (*emptypb.Empty, error)
+	ListData(context.Context, *emptypb.Empty) (*FileList, error)
+	CopyData(context.Context, *CopyRequest) (*emptypb.Empty, error)
+	// Reserve grants leases for chunks which are about to be stored. Data stored under a file id is taken from its lease.
+	// A lease expires if it is not used, otherwise it is kept until Commit or Release
+	Reserve(context.Context, *ReserveRequest) (*emptypb.Empty, error)
+	// Commit ends leases of chunks which have been stored and are kept
+	Commit(context.Context, *FileList) (*emptypb.Empty, error)
+	// Release ends leases of chunks which are not going to be stored
+	Release(context.Context, *FileList) (*emptypb.Empty, error)
 	mustEmbedUnimplementedStorageServer()
 }
 
@@ -110,6 +183,21 @@ func (UnimplementedStorageServer) RetrieveData(*FileInfo, grpc.ServerStreamingSe
 func (UnimplementedStorageServer) DeleteData(context.Context, *FileInfo) (*emptypb.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DeleteData not implemented")
 }
+func (UnimplementedStorageServer) ListData(context.Context, *emptypb.Empty) (*FileList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListData not implemented")
+}
+func (UnimplementedStorageServer) CopyData(context.Context, *CopyRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CopyData not implemented")
+}
+func (UnimplementedStorageServer) Reserve(context.Context, *ReserveRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reserve not implemented")
+}
+func (UnimplementedStorageServer) Commit(context.Context, *FileList) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commit not implemented")
+}
+func (UnimplementedStorageServer) Release(context.Context, *FileList) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
 func (UnimplementedStorageServer) mustEmbedUnimplementedStorageServer() {}
 func (UnimplementedStorageServer) testEmbeddedByValue()                 {}
 
@@ -167,6 +255,96 @@ func _Storage_DeleteData_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Storage_ListData_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).ListData(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_ListData_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).ListData(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_CopyData_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CopyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).CopyData(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_CopyData_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).CopyData(ctx, req.(*CopyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Reserve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReserveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Reserve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_Reserve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Reserve(ctx, req.(*ReserveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Commit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileList)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Commit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_Commit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Commit(ctx, req.(*FileList))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileList)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_Release_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Release(ctx, req.(*FileList))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Storage_ServiceDesc is the grpc.ServiceDesc for Storage service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -178,6 +356,26 @@ var Storage_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DeleteData",
 			Handler:    _Storage_DeleteData_Handler,
 		},
+		{
+			MethodName: "ListData",
+			Handler:    _Storage_ListData_Handler,
+		},
+		{
+			MethodName: "CopyData",
+			Handler:    _Storage_CopyData_Handler,
+		},
+		{
+			MethodName: "Reserve",
+			Handler:    _Storage_Reserve_Handler,
+		},
+		{
+			MethodName: "Commit",
+			Handler:    _Storage_Commit_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _Storage_Release_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
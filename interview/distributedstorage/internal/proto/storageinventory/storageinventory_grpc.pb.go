@@ -20,7 +20,8 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	StorageInventory_UpdateStorageInfo_FullMethodName = "/storage.StorageInventory/UpdateStorageInfo"
+	StorageInventory_UpdateStorageInfo_FullMethodName     = "/storage.StorageInventory/UpdateStorageInfo"
+	StorageInventory_ReportCorruptedChunks_FullMethodName = "/storage.StorageInventory/ReportCorruptedChunks"
 )
 
 // StorageInventoryClient is the client API for StorageInventory service.
@@ -28,6 +29,7 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type StorageInventoryClient interface {
 	UpdateStorageInfo(ctx context.Context, in *StorageInfo, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ReportCorruptedChunks(ctx context.Context, in *CorruptedChunks, opts ...grpc.CallOption) (*emptypb.Empty, error)
 }
 
 type storageInventoryClient struct {
@@ -48,11 +50,22 @@ func (c *storageInventoryClient) UpdateStorageInfo(ctx context.Context, in *Stor
 	return out, nil
 }
 
+func (c *storageInventoryClient) ReportCorruptedChunks(ctx context.Context, in *CorruptedChunks, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, StorageInventory_ReportCorruptedChunks_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // StorageInventoryServer is the server API for StorageInventory service.
 // All implementations must embed UnimplementedStorageInventoryServer
 // for forward compatibility.
 type StorageInventoryServer interface {
 	UpdateStorageInfo(context.Context, *StorageInfo) (*emptypb.Empty, error)
+	ReportCorruptedChunks(context.Context, *CorruptedChunks) (*emptypb.Empty, error)
 	mustEmbedUnimplementedStorageInventoryServer()
 }
 
@@ -66,6 +79,9 @@ type UnimplementedStorageInventoryServer struct{}
 func (UnimplementedStorageInventoryServer) UpdateStorageInfo(context.Context, *StorageInfo) (*emptypb.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateStorageInfo not implemented")
 }
+func (UnimplementedStorageInventoryServer) ReportCorruptedChunks(context.Context, *CorruptedChunks) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportCorruptedChunks not implemented")
+}
 func (UnimplementedStorageInventoryServer) mustEmbedUnimplementedStorageInventoryServer() {}
 func (UnimplementedStorageInventoryServer) testEmbeddedByValue()                          {}
 
@@ -105,6 +121,24 @@ func _StorageInventory_UpdateStorageInfo_Handler(srv interface{}, ctx context.Co
 	return interceptor(ctx, in, info, handler)
 }
 
+func _StorageInventory_ReportCorruptedChunks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CorruptedChunks)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageInventoryServer).ReportCorruptedChunks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageInventory_ReportCorruptedChunks_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageInventoryServer).ReportCorruptedChunks(ctx, req.(*CorruptedChunks))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // StorageInventory_ServiceDesc is the grpc.ServiceDesc for StorageInventory service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -116,6 +150,10 @@ var StorageInventory_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "UpdateStorageInfo",
 			Handler:    _StorageInventory_UpdateStorageInfo_Handler,
 		},
+		{
+			MethodName: "ReportCorruptedChunks",
+			Handler:    _StorageInventory_ReportCorruptedChunks_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "storageinventory.proto",
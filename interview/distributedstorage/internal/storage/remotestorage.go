@@ -2,13 +2,17 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log/slog"
 
 	pb "github.com/ilyalavrinov/justforfun/interview/distributedstorage/internal/proto/storage"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type remoteStorage struct {
@@ -18,8 +22,9 @@ type remoteStorage struct {
 
 var _ Storage = (*remoteStorage)(nil)
 
-func NewRemoteStorage(addr string) (Storage, error) {
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+// NewRemoteStorage connects to a storage service at addr. creds are mtls.ClientCredentials, or insecure ones
+func NewRemoteStorage(addr string, creds credentials.TransportCredentials, opts ...grpc.DialOption) (Storage, error) {
+	conn, err := grpc.NewClient(addr, append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("remote storage cannot connect: %w", err)
 	}
@@ -29,42 +34,88 @@ func NewRemoteStorage(addr string) (Storage, error) {
 	}, nil
 }
 
-func (rs *remoteStorage) StoreChunk(ctx context.Context, fileId string, reader io.Reader) error {
+// remoteError turns gRPC statuses which callers care about into typed errors
+func remoteError(err error) error {
+	switch status.Code(err) {
+	case codes.DataLoss:
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, status.Convert(err).Message())
+	case codes.ResourceExhausted:
+		return fmt.Errorf("%w: %s", ErrNotEnoughSpace, status.Convert(err).Message())
+	}
+	return err
+}
+
+func (rs *remoteStorage) StoreChunk(ctx context.Context, fileId string, reader io.Reader) ([]byte, error) {
+	// cancelling the stream is the only way to tell the storage that data is incomplete, closing it would store a truncated chunk
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	stream, err := rs.client.StoreData(ctx)
 	if err != nil {
-		return fmt.Errorf("store stream open failed for %s: %w", fileId, err)
+		return nil, fmt.Errorf("store stream open failed for %s: %w", fileId, err)
 	}
+	hash := sha256.New()
 	var totalWritten int
 	done := false
 	const portionSize int = 1024 * 1024
 	for !done {
 		data := make([]byte, portionSize)
 		readCnt, readErr := reader.Read(data)
+		if readErr != nil && readErr != io.EOF {
+			return nil, fmt.Errorf("chunk data read failed for %s: %w", fileId, readErr)
+		}
+		hash.Write(data[:readCnt])
 		unit := &pb.StoredUnit{
 			FileInfo: &pb.FileInfo{
 				FileId: fileId,
 			},
 			Data: data[:readCnt],
 		}
+		if readErr == io.EOF || readCnt == 0 {
+			done = true
+			unit.Checksum = hash.Sum(nil)
+		}
 		err := stream.Send(unit)
 		if err != nil {
 			stream.CloseSend()
-			return fmt.Errorf("stream send failed for %s: %w", fileId, err)
+			return nil, fmt.Errorf("stream send failed for %s: %w", fileId, err)
 		}
 		totalWritten += readCnt
-		if readErr == io.EOF || readCnt == 0 {
-			done = true
-		}
 	}
 	_, err = stream.CloseAndRecv()
 	slog.Info("chunk sent", "file_id", fileId, "written", totalWritten, "err", err)
-	return err
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return hash.Sum(nil), nil
 }
 
-func (rs *remoteStorage) RetrieveChunk(ctx context.Context, fileId string, writer io.Writer) error {
+func (rs *remoteStorage) RetrieveChunk(ctx context.Context, fileId string, checksum []byte, writer io.Writer) error {
 	info := &pb.FileInfo{
-		FileId: fileId,
+		FileId:   fileId,
+		Checksum: checksum,
 	}
+	return rs.retrieve(ctx, info, writer)
+}
+
+func (rs *remoteStorage) RetrieveChunkRange(ctx context.Context, fileId string, checksum []byte, offset, length int64, writer io.Writer) error {
+	if length == 0 {
+		// 0 would mean the whole chunk for the storage
+		return nil
+	}
+	info := &pb.FileInfo{
+		FileId:   fileId,
+		Checksum: checksum,
+		Offset:   offset,
+		Length:   length,
+	}
+	return rs.retrieve(ctx, info, writer)
+}
+
+func (rs *remoteStorage) retrieve(ctx context.Context, info *pb.FileInfo, writer io.Writer) error {
+	// the storage keeps sending until the stream is cancelled, even if we stop reading early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fileId := info.GetFileId()
 	stream, err := rs.client.RetrieveData(ctx, info)
 	if err != nil {
 		return fmt.Errorf("remote retrieve data failed: %w", err)
@@ -77,7 +128,7 @@ func (rs *remoteStorage) RetrieveChunk(ctx context.Context, fileId string, write
 		}
 		if err != nil {
 			stream.CloseSend()
-			return fmt.Errorf("stream receive failed for %s: %w", fileId, err)
+			return fmt.Errorf("stream receive failed for %s: %w", fileId, remoteError(err))
 		}
 		written, err := writer.Write(unit.GetData())
 		if err != nil {
@@ -101,3 +152,55 @@ func (rs *remoteStorage) DeleteChunk(ctx context.Context, fileId string) error {
 	slog.Info("remote delete done", "file_id", fileId, "err", err)
 	return err
 }
+
+func (rs *remoteStorage) ListChunks(ctx context.Context) ([]string, error) {
+	list, err := rs.client.ListData(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, fmt.Errorf("remote list data failed: %w", err)
+	}
+	return list.GetFileIds(), nil
+}
+
+func (rs *remoteStorage) CopyChunk(ctx context.Context, fileId string, checksum []byte, source string) error {
+	request := &pb.CopyRequest{
+		FileInfo: &pb.FileInfo{
+			FileId:   fileId,
+			Checksum: checksum,
+		},
+		Source: source,
+	}
+	_, err := rs.client.CopyData(ctx, request)
+	if err != nil {
+		return fmt.Errorf("remote copy data from %s failed: %w", source, remoteError(err))
+	}
+	slog.Info("remote copy done", "file_id", fileId, "source", source)
+	return nil
+}
+
+func (rs *remoteStorage) Reserve(ctx context.Context, reservations map[string]int64) error {
+	request := &pb.ReserveRequest{Reservations: make([]*pb.Reservation, 0, len(reservations))}
+	for fileId, bytes := range reservations {
+		request.Reservations = append(request.Reservations, &pb.Reservation{FileId: fileId, Bytes: bytes})
+	}
+	_, err := rs.client.Reserve(ctx, request)
+	if err != nil {
+		return fmt.Errorf("remote reserve failed: %w", remoteError(err))
+	}
+	return nil
+}
+
+func (rs *remoteStorage) Commit(ctx context.Context, fileIds []string) error {
+	_, err := rs.client.Commit(ctx, &pb.FileList{FileIds: fileIds})
+	if err != nil {
+		return fmt.Errorf("remote commit failed: %w", err)
+	}
+	return nil
+}
+
+func (rs *remoteStorage) Release(ctx context.Context, fileIds []string) error {
+	_, err := rs.client.Release(ctx, &pb.FileList{FileIds: fileIds})
+	if err != nil {
+		return fmt.Errorf("remote release failed: %w", err)
+	}
+	return nil
+}
@@ -2,11 +2,35 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
+// ErrChecksumMismatch means that chunk data does not match its checksum, i.e. it has been corrupted on the way or on disk
+var ErrChecksumMismatch = errors.New("chunk checksum mismatch")
+
+// ErrNotEnoughSpace means that the storage has no space for the chunk which is not reserved by somebody else
+var ErrNotEnoughSpace = errors.New("not enough space on storage")
+
+// Storage keeps chunks. Checksums are SHA-256 of the whole chunk
 type Storage interface {
-	StoreChunk(context.Context, string, io.Reader) error
-	RetrieveChunk(context.Context, string, io.Writer) error
+	// StoreChunk returns checksum of the stored data
+	StoreChunk(context.Context, string, io.Reader) ([]byte, error)
+	// RetrieveChunk fails with ErrChecksumMismatch if stored data does not match the checksum. Empty checksum is not verified
+	RetrieveChunk(context.Context, string, []byte, io.Writer) error
+	// RetrieveChunkRange gives length bytes of the chunk starting from offset. The whole chunk is verified against the checksum before
+	// anything is sent, so it fails the same way as RetrieveChunk. Empty checksum is not verified
+	RetrieveChunkRange(ctx context.Context, fileId string, checksum []byte, offset, length int64, writer io.Writer) error
 	DeleteChunk(context.Context, string) error
+	ListChunks(context.Context) ([]string, error)
+	// CopyChunk makes the storage fetch the chunk from the source storage, addressed the same way as storages are known to the inventory.
+	// The copy is verified against the checksum, which must be set
+	CopyChunk(ctx context.Context, fileId string, checksum []byte, source string) error
+	// Reserve leases space for chunks which are about to be stored, in bytes by file id. It is granted as a whole or fails with ErrNotEnoughSpace.
+	// A lease which is not used for a while expires
+	Reserve(ctx context.Context, reservations map[string]int64) error
+	// Commit ends leases of chunks which have been stored
+	Commit(ctx context.Context, fileIds []string) error
+	// Release ends leases of chunks which are not going to be stored
+	Release(ctx context.Context, fileIds []string) error
 }